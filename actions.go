@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// /actions.json is the OpenAPI document trimmed to what a custom GPT action
+// or ChatGPT plugin can import as is: the manifest capabilities with an
+// operationId each, one server, and the hash sent as a bearer token instead
+// of a query parameter the model would have to fill in. The plugin manifest
+// at /.well-known/ai-plugin.json points at it.
+
+// consequentialActions ask the user before each call even though they are
+// GET requests, which GPT actions otherwise run without asking.
+var consequentialActions = map[string]bool{
+	"run_command":   true,
+	"watch_command": true,
+}
+
+// AIPlugin is the /.well-known/ai-plugin.json manifest.
+type AIPlugin struct {
+	SchemaVersion       string       `json:"schema_version"`
+	NameForHuman        string       `json:"name_for_human"`
+	NameForModel        string       `json:"name_for_model"`
+	DescriptionForHuman string       `json:"description_for_human"`
+	DescriptionForModel string       `json:"description_for_model"`
+	Auth                AIPluginAuth `json:"auth"`
+	API                 AIPluginAPI  `json:"api"`
+	LogoURL             string       `json:"logo_url"`
+	ContactEmail        string       `json:"contact_email"`
+	LegalInfoURL        string       `json:"legal_info_url"`
+}
+
+type AIPluginAuth struct {
+	Type              string `json:"type"`
+	AuthorizationType string `json:"authorization_type"`
+}
+
+type AIPluginAPI struct {
+	Type string `json:"type"`
+	URL  string `json:"url"`
+}
+
+// actionsSpec builds the GPT actions document from the OpenAPI one.
+func actionsSpec(base string) obj {
+	spec := openAPISpec(base)
+	paths := obj{}
+	for _, c := range manifestCapabilities {
+		item, _ := spec["paths"].(obj)[c.path].(obj)
+		op, _ := item[strings.ToLower(c.method)].(obj)
+		if op == nil {
+			continue
+		}
+
+		action := obj{}
+		for k, v := range op {
+			action[k] = v
+		}
+		action["operationId"] = c.name
+		action["description"] = c.description
+		action["x-openai-isConsequential"] = c.method != http.MethodGet || consequentialActions[c.name]
+		params := []obj{}
+		list, _ := op["parameters"].([]obj)
+		for _, p := range list {
+			if p["name"] != "hash" {
+				params = append(params, p)
+			}
+		}
+		action["parameters"] = params
+
+		actionItem, _ := paths[c.path].(obj)
+		if actionItem == nil {
+			actionItem = obj{}
+			paths[c.path] = actionItem
+		}
+		actionItem[strings.ToLower(c.method)] = action
+	}
+
+	components := spec["components"].(obj)
+	return obj{
+		"openapi": spec["openapi"],
+		"info":    spec["info"],
+		"servers": []obj{{"url": base}},
+		"paths":   paths,
+		"components": obj{
+			"schemas":         components["schemas"],
+			"securitySchemes": obj{"hash": obj{"type": "http", "scheme": "bearer", "description": "The HASH"}},
+		},
+		"security": []obj{{"hash": []string{}}},
+	}
+}
+
+func buildAIPlugin(base string) *AIPlugin {
+	m := buildManifest(base)
+	return &AIPlugin{
+		SchemaVersion:       "v1",
+		NameForHuman:        "LLMASS",
+		NameForModel:        m.Name,
+		DescriptionForHuman: "Run shell commands on your server.",
+		DescriptionForModel: m.Description + " " + strings.Join(m.Workflow, " "),
+		Auth:                AIPluginAuth{Type: "user_http", AuthorizationType: "bearer"},
+		API:                 AIPluginAPI{Type: "openapi", URL: base + "/actions.json"},
+		LogoURL:             base + "/assets/logo.png",
+		ContactEmail:        os.Getenv("PLUGIN_CONTACT_EMAIL"),
+		LegalInfoURL:        base + "/",
+	}
+}
+
+func actionsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodGet {
+		writeError(w, errMethodMessage)
+		return
+	}
+
+	jsonResp, err := json.MarshalIndent(actionsSpec(baseURL(r.Context())), "", "  ")
+	if err != nil {
+		msg := fmt.Sprintf("Failed to marshal JSON response: %v", err)
+		writeJsonError(w, msg)
+		return
+	}
+
+	fmt.Fprint(w, string(jsonResp))
+}
+
+func aiPluginHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodGet {
+		writeError(w, errMethodMessage)
+		return
+	}
+
+	jsonResp, err := json.MarshalIndent(buildAIPlugin(baseURL(r.Context())), "", "  ")
+	if err != nil {
+		msg := fmt.Sprintf("Failed to marshal JSON response: %v", err)
+		writeJsonError(w, msg)
+		return
+	}
+
+	fmt.Fprint(w, string(jsonResp))
+}
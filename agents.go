@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Agents report a heartbeat to their controller with what they are and how
+// busy they are. The controller serves the inventory at /agents, marking an
+// agent dead, and its sessions unreachable, once heartbeats stop.
+
+const (
+	agentHeartbeatInterval = 15 * time.Second
+	agentDeadAfter         = 3 * agentHeartbeatInterval
+
+	agentAlive = "alive"
+	agentDead  = "dead"
+
+	agentSessionAvailable   = "available"
+	agentSessionUnreachable = "unreachable"
+)
+
+var (
+	agentCapacity int               // AGENT_CAPACITY, commands the agent advertises it can run at once
+	agentLabels   map[string]string // AGENT_LABELS, matched by placement constraints
+
+	agentsMu sync.Mutex
+	agents   = map[string]*agentRecord{}
+)
+
+// AgentHeartbeat is what an agent reports about itself.
+type AgentHeartbeat struct {
+	OS       string            `json:"os"`
+	Arch     string            `json:"arch"`
+	CPUs     int               `json:"cpus"`
+	Load1    float64           `json:"load1"`
+	Running  int               `json:"running"`
+	Capacity int               `json:"capacity"`
+	Labels   map[string]string `json:"labels"`
+	Sessions []string          `json:"sessions"`
+}
+
+type agentRecord struct {
+	AgentHeartbeat
+	lastSeen time.Time
+}
+
+// AgentSession is a session held by an agent.
+type AgentSession struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+}
+
+// AgentInfo is an agent in the /agents inventory.
+type AgentInfo struct {
+	Name      string            `json:"name"`
+	Status    string            `json:"status"`
+	LastSeen  time.Time         `json:"last_seen"`
+	OS        string            `json:"os"`
+	Arch      string            `json:"arch"`
+	CPUs      int               `json:"cpus"`
+	Load1     float64           `json:"load1"`
+	Running   int               `json:"running"`
+	Capacity  int               `json:"capacity"`
+	Available int               `json:"available"`
+	Labels    map[string]string `json:"labels"`
+	Sessions  []AgentSession    `json:"sessions"`
+}
+
+// loadAgentHeartbeat reads what the heartbeat advertises beyond the
+// platform: AGENT_LABELS and AGENT_CAPACITY, defaulting to the CPU count.
+func loadAgentHeartbeat() error {
+	labels, err := parseLabels(os.Getenv("AGENT_LABELS"))
+	if err != nil {
+		return fmt.Errorf("AGENT_LABELS: %v", err)
+	}
+	agentLabels = labels
+
+	agentCapacity = runtime.NumCPU()
+	if v := os.Getenv("AGENT_CAPACITY"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return fmt.Errorf("AGENT_CAPACITY must be a positive number")
+		}
+		agentCapacity = n
+	}
+	return nil
+}
+
+// localHeartbeat describes this instance.
+func localHeartbeat() *AgentHeartbeat {
+	hb := &AgentHeartbeat{
+		OS:       runtime.GOOS,
+		Arch:     runtime.GOARCH,
+		CPUs:     runtime.NumCPU(),
+		Load1:    loadAverage(),
+		Capacity: agentCapacity,
+		Labels:   agentLabels,
+		Sessions: []string{},
+	}
+	hb.Running = runningCount()
+	if sessions, err := listSessions(); err == nil {
+		for _, s := range sessions {
+			hb.Sessions = append(hb.Sessions, s.Name)
+		}
+	}
+	return hb
+}
+
+// loadAverage returns the one minute load average, 0 where /proc/loadavg
+// isn't available.
+func loadAverage() float64 {
+	data, err := os.ReadFile("/proc/loadavg")
+	if err != nil {
+		return 0
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0
+	}
+	load, _ := strconv.ParseFloat(fields[0], 64)
+	return load
+}
+
+// sendHeartbeats reports to the controller every agentHeartbeatInterval.
+func sendHeartbeats() {
+	client := &http.Client{Timeout: 10 * time.Second}
+	q := url.Values{"hash": {controllerHash}, "agent": {agentName}}
+	target := strings.TrimSuffix(controllerURL, "/") + "/agents/heartbeat?" + q.Encode()
+	for {
+		body, err := json.Marshal(localHeartbeat())
+		if err == nil {
+			var resp *http.Response
+			resp, err = client.Post(target, "application/json", bytes.NewReader(body))
+			if err == nil {
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusOK {
+					err = fmt.Errorf("controller answered %s", resp.Status)
+				}
+			}
+		}
+		if err != nil {
+			logger.Warn("failed to send heartbeat to controller", "err", err)
+		}
+		time.Sleep(agentHeartbeatInterval)
+	}
+}
+
+// agentHeartbeatHandler records a heartbeat from the agent named by the
+// agent parameter.
+func agentHeartbeatHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost {
+		writeError(w, errMethodMessage)
+		return
+	}
+
+	// Validate the hash parameter
+	hashParam := r.URL.Query().Get("hash")
+	if !checkHash(r, hashParam) {
+		writeError(w, errHashMessage)
+		return
+	}
+
+	name := r.URL.Query().Get("agent")
+	if !validAgentName(name) {
+		writeError(w, errAgentMessage)
+		return
+	}
+
+	hb := AgentHeartbeat{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&hb); err != nil {
+		writeError(w, errBodyMessage)
+		return
+	}
+
+	agentsMu.Lock()
+	rec, known := agents[name]
+	wasDead := known && time.Since(rec.lastSeen) > agentDeadAfter
+	agents[name] = &agentRecord{AgentHeartbeat: hb, lastSeen: time.Now()}
+	agentsMu.Unlock()
+	if !known || wasDead {
+		logger.Info("agent is alive", "agent", name, "os", hb.OS, "arch", hb.Arch)
+	}
+
+	fmt.Fprint(w, `{"status":"ok"}`)
+}
+
+// agentInventory lists every agent that has sent a heartbeat, by name.
+func agentInventory() []AgentInfo {
+	agentsMu.Lock()
+	defer agentsMu.Unlock()
+
+	list := make([]AgentInfo, 0, len(agents))
+	for name, rec := range agents {
+		info := AgentInfo{
+			Name:      name,
+			Status:    agentAlive,
+			LastSeen:  rec.lastSeen,
+			OS:        rec.OS,
+			Arch:      rec.Arch,
+			CPUs:      rec.CPUs,
+			Load1:     rec.Load1,
+			Running:   rec.Running,
+			Capacity:  rec.Capacity,
+			Available: rec.Capacity - rec.Running,
+			Labels:    rec.Labels,
+			Sessions:  make([]AgentSession, 0, len(rec.Sessions)),
+		}
+		sessionStatus := agentSessionAvailable
+		if time.Since(rec.lastSeen) > agentDeadAfter {
+			info.Status = agentDead
+			info.Available = 0
+			sessionStatus = agentSessionUnreachable
+		}
+		if info.Available < 0 {
+			info.Available = 0
+		}
+		for _, s := range rec.Sessions {
+			info.Sessions = append(info.Sessions, AgentSession{Name: s, Status: sessionStatus})
+		}
+		list = append(list, info)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// agentsHandler returns the agent inventory.
+func agentsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet {
+		writeError(w, errMethodMessage)
+		return
+	}
+
+	// Validate the hash parameter
+	hashParam := r.URL.Query().Get("hash")
+	if !checkHash(r, hashParam) {
+		writeError(w, errHashMessage)
+		return
+	}
+
+	jsonResp, err := json.Marshal(agentInventory())
+	if err != nil {
+		msg := fmt.Sprintf("Failed to marshal JSON response: %v", err)
+		writeJsonError(w, msg)
+		return
+	}
+
+	fmt.Fprint(w, string(jsonResp))
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// Aliases are a session's shorthands for the commands an agent keeps typing,
+// such as test for "go test ./... -count=1". A command whose first word is
+// an alias is expanded before it runs, the rest of the line appended, like a
+// shell alias. The ticket's input is the expansion, its alias field what was
+// typed. A leading backslash, \test, skips the expansion. Aliases are stored
+// in SESSIONS_DIR/<session>/aliases.json, so they travel with session
+// exports.
+
+const (
+	aliasesFile   = "aliases.json"
+	maxAliasBytes = 16 << 10
+)
+
+var (
+	errAliasNameMessage    = paramError("name", "Invalid or missing 'name' alias parameter")
+	errAliasCommandMessage = paramError("command", "Invalid or missing 'command' alias parameter")
+	errAliasNotFound       = newKindError(errNotFound, "Alias not found")
+)
+
+var aliasNameRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.-]{0,63}$`)
+
+// Alias is one of a session's command shorthands.
+type Alias struct {
+	Type    string `json:"type"`
+	Session string `json:"session"`
+	Name    string `json:"name"`
+	Command string `json:"command"`
+}
+
+// aliasesMu serializes the read, modify and write of aliases files.
+var aliasesMu sync.Mutex
+
+// readAliases returns the session's aliases by name.
+func readAliases(session string) (map[string]string, error) {
+	data, err := os.ReadFile(filepath.Join(sessionsDir, session, aliasesFile))
+	if os.IsNotExist(err) {
+		return map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	aliases := map[string]string{}
+	if err := json.Unmarshal(data, &aliases); err != nil {
+		return nil, fmt.Errorf("Failed to read aliases: %v", err)
+	}
+	return aliases, nil
+}
+
+// saveAliases replaces the session's aliases, the caller holds aliasesMu.
+func saveAliases(session string, aliases map[string]string) error {
+	dir := filepath.Join(sessionsDir, session)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(aliases, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, aliasesFile+".tmp")
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, aliasesFile))
+}
+
+// listAliases returns the session's aliases sorted by name.
+func listAliases(session string) ([]*Alias, error) {
+	aliases, err := readAliases(session)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]*Alias, 0, len(aliases))
+	for name, command := range aliases {
+		list = append(list, &Alias{Type: "alias", Session: session, Name: name, Command: command})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, nil
+}
+
+// setAlias defines or replaces an alias.
+func setAlias(session, name, command string) (*Alias, error) {
+	aliasesMu.Lock()
+	defer aliasesMu.Unlock()
+
+	aliases, err := readAliases(session)
+	if err != nil {
+		return nil, err
+	}
+	aliases[name] = command
+	if err := saveAliases(session, aliases); err != nil {
+		return nil, fmt.Errorf("Failed to save aliases: %v", err)
+	}
+	return &Alias{Type: "alias", Session: session, Name: name, Command: command}, nil
+}
+
+// deleteAlias removes an alias and returns it.
+func deleteAlias(session, name string) (*Alias, error) {
+	aliasesMu.Lock()
+	defer aliasesMu.Unlock()
+
+	aliases, err := readAliases(session)
+	if err != nil {
+		return nil, err
+	}
+	command, ok := aliases[name]
+	if !ok {
+		return nil, errAliasNotFound
+	}
+	delete(aliases, name)
+	if err := saveAliases(session, aliases); err != nil {
+		return nil, fmt.Errorf("Failed to save aliases: %v", err)
+	}
+	return &Alias{Type: "alias", Session: session, Name: name, Command: command}, nil
+}
+
+// expandAlias replaces the command's first word when it is one of the
+// session's aliases, returning the expansion and what was typed, or the
+// command unchanged and "". Expansions aren't expanded again.
+func expandAlias(session, inputCmd string) (string, string) {
+	line := strings.TrimLeftFunc(inputCmd, unicode.IsSpace)
+	end := strings.IndexFunc(line, unicode.IsSpace)
+	if end < 0 {
+		end = len(line)
+	}
+	if !aliasNameRe.MatchString(line[:end]) {
+		return inputCmd, ""
+	}
+	aliases, err := readAliases(session)
+	if err != nil {
+		logger.Warn("failed to read aliases", "session", session, "err", err)
+		return inputCmd, ""
+	}
+	command, ok := aliases[line[:end]]
+	if !ok {
+		return inputCmd, ""
+	}
+	return command + line[end:], inputCmd
+}
+
+// aliasParams reads the alias from a JSON {"name": ..., "command": ...}
+// body, or the name and command parameters.
+func aliasParams(r *http.Request) (string, string, error) {
+	name, command := r.URL.Query().Get("name"), r.URL.Query().Get("command")
+	if command == "" {
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxAliasBytes+1))
+		if err != nil {
+			return "", "", fmt.Errorf("%w: %v", errBodyMessage, err)
+		}
+		if len(strings.TrimSpace(string(body))) > 0 {
+			req := &struct {
+				Name    string `json:"name"`
+				Command string `json:"command"`
+			}{Name: name}
+			if err := json.Unmarshal(body, req); err != nil {
+				return "", "", fmt.Errorf("%w: %v", errBodyMessage, err)
+			}
+			name, command = req.Name, req.Command
+		}
+	}
+	if !aliasNameRe.MatchString(name) {
+		return "", "", errAliasNameMessage
+	}
+	if strings.TrimSpace(command) == "" || len(command) > maxAliasBytes {
+		return "", "", errAliasCommandMessage
+	}
+	return name, command, nil
+}
+
+func aliasesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// Validate the hash parameter
+	hashParam := r.URL.Query().Get("hash")
+	if !checkHash(r, hashParam) {
+		writeError(w, errHashMessage)
+		return
+	}
+
+	session := r.URL.Query().Get("session")
+	if !validSessionName(session) {
+		writeError(w, errSessionMessage)
+		return
+	}
+
+	var resp interface{}
+	switch r.Method {
+	case http.MethodGet:
+		aliases, err := listAliases(session)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		resp = aliases
+
+	case http.MethodPost, http.MethodPut:
+		name, command, err := aliasParams(r)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		alias, err := setAlias(session, name, command)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		logFrom(r.Context()).Info("alias set", "session", session, "name", name)
+		resp = alias
+
+	case http.MethodDelete:
+		name := r.URL.Query().Get("name")
+		if !aliasNameRe.MatchString(name) {
+			writeError(w, errAliasNameMessage)
+			return
+		}
+		alias, err := deleteAlias(session, name)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		logFrom(r.Context()).Info("alias deleted", "session", session, "name", name)
+		resp = alias
+
+	default:
+		writeError(w, errMethodMessage)
+		return
+	}
+
+	jsonResp, err := json.Marshal(resp)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to marshal JSON response: %v", err)
+		writeJsonError(w, msg)
+		return
+	}
+
+	fmt.Fprint(w, string(jsonResp))
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	eventApprovalRequested = "approval.requested"
+	eventApprovalDecided   = "approval.decided"
+)
+
+var (
+	errActionMessage    = paramError("action", "Invalid or missing 'action' parameter, use approve or reject")
+	errApprovalNotFound = newKindError(errNotFound, "Approval not found or already handled")
+)
+
+// Approval is a command waiting for a human to approve it before it runs.
+type Approval struct {
+	ID        string    `json:"id"`
+	Session   string    `json:"session"`
+	Cmd       string    `json:"cmd"`
+	Requester string    `json:"requester,omitempty"`
+	Source    string    `json:"source"`
+	Created   time.Time `json:"created"`
+}
+
+// ApprovalDecision is the outcome of approving or rejecting a command.
+type ApprovalDecision struct {
+	Approval   *Approval      `json:"approval"`
+	Approved   bool           `json:"approved"`
+	Decider    string         `json:"decider,omitempty"`
+	Submission *CmdSubmission `json:"submission,omitempty"`
+}
+
+var (
+	approvalsMu sync.Mutex
+	approvals   = map[string]*Approval{}
+)
+
+// requestApproval queues a command until someone decides on it.
+func requestApproval(session, cmd, requester, source string) *Approval {
+	a := &Approval{
+		ID:        newID(),
+		Session:   session,
+		Cmd:       cmd,
+		Requester: requester,
+		Source:    source,
+		Created:   time.Now().UTC(),
+	}
+	approvalsMu.Lock()
+	approvals[a.ID] = a
+	approvalsMu.Unlock()
+	publishActivity(eventApprovalRequested, session, 0, a)
+	return a
+}
+
+// cancelApproval drops a pending approval without a decision.
+func cancelApproval(id string) {
+	approvalsMu.Lock()
+	delete(approvals, id)
+	approvalsMu.Unlock()
+}
+
+// pendingApprovals lists the queue, oldest first.
+func pendingApprovals() []*Approval {
+	approvalsMu.Lock()
+	defer approvalsMu.Unlock()
+	list := make([]*Approval, 0, len(approvals))
+	for _, a := range approvals {
+		list = append(list, a)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Created.Before(list[j].Created) })
+	return list
+}
+
+// decideApproval removes the approval from the queue and, when approved,
+// submits its command. Each approval is decided at most once.
+func decideApproval(ctx context.Context, id string, approve bool, decider string) (*ApprovalDecision, error) {
+	approvalsMu.Lock()
+	a, ok := approvals[id]
+	delete(approvals, id)
+	approvalsMu.Unlock()
+	if !ok {
+		return nil, errApprovalNotFound
+	}
+
+	d := &ApprovalDecision{Approval: a, Approved: approve, Decider: decider}
+	logFrom(ctx).Info("approval decided", "session", a.Session, "approval", a.ID, "approved", approve, "decider", decider)
+	publishActivity(eventApprovalDecided, a.Session, 0, d)
+	if !approve {
+		return d, nil
+	}
+
+	csr, err := submitCommand(ctx, a.Session, a.Cmd, execOptions{Timeout: defaultCmdTimeout, Confirmed: true})
+	if err != nil {
+		return d, err
+	}
+	d.Submission = csr
+	return d, nil
+}
+
+func parseApprovalAction(action string) (bool, error) {
+	switch action {
+	case "approve":
+		return true, nil
+	case "reject":
+		return false, nil
+	}
+	return false, errActionMessage
+}
+
+// approvalsHandler lists the queue (GET) and decides on an approval (POST
+// with id and action). It requires the admin hash.
+func approvalsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// Validate the hash parameter
+	hashParam := r.URL.Query().Get("hash")
+	if !checkAdmin(r, hashParam) {
+		writeError(w, errHashMessage)
+		return
+	}
+
+	var resp interface{}
+	switch r.Method {
+	case http.MethodGet:
+		resp = pendingApprovals()
+
+	case http.MethodPost:
+		approve, err := parseApprovalAction(r.URL.Query().Get("action"))
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		d, err := decideApproval(r.Context(), r.URL.Query().Get("id"), approve, "api")
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		resp = d
+
+	default:
+		writeError(w, errMethodMessage)
+		return
+	}
+
+	jsonResp, err := json.Marshal(resp)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to marshal JSON response: %v", err)
+		writeJsonError(w, msg)
+		return
+	}
+
+	fmt.Fprint(w, string(jsonResp))
+}
+
+// pendingApprovalView is a queued approval with its session's recent
+// tickets for context.
+type pendingApprovalView struct {
+	*Approval
+	Recent []*TicketRow
+}
+
+const approvalContextTickets = 5
+
+func dashboardApprovalsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		// Buttons post back here and return to the queue
+		if err := r.ParseForm(); err != nil {
+			writeError(w, errBodyMessage)
+			return
+		}
+		approve, err := parseApprovalAction(r.PostForm.Get("action"))
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		if _, err := decideApproval(r.Context(), r.PostForm.Get("id"), approve, "dashboard"); err != nil {
+			logFrom(r.Context()).Warn("approval failed", "err", err)
+		}
+		http.Redirect(w, r, adminLink(r.URL.Query().Get("hash"), "/admin/approvals"), http.StatusSeeOther)
+		return
+	default:
+		writeError(w, errMethodMessage)
+		return
+	}
+
+	var views []pendingApprovalView
+	for _, a := range pendingApprovals() {
+		v := pendingApprovalView{Approval: a}
+		if tickets, err := sessionTickets(a.Session); err == nil {
+			if len(tickets) > approvalContextTickets {
+				tickets = tickets[:approvalContextTickets]
+			}
+			v.Recent = tickets
+		}
+		views = append(views, v)
+	}
+
+	renderDashboard(w, r, "approvals", "Approvals", views)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	artifactsDir    = "artifacts"
+	artifactsEnv    = "LLMASS_ARTIFACTS"
+	artifactURL     = "%s/artifact?hash=%s&session=%s&ticket=%d&name=%s"
+	maxArtifactSize = 100 << 20 // 100MB per file
+)
+
+var (
+	errNameMessage = paramError("name", "Invalid or missing 'name' parameter")
+)
+
+type Artifact struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+	URL  string `json:"url"`
+}
+
+func ArtifactURL(ctx context.Context, session string, ticket int, name string) string {
+	base, hash, extra := linkTarget(ctx)
+	return fmt.Sprintf(artifactURL, base, hash, session, ticket, url.QueryEscape(name)) + extra
+}
+
+func ticketArtifactsDir(sessionFolder string, ticket int) string {
+	return filepath.Join(sessionFolder, artifactsDir, fmt.Sprintf("%02d", ticket))
+}
+
+// newArtifactManifest creates the empty file a command appends artifact
+// paths to, one per line, via $LLMASS_ARTIFACTS.
+func newArtifactManifest() (string, error) {
+	f, err := os.CreateTemp("", "llmass-artifacts-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create artifact manifest: %v", err)
+	}
+	defer f.Close()
+	return f.Name(), nil
+}
+
+// collectArtifacts copies every path listed in the manifest into the ticket's
+// artifacts folder and removes the manifest.
+func collectArtifacts(ctx context.Context, manifest, workDir, sessionFolder, session string, ticket int) []Artifact {
+	defer os.Remove(manifest)
+
+	f, err := os.Open(manifest)
+	if err != nil {
+		logger.Error("failed to open artifact manifest", "path", manifest, "err", err)
+		return nil
+	}
+	defer f.Close()
+
+	var artifacts []Artifact
+	seen := map[string]bool{}
+	dest := ticketArtifactsDir(sessionFolder, ticket)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		src := strings.TrimSpace(scanner.Text())
+		if src == "" {
+			continue
+		}
+		if !filepath.IsAbs(src) {
+			src = filepath.Join(workDir, src)
+		}
+
+		name := filepath.Base(src)
+		for i := 1; seen[name]; i++ {
+			name = fmt.Sprintf("%d-%s", i, filepath.Base(src))
+		}
+
+		size, err := copyArtifact(src, dest, name)
+		if err != nil {
+			logger.Warn("failed to collect artifact", "path", src, "err", err)
+			continue
+		}
+		seen[name] = true
+		artifacts = append(artifacts, Artifact{Name: name, Size: size, URL: ArtifactURL(ctx, session, ticket, name)})
+	}
+	return artifacts
+}
+
+func copyArtifact(src, destDir, name string) (int64, error) {
+	info, err := os.Stat(src)
+	if err != nil {
+		return 0, err
+	}
+	if !info.Mode().IsRegular() {
+		return 0, fmt.Errorf("not a regular file")
+	}
+	if info.Size() > maxArtifactSize {
+		return 0, fmt.Errorf("file exceeds %d bytes", maxArtifactSize)
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+
+	if err := os.MkdirAll(destDir, 0755); err != nil {
+		return 0, err
+	}
+	out, err := os.OpenFile(filepath.Join(destDir, name), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer out.Close()
+
+	return io.Copy(out, in)
+}
+
+func artifactHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodGet {
+		writeError(w, errMethodMessage)
+		return
+	}
+
+	// Validate the ticket parameter
+	ticket, err := strconv.Atoi(r.URL.Query().Get("ticket"))
+	if err != nil {
+		writeError(w, errTicketMessage)
+		return
+	}
+
+	// Validate the hash parameter
+	hashParam := r.URL.Query().Get("hash")
+	if !checkHash(r, hashParam) {
+		writeError(w, errHashMessage)
+		return
+	}
+
+	// Check if session is provided in query parameters
+	session := r.URL.Query().Get("session")
+	if session == "" {
+		writeError(w, errSessionMessage)
+		return
+	}
+
+	// Only plain file names are allowed, never paths
+	name := r.URL.Query().Get("name")
+	if name == "" || name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+		writeError(w, errNameMessage)
+		return
+	}
+
+	path := filepath.Join(ticketArtifactsDir(filepath.Join(sessionsDir, session), ticket), name)
+	if _, err := os.Stat(path); err != nil {
+		writeError(w, notFoundf("Artifact %s not found for ticket %d", name, ticket))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	http.ServeFile(w, r, path)
+}
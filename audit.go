@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	auditFile        = "audit.log"
+	auditPageLimit   = 500
+	auditKeyAdmin    = "admin"
+	auditKeyHash     = "hash"
+	auditKeyListener = "listener"
+	auditKeyInvalid  = "invalid"
+
+	auditSuccess = "success"
+	auditDenied  = "denied"
+	auditError   = "error"
+)
+
+// AuditEntry is one authenticated request, appended to DATA_DIR/audit.log
+// as a JSON line.
+type AuditEntry struct {
+	Time       time.Time `json:"time"`
+	RequestID  string    `json:"request_id"`
+	Key        string    `json:"key"`
+	RemoteAddr string    `json:"remote_addr"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Session    string    `json:"session,omitempty"`
+	Ticket     int       `json:"ticket,omitempty"`
+	Cmd        string    `json:"cmd,omitempty"`
+	Status     int       `json:"status"`
+	Outcome    string    `json:"outcome"`
+}
+
+// auditInfo collects what the handler learns about a request.
+type auditInfo struct {
+	mu    sync.Mutex
+	entry AuditEntry
+}
+
+type auditContextKey struct{}
+
+var auditMu sync.Mutex
+
+func auditFrom(ctx context.Context) *auditInfo {
+	a, _ := ctx.Value(auditContextKey{}).(*auditInfo)
+	return a
+}
+
+// auditKey records which credential the request presented.
+func auditKey(r *http.Request, key string) {
+	if a := auditFrom(r.Context()); a != nil {
+		a.mu.Lock()
+		a.entry.Key = key
+		a.mu.Unlock()
+	}
+}
+
+// auditCommand records the command a request submitted.
+func auditCommand(ctx context.Context, session string, ticket int, cmd string) {
+	if a := auditFrom(ctx); a != nil {
+		a.mu.Lock()
+		a.entry.Session = session
+		a.entry.Ticket = ticket
+		a.entry.Cmd = cmd
+		a.mu.Unlock()
+	}
+}
+
+// withAudit appends an audit entry for every request that presented a
+// credential, successful or not.
+func withAudit(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a := &auditInfo{entry: AuditEntry{
+			Time:       time.Now().UTC(),
+			RequestID:  requestIDFrom(r.Context()),
+			RemoteAddr: r.RemoteAddr,
+			Method:     r.Method,
+			Path:       r.URL.Path,
+			Session:    r.URL.Query().Get("session"),
+		}}
+		a.entry.Ticket, _ = strconv.Atoi(r.URL.Query().Get("ticket"))
+
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), auditContextKey{}, a)))
+
+		a.mu.Lock()
+		e := a.entry
+		a.mu.Unlock()
+		if e.Key == "" {
+			return
+		}
+		e.Status = sw.status
+		switch {
+		case e.Key == auditKeyInvalid:
+			e.Outcome = auditDenied
+		case e.Status >= 400:
+			e.Outcome = auditError
+		default:
+			e.Outcome = auditSuccess
+		}
+		if err := appendAudit(&e); err != nil {
+			logger.Error("failed to write audit log", "err", err)
+		}
+	})
+}
+
+func appendAudit(e *AuditEntry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	f, err := os.OpenFile(filepath.Join(dataDir, auditFile), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(line, '\n'))
+	return err
+}
+
+// auditFilter selects audit entries, zero fields match everything.
+type auditFilter struct {
+	Key     string
+	Session string
+	Outcome string
+	From    time.Time
+	To      time.Time
+}
+
+func parseAuditFilter(r *http.Request) auditFilter {
+	q := r.URL.Query()
+	f := auditFilter{Key: q.Get("key"), Session: q.Get("session"), Outcome: q.Get("outcome")}
+	if t, err := time.Parse("2006-01-02T15:04", q.Get("from")); err == nil {
+		f.From = t
+	}
+	if t, err := time.Parse("2006-01-02T15:04", q.Get("to")); err == nil {
+		f.To = t
+	}
+	return f
+}
+
+func (f auditFilter) match(e *AuditEntry) bool {
+	return (f.Key == "" || e.Key == f.Key) &&
+		(f.Session == "" || e.Session == f.Session) &&
+		(f.Outcome == "" || e.Outcome == f.Outcome) &&
+		(f.From.IsZero() || !e.Time.Before(f.From)) &&
+		(f.To.IsZero() || e.Time.Before(f.To))
+}
+
+// readAudit returns matching entries, newest first, up to limit (0 for all).
+func readAudit(f auditFilter, limit int) ([]*AuditEntry, error) {
+	auditMu.Lock()
+	file, err := os.Open(filepath.Join(dataDir, auditFile))
+	auditMu.Unlock()
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []*AuditEntry
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), maxRequestBody)
+	for scanner.Scan() {
+		e := &AuditEntry{}
+		if json.Unmarshal(scanner.Bytes(), e) != nil || !f.match(e) {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	if limit > 0 && len(entries) > limit {
+		entries = entries[:limit]
+	}
+	return entries, nil
+}
+
+// dashboardAuditHandler browses the audit log, or exports it as CSV with
+// format=csv.
+func dashboardAuditHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, errMethodMessage)
+		return
+	}
+
+	filter := parseAuditFilter(r)
+	csvExport := r.URL.Query().Get("format") == "csv"
+	limit := auditPageLimit
+	if csvExport {
+		limit = 0
+	}
+	entries, err := readAudit(filter, limit)
+	if err != nil {
+		logger.Error("failed to read audit log", "err", err)
+		writeJsonError(w, "Failed to read audit log")
+		return
+	}
+
+	if csvExport {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="audit.csv"`)
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"time", "request_id", "key", "remote_addr", "method", "path", "session", "ticket", "cmd", "status", "outcome"})
+		for _, e := range entries {
+			ticket := ""
+			if e.Ticket > 0 {
+				ticket = strconv.Itoa(e.Ticket)
+			}
+			cw.Write([]string{e.Time.Format(time.RFC3339), e.RequestID, e.Key, e.RemoteAddr, e.Method, e.Path,
+				e.Session, ticket, e.Cmd, strconv.Itoa(e.Status), e.Outcome})
+		}
+		cw.Flush()
+		return
+	}
+
+	q := r.URL.Query()
+	q.Set("format", "csv")
+	renderDashboard(w, r, "audit", "Audit Log", map[string]interface{}{
+		"Entries": entries,
+		"Limit":   auditPageLimit,
+		"Filter":  map[string]string{"key": q.Get("key"), "session": q.Get("session"), "outcome": q.Get("outcome"), "from": q.Get("from"), "to": q.Get("to")},
+		"CSVURL":  basePath + r.URL.Path + "?" + q.Encode(),
+	})
+}
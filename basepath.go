@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+var basePath string // BASE_PATH without a trailing slash, "" when mounted at the root
+
+type baseURLContextKey struct{}
+
+// loadBasePath reads BASE_PATH, the prefix the server is mounted under when
+// a reverse proxy forwards e.g. https://host/llmass/ to it.
+func loadBasePath() error {
+	p := strings.TrimRight(os.Getenv("BASE_PATH"), "/")
+	if p != "" {
+		u, err := url.Parse(p)
+		if err != nil || !strings.HasPrefix(p, "/") || u.Path != p || u.RawQuery != "" || u.Fragment != "" {
+			return fmt.Errorf("BASE_PATH must be a path such as /llmass")
+		}
+	}
+	basePath = p
+	return nil
+}
+
+// fqdnBaseURL is FQDN with BASE_PATH appended unless FQDN already ends
+// with it.
+func fqdnBaseURL() string {
+	base := strings.TrimRight(fqdn, "/")
+	if basePath != "" && !strings.HasSuffix(base, basePath) {
+		base += basePath
+	}
+	return base
+}
+
+// requestBaseURL builds the public URL from X-Forwarded-Proto and
+// X-Forwarded-Host when the proxy sets them, falling back to FQDN.
+func requestBaseURL(r *http.Request) string {
+	proto := firstForwarded(r.Header.Get("X-Forwarded-Proto"))
+	host := firstForwarded(r.Header.Get("X-Forwarded-Host"))
+	if proto == "" && host == "" {
+		return fqdnBaseURL()
+	}
+	if host == "" {
+		host = r.Host
+	}
+	if proto == "" {
+		proto = "http"
+		if r.TLS != nil {
+			proto = "https"
+		}
+	}
+	u, err := url.Parse(proto + "://" + host)
+	if err != nil || (proto != "http" && proto != "https") || u.Host != host || u.Path != "" || u.User != nil {
+		return fqdnBaseURL()
+	}
+	return proto + "://" + host + basePath
+}
+
+// firstForwarded returns the client-most value of a comma separated
+// forwarding header.
+func firstForwarded(v string) string {
+	first, _, _ := strings.Cut(v, ",")
+	return strings.TrimSpace(first)
+}
+
+// withBasePath strips BASE_PATH from the request path and carries the public
+// URL in the request context for generated links.
+func withBasePath(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if basePath != "" {
+			if r.URL.Path == basePath {
+				target := basePath + "/"
+				if r.URL.RawQuery != "" {
+					target += "?" + r.URL.RawQuery
+				}
+				http.Redirect(w, r, target, http.StatusMovedPermanently)
+				return
+			}
+			rest, ok := strings.CutPrefix(r.URL.Path, basePath+"/")
+			if !ok {
+				writeError(w, errNotFoundMessage)
+				return
+			}
+			r2 := new(http.Request)
+			*r2 = *r
+			r2.URL = new(url.URL)
+			*r2.URL = *r.URL
+			r2.URL.Path = "/" + rest
+			r2.URL.RawPath = ""
+			r = r2
+		}
+		h.ServeHTTP(w, r.WithContext(withBaseURL(r.Context(), requestBaseURL(r))))
+	})
+}
+
+func withBaseURL(ctx context.Context, base string) context.Context {
+	return context.WithValue(ctx, baseURLContextKey{}, base)
+}
+
+// baseURL returns the public URL for links generated while handling ctx.
+func baseURL(ctx context.Context) string {
+	if base, ok := ctx.Value(baseURLContextKey{}).(string); ok {
+		return base
+	}
+	return fqdnBaseURL()
+}
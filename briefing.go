@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// /context/auto composes a compact briefing of a session in one call, for an
+// agent resuming work after a restart: the session's size and age, the host
+// and shell its commands run in, its running commands, its last tickets with
+// trimmed outputs, and its notes.
+
+const (
+	defaultBriefingTickets = 5
+	maxBriefingTickets     = 50
+	defaultBriefingTokens  = 200 // of each ticket's output
+)
+
+// BriefingEnv is where the session's commands run.
+type BriefingEnv struct {
+	Host       string   `json:"host"`
+	OS         string   `json:"os"`
+	User       string   `json:"user"`
+	Shell      string   `json:"shell"`
+	Cwd        string   `json:"cwd"`
+	InitFiles  []string `json:"init_files"`
+	Workspaces []string `json:"workspaces"`
+}
+
+// BriefingTicket is a recent ticket with its output trimmed.
+type BriefingTicket struct {
+	Ticket       int    `json:"ticket"`
+	Input        string `json:"input"`
+	Output       string `json:"output"`
+	OmittedLines int    `json:"omitted_lines,omitempty"`
+	ExitCode     *int   `json:"exit_code,omitempty"`
+	Callback     string `json:"callback"`
+}
+
+// Briefing answers /context/auto.
+type Briefing struct {
+	Type       string           `json:"type"`
+	Next       string           `json:"next"`
+	Session    string           `json:"session"`
+	Tickets    int              `json:"tickets"`
+	Modified   time.Time        `json:"modified"`
+	Env        BriefingEnv      `json:"env"`
+	Running    []runningCmd     `json:"running"`
+	Checkpoint *Checkpoint      `json:"checkpoint,omitempty"`
+	Recent     []BriefingTicket `json:"recent"`
+	Notes      []*Note          `json:"notes"`
+}
+
+// briefingEnv describes the host and shell of the session's commands, which
+// start in the server's working directory.
+func briefingEnv(session string) BriefingEnv {
+	sessionFolder := filepath.Join(sessionsDir, session)
+	env := BriefingEnv{
+		OS:         runtime.GOOS + "/" + runtime.GOARCH,
+		Shell:      shellPath,
+		InitFiles:  initFiles(sessionFolder),
+		Workspaces: []string{},
+	}
+	env.Host, _ = os.Hostname()
+	if u, err := user.Current(); err == nil {
+		env.User = u.Username
+	}
+	env.Cwd, _ = os.Getwd()
+	if env.InitFiles == nil {
+		env.InitFiles = []string{}
+	}
+	if dir := sessionWorkspacesDir(sessionFolder); dir != "" {
+		entries, _ := os.ReadDir(dir)
+		for _, e := range entries {
+			env.Workspaces = append(env.Workspaces, e.Name())
+		}
+	}
+	return env
+}
+
+// buildBriefing gathers the session's briefing with its last n tickets, each
+// output trimmed to about maxTokens.
+func buildBriefing(ctx context.Context, session string, n, maxTokens int) (*Briefing, error) {
+	info, err := os.Stat(filepath.Join(sessionsDir, session))
+	if err != nil || !info.IsDir() {
+		return nil, notFoundf("Session %s does not exist", session)
+	}
+
+	b := &Briefing{
+		Type:       "briefing",
+		Next:       "This is where the session stands. Fetch a ticket's callback for its full output, or issue your next command to /shell",
+		Session:    session,
+		Modified:   info.ModTime(),
+		Env:        briefingEnv(session),
+		Running:    runningForSession(session),
+		Checkpoint: latestCheckpoint(session),
+		Recent:     []BriefingTicket{},
+	}
+
+	// A session without tickets yet still gets a briefing
+	history, _ := readHistory(session)
+	b.Tickets = len(history)
+	if len(history) > n {
+		history = history[len(history)-n:]
+	}
+	for _, res := range history {
+		output, lines, _, _ := trimOutput(res.Output, maxTokens)
+		b.Recent = append(b.Recent, BriefingTicket{
+			Ticket:       res.Ticket,
+			Input:        res.Input,
+			Output:       output,
+			OmittedLines: lines,
+			ExitCode:     res.ExitCode,
+			Callback:     Callback(ctx, session, res.Ticket),
+		})
+	}
+
+	if b.Notes, err = readNotes(session); err != nil {
+		return nil, err
+	}
+	if b.Notes == nil {
+		b.Notes = []*Note{}
+	}
+	return b, nil
+}
+
+// briefingText renders a briefing as plain text.
+func briefingText(b *Briefing) string {
+	var s strings.Builder
+	fmt.Fprintf(&s, "# Session %s\n%d tickets, last active %s\n", b.Session, b.Tickets, b.Modified.Format(time.RFC3339))
+	fmt.Fprintf(&s, "Host %s (%s), user %s, shell %s\n", b.Env.Host, b.Env.OS, b.Env.User, b.Env.Shell)
+	fmt.Fprintf(&s, "Commands start in %s\n", b.Env.Cwd)
+	if len(b.Env.InitFiles) > 0 {
+		fmt.Fprintf(&s, "Init files: %s\n", strings.Join(b.Env.InitFiles, ", "))
+	}
+	if len(b.Env.Workspaces) > 0 {
+		fmt.Fprintf(&s, "Workspaces: %s\n", strings.Join(b.Env.Workspaces, ", "))
+	}
+	for _, rc := range b.Running {
+		fmt.Fprintf(&s, "Running: ticket %d, pid %d, since %s: %s\n", rc.Ticket, rc.Pid, rc.Started.Format(time.RFC3339), rc.Input)
+	}
+
+	if b.Checkpoint != nil {
+		fmt.Fprintf(&s, "\n# Checkpoint through ticket %d\n%s", b.Checkpoint.Through, withNewline(b.Checkpoint.Summary))
+	}
+	if len(b.Recent) > 0 {
+		s.WriteString("\n# Recent commands\n")
+		for _, t := range b.Recent {
+			fmt.Fprintf(&s, "$ %s\n%s", t.Input, withNewline(t.Output))
+			if t.ExitCode != nil {
+				fmt.Fprintf(&s, "[ticket %d, exit code %d]\n", t.Ticket, *t.ExitCode)
+			} else {
+				fmt.Fprintf(&s, "[ticket %d]\n", t.Ticket)
+			}
+		}
+	}
+	if len(b.Notes) > 0 {
+		s.WriteString("\n# Notes\n" + notesText(b.Notes))
+	}
+	return s.String()
+}
+
+func briefingHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodGet {
+		writeError(w, errMethodMessage)
+		return
+	}
+
+	format, err := responseFormat(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// Validate the hash parameter
+	hashParam := r.URL.Query().Get("hash")
+	if !checkHash(r, hashParam) {
+		writeError(w, errHashMessage)
+		return
+	}
+
+	session := r.URL.Query().Get("session")
+	if !validSessionName(session) {
+		writeError(w, errSessionMessage)
+		return
+	}
+
+	n := defaultBriefingTickets
+	if s := r.URL.Query().Get("n"); s != "" {
+		v, err := strconv.Atoi(s)
+		if err != nil || v < 0 || v > maxBriefingTickets {
+			writeError(w, errCountMessage)
+			return
+		}
+		n = v
+	}
+	maxTokens, err := parseMaxTokens(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if maxTokens == 0 {
+		maxTokens = defaultBriefingTokens
+	}
+
+	b, err := buildBriefing(r.Context(), session, n, maxTokens)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeFormatted(w, format, b, briefingText(b))
+}
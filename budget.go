@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Token budgets cap how many output tokens the server hands out each clock
+// hour, per session with SESSION_TOKEN_BUDGET and across every session on
+// the HASH with HASH_TOKEN_BUDGET, so a runaway agent loop can't flood its
+// own context or a metered model. Outputs read from /status and /output
+// count when they are returned. Once a budget runs low outputs are trimmed to
+// what is left, and to budgetFloorTokens once it is spent, with
+// budget_exhausted set. Usage is kept in memory and starts over each hour.
+
+const budgetFloorTokens = 100
+
+var (
+	// The budgets are swapped by a reload, usage so far this hour carries over
+	sessionTokenBudget atomic.Int64 // SESSION_TOKEN_BUDGET, 0 is unlimited
+	hashTokenBudget    atomic.Int64 // HASH_TOKEN_BUDGET, 0 is unlimited
+
+	budgetMu    sync.Mutex
+	budgetHour  time.Time
+	budgetUsed  map[string]int // tokens by session this hour
+	budgetTotal int
+)
+
+// parseTokenBudgets reads SESSION_TOKEN_BUDGET and HASH_TOKEN_BUDGET.
+func parseTokenBudgets() (session, hash int, err error) {
+	for _, b := range []struct {
+		name  string
+		value *int
+	}{
+		{"SESSION_TOKEN_BUDGET", &session},
+		{"HASH_TOKEN_BUDGET", &hash},
+	} {
+		s := os.Getenv(b.name)
+		if s == "" {
+			continue
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return 0, 0, fmt.Errorf("%s must be a number of tokens per hour: %q", b.name, s)
+		}
+		*b.value = n
+	}
+	return session, hash, nil
+}
+
+// loadTokenBudgets parses the token budgets and puts them in effect.
+func loadTokenBudgets() error {
+	session, hash, err := parseTokenBudgets()
+	if err != nil {
+		return err
+	}
+	setTokenBudgets(session, hash)
+	return nil
+}
+
+func setTokenBudgets(session, hash int) {
+	sessionTokenBudget.Store(int64(session))
+	hashTokenBudget.Store(int64(hash))
+}
+
+// tokenBudgets returns the session and HASH budgets in effect.
+func tokenBudgets() (session, hash int) {
+	return int(sessionTokenBudget.Load()), int(hashTokenBudget.Load())
+}
+
+func budgetsEnabled() bool {
+	session, hash := tokenBudgets()
+	return session > 0 || hash > 0
+}
+
+// budgetRemaining returns the tokens the session may still receive this
+// hour, the caller holds budgetMu.
+func budgetRemaining(session string) int {
+	if hour := time.Now().UTC().Truncate(time.Hour); !budgetHour.Equal(hour) {
+		budgetHour, budgetUsed, budgetTotal = hour, map[string]int{}, 0
+	}
+	sessionBudget, hashBudget := tokenBudgets()
+	remaining := -1
+	if sessionBudget > 0 {
+		remaining = sessionBudget - budgetUsed[session]
+	}
+	if hashBudget > 0 && (remaining < 0 || hashBudget-budgetTotal < remaining) {
+		remaining = hashBudget - budgetTotal
+	}
+	if remaining < 0 {
+		remaining = 0
+	}
+	return remaining
+}
+
+// budgetLeft returns what is left this hour of the HASH's budget and of
+// each session's, -1 where there is no budget.
+func budgetLeft(sessions []string) (int, map[string]int) {
+	budgetMu.Lock()
+	defer budgetMu.Unlock()
+	budgetRemaining("") // starts the hour over when it has passed
+
+	sessionBudget, hashBudget := tokenBudgets()
+	hashLeft := -1
+	if hashBudget > 0 {
+		hashLeft = max(hashBudget-budgetTotal, 0)
+	}
+	var sessionLeft map[string]int
+	if sessionBudget > 0 {
+		sessionLeft = make(map[string]int, len(sessions))
+		for _, s := range sessions {
+			sessionLeft[s] = max(sessionBudget-budgetUsed[s], 0)
+		}
+	}
+	return hashLeft, sessionLeft
+}
+
+func spendBudget(session string, tokens int) {
+	budgetUsed[session] += tokens
+	budgetTotal += tokens
+}
+
+// budgetLimit returns how many tokens of a tokens long output the session
+// may receive, and whether the output is cut because the budget ran out.
+// The tokens granted are spent.
+func budgetLimit(session string, tokens int) (int, bool) {
+	budgetMu.Lock()
+	defer budgetMu.Unlock()
+
+	remaining := budgetRemaining(session)
+	if tokens <= remaining {
+		spendBudget(session, tokens)
+		return tokens, false
+	}
+	if remaining < budgetFloorTokens {
+		remaining = budgetFloorTokens
+	}
+	spendBudget(session, remaining)
+	return remaining, true
+}
+
+// budgetMessage tells the agent the budget ran out and when it resets.
+func budgetMessage() string {
+	reset := time.Now().UTC().Truncate(time.Hour).Add(time.Hour)
+	return fmt.Sprintf("The output token budget is exhausted and this output was cut to fit it. It resets at %s, until then prefer commands with short outputs", reset.Format(time.RFC3339))
+}
+
+// budgetTokens returns the max_tokens to trim a result to for the session's
+// budget, and whether the budget lowered it. The outputs share what is left.
+func budgetTokens(res *CmdResults, maxTokens int) (int, bool) {
+	if !budgetsEnabled() {
+		return maxTokens, false
+	}
+	outputs := []string{res.Output}
+	for _, it := range res.Iterations {
+		outputs = append(outputs, it.Output)
+	}
+	tokens := 0
+	for _, s := range outputs {
+		n := countTokens(s)
+		if maxTokens > 0 && n > maxTokens {
+			n = maxTokens
+		}
+		tokens += n
+	}
+
+	granted, exhausted := budgetLimit(res.Session, tokens)
+	if !exhausted {
+		return maxTokens, false
+	}
+	if granted /= len(outputs); granted < 1 {
+		granted = 1
+	}
+	return granted, true
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A repeat of a command, in the same directory with the same variables,
+// backend and limits, can be answered with the ticket of its last run in the
+// session instead of running it again, so an agent polling a pure read
+// like cat or ls doesn't pile up tickets. Only the commands the CACHE_RULES
+// file declares cacheable are, for as long as their rule says; everything
+// else runs every time it is submitted, as a stateful command must. Rules
+// are checked in order and the first match decides, so a rule with a ttl of
+// 0 carves an exception out of a broader one below it.
+
+// cacheRule caches the commands its pattern matches for TTL seconds.
+type cacheRule struct {
+	Pattern string `json:"pattern"`
+	TTL     int    `json:"ttl"`
+	re      *regexp.Regexp
+}
+
+// cachedRun is the submission a session's repeats of a command are answered
+// with until it expires.
+type cachedRun struct {
+	sub     CmdSubmission
+	expires time.Time
+}
+
+var (
+	cacheRules atomic.Pointer[[]*cacheRule] // swapped by a reload
+
+	cachedRunsMu sync.Mutex
+	cachedRuns   = map[string]map[string]*cachedRun{} // session -> cacheKey -> run
+)
+
+// parseCachePolicy reads the CACHE_RULES JSON file, an array of
+// {"pattern", "ttl"}. Without it nothing is cached.
+func parseCachePolicy() ([]*cacheRule, error) {
+	path := os.Getenv("CACHE_RULES")
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("CACHE_RULES: %v", err)
+	}
+	var rules []*cacheRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("CACHE_RULES: %v", err)
+	}
+	for _, rule := range rules {
+		re, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("CACHE_RULES: bad pattern %q: %v", rule.Pattern, err)
+		}
+		if rule.TTL < 0 {
+			return nil, fmt.Errorf("CACHE_RULES: %q must have a ttl of 0 or more seconds", rule.Pattern)
+		}
+		rule.re = re
+	}
+	return rules, nil
+}
+
+// loadCachePolicy parses the cache policy and puts it in effect.
+func loadCachePolicy() error {
+	rules, err := parseCachePolicy()
+	if err != nil {
+		return err
+	}
+	cacheRules.Store(&rules)
+	return nil
+}
+
+// cacheTTL returns how long a run of the command answers its repeats, 0
+// when it isn't cached.
+func cacheTTL(cmd string) time.Duration {
+	rules := cacheRules.Load()
+	if rules == nil {
+		return 0
+	}
+	for _, rule := range *rules {
+		if rule.re.MatchString(cmd) {
+			return time.Duration(rule.TTL) * time.Second
+		}
+	}
+	return 0
+}
+
+// cacheKey is what a repeat has to match to be answered with a run: the
+// command and everything else that changes what it does.
+func cacheKey(session, input string, opts execOptions) string {
+	target := shellBackend
+	if e, ok := activeExecutor.(*processExecutor); ok && e.remote != nil {
+		target += ":" + e.remote.target(session)
+	}
+	key, _ := json.Marshal(struct {
+		Input       string
+		Cwd         string
+		Env         map[string]string
+		Target      string
+		Limits      ResourceLimits
+		LineNumbers bool
+	}{input, opts.Cwd, opts.Env, target, opts.Limits, opts.LineNumbers})
+	return string(key)
+}
+
+// cachedSubmission returns the answer to a repeat of the session's command,
+// nil when its last run isn't cached or has expired.
+func cachedSubmission(session, input string, opts execOptions) *CmdSubmission {
+	key := cacheKey(session, input, opts)
+	cachedRunsMu.Lock()
+	defer cachedRunsMu.Unlock()
+	run := cachedRuns[session][key]
+	if run == nil {
+		return nil
+	}
+	if time.Now().After(run.expires) {
+		delete(cachedRuns[session], key)
+		return nil
+	}
+	sub := run.sub
+	sub.IsCached = true
+	return &sub
+}
+
+// rememberRun caches the submission for the command's rule, dropping the
+// session's expired runs.
+func rememberRun(csr *CmdSubmission, opts execOptions) {
+	ttl := cacheTTL(csr.Input)
+	if ttl <= 0 {
+		return
+	}
+	key := cacheKey(csr.Session, csr.Input, opts)
+	cachedRunsMu.Lock()
+	defer cachedRunsMu.Unlock()
+	runs := cachedRuns[csr.Session]
+	if runs == nil {
+		runs = map[string]*cachedRun{}
+		cachedRuns[csr.Session] = runs
+	}
+	now := time.Now()
+	for k, run := range runs {
+		if now.After(run.expires) {
+			delete(runs, k)
+		}
+	}
+	sub := *csr
+	sub.Queued = nil
+	runs[key] = &cachedRun{sub: sub, expires: now.Add(ttl)}
+}
+
+// forgetCachedRuns drops the session's cached runs, whose tickets are gone
+// after a delete, rename or prune.
+func forgetCachedRuns(session string) {
+	cachedRunsMu.Lock()
+	defer cachedRunsMu.Unlock()
+	delete(cachedRuns, session)
+}
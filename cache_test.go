@@ -0,0 +1,40 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestCachedSubmissionKey(t *testing.T) {
+	old := cacheRules.Load()
+	rules := []*cacheRule{{Pattern: "^ls", TTL: 60, re: regexp.MustCompile("^ls")}}
+	cacheRules.Store(&rules)
+	t.Cleanup(func() {
+		cacheRules.Store(old)
+		forgetCachedRuns("cache-test")
+	})
+
+	opts := execOptions{Cwd: "/srv", Env: map[string]string{"A": "1"}, Limits: ResourceLimits{Nice: intp(5)}}
+	rememberRun(&CmdSubmission{Session: "cache-test", Ticket: 7, Input: "ls"}, opts)
+	if sub := cachedSubmission("cache-test", "ls", opts); sub == nil || sub.Ticket != 7 || !sub.IsCached {
+		t.Fatalf("cachedSubmission() for the same run = %+v, want ticket 7", sub)
+	}
+
+	tests := []struct {
+		name string
+		opts execOptions
+	}{
+		{"cwd", execOptions{Cwd: "/tmp", Env: opts.Env, Limits: opts.Limits}},
+		{"env", execOptions{Cwd: opts.Cwd, Env: map[string]string{"A": "2"}, Limits: opts.Limits}},
+		{"no env", execOptions{Cwd: opts.Cwd, Limits: opts.Limits}},
+		{"limits", execOptions{Cwd: opts.Cwd, Env: opts.Env, Limits: ResourceLimits{Nice: intp(10)}}},
+		{"line numbers", execOptions{Cwd: opts.Cwd, Env: opts.Env, Limits: opts.Limits, LineNumbers: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if sub := cachedSubmission("cache-test", "ls", tt.opts); sub != nil {
+				t.Fatalf("cachedSubmission() with another %s = ticket %d, want nil", tt.name, sub.Ticket)
+			}
+		})
+	}
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Checkpoints are rolling summaries of a session's history, so a session
+// hundreds of tickets long can be resumed from one text instead of replaying
+// it. Each folds the tickets since the previous one into its summary, with
+// the summarizer's LLM when SUMMARIZE_URL is set or with rules otherwise.
+// They are made on demand with POST /checkpoints, and every CHECKPOINT_EVERY
+// tickets when it is set, and kept in SESSIONS_DIR/<session>/checkpoints.json.
+
+const (
+	checkpointsFile       = "checkpoints.json"
+	maxCheckpoints        = 20  // kept per session, oldest dropped
+	checkpointOutputTkns  = 200 // of each ticket's output sent to the LLM
+	maxCheckpointInput    = 64 << 10
+	maxCheckpointCommands = 50 // recent commands listed by the rules
+	maxCheckpointFailures = 20 // failed commands listed by the rules
+
+	checkpointRules = "rules"
+	checkpointLLM   = "llm"
+
+	checkpointPrompt = "You keep the running summary of a shell session operated by an AI agent, so the agent can resume the work from it alone. " +
+		"Update the summary with the new commands: what was done, what was found, what failed and what state the system was left in. " +
+		"Keep every file path, host, version and other detail needed to continue, drop what no longer matters. Answer with the summary only."
+)
+
+var (
+	errCheckpointMethodMessage = paramError("method", "Invalid 'method' parameter, use rules or llm")
+	errCheckpointLLMMessage    = paramError("method", "LLM checkpoints are not enabled, set SUMMARIZE_URL")
+	errCheckpointEmpty         = newKindError(errNotFound, "No new tickets since the last checkpoint")
+)
+
+var (
+	checkpointEvery int // CHECKPOINT_EVERY, 0 only checkpoints on demand
+	checkpointsOnce sync.Once
+
+	// checkpointsMu serializes making checkpoints, which also keeps the
+	// automatic ones from racing each other
+	checkpointsMu sync.Mutex
+)
+
+// Checkpoint is a summary of a session's tickets up to Through.
+type Checkpoint struct {
+	Type    string    `json:"type"`
+	ID      int       `json:"id"`
+	Session string    `json:"session"`
+	Through int       `json:"through"`
+	Tickets int       `json:"tickets"`
+	Method  string    `json:"method"`
+	Summary string    `json:"summary"`
+	Created time.Time `json:"created"`
+}
+
+func loadCheckpoints() error {
+	checkpointEvery = 0
+	if s := os.Getenv("CHECKPOINT_EVERY"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return fmt.Errorf("CHECKPOINT_EVERY must be a number of tickets: %q", s)
+		}
+		checkpointEvery = n
+	}
+	checkpointsOnce.Do(func() {
+		onEvent(func(event string, data interface{}) {
+			if cer, ok := data.(*CmdResults); ok && event == eventTicketCompleted && checkpointEvery > 0 {
+				autoCheckpoint(cer.Session, cer.Ticket)
+			}
+		})
+	})
+	return nil
+}
+
+// readCheckpoints returns the session's checkpoints, oldest first.
+func readCheckpoints(session string) ([]*Checkpoint, error) {
+	data, err := os.ReadFile(filepath.Join(sessionsDir, session, checkpointsFile))
+	if os.IsNotExist(err) {
+		return []*Checkpoint{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	checkpoints := []*Checkpoint{}
+	if err := json.Unmarshal(data, &checkpoints); err != nil {
+		return nil, fmt.Errorf("Failed to read checkpoints: %v", err)
+	}
+	return checkpoints, nil
+}
+
+// latestCheckpoint returns the session's newest checkpoint, nil when it has
+// none.
+func latestCheckpoint(session string) *Checkpoint {
+	checkpoints, err := readCheckpoints(session)
+	if err != nil || len(checkpoints) == 0 {
+		return nil
+	}
+	return checkpoints[len(checkpoints)-1]
+}
+
+// saveCheckpoints replaces the session's checkpoints, the caller holds
+// checkpointsMu.
+func saveCheckpoints(session string, checkpoints []*Checkpoint) error {
+	if len(checkpoints) > maxCheckpoints {
+		checkpoints = checkpoints[len(checkpoints)-maxCheckpoints:]
+	}
+	dir := filepath.Join(sessionsDir, session)
+	data, err := json.MarshalIndent(checkpoints, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, checkpointsFile+".tmp")
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, checkpointsFile))
+}
+
+// createCheckpoint folds the tickets since the session's last checkpoint
+// into a new one. An empty method picks llm when SUMMARIZE_URL is set.
+func createCheckpoint(ctx context.Context, session, method string) (*Checkpoint, error) {
+	switch method {
+	case "":
+		method = checkpointRules
+		if summarizeURL != "" {
+			method = checkpointLLM
+		}
+	case checkpointRules:
+	case checkpointLLM:
+		if summarizeURL == "" {
+			return nil, errCheckpointLLMMessage
+		}
+	default:
+		return nil, errCheckpointMethodMessage
+	}
+
+	checkpointsMu.Lock()
+	defer checkpointsMu.Unlock()
+
+	checkpoints, err := readCheckpoints(session)
+	if err != nil {
+		return nil, err
+	}
+	history, err := readHistory(session)
+	if err != nil {
+		return nil, err
+	}
+	prev := &Checkpoint{}
+	if len(checkpoints) > 0 {
+		prev = checkpoints[len(checkpoints)-1]
+	}
+	var fresh []*CmdResults
+	for _, res := range history {
+		if res.Ticket > prev.Through {
+			fresh = append(fresh, res)
+		}
+	}
+	if len(fresh) == 0 {
+		return nil, errCheckpointEmpty
+	}
+
+	cp := &Checkpoint{
+		Type:    "checkpoint",
+		ID:      prev.ID + 1,
+		Session: session,
+		Through: fresh[len(fresh)-1].Ticket,
+		Tickets: prev.Tickets + len(fresh),
+		Method:  method,
+		Created: time.Now().UTC(),
+	}
+	if method == checkpointLLM {
+		if cp.Summary, err = llmCheckpoint(ctx, prev.Summary, fresh); err != nil {
+			return nil, fmt.Errorf("Failed to summarize history: %w", err)
+		}
+	} else {
+		cp.Summary = rulesCheckpoint(history, cp.Through)
+	}
+
+	if err := saveCheckpoints(session, append(checkpoints, cp)); err != nil {
+		return nil, fmt.Errorf("Failed to save checkpoints: %v", err)
+	}
+	logFrom(ctx).Info("checkpoint created", "session", session, "id", cp.ID, "through", cp.Through, "method", method)
+	return cp, nil
+}
+
+// autoCheckpoint makes a checkpoint once CHECKPOINT_EVERY tickets finished
+// since the last one.
+func autoCheckpoint(session string, ticket int) {
+	through := 0
+	if cp := latestCheckpoint(session); cp != nil {
+		through = cp.Through
+	}
+	if ticket-through < checkpointEvery {
+		return
+	}
+	if _, err := createCheckpoint(context.Background(), session, ""); err != nil && !errors.Is(err, errCheckpointEmpty) {
+		logger.Warn("failed to create checkpoint", "session", session, "err", err)
+	}
+}
+
+// rulesCheckpoint summarizes the tickets up to through without a model: how
+// many ran and failed, the latest failures and the latest commands.
+func rulesCheckpoint(history []*CmdResults, through int) string {
+	var commands, failures []string
+	failed := 0
+	for _, res := range history {
+		if res.Ticket > through {
+			break
+		}
+		line := fmt.Sprintf("#%d $ %s", res.Ticket, res.Input)
+		if last := lastLine(res.Output); last != "" {
+			line += "  => " + last
+		}
+		if res.ExitCode != nil && *res.ExitCode != 0 {
+			failed++
+			line = fmt.Sprintf("%s  [exit %d]", line, *res.ExitCode)
+			failures = append(failures, line)
+		}
+		commands = append(commands, line)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d commands ran through ticket %d, %d failed.\n", len(commands), through, failed)
+	if len(failures) > 0 {
+		if len(failures) > maxCheckpointFailures {
+			failures = failures[len(failures)-maxCheckpointFailures:]
+		}
+		b.WriteString("\nLatest failures:\n" + strings.Join(failures, "\n") + "\n")
+	}
+	if len(commands) > maxCheckpointCommands {
+		commands = commands[len(commands)-maxCheckpointCommands:]
+	}
+	b.WriteString("\nLatest commands:\n" + strings.Join(commands, "\n") + "\n")
+	return b.String()
+}
+
+// lastLine returns the last non-empty line of an output, shortened.
+func lastLine(output string) string {
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	line := strings.TrimSpace(lines[len(lines)-1])
+	if len(line) > maxSnippet {
+		line = strings.ToValidUTF8(line[:maxSnippet], "") + "..."
+	}
+	return line
+}
+
+// llmCheckpoint asks the summarizer's model to fold the new tickets into the
+// previous summary. When they don't all fit only the latest keep their
+// outputs.
+func llmCheckpoint(ctx context.Context, previous string, fresh []*CmdResults) (string, error) {
+	var tickets []string
+	size := 0
+	for i := len(fresh) - 1; i >= 0; i-- {
+		res := fresh[i]
+		text := fmt.Sprintf("$ %s\n", res.Input)
+		if size < maxCheckpointInput {
+			output, _, _, _ := trimOutput(res.Output, checkpointOutputTkns)
+			text += withNewline(output)
+		}
+		if res.ExitCode != nil {
+			text += fmt.Sprintf("[exit code %d]\n", *res.ExitCode)
+		}
+		size += len(text)
+		tickets = append([]string{text}, tickets...)
+	}
+
+	prompt := "New commands:\n" + strings.Join(tickets, "")
+	if previous != "" {
+		prompt = "Summary so far:\n" + previous + "\n\n" + prompt
+	}
+	return chatCompletion(ctx, summarizeURL, summarizeKey, &chatRequest{
+		Model: summarizeModel,
+		Messages: []chatMessage{
+			{Role: "system", Content: checkpointPrompt},
+			{Role: "user", Content: prompt},
+		},
+		MaxTokens: summarizeTokens,
+	})
+}
+
+func checkpointsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// Validate the hash parameter
+	hashParam := r.URL.Query().Get("hash")
+	if !checkHash(r, hashParam) {
+		writeError(w, errHashMessage)
+		return
+	}
+
+	session := r.URL.Query().Get("session")
+	if !validSessionName(session) {
+		writeError(w, errSessionMessage)
+		return
+	}
+	if !sessionExists(session) {
+		writeError(w, notFoundf("Session %s does not exist", session))
+		return
+	}
+
+	var resp interface{}
+	switch r.Method {
+	case http.MethodGet:
+		checkpoints, err := readCheckpoints(session)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		resp = checkpoints
+
+	case http.MethodPost:
+		cp, err := createCheckpoint(r.Context(), session, r.URL.Query().Get("method"))
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		resp = cp
+
+	default:
+		writeError(w, errMethodMessage)
+		return
+	}
+
+	jsonResp, err := json.Marshal(resp)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to marshal JSON response: %v", err)
+		writeJsonError(w, msg)
+		return
+	}
+
+	fmt.Fprint(w, string(jsonResp))
+}
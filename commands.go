@@ -0,0 +1,229 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const usage = `Usage: llmass [command] [flags]
+
+Commands:
+  serve   run the server, the default when no command is given
+  init    write a .env or llmass.toml with random strong hashes
+  check   validate the configuration and environment
+  client  talk to a server, see "llmass client -h"
+  version print the version and build information
+
+Run "llmass <command> -h" for the command's flags.
+`
+
+// randomHash returns a 64 character hex secret.
+func randomHash() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// runInit writes a starter configuration, refusing to overwrite one.
+func runInit(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("init", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	format := fs.String("format", "env", "env for a .env file or toml for a config file")
+	out := fs.String("o", "", "file to write (default .env or "+defaultConfigFile+")")
+	fqdnFlag := fs.String("fqdn", "http://localhost:8083", "public base URL")
+	portFlag := fs.String("port", "8083", "TCP port")
+	force := fs.Bool("force", false, "overwrite an existing file")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	settings, err := starterSettings(*fqdnFlag, *portFlag, "sessions", "data")
+	if err != nil {
+		fmt.Fprintf(stderr, "failed to generate hash: %v\n", err)
+		return 1
+	}
+
+	path, err := writeStarterConfig(*out, *format, settings, *force)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		if errors.Is(err, errUnknownFormat) {
+			return 2
+		}
+		return 1
+	}
+
+	fmt.Fprintf(stdout, "wrote %s with a new HASH and ADMIN_HASH, run \"llmass check\" next\n", path)
+	return 0
+}
+
+var errUnknownFormat = errors.New("unknown format")
+
+// starterSettings returns a configuration with a new random HASH and
+// ADMIN_HASH.
+func starterSettings(fqdn, port, sessionsDir, dataDir string) ([][2]string, error) {
+	hash, err := randomHash()
+	if err != nil {
+		return nil, err
+	}
+	admin, err := randomHash()
+	if err != nil {
+		return nil, err
+	}
+	return [][2]string{
+		{"HASH", hash},
+		{"ADMIN_HASH", admin},
+		{"FQDN", fqdn},
+		{"PORT", port},
+		{"SESSIONS_DIR", sessionsDir},
+		{"DATA_DIR", dataDir},
+	}, nil
+}
+
+// writeStarterConfig writes settings as a .env (format env) or config file
+// (format toml), readable only by the owner, and returns the path written.
+func writeStarterConfig(path, format string, settings [][2]string, force bool) (string, error) {
+	var b strings.Builder
+	switch format {
+	case "env":
+		if path == "" {
+			path = ".env"
+		}
+		for _, kv := range settings {
+			fmt.Fprintf(&b, "%s=%s\n", kv[0], kv[1])
+		}
+	case "toml":
+		if path == "" {
+			path = defaultConfigFile
+		}
+		for _, kv := range settings {
+			fmt.Fprintf(&b, "%s = %q\n", strings.ToLower(kv[0]), kv[1])
+		}
+	default:
+		return "", fmt.Errorf("%w %q, use env or toml", errUnknownFormat, format)
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if force {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+	f, err := os.OpenFile(path, flags, 0600)
+	if err != nil {
+		if os.IsExist(err) {
+			return "", fmt.Errorf("%s already exists, use -force to overwrite it", path)
+		}
+		return "", fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(b.String()); err != nil {
+		return "", fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	return path, nil
+}
+
+// runCheck validates the configuration the server would start with and the
+// environment it needs, printing one line per check.
+func runCheck(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("check", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	config := registerConfigFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	failed := 0
+	report := func(name string, err error) {
+		if err != nil {
+			failed++
+			fmt.Fprintf(stdout, "FAIL  %s: %v\n", name, err)
+			return
+		}
+		fmt.Fprintf(stdout, "ok    %s\n", name)
+	}
+
+	if err := config.apply(); err != nil {
+		report("configuration files", err)
+		return 1
+	}
+	report("configuration files", nil)
+
+	report("logging", loadLogging(io.Discard))
+	report("HASH, ADMIN_HASH, INIT_SCRIPT and WEB_DIR", loadReloadable())
+	report("FQDN", requireSetting("FQDN"))
+	report("BASE_PATH", loadBasePath())
+	report("listener", func() error {
+		specs, err := loadListeners()
+		if err != nil {
+			return err
+		}
+		if len(specs) == 0 && os.Getenv("CONTROLLER_URL") == "" && !socketActivated() {
+			return fmt.Errorf("PORT, UNIX_SOCKET, LISTEN, CONTROLLER_URL or a systemd socket must be set")
+		}
+		for _, spec := range specs {
+			if _, err := spec.tlsConfig(); err != nil {
+				return fmt.Errorf("%s: %v", spec, err)
+			}
+		}
+		return nil
+	}())
+	report("DRAIN_TIMEOUT", loadShutdown())
+	report("SHELL_PATH and SHELL_ARGS", loadShell())
+	report("SHELL_BACKEND, TMUX_SOCKET and TMUX_WRAP", loadShellBackend())
+	report("SERIALIZE_COMMANDS", loadQueue())
+	report("RESPAWN_SHELLS", loadRecovery())
+	report("OUTPUT_MEMORY_LIMIT", loadOutputCapture())
+	report("TOKENIZER", loadTokenizer())
+	report("SUMMARIZE_URL", loadSummarizer())
+	report("SUGGEST_URL", loadSuggester())
+	report("CHECKPOINT_EVERY", loadCheckpoints())
+	report("GIT_HISTORY", loadGitHistory())
+	report("EMBEDDINGS_URL", loadEmbeddings())
+	report("SESSION_TOKEN_BUDGET and HASH_TOKEN_BUDGET", loadTokenBudgets())
+	report("CONFIRM_RISK and RISK_RULES", loadRiskPolicy())
+	report("CACHE_RULES", loadCachePolicy())
+	report("SHARED_STORAGE", loadStorage())
+	report("ROUTING_RULES", loadRoutingRules())
+	report("SESSIONS_DIR", checkWritable(settingOr("SESSIONS_DIR", "sessions"), 0755))
+	report("DATA_DIR", checkWritable(settingOr("DATA_DIR", "data"), 0700))
+
+	if failed > 0 {
+		fmt.Fprintf(stdout, "%d check(s) failed\n", failed)
+		return 1
+	}
+	return 0
+}
+
+func requireSetting(key string) error {
+	if os.Getenv(key) == "" {
+		return fmt.Errorf("%s must be set", key)
+	}
+	return nil
+}
+
+func settingOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// checkWritable creates dir like the server would and writes a probe file.
+func checkWritable(dir string, mode os.FileMode) error {
+	if err := os.MkdirAll(dir, mode); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, ".llmass-check-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(filepath.Join(dir, filepath.Base(f.Name())))
+}
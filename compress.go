@@ -0,0 +1,190 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// History and ticket results are text that compresses several times over,
+// so they are gzipped for clients sending Accept-Encoding: gzip once they
+// pass minCompressSize. Brotli isn't offered, it would take an encoder from
+// outside the standard library.
+
+const minCompressSize = 1024
+
+// compressedPaths are the endpoints whose responses are compressed.
+var compressedPaths = map[string]bool{
+	"/history":  true,
+	"/callback": true,
+	"/status":   true,
+	"/output":   true,
+}
+
+var gzipWriters = sync.Pool{New: func() interface{} {
+	gz, _ := gzip.NewWriterLevel(io.Discard, gzip.DefaultCompression)
+	return gz
+}}
+
+// compressWriter holds the response back until it knows whether it is worth
+// compressing.
+type compressWriter struct {
+	http.ResponseWriter
+	mu      sync.Mutex // a handler past its timeout may still write
+	buf     []byte
+	gz      *gzip.Writer
+	status  int
+	decided bool // headers are written, gzipped when gz is set
+	closed  bool
+}
+
+// compress gzips h's responses for the path when the client accepts it.
+func compress(path string, h http.HandlerFunc) http.HandlerFunc {
+	if !compressedPaths[path] {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if r.Method == http.MethodHead || !acceptsGzip(r) {
+			h(w, r)
+			return
+		}
+		cw := &compressWriter{ResponseWriter: w}
+		defer cw.Close()
+		h(cw, r)
+	}
+}
+
+// acceptsGzip reports whether the request's Accept-Encoding allows gzip.
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(enc, ";")
+		if strings.TrimSpace(name) != "gzip" {
+			continue
+		}
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			v, err := strconv.ParseFloat(q, 64)
+			return err == nil && v > 0
+		}
+		return true
+	}
+	return false
+}
+
+func (w *compressWriter) WriteHeader(status int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.decided || w.status != 0 {
+		return
+	}
+	w.status = status
+	// Nothing to compress
+	if status == http.StatusNotModified || status == http.StatusNoContent {
+		w.decide(false)
+	}
+}
+
+func (w *compressWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return 0, http.ErrHandlerTimeout
+	}
+	if w.decided {
+		if w.gz != nil {
+			return w.gz.Write(p)
+		}
+		return w.ResponseWriter.Write(p)
+	}
+	w.buf = append(w.buf, p...)
+	if len(w.buf) >= minCompressSize {
+		w.decide(true)
+		if err := w.flushBuf(); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// decide writes the headers, gzipped unless the handler encoded the
+// response itself, the caller holds mu.
+func (w *compressWriter) decide(gzipped bool) {
+	w.decided = true
+	if w.ResponseWriter.Header().Get("Content-Encoding") != "" {
+		gzipped = false
+	}
+	if gzipped {
+		w.ResponseWriter.Header().Set("Content-Encoding", "gzip")
+		w.ResponseWriter.Header().Del("Content-Length")
+		w.gz = gzipWriters.Get().(*gzip.Writer)
+		w.gz.Reset(w.ResponseWriter)
+	}
+	if w.status != 0 {
+		w.ResponseWriter.WriteHeader(w.status)
+	}
+}
+
+// flushBuf writes out what was held back, the caller holds mu.
+func (w *compressWriter) flushBuf() error {
+	buf := w.buf
+	w.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	var err error
+	if w.gz != nil {
+		_, err = w.gz.Write(buf)
+	} else {
+		_, err = w.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+// Flush sends what was written so far, uncompressed if it hasn't been
+// decided yet.
+func (w *compressWriter) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return
+	}
+	if !w.decided {
+		w.decide(false)
+		w.flushBuf()
+	}
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *compressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Close finishes the response, a small one goes out as it is.
+func (w *compressWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	if !w.decided {
+		w.decide(false)
+		return w.flushBuf()
+	}
+	if w.gz == nil {
+		return nil
+	}
+	err := w.gz.Close()
+	w.gz.Reset(io.Discard)
+	gzipWriters.Put(w.gz)
+	w.gz = nil
+	return err
+}
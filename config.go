@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/joho/godotenv"
+)
+
+const defaultConfigFile = "llmass.toml"
+
+// Settings come from, highest precedence first: command line flags, the
+// process environment, the .env file, and the config file. Every layer is
+// folded into the environment, so the rest of the server keeps reading
+// os.Getenv.
+
+// configFlags are the command line flags for the common settings, each
+// overriding the environment variable of the same name.
+var configFlags = []struct{ name, env, usage string }{
+	{"hash", "HASH", "password for the API, at least 32 characters"},
+	{"admin-hash", "ADMIN_HASH", "password for the admin endpoints and dashboard"},
+	{"fqdn", "FQDN", "public base URL used in callbacks"},
+	{"base-path", "BASE_PATH", "path prefix when mounted behind a reverse proxy"},
+	{"port", "PORT", "TCP port to listen on"},
+	{"unix-socket", "UNIX_SOCKET", "unix domain socket to listen on"},
+	{"listen", "LISTEN", "additional listeners with their own TLS and auth policy"},
+	{"sessions-dir", "SESSIONS_DIR", "directory holding the sessions"},
+	{"data-dir", "DATA_DIR", "directory holding server state"},
+	{"init-script", "INIT_SCRIPT", "shell file sourced before every command"},
+	{"shell-path", "SHELL_PATH", "shell that runs commands, default bash or /bin/sh"},
+	{"web-dir", "WEB_DIR", "directory overriding the embedded web files"},
+	{"log-level", "LOG_LEVEL", "debug, info, warn or error"},
+	{"log-format", "LOG_FORMAT", "text or json"},
+}
+
+// settingList collects repeated -set KEY=VALUE flags.
+type settingList []string
+
+func (s *settingList) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *settingList) Set(v string) error {
+	if k, _, ok := strings.Cut(v, "="); !ok || k == "" {
+		return fmt.Errorf("want KEY=VALUE, got %q", v)
+	}
+	*s = append(*s, v)
+	return nil
+}
+
+type cliConfig struct {
+	fs         *flag.FlagSet
+	configFile *string
+	envFile    *string
+	values     map[string]*string
+	settings   settingList
+	explicit   map[string]bool
+	fileKeys   []string // set from the .env or config file, dropped on reload
+	loaded     []string // the .env and config files found
+}
+
+// activeConfig is the configuration the server started with, kept for
+// reloads.
+var activeConfig *cliConfig
+
+// registerConfigFlags defines the configuration flags on fs.
+func registerConfigFlags(fs *flag.FlagSet) *cliConfig {
+	c := &cliConfig{fs: fs, values: map[string]*string{}}
+	c.configFile = fs.String("config", "", "TOML config file (default "+defaultConfigFile+" when present, or CONFIG_FILE)")
+	c.envFile = fs.String("env-file", ".env", "dotenv file, optional unless set explicitly")
+	for _, f := range configFlags {
+		c.values[f.name] = fs.String(f.name, "", f.usage+" ("+f.env+")")
+	}
+	fs.Var(&c.settings, "set", "any other setting as KEY=VALUE, repeatable")
+	return c
+}
+
+// apply folds the flags, .env and config file into the environment. Call it
+// after parsing the flags.
+func (c *cliConfig) apply() error {
+	c.explicit = map[string]bool{}
+	c.fs.Visit(func(f *flag.Flag) { c.explicit[f.Name] = true })
+
+	for _, f := range configFlags {
+		if c.explicit[f.name] {
+			os.Setenv(f.env, *c.values[f.name])
+		}
+	}
+	for _, s := range c.settings {
+		k, v, _ := strings.Cut(s, "=")
+		os.Setenv(k, v)
+	}
+	activeConfig = c
+	return c.loadFiles()
+}
+
+// reload drops what the files set before and reads them again, the flags
+// and process environment keep their precedence.
+func (c *cliConfig) reload() error {
+	for _, k := range c.fileKeys {
+		os.Unsetenv(k)
+	}
+	c.fileKeys = nil
+	c.loaded = nil
+	return c.loadFiles()
+}
+
+func (c *cliConfig) loadFiles() error {
+	env, err := godotenv.Read(*c.envFile)
+	if err != nil && (c.explicit["env-file"] || !os.IsNotExist(err)) {
+		return fmt.Errorf("error loading %s: %v", *c.envFile, err)
+	}
+	if err == nil {
+		c.loaded = append(c.loaded, *c.envFile)
+	}
+	c.setDefaults(env)
+
+	path := *c.configFile
+	if path == "" {
+		path = os.Getenv("CONFIG_FILE")
+	}
+	if path == "" {
+		if _, err := os.Stat(defaultConfigFile); err != nil {
+			return nil
+		}
+		path = defaultConfigFile
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("error loading config file: %v", err)
+	}
+	defer f.Close()
+	settings, err := parseConfig(f)
+	if err != nil {
+		return fmt.Errorf("error loading config file %s: %v", path, err)
+	}
+	c.loaded = append(c.loaded, path)
+	c.setDefaults(settings)
+	return nil
+}
+
+// setDefaults sets the settings that nothing with higher precedence has.
+func (c *cliConfig) setDefaults(settings map[string]string) {
+	for k, v := range settings {
+		if _, set := os.LookupEnv(k); !set {
+			os.Setenv(k, v)
+			c.fileKeys = append(c.fileKeys, k)
+		}
+	}
+}
+
+// parseConfig reads the flat subset of TOML the settings need: one
+// key = value per line with strings, numbers and booleans, and # comments.
+// Keys are the environment variable names, case-insensitive, with - or _.
+func parseConfig(r io.Reader) (map[string]string, error) {
+	settings := map[string]string{}
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			return nil, fmt.Errorf("line %d: tables are not supported, keep every setting at the top level", n)
+		}
+
+		k, v, ok := strings.Cut(line, "=")
+		k = strings.TrimSpace(k)
+		if !ok || k == "" || strings.ContainsAny(k, " \t\"'") {
+			return nil, fmt.Errorf("line %d: want key = value", n)
+		}
+		value, err := parseConfigValue(strings.TrimSpace(v))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		settings[strings.ToUpper(strings.ReplaceAll(k, "-", "_"))] = value
+	}
+	return settings, scanner.Err()
+}
+
+func parseConfigValue(v string) (string, error) {
+	switch {
+	case strings.HasPrefix(v, `"`):
+		// A basic string, its escapes are a subset of Go's
+		end := 1
+		for ; end < len(v) && v[end] != '"'; end++ {
+			if v[end] == '\\' {
+				end++
+			}
+		}
+		if end >= len(v) {
+			return "", fmt.Errorf("unterminated string")
+		}
+		if err := trailingComment(v[end+1:]); err != nil {
+			return "", err
+		}
+		return strconv.Unquote(v[:end+1])
+	case strings.HasPrefix(v, "'"):
+		// A literal string, no escapes
+		end := strings.Index(v[1:], "'") + 1
+		if end == 0 {
+			return "", fmt.Errorf("unterminated string")
+		}
+		if err := trailingComment(v[end+1:]); err != nil {
+			return "", err
+		}
+		return v[1:end], nil
+	}
+
+	if i := strings.Index(v, "#"); i >= 0 {
+		v = strings.TrimSpace(v[:i])
+	}
+	if v == "true" || v == "false" {
+		return v, nil
+	}
+	if _, err := strconv.ParseFloat(strings.ReplaceAll(v, "_", ""), 64); err == nil {
+		return strings.ReplaceAll(v, "_", ""), nil
+	}
+	return "", fmt.Errorf("unsupported value %q, quote strings", v)
+}
+
+func trailingComment(rest string) error {
+	if rest = strings.TrimSpace(rest); rest != "" && !strings.HasPrefix(rest, "#") {
+		return fmt.Errorf("unexpected %q after string", rest)
+	}
+	return nil
+}
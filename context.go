@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/russross/blackfriday/v2"
+)
+
+// Session context documents give one session's agent task specific
+// instructions. They live in SESSIONS_DIR/<session>/context/<name>.md, and
+// /context?session= serves CONTEXT.md followed by each of them.
+
+const (
+	contextDir         = "context"
+	defaultContextName = "CONTEXT"
+	maxContextBytes    = 1 << 20
+
+	formatMarkdown = "markdown"
+)
+
+var (
+	errContextNameMessage   = paramError("name", "Invalid 'name' context document parameter")
+	errContextFormatMessage = paramError("format", "Invalid 'format' parameter, use html, markdown or text")
+	errContextNotFound      = newKindError(errNotFound, "Context document does not exist")
+)
+
+// ContextDoc describes a stored session context document.
+type ContextDoc struct {
+	Session  string    `json:"session"`
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+}
+
+var htmlTagRe = regexp.MustCompile(`<[^>]*>`)
+
+func contextDocPath(session, name string) string {
+	return filepath.Join(sessionsDir, session, contextDir, name+".md")
+}
+
+// sessionContextDocs returns the session's documents by name.
+func sessionContextDocs(session string) ([]ContextDoc, error) {
+	entries, err := os.ReadDir(filepath.Join(sessionsDir, session, contextDir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var docs []ContextDoc
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), ".md")
+		info, err := e.Info()
+		if !ok || err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		docs = append(docs, ContextDoc{Session: session, Name: name, Size: info.Size(), Modified: info.ModTime()})
+	}
+	sort.Slice(docs, func(i, j int) bool { return docs[i].Name < docs[j].Name })
+	return docs, nil
+}
+
+// contextMarkdown returns CONTEXT.md followed by the session's documents,
+// or only the named one.
+func contextMarkdown(session, name string) ([]byte, error) {
+	if session != "" && name != "" {
+		content, err := os.ReadFile(contextDocPath(session, name))
+		if os.IsNotExist(err) {
+			return nil, errContextNotFound
+		}
+		return content, err
+	}
+
+	content, err := fs.ReadFile(webFS, "CONTEXT.md")
+	if err != nil || session == "" {
+		return content, err
+	}
+	docs, err := sessionContextDocs(session)
+	if err != nil {
+		return nil, err
+	}
+	for _, doc := range docs {
+		data, err := os.ReadFile(contextDocPath(session, doc.Name))
+		if err != nil {
+			return nil, err
+		}
+		content = append(append(content, "\n\n"...), data...)
+	}
+	return content, nil
+}
+
+// writeContext renders markdown in the requested format.
+func writeContext(w http.ResponseWriter, format string, markdown []byte) {
+	switch format {
+	case formatMarkdown:
+		w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+		w.Write(markdown)
+	case formatText:
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		text := html.UnescapeString(htmlTagRe.ReplaceAllString(string(blackfriday.Run(markdown)), ""))
+		fmt.Fprint(w, strings.TrimSpace(text)+"\n")
+	default:
+		printHTML(w, string(blackfriday.Run(markdown)))
+	}
+}
+
+// saveContextDoc creates or replaces a session's context document.
+func saveContextDoc(session, name string, body io.Reader) (*ContextDoc, error) {
+	content, err := io.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errBodyMessage, err)
+	}
+	if err := os.MkdirAll(filepath.Join(sessionsDir, session, contextDir), 0755); err != nil {
+		return nil, fmt.Errorf("Failed to create context directory: %v", err)
+	}
+	path := contextDocPath(session, name)
+	if err := os.WriteFile(path+".tmp", content, 0644); err != nil {
+		return nil, fmt.Errorf("Failed to write context document: %v", err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return nil, fmt.Errorf("Failed to write context document: %v", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	return &ContextDoc{Session: session, Name: name, Size: info.Size(), Modified: info.ModTime()}, nil
+}
+
+// sessionContextHandler serves the POST, DELETE and listing calls of
+// /context for one session, answering JSON like the other session APIs.
+func sessionContextHandler(w http.ResponseWriter, r *http.Request, session, name string) {
+	w.Header().Set("Content-Type", "application/json")
+	if !validSessionName(session) {
+		writeError(w, errSessionMessage)
+		return
+	}
+	if name == "" {
+		name = defaultContextName
+	}
+	if !validSessionName(name) {
+		writeError(w, errContextNameMessage)
+		return
+	}
+
+	var resp interface{}
+	switch r.Method {
+	case http.MethodPost, http.MethodPut:
+		doc, err := saveContextDoc(session, name, http.MaxBytesReader(w, r.Body, maxContextBytes))
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		logFrom(r.Context()).Info("context document saved", "session", session, "name", name, "size", doc.Size)
+		resp = doc
+	case http.MethodDelete:
+		// Answer with the document as it was before deleting it
+		path := contextDocPath(session, name)
+		info, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			writeError(w, errContextNotFound)
+			return
+		}
+		if err == nil {
+			err = os.Remove(path)
+		}
+		if err != nil {
+			writeJsonError(w, fmt.Sprintf("Failed to delete context document: %v", err))
+			return
+		}
+		logFrom(r.Context()).Info("context document deleted", "session", session, "name", name)
+		resp = &ContextDoc{Session: session, Name: name, Size: info.Size(), Modified: info.ModTime()}
+	case http.MethodGet:
+		docs, err := sessionContextDocs(session)
+		if err != nil {
+			writeJsonError(w, fmt.Sprintf("Failed to read context documents: %v", err))
+			return
+		}
+		if docs == nil {
+			docs = []ContextDoc{}
+		}
+		resp = docs
+	default:
+		writeError(w, errMethodMessage)
+		return
+	}
+
+	jsonResp, err := json.Marshal(resp)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to marshal JSON response: %v", err)
+		writeJsonError(w, msg)
+		return
+	}
+
+	fmt.Fprint(w, string(jsonResp))
+}
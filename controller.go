@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// A controller drives many agents through one endpoint: API requests with
+// an agent parameter are checked against the controller's HASH and sent
+// down that agent's tunnel. The controller vouches for them with its HASH,
+// which the agent knows as CONTROLLER_HASH, and tells the agent its public
+// URL so callbacks route back through the controller.
+
+const (
+	controllerHashHeader = "X-Llmass-Controller-Hash"
+	controllerURLHeader  = "X-Llmass-Controller-Url"
+	agentHeader          = "X-Llmass-Agent" // names the agent a routed request ran on
+)
+
+type controllerContextKey struct{}
+
+// routeAgent runs h locally, or forwards the request to the agent named by
+// the agent parameter, the agent the session was placed on, or the agent
+// placeSession picks for the placement parameter and routing rules.
+func routeAgent(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		name, session := q.Get("agent"), q.Get("session")
+		explicit := name != ""
+		if name == "" && session != "" {
+			name = placedAgent(session)
+		}
+		// A new session matching a routing rule is placed by it
+		rule := routingRuleFor(session)
+		placing := name == "" && (q.Has("placement") || rule != nil && createsSession(r) && !sessionExists(session))
+		if name == "" && !placing {
+			h(w, r)
+			return
+		}
+
+		hashParam := q.Get("hash")
+		if !checkHash(r, hashParam) {
+			w.Header().Set("Content-Type", "application/json")
+			writeError(w, errHashMessage)
+			return
+		}
+
+		if placing {
+			want, err := parseLabels(q.Get("placement"))
+			if err != nil || (len(want) == 0 && rule == nil) || !validSessionName(session) {
+				w.Header().Set("Content-Type", "application/json")
+				writeError(w, errPlacementMessage)
+				return
+			}
+			if rule != nil {
+				if err := rule.constrain(want); err != nil {
+					logFrom(r.Context()).Warn("placement conflicts with routing rule", "session", session, "rule", rule.Pattern)
+					w.Header().Set("Content-Type", "application/json")
+					writeError(w, err)
+					return
+				}
+			}
+			if name, err = placeSession(session, want); err != nil {
+				w.Header().Set("Content-Type", "application/json")
+				writeError(w, err)
+				return
+			}
+		} else if explicit && rule != nil && !rule.allows(name) {
+			logFrom(r.Context()).Warn("routing rule refused agent", "session", session, "agent", name, "rule", rule.Pattern)
+			w.Header().Set("Content-Type", "application/json")
+			writeError(w, errRoutingMessage)
+			return
+		}
+
+		tunnelMu.Lock()
+		p, ok := tunnels[name]
+		tunnelMu.Unlock()
+		if !ok {
+			w.Header().Set("Content-Type", "application/json")
+			writeError(w, errAgentMessage)
+			return
+		}
+
+		r2 := r.Clone(r.Context())
+		q.Del("hash")
+		q.Del("agent")
+		q.Del("placement")
+		r2.URL.RawQuery = q.Encode()
+		r2.Header.Set(controllerHashHeader, hashPassword.Load())
+		r2.Header.Set(controllerURLHeader, baseURL(r.Context()))
+		w.Header().Set(agentHeader, name)
+		logFrom(r.Context()).Debug("routing request to agent", "agent", name)
+		p.proxy.ServeHTTP(w, r2)
+		if r.Method == http.MethodDelete && strings.HasSuffix(r.URL.Path, "/sessions") {
+			forgetPlacement(session)
+		}
+	}
+}
+
+// withController marks tunnel requests the controller vouched for, keeping
+// the controller's URL for the links the agent generates.
+func withController(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hash := r.Header.Get(controllerHashHeader)
+		if hash != "" && subtle.ConstantTimeCompare([]byte(hash), []byte(controllerHash)) == 1 {
+			base := r.Header.Get(controllerURLHeader)
+			if u, err := url.Parse(base); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+				base = controllerURL
+			}
+			r = r.WithContext(context.WithValue(r.Context(), controllerContextKey{}, base))
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// viaController reports whether the controller vouched for the request.
+func viaController(ctx context.Context) bool {
+	_, ok := ctx.Value(controllerContextKey{}).(string)
+	return ok
+}
+
+// linkTarget returns the base URL, hash and extra query generated links
+// use: the controller's, naming this agent, for requests routed through it.
+func linkTarget(ctx context.Context) (base, hash, extra string) {
+	if base, ok := ctx.Value(controllerContextKey{}).(string); ok {
+		return base, controllerHash, "&agent=" + url.QueryEscape(agentName)
+	}
+	return baseURL(ctx), hashPassword.Load(), ""
+}
+
+// agentRequest makes a request of the named agent through its tunnel,
+// vouched for with the controller's HASH.
+func agentRequest(ctx context.Context, name, method, path string, q url.Values, body io.Reader) (*http.Response, error) {
+	tunnelMu.Lock()
+	p, ok := tunnels[name]
+	tunnelMu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("agent %s is not connected", name)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, "http://"+name+path+"?"+q.Encode(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(controllerHashHeader, hashPassword.Load())
+	req.Header.Set(controllerURLHeader, baseURL(ctx))
+	return p.client.Do(req)
+}
+
+// detachLinks carries what linkTarget needs from ctx into the background
+// context bg.
+func detachLinks(ctx, bg context.Context) context.Context {
+	bg = withBaseURL(bg, baseURL(ctx))
+	if base, ok := ctx.Value(controllerContextKey{}).(string); ok {
+		bg = context.WithValue(bg, controllerContextKey{}, base)
+	}
+	return bg
+}
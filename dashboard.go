@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	templatesDir     = "templates"
+	recentTicketsMax = 25
+)
+
+// TicketRow is one ticket as listed on the dashboard.
+type TicketRow struct {
+	Session  string
+	Ticket   int
+	Working  bool
+	Modified time.Time
+	Result   *CmdResults
+}
+
+// RunningRow is a live command on the dashboard.
+type RunningRow struct {
+	Session string
+	runningCmd
+}
+
+type dashboardPage struct {
+	Title string
+	Hash  string
+	Data  interface{}
+}
+
+// adminLink builds a dashboard URL carrying the admin hash.
+func adminLink(hash, path string, kv ...interface{}) string {
+	q := url.Values{"hash": {hash}}
+	for i := 0; i+1 < len(kv); i += 2 {
+		q.Set(fmt.Sprint(kv[i]), fmt.Sprint(kv[i+1]))
+	}
+	return basePath + path + "?" + q.Encode()
+}
+
+var dashboardFuncs = template.FuncMap{
+	"link": adminLink,
+	"base": func() string {
+		return basePath
+	},
+	"list": func(items ...string) []string {
+		return items
+	},
+	"ago": func(t time.Time) string {
+		return time.Since(t).Round(time.Second).String()
+	},
+	"exitCode": func(cer *CmdResults) string {
+		if cer == nil || cer.ExitCode == nil {
+			return ""
+		}
+		return strconv.Itoa(*cer.ExitCode)
+	},
+	"short": func(s string) string {
+		if len(s) > 80 {
+			return s[:77] + "..."
+		}
+		return s
+	},
+}
+
+// renderDashboard executes templates/<page>.html inside the shared layout.
+func renderDashboard(w http.ResponseWriter, r *http.Request, page, title string, data interface{}) {
+	tmpl, err := template.New("layout.html").Funcs(dashboardFuncs).ParseFS(webFS,
+		path.Join(templatesDir, "layout.html"),
+		path.Join(templatesDir, page+".html"),
+	)
+	if err != nil {
+		logger.Error("failed to parse dashboard template", "page", page, "err", err)
+		writeJsonError(w, "Failed to render dashboard")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err = tmpl.Execute(w, &dashboardPage{Title: title, Hash: r.URL.Query().Get("hash"), Data: data})
+	if err != nil {
+		logger.Error("failed to render dashboard", "page", page, "err", err)
+	}
+}
+
+// readTicketRow reads a ticket file, an empty one is still working.
+func readTicketRow(session, name string) (*TicketRow, error) {
+	path := filepath.Join(sessionsDir, session, name)
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSuffix(name, ".ticket"))
+	if err != nil {
+		return nil, err
+	}
+
+	row := &TicketRow{Session: session, Ticket: n, Modified: info.ModTime()}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(content) == 0 {
+		row.Working = true
+		return row, nil
+	}
+	row.Result = &CmdResults{}
+	if err := json.Unmarshal(content, row.Result); err != nil {
+		return nil, err
+	}
+	return row, nil
+}
+
+// sessionTickets lists a session's tickets, newest first.
+func sessionTickets(session string) ([]*TicketRow, error) {
+	files, err := os.ReadDir(filepath.Join(sessionsDir, session))
+	if err != nil {
+		return nil, err
+	}
+	var rows []*TicketRow
+	for _, f := range files {
+		if f.IsDir() || filepath.Ext(f.Name()) != ".ticket" {
+			continue
+		}
+		if row, err := readTicketRow(session, f.Name()); err == nil {
+			rows = append(rows, row)
+		}
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i].Ticket > rows[j].Ticket })
+	return rows, nil
+}
+
+// recentTickets returns the most recently modified tickets of every session.
+func recentTickets(n int) []*TicketRow {
+	sessions, err := listSessions()
+	if err != nil {
+		return nil
+	}
+	var rows []*TicketRow
+	for _, s := range sessions {
+		tickets, err := sessionTickets(s.Name)
+		if err != nil {
+			continue
+		}
+		rows = append(rows, tickets...)
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i].Modified.After(rows[j].Modified) })
+	if len(rows) > n {
+		rows = rows[:n]
+	}
+	return rows
+}
+
+func allRunning() []RunningRow {
+	var rows []RunningRow
+	eachRunning(func(session string, rc runningCmd) {
+		rows = append(rows, RunningRow{Session: session, runningCmd: rc})
+	})
+	sort.Slice(rows, func(i, j int) bool { return rows[i].Started.Before(rows[j].Started) })
+	return rows
+}
+
+func allWatches() []string {
+	watchMu.Lock()
+	defer watchMu.Unlock()
+	keys := make([]string, 0, len(watches))
+	for k := range watches {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func dashboardHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, errMethodMessage)
+		return
+	}
+
+	sessions, err := listSessions()
+	if err != nil {
+		logger.Error("failed to list sessions", "err", err)
+	}
+
+	renderDashboard(w, r, "dashboard", "Dashboard", map[string]interface{}{
+		"Sessions":  sessions,
+		"Templates": listSessionTemplates(),
+		"Running":   allRunning(),
+		"Watches":   allWatches(),
+		"Approvals": len(pendingApprovals()),
+		"Recent":    recentTickets(recentTicketsMax),
+		"Runtime":   runtimeStats(),
+	})
+}
+
+func dashboardSessionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, errMethodMessage)
+		return
+	}
+
+	session := r.URL.Query().Get("session")
+	if session == "" || filepath.Base(session) != session {
+		writeError(w, errSessionMessage)
+		return
+	}
+	tickets, err := sessionTickets(session)
+	if err != nil {
+		writeError(w, notFoundf("Session %s does not exist", session))
+		return
+	}
+
+	renderDashboard(w, r, "session", "Session "+session, map[string]interface{}{
+		"Session": session,
+		"Running": runningForSession(session),
+		"Tickets": tickets,
+	})
+}
+
+func dashboardTicketHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, errMethodMessage)
+		return
+	}
+
+	session := r.URL.Query().Get("session")
+	ticket, err := strconv.Atoi(r.URL.Query().Get("ticket"))
+	if session == "" || filepath.Base(session) != session || err != nil {
+		writeError(w, errTicketMessage)
+		return
+	}
+	row, err := readTicketRow(session, fmt.Sprintf("%02d.ticket", ticket))
+	if err != nil {
+		writeError(w, notFoundf("Ticket %d not found in session %s", ticket, session))
+		return
+	}
+
+	renderDashboard(w, r, "ticket", fmt.Sprintf("Ticket %d", ticket), row)
+}
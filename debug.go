@@ -0,0 +1,128 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	adminHash settingString // ADMIN_HASH, guards admin endpoints, defaults to HASH
+	startTime = time.Now()
+)
+
+// RuntimeStats is the /debug/runtime snapshot used to diagnose leaked
+// goroutines and shells.
+type RuntimeStats struct {
+	Uptime           string `json:"uptime"`
+	GoVersion        string `json:"go_version"`
+	Goroutines       int    `json:"goroutines"`
+	HeapAllocBytes   uint64 `json:"heap_alloc_bytes"`
+	HeapInuseBytes   uint64 `json:"heap_inuse_bytes"`
+	HeapObjects      uint64 `json:"heap_objects"`
+	SysBytes         uint64 `json:"sys_bytes"`
+	NumGC            uint32 `json:"num_gc"`
+	RunningCommands  int    `json:"running_commands"`
+	Watches          int    `json:"watches"`
+	EventSubscribers int    `json:"event_subscribers"`
+	MCPStreams       int    `json:"mcp_streams"`
+	AgentTunnels     int    `json:"agent_tunnels"`
+}
+
+// checkAdmin validates the hash for admin endpoints against ADMIN_HASH when
+// it is set, falling back to HASH.
+func checkAdmin(r *http.Request, hash string) bool {
+	admin := adminHash.Load()
+	if admin == "" {
+		if !checkHash(r, hash) {
+			return false
+		}
+		auditKey(r, auditKeyAdmin)
+		return true
+	}
+	if subtle.ConstantTimeCompare([]byte(hash), []byte(admin)) == 1 {
+		auditKey(r, auditKeyAdmin)
+		return true
+	}
+	authFailed(r)
+	return false
+}
+
+// admin guards a handler with checkAdmin. Admin endpoints are new, so they
+// use the v1 error envelope.
+func admin(h http.HandlerFunc) http.HandlerFunc {
+	return v1(func(w http.ResponseWriter, r *http.Request) {
+		if !checkAdmin(r, r.URL.Query().Get("hash")) {
+			writeError(w, errHashMessage)
+			return
+		}
+		h(w, r)
+	})
+}
+
+// registerDebug mounts net/http/pprof and /debug/runtime behind admin auth.
+func registerDebug(mux *http.ServeMux) {
+	mux.HandleFunc("/debug/pprof/", admin(pprof.Index))
+	mux.HandleFunc("/debug/pprof/cmdline", admin(pprof.Cmdline))
+	mux.HandleFunc("/debug/pprof/profile", admin(pprof.Profile))
+	mux.HandleFunc("/debug/pprof/symbol", admin(pprof.Symbol))
+	mux.HandleFunc("/debug/pprof/trace", admin(pprof.Trace))
+	mux.HandleFunc("/debug/runtime", admin(runtimeHandler))
+}
+
+func runtimeStats() *RuntimeStats {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+
+	stats := &RuntimeStats{
+		Uptime:         time.Since(startTime).Round(time.Second).String(),
+		GoVersion:      runtime.Version(),
+		Goroutines:     runtime.NumGoroutine(),
+		HeapAllocBytes: m.HeapAlloc,
+		HeapInuseBytes: m.HeapInuse,
+		HeapObjects:    m.HeapObjects,
+		SysBytes:       m.Sys,
+		NumGC:          m.NumGC,
+	}
+
+	stats.RunningCommands = runningCount()
+
+	watchMu.Lock()
+	stats.Watches = len(watches)
+	watchMu.Unlock()
+
+	stats.EventSubscribers = int(atomic.LoadInt32(&activityCount))
+
+	mcpSSEMu.Lock()
+	stats.MCPStreams = len(mcpSSEStreams)
+	mcpSSEMu.Unlock()
+
+	tunnelMu.Lock()
+	stats.AgentTunnels = len(tunnels)
+	tunnelMu.Unlock()
+
+	return stats
+}
+
+func runtimeHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet {
+		writeError(w, errMethodMessage)
+		return
+	}
+
+	jsonResp, err := json.Marshal(runtimeStats())
+	if err != nil {
+		msg := fmt.Sprintf("Failed to marshal JSON response: %v", err)
+		writeJsonError(w, msg)
+		return
+	}
+
+	fmt.Fprint(w, string(jsonResp))
+}
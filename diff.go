@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// diff=1 answers a re-run command, git status or kubectl get pods in a
+// monitoring loop, with only the lines that changed since the session last
+// ran the same command: "+ " lines are new, "- " lines are gone. Given to
+// /shell it carries over to the callback URL, the ticket on disk keeps the
+// full output.
+
+// maxDiffEdits bounds the work of a diff, outputs that changed more than
+// this are returned whole.
+const maxDiffEdits = 1000
+
+// previousRun returns the latest ticket before ticket in the session that
+// ran the same command, nil when there is none.
+func previousRun(session string, ticket int, input string) *CmdResults {
+	for n := ticket - 1; n > 0; n-- {
+		file, err := readTicket(session, n)
+		if err != nil || len(file) == 0 {
+			continue
+		}
+		res := &CmdResults{}
+		if json.Unmarshal(file, res) != nil || res.Input != input {
+			continue
+		}
+		return res
+	}
+	return nil
+}
+
+// diffResult replaces the output with its changes since the previous run of
+// the command, leaving first runs and wholesale changes as they are. With a
+// filter the output was already filtered, the previous one is filtered too.
+func diffResult(res *CmdResults, f *outputFilter) {
+	prev := previousRun(res.Session, res.Ticket, res.Input)
+	if prev == nil {
+		return
+	}
+	if f != nil {
+		var err error
+		if prev.Output, err = f.apply(prev.Output); err != nil {
+			return
+		}
+	}
+	changes, ok := diffLines(splitLines(prev.Output), splitLines(res.Output))
+	if !ok {
+		return
+	}
+
+	res.DiffFrom = prev.Ticket
+	res.Output = strings.Join(changes, "")
+	res.Tokens = estimateTokens(res.Output)
+	if len(changes) == 0 {
+		res.Next = fmt.Sprintf("The output is unchanged since ticket %d. You can now issue your next command to /shell", prev.Ticket)
+		return
+	}
+	res.Next = fmt.Sprintf("This output only holds the lines that changed since ticket %d: + lines are new, - lines are gone. You can now issue your next command to /shell", prev.Ticket)
+}
+
+// splitLines splits s into lines keeping their line breaks.
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// diffLines returns the lines removed from a ("- ") and added in b ("+ "),
+// in order, with Myers' algorithm. It gives up when more than maxDiffEdits
+// lines changed.
+func diffLines(a, b []string) ([]string, bool) {
+	// The common head and tail are no change
+	for len(a) > 0 && len(b) > 0 && a[0] == b[0] {
+		a, b = a[1:], b[1:]
+	}
+	for len(a) > 0 && len(b) > 0 && a[len(a)-1] == b[len(b)-1] {
+		a, b = a[:len(a)-1], b[:len(b)-1]
+	}
+
+	n, m := len(a), len(b)
+	limit := n + m
+	if limit > maxDiffEdits {
+		limit = maxDiffEdits
+	}
+
+	// v[off+k] is the furthest x reached on diagonal k, trace keeps the
+	// window of v each step started from for the walk back
+	off := limit + 1
+	v := make([]int, 2*limit+3)
+	var trace [][]int
+	for d := 0; d <= limit; d++ {
+		trace = append(trace, append([]int(nil), v[off-d:off+d+1]...))
+		for k := -d; k <= d; k += 2 {
+			x := v[off+k-1] + 1
+			if k == -d || (k != d && v[off+k-1] < v[off+k+1]) {
+				x = v[off+k+1]
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x, y = x+1, y+1
+			}
+			v[off+k] = x
+			if x >= n && y >= m {
+				return diffTrace(a, b, trace, d), true
+			}
+		}
+	}
+	return nil, false
+}
+
+// diffTrace walks the trace back from the end, collecting the edits.
+func diffTrace(a, b []string, trace [][]int, d int) []string {
+	var edits []string
+	x, y := len(a), len(b)
+	for ; d > 0; d-- {
+		prev := trace[d] // indexed by k+d
+		k := x - y
+		prevK := k - 1
+		if k == -d || (k != d && prev[k-1+d] < prev[k+1+d]) {
+			prevK = k + 1
+		}
+		prevX := prev[prevK+d]
+		prevY := prevX - prevK
+		if prevK == k+1 {
+			edits = append(edits, "+ "+withNewline(b[prevY]))
+		} else {
+			edits = append(edits, "- "+withNewline(a[prevX]))
+		}
+		x, y = prevX, prevY
+	}
+
+	for i, j := 0, len(edits)-1; i < j; i, j = i+1, j-1 {
+		edits[i], edits[j] = edits[j], edits[i]
+	}
+	return edits
+}
+
+func withNewline(line string) string {
+	if strings.HasSuffix(line, "\n") {
+		return line
+	}
+	return line + "\n"
+}
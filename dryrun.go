@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type DryRunResult struct {
+	Type    string `json:"type"`
+	Session string `json:"session"`
+	Input   string `json:"input"`
+	Alias   string `json:"alias,omitempty"`
+	Execute string `json:"execute"`
+	Valid   bool   `json:"valid"`
+	Error   string `json:"error,omitempty"`
+
+	Risk     *RiskAssessment `json:"risk,omitempty"`
+	CacheTTL int             `json:"cache_ttl,omitempty"` // seconds a run answers repeats for, see CACHE_RULES
+}
+
+// checkSyntax runs the script through the shell's -n option, which parses
+// it without executing anything.
+func checkSyntax(ctx context.Context, script string) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	cmd := shellCommand(ctx, script, "-n")
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		msg := strings.TrimSpace(string(output))
+		if msg == "" {
+			msg = err.Error()
+		}
+		return fmt.Errorf("%s", msg)
+	}
+	return nil
+}
+
+// dryRun reports what /shell would execute for inputCmd without running it.
+func dryRun(ctx context.Context, session, sessionFolder, inputCmd string) *DryRunResult {
+	inputCmd, alias := expandAlias(session, inputCmd)
+	script := wrapCommand(sessionFolder, inputCmd)
+	result := &DryRunResult{
+		Type:     "dryrun",
+		Session:  session,
+		Input:    inputCmd,
+		Alias:    alias,
+		Execute:  script,
+		Valid:    true,
+		Risk:     classifyCommand(inputCmd),
+		CacheTTL: int(cacheTTL(inputCmd).Seconds()),
+	}
+
+	if err := checkSyntax(ctx, script); err != nil {
+		result.Valid = false
+		result.Error = err.Error()
+	}
+	return result
+}
+
+func writeDryRun(w http.ResponseWriter, r *http.Request, session, sessionFolder, inputCmd string) {
+	jsonResp, err := json.Marshal(dryRun(r.Context(), session, sessionFolder, inputCmd))
+	if err != nil {
+		msg := fmt.Sprintf("Failed to marshal JSON response: %v", err)
+		writeJsonError(w, msg)
+		return
+	}
+
+	fmt.Fprint(w, string(jsonResp))
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With EMBEDDINGS_URL set, each finished ticket's command and output are
+// embedded by the OpenAI-compatible embeddings endpoint there, OpenAI,
+// Ollama, vLLM or anything speaking the same API, and the vector is kept in
+// SESSIONS_DIR/<session>/embeddings/<ticket>.json for /search?mode=semantic.
+// Tickets from before embeddings were enabled, or embedded by another model,
+// are embedded on the first search that needs them.
+
+const (
+	embeddingsDir     = "embeddings"
+	embeddingsTimeout = time.Minute
+	embeddingsBatch   = 32
+	maxEmbedInput     = 8000 // bytes of a ticket sent to the model
+)
+
+var (
+	embeddingsURL    string // EMBEDDINGS_URL, "" disables semantic search
+	embeddingsModel  string
+	embeddingsKey    string
+	embeddingsClient = &http.Client{Timeout: embeddingsTimeout}
+	embeddingsOnce   sync.Once
+)
+
+func loadEmbeddings() error {
+	embeddingsURL = strings.TrimSuffix(os.Getenv("EMBEDDINGS_URL"), "/")
+	embeddingsModel = os.Getenv("EMBEDDINGS_MODEL")
+	embeddingsKey = os.Getenv("EMBEDDINGS_API_KEY")
+	if embeddingsURL == "" {
+		return nil
+	}
+	if !strings.HasPrefix(embeddingsURL, "http://") && !strings.HasPrefix(embeddingsURL, "https://") {
+		return fmt.Errorf("EMBEDDINGS_URL must be an http or https URL: %s", embeddingsURL)
+	}
+	if embeddingsModel == "" {
+		return fmt.Errorf("EMBEDDINGS_MODEL must be set with EMBEDDINGS_URL")
+	}
+	embeddingsOnce.Do(func() {
+		onEvent(func(event string, data interface{}) {
+			if cer, ok := data.(*CmdResults); ok && event == eventTicketCompleted && embeddingsURL != "" {
+				embedTickets(context.Background(), []*CmdResults{cer})
+			}
+		})
+	})
+	return nil
+}
+
+// TicketEmbedding is the stored vector of a ticket.
+type TicketEmbedding struct {
+	Model  string    `json:"model"`
+	Vector []float32 `json:"vector"`
+}
+
+type embeddingsRequest struct {
+	Model string   `json:"model"`
+	Input []string `json:"input"`
+}
+
+type embeddingsResponse struct {
+	Data []struct {
+		Index     int       `json:"index"`
+		Embedding []float32 `json:"embedding"`
+	} `json:"data"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// embedTexts returns the vectors of inputs, in order.
+func embedTexts(ctx context.Context, inputs []string) ([][]float32, error) {
+	body, err := json.Marshal(&embeddingsRequest{Model: embeddingsModel, Input: inputs})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, embeddingsURL+"/embeddings", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if embeddingsKey != "" {
+		req.Header.Set("Authorization", "Bearer "+embeddingsKey)
+	}
+	resp, err := embeddingsClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	er := &embeddingsResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(er); err != nil {
+		return nil, responseError(resp, fmt.Errorf("failed to decode response: %s: %v", resp.Status, err))
+	}
+	if er.Error != nil {
+		return nil, responseError(resp, fmt.Errorf("%s: %s", resp.Status, er.Error.Message))
+	}
+	if resp.StatusCode != http.StatusOK || len(er.Data) != len(inputs) {
+		return nil, responseError(resp, fmt.Errorf("expected %d embeddings in response: %s", len(inputs), resp.Status))
+	}
+
+	vectors := make([][]float32, len(inputs))
+	for _, d := range er.Data {
+		if d.Index < 0 || d.Index >= len(inputs) || len(d.Embedding) == 0 {
+			return nil, fmt.Errorf("bad embedding index %d in response", d.Index)
+		}
+		vectors[d.Index] = d.Embedding
+	}
+	return vectors, nil
+}
+
+// embedInput is the text embedded for a ticket, its command and the head
+// of its output.
+func embedInput(res *CmdResults) string {
+	text := "$ " + res.Input + "\n" + res.Output
+	if len(text) > maxEmbedInput {
+		text = strings.ToValidUTF8(text[:maxEmbedInput], "")
+	}
+	return text
+}
+
+func ticketEmbeddingPath(session string, ticket int) string {
+	return filepath.Join(sessionsDir, session, embeddingsDir, fmt.Sprintf("%d.json", ticket))
+}
+
+// readTicketEmbedding returns the ticket's vector, nil when it has none from
+// the current model.
+func readTicketEmbedding(session string, ticket int) []float32 {
+	data, err := os.ReadFile(ticketEmbeddingPath(session, ticket))
+	if err != nil {
+		return nil
+	}
+	te := &TicketEmbedding{}
+	if json.Unmarshal(data, te) != nil || te.Model != embeddingsModel {
+		return nil
+	}
+	return te.Vector
+}
+
+func saveTicketEmbedding(session string, ticket int, vector []float32) error {
+	path := ticketEmbeddingPath(session, ticket)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	data, err := json.Marshal(&TicketEmbedding{Model: embeddingsModel, Vector: vector})
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// embedTickets embeds and saves the tickets in batches, returning the
+// vectors by position. A failed batch leaves its tickets without one.
+func embedTickets(ctx context.Context, tickets []*CmdResults) [][]float32 {
+	vectors := make([][]float32, len(tickets))
+	for start := 0; start < len(tickets); start += embeddingsBatch {
+		end := start + embeddingsBatch
+		if end > len(tickets) {
+			end = len(tickets)
+		}
+		inputs := make([]string, 0, end-start)
+		for _, res := range tickets[start:end] {
+			inputs = append(inputs, embedInput(res))
+		}
+
+		batch, err := embedTexts(ctx, inputs)
+		if err != nil {
+			logFrom(ctx).Warn("failed to embed tickets", "session", tickets[start].Session, "tickets", len(inputs), "err", err)
+			continue
+		}
+		for i, vector := range batch {
+			res := tickets[start+i]
+			vectors[start+i] = vector
+			if err := saveTicketEmbedding(res.Session, res.Ticket, vector); err != nil {
+				logFrom(ctx).Warn("failed to save embedding", "session", res.Session, "ticket", res.Ticket, "err", err)
+			}
+		}
+	}
+	return vectors
+}
+
+// ticketVectors returns the vector of each ticket, embedding the ones that
+// have none yet.
+func ticketVectors(ctx context.Context, tickets []*CmdResults) [][]float32 {
+	vectors := make([][]float32, len(tickets))
+	var missing []*CmdResults
+	var at []int
+	for i, res := range tickets {
+		if vectors[i] = readTicketEmbedding(res.Session, res.Ticket); vectors[i] == nil {
+			missing = append(missing, res)
+			at = append(at, i)
+		}
+	}
+	if len(missing) > 0 {
+		for i, vector := range embedTickets(ctx, missing) {
+			vectors[at[i]] = vector
+		}
+	}
+	return vectors
+}
+
+func cosineSimilarity(a, b []float32) float64 {
+	if len(a) != len(b) {
+		return 0
+	}
+	var dot, na, nb float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		na += float64(a[i]) * float64(a[i])
+		nb += float64(b[i]) * float64(b[i])
+	}
+	if na == 0 || nb == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(na) * math.Sqrt(nb))
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// /env tells an agent where its commands run without spending a ticket: the
+// working directory, PATH, a few well known variables, the shell's pid and
+// how long the host and shell have been up. With the tmux backend the
+// session's shell is read from /proc, nothing is typed into it, so the
+// directory is current but the variables are the ones it started with. The
+// exec backend starts every command in a fresh shell, so a fixed probe runs
+// in one the way the next command would, after the session's init files.
+
+const envProbeTimeout = 5 * time.Second
+
+// envKeys are the variables reported, only these so secrets in the
+// environment stay out of the snapshot.
+var envKeys = []string{
+	"HOME", "USER", "LOGNAME", "SHELL", "LANG", "LC_ALL", "TERM", "TZ", "TMPDIR",
+	"EDITOR", "VIRTUAL_ENV", "CONDA_DEFAULT_ENV", "GOPATH", "JAVA_HOME",
+	"KUBECONFIG", "AWS_PROFILE", "AWS_REGION", workspacesEnv,
+}
+
+const (
+	envSourceShell = "shell" // the session's running shell
+	envSourceProbe = "probe" // a fresh shell like the next command's
+)
+
+// EnvSnapshot answers /env.
+type EnvSnapshot struct {
+	Type        string            `json:"type"`
+	Session     string            `json:"session"`
+	Backend     string            `json:"backend"`
+	Source      string            `json:"source"`
+	Host        string            `json:"host"`
+	User        string            `json:"user"`
+	Shell       string            `json:"shell"`
+	ShellPid    int               `json:"shell_pid"`
+	Cwd         string            `json:"cwd"`
+	Path        []string          `json:"path"`
+	Env         map[string]string `json:"env"`
+	HostUptime  float64           `json:"host_uptime_seconds"`
+	ShellUptime float64           `json:"shell_uptime_seconds,omitempty"`
+	Running     int               `json:"running"`
+}
+
+// envProbe prints the directory, the pid and PATH, then each of envKeys
+// prefixed with = when set, NUL separated.
+func envProbe() string {
+	var b strings.Builder
+	b.WriteString(`printf '%s\0' "$PWD" "$$" "${PATH-}"`)
+	for _, k := range envKeys {
+		fmt.Fprintf(&b, ` "${%[1]s+=}${%[1]s-}"`, k)
+	}
+	return b.String()
+}
+
+// probeEnv runs envProbe in a fresh shell for the session.
+func probeEnv(ctx context.Context, snap *EnvSnapshot, sessionFolder string) error {
+	ctx, cancel := context.WithTimeout(ctx, envProbeTimeout)
+	defer cancel()
+	cmd := probeCommand(ctx, snap.Session, sessionFolder, envProbe())
+	out, err := cmd.Output()
+	if err != nil {
+		return fmt.Errorf("Failed to probe the environment: %v", err)
+	}
+
+	// The init files may print, the probe's fields are the last ones
+	fields := strings.Split(strings.TrimSuffix(string(out), "\x00"), "\x00")
+	if len(fields) < 3+len(envKeys) {
+		return fmt.Errorf("Failed to probe the environment: short output")
+	}
+	fields = fields[len(fields)-3-len(envKeys):]
+	snap.Cwd = fields[0]
+	if i := strings.LastIndexByte(snap.Cwd, '\n'); i >= 0 {
+		snap.Cwd = snap.Cwd[i+1:]
+	}
+	snap.ShellPid, _ = strconv.Atoi(fields[1])
+	snap.Path = filepath.SplitList(fields[2])
+	for i, k := range envKeys {
+		if v, ok := strings.CutPrefix(fields[3+i], "="); ok {
+			snap.Env[k] = v
+		}
+	}
+	return nil
+}
+
+// readShellEnv reads the running shell's directory and starting
+// environment from /proc.
+func readShellEnv(snap *EnvSnapshot, pid int) error {
+	dir := filepath.Join("/proc", strconv.Itoa(pid))
+	cwd, err := os.Readlink(filepath.Join(dir, "cwd"))
+	if err != nil {
+		return fmt.Errorf("Failed to read the shell's directory: %v", err)
+	}
+	environ, err := os.ReadFile(filepath.Join(dir, "environ"))
+	if err != nil {
+		return fmt.Errorf("Failed to read the shell's environment: %v", err)
+	}
+	snap.Cwd, snap.ShellPid = cwd, pid
+	vars := map[string]string{}
+	for _, kv := range bytes.Split(environ, []byte{0}) {
+		if k, v, ok := strings.Cut(string(kv), "="); ok {
+			vars[k] = v
+		}
+	}
+	snap.Path = filepath.SplitList(vars["PATH"])
+	for _, k := range envKeys {
+		if v, ok := vars[k]; ok {
+			snap.Env[k] = v
+		}
+	}
+	snap.ShellUptime = procUptime(pid)
+	return nil
+}
+
+// hostUptime returns the seconds since boot, 0 when unknown.
+func hostUptime() float64 {
+	data, err := os.ReadFile("/proc/uptime")
+	if err != nil {
+		return 0
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0
+	}
+	up, _ := strconv.ParseFloat(fields[0], 64)
+	return up
+}
+
+// procUptime returns the seconds since the process started, 0 when
+// unknown.
+func procUptime(pid int) float64 {
+	stat, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return 0
+	}
+	// Fields after comm, which may contain spaces, start at the state
+	end := bytes.LastIndexByte(stat, ')')
+	if end < 0 {
+		return 0
+	}
+	fields := strings.Fields(string(stat[end+1:]))
+	if len(fields) < 20 {
+		return 0
+	}
+	started, _ := strconv.ParseFloat(fields[19], 64)
+	up := hostUptime() - started/clockTicks
+	if up < 0 {
+		return 0
+	}
+	return float64(int64(up*100)) / 100
+}
+
+// sessionEnv snapshots where the session's commands run.
+func sessionEnv(ctx context.Context, session string) (*EnvSnapshot, error) {
+	sessionFolder := filepath.Join(sessionsDir, session)
+	snap := &EnvSnapshot{
+		Type:       "env",
+		Session:    session,
+		Backend:    shellBackend,
+		Shell:      shellPath,
+		Path:       []string{},
+		Env:        map[string]string{},
+		HostUptime: hostUptime(),
+		Running:    len(runningForSession(session)),
+	}
+	snap.Host, _ = os.Hostname()
+	if u, err := user.Current(); err == nil {
+		snap.User = u.Username
+	}
+
+	// A session whose shell isn't running is probed like the exec backend,
+	// the next command starts it the same way
+	if shellBackend == backendTmux {
+		if pid := tmuxPanePid(tmuxName(session)); pid > 0 && tmuxAlive(tmuxName(session)) {
+			snap.Source = envSourceShell
+			return snap, readShellEnv(snap, pid)
+		}
+	}
+	snap.Source = envSourceProbe
+	return snap, probeEnv(ctx, snap, sessionFolder)
+}
+
+// envText renders a snapshot as plain text.
+func envText(snap *EnvSnapshot) string {
+	var s strings.Builder
+	fmt.Fprintf(&s, "Session %s, %s backend, %s\n", snap.Session, snap.Backend, snap.Source)
+	fmt.Fprintf(&s, "Host %s, user %s, up %s\n", snap.Host, snap.User, time.Duration(snap.HostUptime*float64(time.Second)).Round(time.Second))
+	fmt.Fprintf(&s, "Shell %s, pid %d", snap.Shell, snap.ShellPid)
+	if snap.ShellUptime > 0 {
+		fmt.Fprintf(&s, ", up %s", time.Duration(snap.ShellUptime*float64(time.Second)).Round(time.Second))
+	}
+	fmt.Fprintf(&s, "\nCwd %s\nPATH %s\n", snap.Cwd, strings.Join(snap.Path, string(filepath.ListSeparator)))
+	keys := make([]string, 0, len(snap.Env))
+	for k := range snap.Env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(&s, "%s=%s\n", k, snap.Env[k])
+	}
+	fmt.Fprintf(&s, "%d commands running\n", snap.Running)
+	return s.String()
+}
+
+func envHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodGet {
+		writeError(w, errMethodMessage)
+		return
+	}
+
+	format, err := responseFormat(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// Validate the hash parameter
+	hashParam := r.URL.Query().Get("hash")
+	if !checkHash(r, hashParam) {
+		writeError(w, errHashMessage)
+		return
+	}
+
+	session := r.URL.Query().Get("session")
+	if !validSessionName(session) {
+		writeError(w, errSessionMessage)
+		return
+	}
+	if !sessionExists(session) {
+		writeError(w, errSessionNotFound)
+		return
+	}
+
+	snap, err := sessionEnv(r.Context(), session)
+	if err != nil {
+		logFrom(r.Context()).Error("failed to snapshot the environment", "session", session, "err", err)
+		writeError(w, err)
+		return
+	}
+	writeFormatted(w, format, snap, envText(snap))
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Every endpoint reports errors through writeError, or writeJsonError for
+// a server error. An error's kind sets the HTTP status and a machine readable
+// code, so the legacy {"error", "code"} body, the /v1 envelope and
+// observations all agree on them. The handler errors are values of their
+// kind declared with their message, the rest are made with notFoundf,
+// rateLimited or newKindError; an error of no kind is a server error.
+
+var (
+	errNotFoundMessage = newKindError(errNotFound, "Not found")
+	errUpgradeMessage  = newKindError(errInvalidParameter, "Expected Upgrade")
+)
+
+// The kinds of errors, each answered with its own status.
+var (
+	errUnauthorized     = errors.New("unauthorized")
+	errForbidden        = errors.New("forbidden")
+	errConfirmRequired  = errors.New("confirmation required")
+	errMethodNotAllowed = errors.New("method not allowed")
+	errTimedOut         = errors.New("timeout")
+	errInvalidParameter = errors.New("invalid parameter")
+	errBadGateway       = errors.New("bad gateway")
+	errUnavailable      = errors.New("unavailable")
+	errConflict         = errors.New("conflict")
+	// errNotFound is the kind of the errors naming something that doesn't
+	// exist.
+	errNotFound = errors.New("not found")
+	// errRateLimited is the kind of the errors from a rate limited model
+	// behind summaries, suggestions or embeddings.
+	errRateLimited = errors.New("rate limited")
+)
+
+// errorKinds maps each kind to its HTTP status and code.
+var errorKinds = []struct {
+	kind   error
+	status int
+	code   string
+}{
+	{errUnauthorized, http.StatusUnauthorized, "unauthorized"},
+	{errForbidden, http.StatusForbidden, "forbidden"},
+	{errConfirmRequired, http.StatusPreconditionRequired, "confirmation_required"},
+	{errMethodNotAllowed, http.StatusMethodNotAllowed, "method_not_allowed"},
+	{errTimedOut, http.StatusGatewayTimeout, "timeout"},
+	{errInvalidParameter, http.StatusBadRequest, "invalid_parameter"},
+	{errBadGateway, http.StatusBadGateway, "bad_gateway"},
+	{errUnavailable, http.StatusServiceUnavailable, "unavailable"},
+	{errConflict, http.StatusConflict, "conflict"},
+	{errNotFound, http.StatusNotFound, "not_found"},
+	{errRateLimited, http.StatusTooManyRequests, "rate_limited"},
+}
+
+// kindError is an error of a kind, reported by its own message. param names
+// the offending request parameter, if any.
+type kindError struct {
+	kind  error
+	msg   string
+	param string
+}
+
+func (e *kindError) Error() string {
+	return e.msg
+}
+
+func (e *kindError) Is(target error) bool {
+	return target == e.kind
+}
+
+// newKindError makes an error of kind with msg.
+func newKindError(kind error, msg string) error {
+	return &kindError{kind: kind, msg: msg}
+}
+
+// paramError makes an errInvalidParameter error for param.
+func paramError(param, msg string) error {
+	return &kindError{kind: errInvalidParameter, msg: msg, param: param}
+}
+
+// notFoundf formats an errNotFound error.
+func notFoundf(format string, a ...interface{}) error {
+	return newKindError(errNotFound, fmt.Sprintf(format, a...))
+}
+
+// rateLimited makes err an errRateLimited error.
+func rateLimited(err error) error {
+	return newKindError(errRateLimited, err.Error())
+}
+
+// JsonErr is the error body of the unversioned endpoints.
+type JsonErr struct {
+	Error string `json:"error"`
+	Code  string `json:"code,omitempty"`
+}
+
+// writeJSON writes v as the response with status.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	resp, err := json.Marshal(v)
+	if err != nil {
+		logger.Error("failed to marshal JSON response", "err", err)
+		status = http.StatusInternalServerError
+		resp = []byte(`{"error":"Failed to marshal JSON response","code":"internal_error"}`)
+	}
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(resp)
+	w.Write([]byte("\n"))
+}
+
+// writeJsonError answers with msg as a server error.
+func writeJsonError(w http.ResponseWriter, msg string) {
+	writeError(w, errors.New(msg))
+}
+
+// writeError answers with err, its status and code from its kind.
+func writeError(w http.ResponseWriter, err error) {
+	msg := err.Error()
+	status, code := errorStatus(err)
+	if ow, ok := w.(*observationWriter); ok {
+		ow.obs = errorObservation(msg, code)
+		ow.status = status
+		return
+	}
+	if vw, ok := w.(*v1Writer); ok {
+		writeV1Error(vw, msg, errorParam(err), status, code)
+		return
+	}
+	writeJSON(w, status, &JsonErr{Error: msg, Code: code})
+}
+
+// errorStatus returns the HTTP status and code of err's kind.
+func errorStatus(err error) (int, string) {
+	for _, k := range errorKinds {
+		if errors.Is(err, k.kind) {
+			return k.status, k.code
+		}
+	}
+	return http.StatusInternalServerError, "internal_error"
+}
+
+// statusCode returns the code of an HTTP error status.
+func statusCode(status int) string {
+	for _, k := range errorKinds {
+		if k.status == status {
+			return k.code
+		}
+	}
+	return "internal_error"
+}
+
+// errorParam returns the request parameter err is about, "" when none.
+func errorParam(err error) string {
+	var ke *kindError
+	if errors.As(err, &ke) {
+		return ke.param
+	}
+	return ""
+}
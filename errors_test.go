@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestErrorKinds(t *testing.T) {
+	tests := []struct {
+		err    error
+		status int
+		code   string
+	}{
+		{errHashMessage, http.StatusUnauthorized, "unauthorized"},
+		{errSlackSignature, http.StatusUnauthorized, "unauthorized"},
+		{errRoutingMessage, http.StatusForbidden, "forbidden"},
+		{&riskError{warning: &RiskWarning{Risk: riskHigh, Reasons: []string{"deletes files"}}}, http.StatusPreconditionRequired, "confirmation_required"},
+		{errMethodMessage, http.StatusMethodNotAllowed, "method_not_allowed"},
+		{newKindError(errTimedOut, "Request timeout exceeded"), http.StatusGatewayTimeout, "timeout"},
+		{fmt.Errorf("%w: unexpected EOF", errBodyMessage), http.StatusBadRequest, "invalid_parameter"},
+		{fmt.Errorf("%w: not a tarball", errArchiveMessage), http.StatusBadRequest, "invalid_parameter"},
+		{fmt.Errorf("%w: bad jq", errFilterFailedMessage), http.StatusBadRequest, "invalid_parameter"},
+		{fmt.Errorf("%w: step 2", errExpectMessage), http.StatusBadRequest, "invalid_parameter"},
+		{errUpgradeMessage, http.StatusBadRequest, "invalid_parameter"},
+		{errSemanticMessage, http.StatusBadRequest, "invalid_parameter"},
+		{errCheckpointLLMMessage, http.StatusBadRequest, "invalid_parameter"},
+		{errProxyMessage, http.StatusBadGateway, "bad_gateway"},
+		{errDrainingMessage, http.StatusServiceUnavailable, "unavailable"},
+		{errStandbyMessage, http.StatusServiceUnavailable, "unavailable"},
+		{errSuggestOffMessage, http.StatusServiceUnavailable, "unavailable"},
+		{errSMTPMessage, http.StatusServiceUnavailable, "unavailable"},
+		{errNotifySlackOff, http.StatusServiceUnavailable, "unavailable"},
+		{errGitHistoryOff, http.StatusServiceUnavailable, "unavailable"},
+		{errNoPlacementMessage, http.StatusServiceUnavailable, "unavailable"},
+		{errSessionExists, http.StatusConflict, "conflict"},
+		{errSessionRunning, http.StatusConflict, "conflict"},
+		{errMigrateSameMessage, http.StatusConflict, "conflict"},
+		{errWorkspaceExists, http.StatusConflict, "conflict"},
+		{errWorkspaceAttached, http.StatusConflict, "conflict"},
+		{errWorkspaceLinked, http.StatusConflict, "conflict"},
+		{errGitSnapshotEmpty, http.StatusConflict, "conflict"},
+		{errLimitsShared, http.StatusConflict, "conflict"},
+		{errExpectShared, http.StatusConflict, "conflict"},
+		{errNotFoundMessage, http.StatusNotFound, "not_found"},
+		{errSessionNotFound, http.StatusNotFound, "not_found"},
+		{errTemplateNotFound, http.StatusNotFound, "not_found"},
+		{errWorkspaceNotFound, http.StatusNotFound, "not_found"},
+		{errWorkspaceUnlinked, http.StatusNotFound, "not_found"},
+		{errContextNotFound, http.StatusNotFound, "not_found"},
+		{errAliasNotFound, http.StatusNotFound, "not_found"},
+		{errNoteNotFound, http.StatusNotFound, "not_found"},
+		{errNotifyNotFound, http.StatusNotFound, "not_found"},
+		{errWebhookNotFound, http.StatusNotFound, "not_found"},
+		{errApprovalNotFound, http.StatusNotFound, "not_found"},
+		{errGitHistoryMissing, http.StatusNotFound, "not_found"},
+		{errCheckpointEmpty, http.StatusNotFound, "not_found"},
+		{errMCPSessionMessage, http.StatusNotFound, "not_found"},
+		// Only a kind sets the status, never the text
+		{errors.New(errSessionNotFound.Error()), http.StatusInternalServerError, "internal_error"},
+		{errors.New("429 Too Many Requests: slow down"), http.StatusInternalServerError, "internal_error"},
+		{fmt.Errorf("Failed to rename session: %v", errSessionRunning), http.StatusInternalServerError, "internal_error"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.err.Error(), func(t *testing.T) {
+			if status, code := errorStatus(tt.err); status != tt.status || code != tt.code {
+				t.Fatalf("errorStatus(%q) = %d %s, want %d %s", tt.err, status, code, tt.status, tt.code)
+			}
+		})
+	}
+}
+
+func TestErrorParam(t *testing.T) {
+	tests := []struct {
+		err   error
+		param string
+	}{
+		{errHashMessage, "hash"},
+		{errSessionMessage, "session"},
+		{errSessionToMessage, "to"},
+		{errLimitsEmpty, "nice"},
+		{fmt.Errorf("%w, at most 2 steps", errExpectMessage), "expect"},
+		{errBodyMessage, ""},
+		{errSessionNotFound, ""},
+		{errors.New("boom"), ""},
+	}
+	for _, tt := range tests {
+		if got := errorParam(tt.err); got != tt.param {
+			t.Errorf("errorParam(%q) = %q, want %q", tt.err, got, tt.param)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	writeError(&v1Writer{ResponseWriter: rec, path: "/v1/shell"}, errTicketMessage)
+	var body V1ErrorResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusBadRequest || body.Error.Details["parameter"] != "ticket" {
+		t.Fatalf("writeError() on /v1 = %d %+v", rec.Code, body.Error)
+	}
+}
+
+func TestErrorStatus(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		status int
+		code   string
+	}{
+		{"not found", notFoundf("Session %s does not exist", "demo"), http.StatusNotFound, "not_found"},
+		{"wrapped not found", fmt.Errorf("Failed to brief: %w", notFoundf("No tickets found for session demo")), http.StatusNotFound, "not_found"},
+		{"rate limited", rateLimited(errors.New("429 Too Many Requests: slow down")), http.StatusTooManyRequests, "rate_limited"},
+		{"wrapped rate limited", fmt.Errorf("%s: %w", errSuggestFailedMessage, rateLimited(errors.New("slow down"))), http.StatusTooManyRequests, "rate_limited"},
+		{"wrapped conflict", fmt.Errorf("Failed to import: %w", errSessionExists), http.StatusConflict, "conflict"},
+		{"unknown", errors.New("boom"), http.StatusInternalServerError, "internal_error"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if status, code := errorStatus(tt.err); status != tt.status || code != tt.code {
+				t.Fatalf("errorStatus(%q) = %d %s, want %d %s", tt.err, status, code, tt.status, tt.code)
+			}
+		})
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	rec := httptest.NewRecorder()
+	writeError(rec, notFoundf("Ticket %d does not exist in session %s", 3, "demo"))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("writeError() status = %d, want 404", rec.Code)
+	}
+	var body JsonErr
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Error != "Ticket 3 does not exist in session demo" || body.Code != "not_found" {
+		t.Fatalf("writeError() body = %+v", body)
+	}
+
+	rec = httptest.NewRecorder()
+	writeError(&v1Writer{ResponseWriter: rec, path: "/v1/status"}, rateLimited(errors.New("slow down")))
+	var v1Body V1ErrorResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &v1Body); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusTooManyRequests || v1Body.Error.Code != "rate_limited" || v1Body.Error.Message != "slow down" {
+		t.Fatalf("writeError() on /v1 = %d %+v", rec.Code, v1Body.Error)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// /history and /status answer with a weak ETag made from what the ticket
+// index knows of the tickets, not from the response, so a conditional
+// request is answered 304 Not Modified before any ticket is read. The tag
+// covers the request URL, so every format and option gets its own. A ticket
+// trimmed to a token budget isn't tagged, its response changes with the
+// budget while the ticket doesn't.
+
+// weakETag tags the response to r from the state of what it reads.
+func weakETag(r *http.Request, state ...interface{}) string {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%s?%s", r.URL.Path, r.URL.RawQuery)
+	for _, s := range state {
+		fmt.Fprintf(h, "|%v", s)
+	}
+	return fmt.Sprintf(`W/"%x"`, h.Sum64())
+}
+
+// ticketETag tags a response showing one ticket.
+func ticketETag(r *http.Request, meta TicketMeta) string {
+	return weakETag(r, meta.Ticket, meta.Size, meta.Modified.UnixNano())
+}
+
+// historyETag tags a response showing the session's tickets, and its notes
+// when withNotes.
+func historyETag(r *http.Request, session string, tickets []TicketMeta, withNotes bool) string {
+	state := make([]interface{}, 0, len(tickets)+1)
+	for _, meta := range tickets {
+		state = append(state, fmt.Sprintf("%d:%d:%d", meta.Ticket, meta.Size, meta.Modified.UnixNano()))
+	}
+	if withNotes {
+		var notesMod int64
+		if info, err := os.Stat(filepath.Join(sessionsDir, session, notesFile)); err == nil {
+			notesMod = info.ModTime().UnixNano()
+		}
+		state = append(state, notesMod)
+	}
+	return weakETag(r, state...)
+}
+
+// notModified sets the response's ETag and answers 304 Not Modified when
+// the client already has it, reporting whether it did.
+func notModified(w http.ResponseWriter, r *http.Request, etag string) bool {
+	w.Header().Set("ETag", etag)
+	match := r.Header.Get("If-None-Match")
+	if match == "" {
+		return false
+	}
+	for _, tag := range strings.Split(match, ",") {
+		// Weak comparison, W/ doesn't matter
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == strings.TrimPrefix(etag, "W/") {
+			w.Header().Del("Content-Type")
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+	return false
+}
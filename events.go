@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	eventCommandStarted  = "command.started"
+	eventCommandOutput   = "command.output"
+	eventCommandFinished = "command.finished"
+
+	activityBuffer = 256
+)
+
+// Activity is one entry of the /events firehose.
+type Activity struct {
+	ID      uint64      `json:"id"`
+	Event   string      `json:"event"`
+	Session string      `json:"session,omitempty"`
+	Ticket  int         `json:"ticket,omitempty"`
+	Time    time.Time   `json:"time"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+var (
+	activitySeq   uint64
+	activityCount int32 // len(activitySubs), read without the lock
+	activityMu    sync.RWMutex
+	activitySubs  = map[chan *Activity]struct{}{}
+)
+
+// publishActivity fans an event out to every /events subscriber. Slow
+// subscribers drop events rather than stall command execution. Every chunk
+// of output is published, so without subscribers it returns before taking
+// any lock, and publishers only share a read lock.
+func publishActivity(event, session string, ticket int, data interface{}) {
+	if !activityWatched() {
+		return
+	}
+	activityMu.RLock()
+	defer activityMu.RUnlock()
+
+	a := &Activity{
+		ID:      atomic.AddUint64(&activitySeq, 1),
+		Event:   event,
+		Session: session,
+		Ticket:  ticket,
+		Time:    time.Now().UTC(),
+		Data:    data,
+	}
+	for ch := range activitySubs {
+		select {
+		case ch <- a:
+		default:
+		}
+	}
+}
+
+// activityWatched reports whether anyone subscribes to /events.
+func activityWatched() bool {
+	return atomic.LoadInt32(&activityCount) > 0
+}
+
+func subscribeActivity() chan *Activity {
+	ch := make(chan *Activity, activityBuffer)
+	activityMu.Lock()
+	activitySubs[ch] = struct{}{}
+	atomic.StoreInt32(&activityCount, int32(len(activitySubs)))
+	activityMu.Unlock()
+	return ch
+}
+
+func unsubscribeActivity(ch chan *Activity) {
+	activityMu.Lock()
+	delete(activitySubs, ch)
+	atomic.StoreInt32(&activityCount, int32(len(activitySubs)))
+	activityMu.Unlock()
+}
+
+// activityWriter publishes command output as it is produced.
+type activityWriter struct {
+	session string
+	ticket  int
+}
+
+func (aw *activityWriter) Write(p []byte) (int, error) {
+	// Only copy the chunk into an event when someone will see it
+	if !activityWatched() {
+		return len(p), nil
+	}
+	publishActivity(eventCommandOutput, aw.session, aw.ticket, map[string]string{"chunk": string(p)})
+	return len(p), nil
+}
+
+// eventsHandler streams every activity event as Server-Sent Events,
+// optionally limited to one session.
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, errMethodMessage)
+		return
+	}
+
+	// Validate the hash parameter
+	hashParam := r.URL.Query().Get("hash")
+	if !checkHash(r, hashParam) {
+		writeError(w, errHashMessage)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJsonError(w, "Streaming unsupported")
+		return
+	}
+
+	// The stream outlives the server's write timeout
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	session := r.URL.Query().Get("session")
+	ch := subscribeActivity()
+	defer unsubscribeActivity(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(30 * time.Second)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			fmt.Fprint(w, ": ping\n\n")
+			flusher.Flush()
+		case a := <-ch:
+			if session != "" && a.Session != session {
+				continue
+			}
+			data, err := json.Marshal(a)
+			if err != nil {
+				logger.Error("failed to marshal activity", "err", err)
+				continue
+			}
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", a.ID, a.Event, data)
+			flusher.Flush()
+		}
+	}
+}
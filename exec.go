@@ -0,0 +1,367 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// execution is the outcome of running one command for a ticket.
+type execution struct {
+	Output    []byte
+	Usage     *ResourceUsage
+	Artifacts []Artifact
+	ExitCode  int
+	Expect    *ExpectResult
+	Err       error
+}
+
+// execute runs inputCmd for the session with the SHELL_BACKEND and blocks
+// until it exits or ctx is done.
+func execute(ctx context.Context, session, sessionFolder string, ticket int, inputCmd string, opts execOptions) *execution {
+	if opts.turn != nil {
+		start := time.Now()
+		if err := opts.turn.wait(ctx); err != nil {
+			return &execution{Output: []byte(err.Error() + "\n"), Usage: newResourceUsage(nil, time.Since(start)), ExitCode: -1, Err: err}
+		}
+		defer opts.turn.release()
+	}
+	return activeExecutor.execute(ctx, session, sessionFolder, ticket, inputCmd, opts)
+}
+
+// executeProcess runs inputCmd in a fresh shell of the executor and blocks
+// until it exits or ctx is done.
+func executeProcess(ctx context.Context, e *processExecutor, session, sessionFolder string, ticket int, inputCmd string, opts execOptions) *execution {
+	// Artifacts and workspaces are only reachable on the server
+	local := map[string]string{}
+	var manifest string
+	if e.remote == nil {
+		var err error
+		if manifest, err = newArtifactManifest(); err != nil {
+			logger.Error("failed to create artifact manifest", "err", err)
+		} else {
+			local[artifactsEnv] = manifest
+		}
+		if dir := sessionWorkspacesDir(sessionFolder); dir != "" {
+			local[workspacesEnv] = dir
+		}
+	}
+	// Expect steps need a terminal to type into, and a way to stop a
+	// dialogue that failed
+	tty := e.terminal(opts)
+	runCtx, stop := ctx, func() {}
+	if len(opts.Expect) > 0 {
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithCancel(ctx)
+		defer cancel()
+		stop = cancel
+	}
+	cmd, script := e.command(runCtx, session, sessionFolder, inputCmd, opts, local)
+
+	buf := newSpillBuffer(sessionFolder)
+	out := io.MultiWriter(buf, &activityWriter{session: session, ticket: ticket})
+	rec := openRecording(sessionFolder, session)
+	if rec != nil {
+		rec.prompt(session, ticket, inputCmd)
+		out = io.MultiWriter(out, rec)
+	}
+	cmd.Stdout = outputWriter{out}
+	cmd.Stderr = cmd.Stdout
+
+	// With a transcript stdout and stderr are recorded apart, so the shared
+	// buffer needs a lock once they are separate writers. A terminal has a
+	// single stream.
+	tr := openTranscript(sessionFolder, ticket)
+	if tr != nil {
+		defer tr.Close()
+		tr.record("in", []byte(script))
+		if tty {
+			cmd.Stdout = outputWriter{io.MultiWriter(out, tr.writer("out"))}
+		} else {
+			locked := &lockedWriter{w: out}
+			cmd.Stdout = outputWriter{io.MultiWriter(locked, tr.writer("out"))}
+			cmd.Stderr = outputWriter{io.MultiWriter(locked, tr.writer("err"))}
+		}
+	}
+	var x *expecter
+	if len(opts.Expect) > 0 {
+		x = newExpecter()
+		cmd.Stdout = outputWriter{io.MultiWriter(cmd.Stdout, x)}
+	}
+	var err error
+	var term *ptyCopy
+	if tty {
+		term, err = attachPty(cmd)
+	}
+	_, span := startSpan(ctx, "shell.exec", spanKindInternal)
+	span.SetAttr("llmass.session", session)
+	span.SetAttr("llmass.ticket", ticket)
+	start := time.Now()
+	if err == nil {
+		err = cmd.Start()
+		if term != nil {
+			term.started()
+		}
+	}
+	var dialogue chan *ExpectResult
+	if err == nil {
+		trackRunning(session, &runningCmd{Ticket: ticket, Input: inputCmd, Pid: cmd.Process.Pid, Started: start})
+		if x != nil {
+			dialogue = make(chan *ExpectResult, 1)
+			go func() { dialogue <- x.run(runCtx, opts.Expect, term, tr, stop) }()
+		}
+		err = cmd.Wait()
+		untrackRunning(session, ticket)
+	}
+	if term != nil {
+		term.drain()
+	}
+	var expected *ExpectResult
+	if dialogue != nil {
+		if expected = <-dialogue; expected.Failed != "" {
+			fmt.Fprintf(out, "\n%s\n", expected.Failed)
+		}
+	}
+	span.SetError(err)
+	span.End()
+
+	ex := &execution{
+		Output: buf.Bytes(),
+		Usage:  newResourceUsage(cmd.ProcessState, time.Since(start)),
+		Expect: expected,
+		Err:    err,
+	}
+	if cmd.ProcessState != nil {
+		ex.ExitCode = cmd.ProcessState.ExitCode()
+	} else {
+		ex.ExitCode = -1
+	}
+	if tr != nil {
+		tr.record("exit", []byte(strconv.Itoa(ex.ExitCode)))
+	}
+	if rec != nil {
+		rec.exit(ex.ExitCode)
+	}
+
+	if manifest != "" {
+		workDir := opts.Cwd
+		if !filepath.IsAbs(workDir) {
+			wd, _ := os.Getwd()
+			workDir = filepath.Join(wd, workDir)
+		}
+		_, collect := startSpan(ctx, "output.collect", spanKindInternal)
+		ex.Artifacts = collectArtifacts(ctx, manifest, workDir, sessionFolder, session, ticket)
+		collect.SetAttr("llmass.artifacts", len(ex.Artifacts))
+		collect.End()
+	}
+	if a := buf.keep(ctx, sessionFolder, session, ticket); a != nil {
+		ex.Artifacts = append(ex.Artifacts, *a)
+	}
+	return ex
+}
+
+// submitCommand allocates a ticket for inputCmd and runs it in the
+// background, returning the submission the caller polls with.
+func submitCommand(ctx context.Context, session, inputCmd string, opts execOptions) (*CmdSubmission, error) {
+	// Background work stays in the caller's trace but not its lifetime
+	bg := detachLinks(ctx, detachSpan(ctx))
+	_, span := startSpan(ctx, "command.submit", spanKindInternal)
+	span.SetAttr("llmass.session", session)
+	defer span.End()
+	log := logFrom(ctx).With("session", session)
+
+	// The name becomes a folder, a tmux session and a remote target, where a
+	// leading - would read as an option
+	if !validSessionName(session) || strings.HasPrefix(session, "-") {
+		return nil, errSessionMessage
+	}
+
+	// The expansion is what runs, and what risk and repeats are judged by
+	inputCmd, opts.Alias = expandAlias(session, inputCmd)
+
+	if err := checkRisk(session, inputCmd, opts); err != nil {
+		log.Warn("risky command needs confirmation", cmdAttr(inputCmd))
+		return nil, err
+	}
+	// What expect steps type is run as much as the command
+	for _, step := range opts.Expect {
+		if err := checkRisk(session, step.Send, opts); err != nil {
+			log.Warn("risky expect send needs confirmation", cmdAttr(step.Send))
+			return nil, err
+		}
+	}
+	if len(opts.Expect) > 0 && activeExecutor.persistent() {
+		return nil, errExpectShared
+	}
+
+	// The session's default limits fill in the ones the request left out
+	limits, err := commandLimits(session, opts.Limits)
+	if err != nil {
+		return nil, err
+	}
+	opts.Limits = limits
+
+	if !beginCommand() {
+		return nil, errDrainingMessage
+	}
+	started := false
+	defer func() {
+		if !started {
+			endCommand()
+		}
+	}()
+
+	// Create the session directory if it doesn't exist
+	sessionFolder := filepath.Join(sessionsDir, session)
+	if _, err := os.Stat(sessionFolder); os.IsNotExist(err) {
+		if err := os.MkdirAll(sessionFolder, 0755); err != nil {
+			msg := fmt.Sprintf("Failed to create session directory %s: %v", sessionFolder, err)
+			log.Error(msg)
+			return nil, fmt.Errorf("%s", msg)
+		}
+		log.Info("created session directory", "dir", sessionFolder)
+		emitEvent(eventSessionCreated, map[string]string{"session": session})
+		publishActivity(eventSessionCreated, session, 0, nil)
+	}
+
+	// Repeats of a cacheable command get its last ticket, unless a re-run is
+	// meant. A dialogue is never answered from the cache.
+	if !opts.Rerun && len(opts.Expect) == 0 {
+		if cached := cachedSubmission(session, inputCmd, opts); cached != nil {
+			countSubmission(session, true)
+			cached.RequestID = requestIDFrom(ctx)
+			return cached, nil
+		}
+	}
+	countSubmission(session, false)
+
+	// Get the next ticket number
+	ticket, err := getNextTicket(sessionFolder)
+	if err != nil {
+		return nil, errTicketMessage
+	}
+	recordBackend(sessionFolder)
+
+	csr := &CmdSubmission{
+		Type:      "submission",
+		Ticket:    ticket,
+		Session:   session,
+		Input:     inputCmd,
+		Alias:     opts.Alias,
+		Callback:  Callback(ctx, session, ticket),
+		RequestID: requestIDFrom(ctx),
+	}
+
+	// Take the command's turn now so the answer says how long it waits
+	if queued() {
+		opts.turn = enqueueCommand(session, ticket, inputCmd)
+		csr.Queued = opts.turn.state()
+	}
+
+	if len(opts.Expect) == 0 {
+		rememberRun(csr, opts)
+	}
+
+	log = log.With("ticket", ticket)
+	auditCommand(ctx, session, ticket, inputCmd)
+	log.Info("executing command", cmdAttr(inputCmd))
+
+	// Create the ticket file up front so pollers see it as working
+	outputFile := filepath.Join(sessionFolder, fmt.Sprintf("%02d.ticket", ticket))
+	file, err := os.OpenFile(outputFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to open output file %s: %v", outputFile, err)
+		log.Error(msg)
+		return nil, fmt.Errorf("%s", msg)
+	}
+
+	span.SetAttr("llmass.ticket", ticket)
+	_, queued := startSpan(bg, "command.queue", spanKindInternal)
+
+	started = true
+	go func() {
+		defer endCommand()
+		defer file.Close()
+		queued.End()
+
+		ctx, cancel := context.WithTimeout(bg, opts.Timeout)
+		defer cancel()
+
+		publishActivity(eventCommandStarted, session, ticket, map[string]string{"input": inputCmd})
+
+		ex := execute(ctx, session, sessionFolder, ticket, inputCmd, opts)
+		finishTicket(bg, log, file, csr, opts, ex)
+	}()
+
+	return csr, nil
+}
+
+// finishTicket writes the result of the submitted command to its ticket file
+// and announces it.
+func finishTicket(bg context.Context, log *slog.Logger, file *os.File, csr *CmdSubmission, opts execOptions, ex *execution) {
+	var jsonResp []byte
+	defer func() { indexTicket(filepath.Join(sessionsDir, csr.Session), csr.Ticket, jsonResp) }()
+
+	output := ex.Output
+	if err := ex.Err; err != nil {
+		log.Warn("command failed", "exit_code", ex.ExitCode, "err", err)
+		// WARNING: don't return
+		// falled through so we can write the error to file
+	} else {
+		log.Debug("command finished", "wall_ms", ex.Usage.WallMs)
+	}
+
+	cer := &CmdResults{
+		Type:      "result",
+		Next:      "This is your result. Review the Input & Output. You can now issue your next command to /shell",
+		Ticket:    csr.Ticket,
+		Session:   csr.Session,
+		Input:     csr.Input,
+		Alias:     opts.Alias,
+		Output:    string(output),
+		Tokens:    estimateTokens(string(output)),
+		ExitCode:  &ex.ExitCode,
+		Usage:     ex.Usage,
+		Expect:    ex.Expect,
+		Backend:   shellBackend,
+		Artifacts: ex.Artifacts,
+		RequestID: csr.RequestID,
+	}
+	if opts.LineNumbers {
+		numberResult(cer)
+	}
+	if shouldSummarize(opts, cer.Tokens) {
+		summarizeResult(bg, filepath.Join(sessionsDir, csr.Session), cer)
+	}
+
+	var err error
+	jsonResp, err = json.Marshal(cer)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to marshal JSON response: %v", err)
+		log.Error(msg)
+		file.WriteString(msg)
+		return
+	}
+
+	_, persist := startSpan(bg, "ticket.persist", spanKindInternal)
+	_, writeErr := file.Write(jsonResp)
+	persist.SetError(writeErr)
+	persist.End()
+	if writeErr != nil {
+		msg := fmt.Sprintf("Failed to write error to file: %v", writeErr)
+		log.Error(msg)
+		file.WriteString(msg)
+		return
+	}
+
+	recordCommand(csr.Session, cer)
+	emitEvent(eventTicketCompleted, cer)
+	publishActivity(eventCommandFinished, csr.Session, csr.Ticket, cer)
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Commands run on the executor SHELL_BACKEND names:
+//
+//   - exec (default) runs every command in a fresh shell process of the
+//     server.
+//   - pty does the same on a pseudo terminal, so the command sees a TTY.
+//   - tmux types each session's commands into a long-lived shell, see
+//     tmux.go.
+//   - docker, ssh and k8s run every command in a fresh shell of a container,
+//     a host or a pod through the docker, ssh or kubectl client, see
+//     remote.go.
+//
+// Handlers only talk to the executor, so another backend plugs in by
+// implementing executor and adding itself to executors. One that runs each
+// command in a process of its own can be a processExecutor with a remote.
+// Each session records the backend its last command ran on.
+
+const (
+	backendExec   = "exec"
+	backendPTY    = "pty"
+	backendTmux   = "tmux"
+	backendDocker = "docker"
+	backendSSH    = "ssh"
+	backendK8s    = "k8s"
+
+	sessionBackendFile = "backend"
+)
+
+// executor runs a session's commands.
+type executor interface {
+	// load reads the backend's settings and checks what it needs, once it
+	// is picked.
+	load() error
+	// execute runs inputCmd for the session and blocks until it exits or
+	// ctx is done.
+	execute(ctx context.Context, session, sessionFolder string, ticket int, inputCmd string, opts execOptions) *execution
+	// persistent reports whether the session's commands share a shell that
+	// outlives them, and the server.
+	persistent() bool
+	// restart replaces the session's shell and returns the directory the
+	// new one starts in, "" when every command starts a shell of its own.
+	restart(session string) (string, error)
+	// remove ends what the backend keeps for a deleted session.
+	remove(session string)
+	// rename moves what the backend keeps for the session to its new name.
+	rename(session, to string) error
+}
+
+var executors = map[string]executor{
+	backendExec:   &processExecutor{},
+	backendPTY:    &processExecutor{tty: true},
+	backendTmux:   tmuxExecutor{},
+	backendDocker: &processExecutor{remote: &dockerRemote{}},
+	backendSSH:    &processExecutor{remote: &sshRemote{}},
+	backendK8s:    &processExecutor{remote: &k8sRemote{}},
+}
+
+var (
+	shellBackend            = backendExec // SHELL_BACKEND
+	activeExecutor executor = executors[backendExec]
+)
+
+// executorNames lists the backends SHELL_BACKEND may name.
+func executorNames() []string {
+	names := make([]string, 0, len(executors))
+	for name := range executors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// loadShellBackend reads SHELL_BACKEND and the picked backend's settings,
+// after loadShell.
+func loadShellBackend() error {
+	name := os.Getenv("SHELL_BACKEND")
+	if name == "" {
+		name = backendExec
+	}
+	e, ok := executors[name]
+	if !ok {
+		return fmt.Errorf("SHELL_BACKEND must be one of %s: %q", strings.Join(executorNames(), ", "), name)
+	}
+	if err := e.load(); err != nil {
+		return err
+	}
+	shellBackend, activeExecutor = name, e
+	return nil
+}
+
+// recordBackend notes in the session folder the backend its commands run
+// on, when that changed.
+func recordBackend(sessionFolder string) {
+	path := filepath.Join(sessionFolder, sessionBackendFile)
+	if data, err := os.ReadFile(path); err == nil && strings.TrimSpace(string(data)) == shellBackend {
+		return
+	}
+	if err := os.WriteFile(path, []byte(shellBackend+"\n"), 0644); err != nil {
+		logger.Warn("failed to record the session's backend", "dir", sessionFolder, "err", err)
+	}
+}
+
+// sessionBackend returns the backend the session's last command ran on, ""
+// when none ran since backends were recorded.
+func sessionBackend(sessionFolder string) string {
+	data, err := os.ReadFile(filepath.Join(sessionFolder, sessionBackendFile))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// processExecutor runs every command in a fresh shell process: one of the
+// server, on a pseudo terminal with tty, or the client of a remote.
+type processExecutor struct {
+	tty    bool
+	remote remote
+}
+
+func (e *processExecutor) load() error {
+	if e.remote != nil {
+		return e.remote.load()
+	}
+	if e.tty {
+		master, tty, err := openPty()
+		if err != nil {
+			return fmt.Errorf("SHELL_BACKEND=pty can't open a pseudo terminal: %v", err)
+		}
+		master.Close()
+		tty.Close()
+	}
+	return nil
+}
+
+func (e *processExecutor) execute(ctx context.Context, session, sessionFolder string, ticket int, inputCmd string, opts execOptions) *execution {
+	return executeProcess(ctx, e, session, sessionFolder, ticket, inputCmd, opts)
+}
+
+// terminal reports whether the command runs on a pseudo terminal, as every
+// command with expect steps does.
+func (e *processExecutor) terminal(opts execOptions) bool {
+	return e.tty || len(opts.Expect) > 0
+}
+
+func (e *processExecutor) persistent() bool               { return false }
+func (e *processExecutor) restart(string) (string, error) { return "", nil }
+func (e *processExecutor) remove(string)                  {}
+func (e *processExecutor) rename(string, string) error    { return nil }
+
+// command returns the process that runs inputCmd for the session, and the
+// script it runs. A local command also gets the variables of local, such as
+// the artifact manifest, which a remote can't reach.
+func (e *processExecutor) command(ctx context.Context, session, sessionFolder, inputCmd string, opts execOptions, local map[string]string) (*exec.Cmd, string) {
+	env := map[string]string{sessionNameEnv: session}
+	for k, v := range opts.Env {
+		env[k] = v
+	}
+	if e.remote != nil {
+		script := opts.Limits.prelude() + remoteScript(sessionFolder, inputCmd, opts.Cwd, env)
+		return e.remote.command(ctx, session, script, e.terminal(opts)), script
+	}
+
+	// Execute the command using a shell to preserve quotes and complex syntax
+	script := opts.Limits.prelude() + wrapCommand(sessionFolder, inputCmd)
+	cmd := shellCommand(ctx, script)
+	cmd.Dir = opts.Cwd
+	cmd.Env = os.Environ()
+	for _, vars := range []map[string]string{env, local} {
+		for k, v := range vars {
+			cmd.Env = append(cmd.Env, k+"="+v)
+		}
+	}
+	return cmd, script
+}
+
+// probeCommand returns the process that runs the environment probe script
+// where the session's commands run.
+func probeCommand(ctx context.Context, session, sessionFolder, script string) *exec.Cmd {
+	var local map[string]string
+	if dir := sessionWorkspacesDir(sessionFolder); dir != "" {
+		local = map[string]string{workspacesEnv: dir}
+	}
+	cmd, _ := processBackend().command(ctx, session, sessionFolder, script, execOptions{}, local)
+	return cmd
+}
+
+// processBackend is the executor of the commands that always run in a
+// fresh shell, such as watches: the SHELL_BACKEND when it runs each command
+// in a process of its own, exec otherwise.
+func processBackend() *processExecutor {
+	if e, ok := activeExecutor.(*processExecutor); ok {
+		return e
+	}
+	return executors[backendExec].(*processExecutor)
+}
+
+// tmuxExecutor types each session's commands into its long-lived tmux shell.
+type tmuxExecutor struct{}
+
+func (tmuxExecutor) load() error { return loadTmux() }
+
+func (tmuxExecutor) execute(ctx context.Context, session, sessionFolder string, ticket int, inputCmd string, opts execOptions) *execution {
+	return executeTmux(ctx, session, sessionFolder, ticket, inputCmd, opts)
+}
+
+func (tmuxExecutor) persistent() bool                       { return true }
+func (tmuxExecutor) restart(session string) (string, error) { return restartShell(session) }
+func (tmuxExecutor) remove(session string)                  { killTmuxSession(session) }
+func (tmuxExecutor) rename(session, to string) error        { return renameShell(session, to) }
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// A command can carry expect steps to drive an interactive program, such as
+// an installer or a password prompt: each step waits until the output
+// matches its expect regular expression and then types its send text
+// followed by Enter, so an agent doesn't have to sleep and hope the prompt
+// is up. Commands with steps run on a pseudo terminal, whatever the backend,
+// as most programs only prompt on one, and a remote backend's on a remote
+// one. A step's search starts where the previous step's match ended.
+//
+// A step that isn't matched within its timeout, or a command that exits
+// before, stops the dialogue: the command is killed and the ticket says
+// which step failed. Once the last step is sent the command runs on to its
+// end as usual. The tmux backend refuses steps, its shell is shared.
+
+const (
+	defaultExpectTimeout = 30 * time.Second
+	maxExpectSteps       = 50
+	maxExpectBuffer      = 64 << 10 // of output the next match is searched in
+)
+
+var (
+	errExpectMessage        = paramError("expect", "Invalid 'expect' parameter, pass an expect regular expression and a send for every step")
+	errExpectTimeoutMessage = paramError("expect_timeout", "Invalid 'expect_timeout' parameter")
+	errExpectShared         = newKindError(errConflict, "Expect steps need a backend that starts a shell per command, the tmux shell is shared")
+)
+
+// ExpectStep waits for the command's output to match Expect, then types Send.
+type ExpectStep struct {
+	Expect  string `json:"expect"`            // regular expression
+	Send    string `json:"send"`              // typed followed by Enter
+	Timeout int    `json:"timeout,omitempty"` // seconds to wait for the match, 30 by default
+}
+
+// ExpectResult is how far the command's expect steps got.
+type ExpectResult struct {
+	Steps   int    `json:"steps"`
+	Matched int    `json:"matched"`
+	Failed  string `json:"failed,omitempty"` // why the step after the matched ones failed
+}
+
+func (s ExpectStep) timeout() time.Duration {
+	if s.Timeout == 0 {
+		return defaultExpectTimeout
+	}
+	return time.Duration(s.Timeout) * time.Second
+}
+
+// expectParams reads the steps from the query string, where expect and send
+// repeat in step order and expect_timeout applies to every step.
+func expectParams(r *http.Request) ([]ExpectStep, error) {
+	q := r.URL.Query()
+	expects, sends := q["expect"], q["send"]
+	if len(expects) == 0 && len(sends) == 0 {
+		return nil, nil
+	}
+	if len(expects) != len(sends) {
+		return nil, errExpectMessage
+	}
+	timeout := 0
+	if t := q.Get("expect_timeout"); t != "" {
+		n, err := strconv.Atoi(t)
+		if err != nil {
+			return nil, errExpectTimeoutMessage
+		}
+		timeout = n
+	}
+	steps := make([]ExpectStep, len(expects))
+	for i := range expects {
+		steps[i] = ExpectStep{Expect: expects[i], Send: sends[i], Timeout: timeout}
+	}
+	return steps, nil
+}
+
+// validateExpect checks the steps' count, patterns and timeouts.
+func validateExpect(steps []ExpectStep) error {
+	if len(steps) > maxExpectSteps {
+		return fmt.Errorf("%w, at most %d steps", errExpectMessage, maxExpectSteps)
+	}
+	for _, s := range steps {
+		if s.Expect == "" {
+			return errExpectMessage
+		}
+		if _, err := regexp.Compile(s.Expect); err != nil {
+			return fmt.Errorf("%w: %v", errExpectMessage, err)
+		}
+		if s.Timeout < 0 || s.timeout() > maxCmdTimeout {
+			return errExpectTimeoutMessage
+		}
+	}
+	return nil
+}
+
+// expecter collects the command's output for the steps to match.
+type expecter struct {
+	mu   sync.Mutex
+	buf  []byte // since the last match
+	more chan struct{}
+}
+
+func newExpecter() *expecter {
+	return &expecter{more: make(chan struct{}, 1)}
+}
+
+func (x *expecter) Write(p []byte) (int, error) {
+	x.mu.Lock()
+	x.buf = append(x.buf, p...)
+	if over := len(x.buf) - maxExpectBuffer; over > 0 {
+		x.buf = append(x.buf[:0], x.buf[over:]...)
+	}
+	x.mu.Unlock()
+	select {
+	case x.more <- struct{}{}:
+	default:
+	}
+	return len(p), nil
+}
+
+// match consumes the output up to the end of the first match of re.
+func (x *expecter) match(re *regexp.Regexp) bool {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	loc := re.FindIndex(x.buf)
+	if loc == nil {
+		return false
+	}
+	x.buf = append(x.buf[:0], x.buf[loc[1]:]...)
+	return true
+}
+
+// run plays the steps on the command's terminal and calls stop when one
+// fails. It returns once the steps are done or one failed.
+func (x *expecter) run(ctx context.Context, steps []ExpectStep, term *ptyCopy, tr *transcript, stop func()) *ExpectResult {
+	res := &ExpectResult{Steps: len(steps)}
+	for i, s := range steps {
+		if res.Failed = x.wait(ctx, s, term); res.Failed == "" && isClosed(term.done) {
+			res.Failed = "the command exited before it was sent"
+		}
+		if res.Failed == "" {
+			if tr != nil {
+				tr.record("in", []byte(s.Send+"\n"))
+			}
+			if _, err := term.master.Write([]byte(s.Send + "\r")); err != nil {
+				res.Failed = fmt.Sprintf("failed to send: %v", err)
+			}
+		}
+		if res.Failed != "" {
+			res.Failed = fmt.Sprintf("expect step %d: %s", i+1, res.Failed)
+			stop()
+			return res
+		}
+		res.Matched++
+	}
+	return res
+}
+
+// wait blocks until the output matches the step, returning why it didn't.
+func (x *expecter) wait(ctx context.Context, s ExpectStep, term *ptyCopy) string {
+	re := regexp.MustCompile(s.Expect)
+	timer := time.NewTimer(s.timeout())
+	defer timer.Stop()
+	for !x.match(re) {
+		select {
+		case <-x.more:
+		case <-timer.C:
+			return fmt.Sprintf("timed out after %s waiting for /%s/", s.timeout(), s.Expect)
+		case <-term.done:
+			// The copy has written all there was, one last look
+			if x.match(re) {
+				return ""
+			}
+			return fmt.Sprintf("the command exited before its output matched /%s/", s.Expect)
+		case <-ctx.Done():
+			return fmt.Sprintf("the command was stopped waiting for /%s/", s.Expect)
+		}
+	}
+	return ""
+}
+
+// isClosed reports whether ch is closed, without blocking.
+func isClosed(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeTerm is a terminal whose master end writes to a pipe the test reads
+// what was typed from.
+func fakeTerm(t *testing.T) (*ptyCopy, *bufio.Reader) {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		r.Close()
+		w.Close()
+	})
+	return &ptyCopy{master: w, done: make(chan struct{})}, bufio.NewReader(r)
+}
+
+func TestExpecterSendOrder(t *testing.T) {
+	term, typed := fakeTerm(t)
+	x := newExpecter()
+	steps := []ExpectStep{
+		{Expect: `Name\? $`, Send: "alice", Timeout: 5},
+		{Expect: `Color\? $`, Send: "blue", Timeout: 5},
+		{Expect: `Sure\? \[y/N\]`, Send: "y", Timeout: 5},
+	}
+
+	// The program asks its next question once it read the previous answer
+	var sent []string
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		x.Write([]byte("Name? "))
+		for _, next := range []string{"Color? ", "Sure? [y/N]", ""} {
+			answer, err := typed.ReadString('\r')
+			if err != nil {
+				return
+			}
+			sent = append(sent, strings.TrimSuffix(answer, "\r"))
+			x.Write([]byte(answer + "\n" + next))
+		}
+	}()
+
+	res := x.run(context.Background(), steps, term, nil, func() { t.Error("stop called") })
+	<-done
+	if res.Failed != "" || res.Matched != 3 || res.Steps != 3 {
+		t.Fatalf("run() = %+v, want all 3 steps matched", res)
+	}
+	if want := []string{"alice", "blue", "y"}; strings.Join(sent, ",") != strings.Join(want, ",") {
+		t.Fatalf("sent %q, want %q", sent, want)
+	}
+}
+
+func TestExpecterMatchConsumes(t *testing.T) {
+	term, typed := fakeTerm(t)
+	go func() {
+		for {
+			if _, err := typed.ReadString('\r'); err != nil {
+				return
+			}
+		}
+	}()
+	x := newExpecter()
+
+	// Both prompts are already out, the second step must not match the
+	// first prompt again
+	x.Write([]byte("password: password: "))
+	steps := []ExpectStep{{Expect: "password: ", Send: "a", Timeout: 1}, {Expect: "password: ", Send: "b", Timeout: 1}, {Expect: "password: ", Send: "c", Timeout: 1}}
+	res := x.run(context.Background(), steps, term, nil, func() {})
+	if res.Matched != 2 || !strings.HasPrefix(res.Failed, "expect step 3: timed out") {
+		t.Fatalf("run() = %+v, want 2 matched and step 3 timed out", res)
+	}
+}
+
+func TestExpecterTimeout(t *testing.T) {
+	term, _ := fakeTerm(t)
+	x := newExpecter()
+	x.Write([]byte("Continue? "))
+
+	stopped := false
+	start := time.Now()
+	res := x.run(context.Background(), []ExpectStep{{Expect: `Proceed\?`, Send: "y", Timeout: 1}}, term, nil, func() { stopped = true })
+	if elapsed := time.Since(start); elapsed < time.Second || elapsed > 5*time.Second {
+		t.Errorf("run() took %s, want about the 1s timeout", elapsed)
+	}
+	if !stopped {
+		t.Error("run() didn't stop the command")
+	}
+	if res.Matched != 0 || res.Failed != `expect step 1: timed out after 1s waiting for /Proceed\?/` {
+		t.Fatalf("run() = %+v", res)
+	}
+}
+
+func TestExpecterCommandExited(t *testing.T) {
+	term, _ := fakeTerm(t)
+	x := newExpecter()
+	x.Write([]byte("bye\n"))
+	close(term.done)
+
+	res := x.run(context.Background(), []ExpectStep{{Expect: "login: ", Send: "root", Timeout: 5}}, term, nil, func() {})
+	if res.Failed != "expect step 1: the command exited before its output matched /login: /" {
+		t.Fatalf("run() = %+v", res)
+	}
+}
+
+func TestValidateExpect(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []ExpectStep
+		ok    bool
+	}{
+		{"valid", []ExpectStep{{Expect: "ok", Send: "y"}, {Expect: "done", Timeout: 60}}, true},
+		{"empty expect", []ExpectStep{{Expect: "", Send: "y"}}, false},
+		{"bad pattern", []ExpectStep{{Expect: "(", Send: "y"}}, false},
+		{"negative timeout", []ExpectStep{{Expect: "ok", Timeout: -1}}, false},
+		{"timeout too long", []ExpectStep{{Expect: "ok", Timeout: int(maxCmdTimeout/time.Second) + 1}}, false},
+		{"too many steps", make([]ExpectStep, maxExpectSteps+1), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateExpect(tt.steps); (err == nil) != tt.ok {
+				t.Fatalf("validateExpect() = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// filter trims noise out of an output on the server, sparing agents a
+// follow-up command: grep:REGEX keeps the matching lines, grep-v:REGEX drops
+// them, jq:PATH picks values out of JSON output with a subset of jq, and
+// cols:LIST keeps whitespace separated columns like awk '{print $1, $3}'.
+// Given to /shell it carries over to the callback URL.
+
+var (
+	errFilterMessage       = paramError("filter", "Invalid 'filter' parameter, use grep:REGEX, grep-v:REGEX, jq:PATH or cols:LIST")
+	errFilterFailedMessage = newKindError(errInvalidParameter, "Filter failed")
+)
+
+// outputFilter is a parsed filter expression.
+type outputFilter struct {
+	expr  string
+	apply func(string) (string, error)
+}
+
+// parseFilter parses a filter expression, nil when it is empty.
+func parseFilter(expr string) (*outputFilter, error) {
+	if expr == "" {
+		return nil, nil
+	}
+	kind, arg, ok := strings.Cut(expr, ":")
+	if !ok || arg == "" {
+		return nil, errFilterMessage
+	}
+
+	f := &outputFilter{expr: expr}
+	switch kind {
+	case "grep", "grep-v":
+		re, err := regexp.Compile(arg)
+		if err != nil {
+			return nil, errFilterMessage
+		}
+		keep := kind == "grep"
+		f.apply = func(s string) (string, error) { return grepLines(s, re, keep), nil }
+	case "jq":
+		steps, err := parseJQ(arg)
+		if err != nil {
+			return nil, errFilterMessage
+		}
+		f.apply = func(s string) (string, error) { return runJQ(s, steps) }
+	case "cols":
+		cols, err := parseColumns(arg)
+		if err != nil {
+			return nil, errFilterMessage
+		}
+		f.apply = func(s string) (string, error) { return selectColumns(s, cols), nil }
+	default:
+		return nil, errFilterMessage
+	}
+	return f, nil
+}
+
+// requestFilter reads the filter parameter.
+func requestFilter(r *http.Request) (*outputFilter, error) {
+	return parseFilter(r.URL.Query().Get("filter"))
+}
+
+// filterResult filters a result's outputs.
+func filterResult(res *CmdResults, f *outputFilter) error {
+	out, err := f.apply(res.Output)
+	if err != nil {
+		return err
+	}
+	res.Output, res.Filter = out, f.expr
+	res.Tokens = estimateTokens(out)
+	for _, it := range res.Iterations {
+		if it.Output, err = f.apply(it.Output); err != nil {
+			return err
+		}
+		it.Tokens = estimateTokens(it.Output)
+	}
+	return nil
+}
+
+func grepLines(s string, re *regexp.Regexp, keep bool) string {
+	var b strings.Builder
+	for _, line := range splitLines(s) {
+		if re.MatchString(strings.TrimSuffix(line, "\n")) == keep {
+			b.WriteString(withNewline(line))
+		}
+	}
+	return b.String()
+}
+
+// column is a 1-based range of columns, to 0 running to the last one.
+type column struct {
+	from, to int
+}
+
+// parseColumns parses a list like 1,3 or 2-4 or 5-.
+func parseColumns(list string) ([]column, error) {
+	var cols []column
+	for _, part := range strings.Split(list, ",") {
+		from, to, isRange := strings.Cut(strings.TrimSpace(part), "-")
+		c := column{}
+		var err error
+		if c.from, err = strconv.Atoi(from); err != nil || c.from < 1 {
+			return nil, errFilterMessage
+		}
+		switch {
+		case !isRange:
+			c.to = c.from
+		case to != "":
+			if c.to, err = strconv.Atoi(to); err != nil || c.to < c.from {
+				return nil, errFilterMessage
+			}
+		}
+		cols = append(cols, c)
+	}
+	return cols, nil
+}
+
+// selectColumns keeps the columns of each line, dropping lines without any.
+func selectColumns(s string, cols []column) string {
+	var b strings.Builder
+	for _, line := range splitLines(s) {
+		fields := strings.Fields(line)
+		var picked []string
+		for _, c := range cols {
+			to := c.to
+			if to == 0 || to > len(fields) {
+				to = len(fields)
+			}
+			for i := c.from; i <= to; i++ {
+				picked = append(picked, fields[i-1])
+			}
+		}
+		if len(picked) > 0 {
+			b.WriteString(strings.Join(picked, " ") + "\n")
+		}
+	}
+	return b.String()
+}
+
+// jq subset: paths of .key, ."key", [N], [] and .[] joined by pipes,
+// optionally ending in keys or length.
+
+const (
+	jqField = iota
+	jqIndex
+	jqIterate
+	jqKeys
+	jqLength
+)
+
+type jqStep struct {
+	kind  int
+	key   string
+	index int
+}
+
+func parseJQ(expr string) ([]jqStep, error) {
+	var steps []jqStep
+	for _, stage := range strings.Split(expr, "|") {
+		stage = strings.TrimSpace(stage)
+		switch stage {
+		case "keys":
+			steps = append(steps, jqStep{kind: jqKeys})
+			continue
+		case "length":
+			steps = append(steps, jqStep{kind: jqLength})
+			continue
+		}
+		if !strings.HasPrefix(stage, ".") {
+			return nil, errFilterMessage
+		}
+		for s := stage; s != ""; {
+			switch {
+			case s == ".":
+				s = ""
+			case strings.HasPrefix(s, ".["), strings.HasPrefix(s, "["):
+				s = strings.TrimPrefix(s, ".")
+				end := strings.IndexByte(s, ']')
+				if end < 0 {
+					return nil, errFilterMessage
+				}
+				if inner := strings.TrimSpace(s[1:end]); inner == "" {
+					steps = append(steps, jqStep{kind: jqIterate})
+				} else {
+					n, err := strconv.Atoi(inner)
+					if err != nil {
+						return nil, errFilterMessage
+					}
+					steps = append(steps, jqStep{kind: jqIndex, index: n})
+				}
+				s = s[end+1:]
+			case strings.HasPrefix(s, `."`):
+				end := strings.IndexByte(s[2:], '"')
+				if end < 0 {
+					return nil, errFilterMessage
+				}
+				steps = append(steps, jqStep{kind: jqField, key: s[2 : 2+end]})
+				s = s[3+end:]
+			case strings.HasPrefix(s, "."):
+				end := strings.IndexAny(s[1:], ".[")
+				if end < 0 {
+					end = len(s) - 1
+				}
+				key := s[1 : 1+end]
+				if !validJQKey(key) {
+					return nil, errFilterMessage
+				}
+				steps = append(steps, jqStep{kind: jqField, key: key})
+				s = s[1+end:]
+			default:
+				return nil, errFilterMessage
+			}
+		}
+	}
+	return steps, nil
+}
+
+func validJQKey(key string) bool {
+	for i, r := range key {
+		if !(r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || i > 0 && r >= '0' && r <= '9') {
+			return false
+		}
+	}
+	return key != ""
+}
+
+// runJQ applies the steps to every JSON value in s, printing one result
+// per line, strings raw like jq -r.
+func runJQ(s string, steps []jqStep) (string, error) {
+	dec := json.NewDecoder(strings.NewReader(s))
+	dec.UseNumber()
+	var values []interface{}
+	for {
+		var v interface{}
+		err := dec.Decode(&v)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("%w: the output is not JSON: %v", errFilterFailedMessage, err)
+		}
+		values = append(values, v)
+	}
+
+	for _, step := range steps {
+		var next []interface{}
+		for _, v := range values {
+			out, err := jqApply(step, v)
+			if err != nil {
+				return "", fmt.Errorf("%w: %v", errFilterFailedMessage, err)
+			}
+			next = append(next, out...)
+		}
+		values = next
+	}
+
+	var b strings.Builder
+	for _, v := range values {
+		if str, ok := v.(string); ok {
+			b.WriteString(str + "\n")
+			continue
+		}
+		data, err := json.Marshal(v)
+		if err != nil {
+			return "", err
+		}
+		b.Write(data)
+		b.WriteString("\n")
+	}
+	return b.String(), nil
+}
+
+func jqApply(step jqStep, v interface{}) ([]interface{}, error) {
+	switch step.kind {
+	case jqField:
+		switch t := v.(type) {
+		case nil:
+			return []interface{}{nil}, nil
+		case map[string]interface{}:
+			return []interface{}{t[step.key]}, nil
+		}
+		return nil, fmt.Errorf("cannot index %s with %q", jqType(v), step.key)
+	case jqIndex:
+		switch t := v.(type) {
+		case nil:
+			return []interface{}{nil}, nil
+		case []interface{}:
+			i := step.index
+			if i < 0 {
+				i += len(t)
+			}
+			if i < 0 || i >= len(t) {
+				return []interface{}{nil}, nil
+			}
+			return []interface{}{t[i]}, nil
+		}
+		return nil, fmt.Errorf("cannot index %s with a number", jqType(v))
+	case jqIterate:
+		switch t := v.(type) {
+		case []interface{}:
+			return t, nil
+		case map[string]interface{}:
+			var out []interface{}
+			for _, k := range sortedKeys(t) {
+				out = append(out, t[k])
+			}
+			return out, nil
+		}
+		return nil, fmt.Errorf("cannot iterate over %s", jqType(v))
+	case jqKeys:
+		switch t := v.(type) {
+		case []interface{}:
+			keys := make([]interface{}, len(t))
+			for i := range t {
+				keys[i] = i
+			}
+			return []interface{}{keys}, nil
+		case map[string]interface{}:
+			keys := []interface{}{}
+			for _, k := range sortedKeys(t) {
+				keys = append(keys, k)
+			}
+			return []interface{}{keys}, nil
+		}
+		return nil, fmt.Errorf("%s has no keys", jqType(v))
+	default: // jqLength
+		switch t := v.(type) {
+		case nil:
+			return []interface{}{0}, nil
+		case string:
+			return []interface{}{utf8.RuneCountInString(t)}, nil
+		case []interface{}:
+			return []interface{}{len(t)}, nil
+		case map[string]interface{}:
+			return []interface{}{len(t)}, nil
+		}
+		return nil, fmt.Errorf("%s has no length", jqType(v))
+	}
+}
+
+func jqType(v interface{}) string {
+	switch v.(type) {
+	case map[string]interface{}:
+		return "an object"
+	case []interface{}:
+		return "an array"
+	case string:
+		return "a string"
+	case json.Number:
+		return "a number"
+	case bool:
+		return "a boolean"
+	}
+	return "null"
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
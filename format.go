@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const (
+	formatJSON   = "json"
+	formatText   = "text"
+	formatNDJSON = "ndjson"
+)
+
+var (
+	errFormatMessage = paramError("format", "Invalid 'format' parameter, use json, text, ndjson or observation")
+)
+
+// responseFormat returns the requested output format, defaulting to json.
+func responseFormat(r *http.Request) (string, error) {
+	switch f := r.URL.Query().Get("format"); f {
+	case "", formatJSON:
+		return formatJSON, nil
+	case formatText, formatNDJSON, formatObservation:
+		return f, nil
+	}
+	return "", errFormatMessage
+}
+
+func setFormatContentType(w http.ResponseWriter, format string) {
+	switch format {
+	case formatText:
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	case formatNDJSON:
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	default:
+		w.Header().Set("Content-Type", "application/json")
+	}
+}
+
+// resultText renders a ticket as a shell transcript.
+func resultText(res *CmdResults) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "$ %s\n%s", res.Input, res.Output)
+	if res.Output != "" && !strings.HasSuffix(res.Output, "\n") {
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// writeFormatted writes a single value, text is supplied by the caller since
+// each endpoint has its own plain representation.
+func writeFormatted(w http.ResponseWriter, format string, v interface{}, text string) {
+	switch format {
+	case formatText:
+		setFormatContentType(w, format)
+		fmt.Fprint(w, text)
+		return
+	case formatObservation:
+		writeObservation(w, observationOf(v, text))
+		return
+	}
+
+	jsonResp, err := json.Marshal(v)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to marshal JSON response: %v", err)
+		writeJsonError(w, msg)
+		return
+	}
+
+	setFormatContentType(w, format)
+	fmt.Fprint(w, string(jsonResp))
+	if format == formatNDJSON {
+		fmt.Fprint(w, "\n")
+	}
+}
+
+// writeHistory writes tickets as a JSON array, a transcript, or one JSON
+// object per line flushed as it goes. An observation holds the transcript.
+func writeHistory(w http.ResponseWriter, format string, responses []*CmdResults, notes []*Note) {
+	switch format {
+	case formatText, formatObservation:
+		var b strings.Builder
+		for _, res := range responses {
+			b.WriteString(resultText(res))
+		}
+		b.WriteString(notesText(notes))
+		writeFormatted(w, format, responses, b.String())
+	case formatNDJSON:
+		setFormatContentType(w, format)
+		flusher, _ := w.(http.Flusher)
+		enc := json.NewEncoder(w)
+		for _, res := range responses {
+			if err := enc.Encode(res); err != nil {
+				logger.Warn("failed to write ticket", "ticket", res.Ticket, "err", err)
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		for _, note := range notes {
+			if err := enc.Encode(note); err != nil {
+				logger.Warn("failed to write note", "note", note.ID, "err", err)
+				return
+			}
+		}
+	default:
+		// Notes turn the array into an object holding both
+		if notes != nil {
+			writeFormatted(w, format, obj{"tickets": responses, "notes": notes}, "")
+			return
+		}
+		writeFormatted(w, format, responses, "")
+	}
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Git history commits a session's folder to a git repository after each of
+// its tickets completes, so the session's record is diffable and tamper
+// evident: rewriting a ticket changes every commit hash after it, which a
+// copy pushed elsewhere exposes. The repository is DATA_DIR/history/
+// <session>.git, outside the session folder so the agent's own git commands
+// never see it. With GIT_HISTORY_WORKSPACES the shared workspaces attached
+// to the session are snapshotted under workspaces/<name>/ in the same
+// commit, and with GIT_HISTORY_REMOTE every commit is pushed, {session} in
+// the URL replaced by the session's name.
+
+const (
+	gitHistoryDir     = "history"
+	gitHistoryBranch  = "main"
+	gitHistoryTimeout = 2 * time.Minute
+	gitLogDefault     = 50
+	gitLogMax         = 1000
+	gitSubjectLength  = 200
+)
+
+var (
+	errGitHistoryOff     = newKindError(errUnavailable, "Git history is not enabled, set GIT_HISTORY")
+	errGitCommitMessage  = paramError("commit", "Invalid 'commit' parameter")
+	errGitSnapshotEmpty  = newKindError(errConflict, "No changes since the last commit")
+	errGitHistoryMissing = newKindError(errNotFound, "No git history for the session")
+)
+
+var (
+	gitHistory           bool   // GIT_HISTORY
+	gitHistoryWorkspaces bool   // GIT_HISTORY_WORKSPACES
+	gitHistoryRemote     string // GIT_HISTORY_REMOTE
+	gitHistoryOnce       sync.Once
+
+	// gitHistoryMu serializes the commits, which share the index
+	gitHistoryMu sync.Mutex
+
+	gitCommitRe = regexp.MustCompile(`^[0-9a-f]{4,64}$`)
+)
+
+// GitCommit is a commit of a session's git history.
+type GitCommit struct {
+	Commit  string    `json:"commit"`
+	Session string    `json:"session"`
+	Ticket  int       `json:"ticket,omitempty"`
+	Subject string    `json:"subject"`
+	Time    time.Time `json:"time"`
+	Files   []string  `json:"files,omitempty"`
+}
+
+func loadGitHistory() error {
+	gitHistory = os.Getenv("GIT_HISTORY") == "1"
+	gitHistoryWorkspaces = os.Getenv("GIT_HISTORY_WORKSPACES") == "1"
+	gitHistoryRemote = os.Getenv("GIT_HISTORY_REMOTE")
+	if !gitHistory {
+		if gitHistoryWorkspaces || gitHistoryRemote != "" {
+			return fmt.Errorf("GIT_HISTORY_WORKSPACES and GIT_HISTORY_REMOTE require GIT_HISTORY=1")
+		}
+		return nil
+	}
+	if _, err := exec.LookPath("git"); err != nil {
+		return fmt.Errorf("GIT_HISTORY requires git: %v", err)
+	}
+	gitHistoryOnce.Do(func() {
+		onEvent(func(event string, data interface{}) {
+			if cer, ok := data.(*CmdResults); ok && event == eventTicketCompleted && gitHistory {
+				if _, err := commitGitHistory(cer.Session, ticketCommitMessage(cer)); err != nil && !errors.Is(err, errGitSnapshotEmpty) {
+					logger.Error("failed to commit git history", "session", cer.Session, "ticket", cer.Ticket, "err", err)
+				}
+			}
+		})
+	})
+	logger.Info("git history enabled", "workspaces", gitHistoryWorkspaces, "remote", gitHistoryRemote != "")
+	return nil
+}
+
+func gitHistoryPath(session string) string {
+	return filepath.Join(dataDir, gitHistoryDir, session+".git")
+}
+
+// git runs a git command on the session's repository with the session
+// folder as its work tree, and extra environment such as GIT_INDEX_FILE.
+func git(session string, env []string, args ...string) (string, error) {
+	return gitIn(filepath.Join(sessionsDir, session), session, env, args...)
+}
+
+// gitIn runs a git command on the session's repository with another work
+// tree.
+func gitIn(worktree, session string, env []string, args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), gitHistoryTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "git", append([]string{
+		"--git-dir", gitHistoryPath(session),
+		"--work-tree", worktree,
+		"-c", "user.name=llmass",
+		"-c", "user.email=llmass@localhost",
+		"-c", "core.autocrlf=false",
+	}, args...)...)
+	cmd.Env = append(os.Environ(), env...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("git %s: %v: %s", args[0], err, strings.TrimSpace(string(out)))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// initGitHistory creates the session's repository on its first commit.
+func initGitHistory(session string) error {
+	dir := gitHistoryPath(session)
+	if _, err := os.Stat(dir); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(dir), 0700); err != nil {
+		return err
+	}
+	if _, err := git(session, nil, "init", "-q"); err != nil {
+		return err
+	}
+	if _, err := git(session, nil, "symbolic-ref", "HEAD", "refs/heads/"+gitHistoryBranch); err != nil {
+		return err
+	}
+	// Workspaces are links, snapshotted from their targets instead
+	exclude := "*.tmp\n/" + sessionWorkspaces + "/\n"
+	return os.WriteFile(filepath.Join(dir, "info", "exclude"), []byte(exclude), 0644)
+}
+
+// stageWorkspaces replaces the workspaces in the index with snapshots of
+// those attached now. Each is added through an index of its own, which
+// keeps git from rehashing unchanged files.
+func stageWorkspaces(session string) error {
+	if _, err := git(session, nil, "rm", "-r", "-q", "--cached", "--ignore-unmatch", sessionWorkspaces); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(filepath.Join(sessionsDir, session, sessionWorkspaces))
+	if err != nil {
+		return nil
+	}
+	for _, e := range entries {
+		if !workspaceExists(e.Name()) {
+			continue
+		}
+		env := []string{"GIT_INDEX_FILE=" + filepath.Join(gitHistoryPath(session), "workspace-"+e.Name()+".index")}
+		if _, err := gitIn(workspacePath(e.Name()), session, env, "add", "-A", "."); err != nil {
+			return err
+		}
+		tree, err := git(session, env, "write-tree")
+		if err != nil {
+			return err
+		}
+		if _, err := git(session, nil, "read-tree", "--prefix="+sessionWorkspaces+"/"+e.Name()+"/", tree); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// commitGitHistory commits the session folder, and its workspaces when
+// enabled, returning the commit.
+func commitGitHistory(session, message string) (*GitCommit, error) {
+	gitHistoryMu.Lock()
+	defer gitHistoryMu.Unlock()
+
+	if !sessionExists(session) {
+		return nil, errSessionNotFound
+	}
+	if err := initGitHistory(session); err != nil {
+		return nil, fmt.Errorf("Failed to create git history: %v", err)
+	}
+	if _, err := git(session, nil, "add", "-A", "."); err != nil {
+		return nil, err
+	}
+	if gitHistoryWorkspaces {
+		if err := stageWorkspaces(session); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := git(session, nil, "diff", "--cached", "--quiet"); err == nil {
+		if _, err := git(session, nil, "rev-parse", "-q", "--verify", "HEAD"); err == nil {
+			return nil, errGitSnapshotEmpty
+		}
+	}
+	if _, err := git(session, nil, "commit", "-q", "--allow-empty", "-m", message); err != nil {
+		return nil, err
+	}
+	commits, err := gitLog(session, "HEAD", 1)
+	if err != nil || len(commits) == 0 {
+		return nil, fmt.Errorf("Failed to read the commit: %v", err)
+	}
+
+	if gitHistoryRemote != "" {
+		remote := strings.ReplaceAll(gitHistoryRemote, "{session}", session)
+		if _, err := git(session, nil, "push", "-q", remote, "HEAD:refs/heads/"+gitHistoryBranch); err != nil {
+			logger.Error("failed to push git history", "session", session, "err", err)
+		}
+	}
+	return commits[0], nil
+}
+
+// ticketCommitMessage describes the completed ticket, its number in a
+// trailer git log reads back.
+func ticketCommitMessage(cer *CmdResults) string {
+	input, _, _ := strings.Cut(cer.Input, "\n")
+	if len(input) > gitSubjectLength {
+		input = strings.ToValidUTF8(input[:gitSubjectLength], "") + "..."
+	}
+	subject := fmt.Sprintf("Ticket %d: %s", cer.Ticket, input)
+	if cer.ExitCode != nil {
+		subject += fmt.Sprintf(" (exit %d)", *cer.ExitCode)
+	}
+	return fmt.Sprintf("%s\n\nTicket: %d\nSession: %s\n", subject, cer.Ticket, cer.Session)
+}
+
+// gitLog returns up to n commits reachable from rev, newest first, with the
+// files each changed.
+func gitLog(session, rev string, n int) ([]*GitCommit, error) {
+	const sep = "\x1e"
+	out, err := git(session, nil, "log", "-n", strconv.Itoa(n), "--name-only",
+		"--format="+sep+"%H%x00%ct%x00%s%x00%(trailers:key=Ticket,valueonly)", rev, "--")
+	if err != nil {
+		return nil, err
+	}
+	commits := []*GitCommit{}
+	for _, entry := range strings.Split(out, sep) {
+		fields := strings.SplitN(entry, "\x00", 4)
+		if len(fields) < 4 {
+			continue
+		}
+		sec, _ := strconv.ParseInt(fields[1], 10, 64)
+		c := &GitCommit{Commit: fields[0], Session: session, Subject: fields[2], Time: time.Unix(sec, 0).UTC()}
+		trailer, files, _ := strings.Cut(fields[3], "\n")
+		c.Ticket, _ = strconv.Atoi(strings.TrimSpace(trailer))
+		for _, f := range strings.Split(files, "\n") {
+			if f = strings.TrimSpace(f); f != "" {
+				c.Files = append(c.Files, f)
+			}
+		}
+		commits = append(commits, c)
+	}
+	return commits, nil
+}
+
+// moveGitHistory follows a session rename.
+func moveGitHistory(session, to string) {
+	gitHistoryMu.Lock()
+	defer gitHistoryMu.Unlock()
+	if _, err := os.Stat(gitHistoryPath(session)); err != nil {
+		return
+	}
+	if err := os.Rename(gitHistoryPath(session), gitHistoryPath(to)); err != nil {
+		logger.Error("failed to move git history", "session", session, "to", to, "err", err)
+	}
+}
+
+// gitHistoryHandler lists the session's commits (GET), shows one with its
+// diff (GET with commit) or commits a snapshot now (POST).
+func gitHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// Validate the hash parameter
+	hashParam := r.URL.Query().Get("hash")
+	if !checkHash(r, hashParam) {
+		writeError(w, errHashMessage)
+		return
+	}
+
+	if !gitHistory {
+		writeError(w, errGitHistoryOff)
+		return
+	}
+
+	session := r.URL.Query().Get("session")
+	if !validSessionName(session) {
+		writeError(w, errSessionMessage)
+		return
+	}
+
+	var resp interface{}
+	switch r.Method {
+	case http.MethodGet:
+		if _, err := os.Stat(gitHistoryPath(session)); err != nil {
+			writeError(w, errGitHistoryMissing)
+			return
+		}
+		if commit := r.URL.Query().Get("commit"); commit != "" {
+			if !gitCommitRe.MatchString(commit) {
+				writeError(w, errGitCommitMessage)
+				return
+			}
+			patch, err := git(session, nil, "show", "--format=fuller", "--patch-with-stat", commit, "--")
+			if err != nil {
+				writeError(w, notFoundf("Commit %s not found", commit))
+				return
+			}
+			setFormatContentType(w, formatText)
+			fmt.Fprintln(w, patch)
+			return
+		}
+		limit := gitLogDefault
+		if v := r.URL.Query().Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > gitLogMax {
+				writeError(w, errLimitMessage)
+				return
+			}
+			limit = n
+		}
+		commits, err := gitLog(session, "HEAD", limit)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		resp = commits
+
+	case http.MethodPost:
+		message := r.URL.Query().Get("message")
+		if message == "" {
+			message = "Snapshot"
+		}
+		commit, err := commitGitHistory(session, message)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		logFrom(r.Context()).Info("git history snapshot", "session", session, "commit", commit.Commit)
+		resp = commit
+
+	default:
+		writeError(w, errMethodMessage)
+		return
+	}
+
+	jsonResp, err := json.Marshal(resp)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to marshal JSON response: %v", err)
+		writeJsonError(w, msg)
+		return
+	}
+
+	fmt.Fprint(w, string(jsonResp))
+}
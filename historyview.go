@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	formatHTML = "html"
+
+	// Outputs longer than this start collapsed in the HTML history
+	collapseLines = 25
+	collapseBytes = 4000
+)
+
+// historyEntry is one ticket as shown in the HTML history.
+type historyEntry struct {
+	*CmdResults
+	Lines     int
+	Collapsed bool
+	JSONURL   string
+}
+
+// writeHistoryHTML renders a session's history for humans reviewing an agent
+// run, with links back to the raw and JSON forms.
+func writeHistoryHTML(w http.ResponseWriter, r *http.Request, session string, responses []*CmdResults, notes []*Note) {
+	hash := r.URL.Query().Get("hash")
+	formatURL := func(format string) string {
+		q := url.Values{"hash": {hash}, "session": {session}, "format": {format}}
+		if notes != nil {
+			q.Set("notes", "1")
+		}
+		return basePath + r.URL.Path + "?" + q.Encode()
+	}
+
+	entries := make([]historyEntry, 0, len(responses))
+	for _, res := range responses {
+		lines := strings.Count(res.Output, "\n")
+		entries = append(entries, historyEntry{
+			CmdResults: res,
+			Lines:      lines,
+			Collapsed:  lines > collapseLines || len(res.Output) > collapseBytes,
+			JSONURL:    Callback(r.Context(), res.Session, res.Ticket),
+		})
+	}
+
+	renderDashboard(w, r, "history", fmt.Sprintf("History %s", session), map[string]interface{}{
+		"Session": session,
+		"Entries": entries,
+		"Notes":   notes,
+		"RawURL":  formatURL(formatText),
+		"JSONURL": formatURL(formatJSON),
+	})
+}
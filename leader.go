@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Clustered controllers run active/standby: the instance holding the lease
+// in LEADER_LEASE, a file on storage every instance shares, serves requests
+// and owns the agents, placements, webhooks and watches. Standbys answer
+// 503 until the leader stops renewing the lease, then one of them takes it
+// over and reloads the shared DATA_DIR state before serving.
+
+const (
+	leaseRenewInterval = 5 * time.Second
+	leaseTTL           = 3 * leaseRenewInterval
+
+	roleLeader  = "leader"
+	roleStandby = "standby"
+)
+
+var (
+	errStandbyMessage = newKindError(errUnavailable, "This instance is a standby, send requests to the leader")
+)
+
+var (
+	leaderLease string // LEADER_LEASE, "" when not clustered
+	instanceID  string
+	leading     atomic.Bool
+
+	electMu  sync.Mutex
+	resigned bool // set on shutdown, no more elections
+)
+
+type leaseRecord struct {
+	Holder  string    `json:"holder"`
+	Expires time.Time `json:"expires"`
+}
+
+// loadLeader reads LEADER_LEASE and, when set, runs the first election so
+// the first instance up serves right away.
+func loadLeader() error {
+	leaderLease = os.Getenv("LEADER_LEASE")
+	if leaderLease == "" {
+		leading.Store(true)
+		return nil
+	}
+	if info, err := os.Stat(filepath.Dir(leaderLease)); err != nil || !info.IsDir() {
+		return fmt.Errorf("LEADER_LEASE must be a file in an existing directory: %s", leaderLease)
+	}
+	host, _ := os.Hostname()
+	instanceID = fmt.Sprintf("%s-%d-%s", host, os.Getpid(), newID())
+	electLeader()
+	go func() {
+		for range time.Tick(leaseRenewInterval) {
+			electLeader()
+		}
+	}()
+	return nil
+}
+
+// electLeader renews the lease when this instance holds it, and tries to
+// take it over once it expires.
+func electLeader() {
+	electMu.Lock()
+	defer electMu.Unlock()
+	if resigned {
+		return
+	}
+
+	rec, err := readLease()
+	switch {
+	case err == nil && rec.Holder == instanceID:
+		if err := writeLease(); err != nil {
+			logger.Error("failed to renew leader lease", "err", err)
+			if time.Now().After(rec.Expires) {
+				stepDown("lease expired")
+			}
+		}
+	case err == nil && time.Now().Before(rec.Expires):
+		stepDown("lease held by " + rec.Holder)
+	default:
+		// Missing, unreadable or expired: whoever links theirs in first wins
+		if err == nil {
+			os.Remove(leaderLease)
+		}
+		if err := acquireLease(); err != nil {
+			if !errors.Is(err, os.ErrExist) {
+				logger.Warn("failed to acquire leader lease", "err", err)
+			}
+			return
+		}
+		becomeLeader()
+	}
+}
+
+func readLease() (*leaseRecord, error) {
+	data, err := os.ReadFile(leaderLease)
+	if err != nil {
+		return nil, err
+	}
+	rec := &leaseRecord{}
+	return rec, json.Unmarshal(data, rec)
+}
+
+func writeLeaseTmp() (string, error) {
+	data, err := json.Marshal(&leaseRecord{Holder: instanceID, Expires: time.Now().Add(leaseTTL)})
+	if err != nil {
+		return "", err
+	}
+	tmp := leaderLease + "." + instanceID
+	return tmp, os.WriteFile(tmp, data, 0644)
+}
+
+// writeLease renews the lease this instance holds.
+func writeLease() error {
+	tmp, err := writeLeaseTmp()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, leaderLease)
+}
+
+// acquireLease links a new lease into place, failing if one exists.
+func acquireLease() error {
+	tmp, err := writeLeaseTmp()
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	return os.Link(tmp, leaderLease)
+}
+
+// becomeLeader reloads the state the previous leader may have changed
+// before serving.
+func becomeLeader() {
+	if leading.Load() {
+		return
+	}
+	if err := loadWebhooks(); err != nil {
+		logger.Error("failed to load webhooks", "err", err)
+	}
+	if err := loadPlacements(); err != nil {
+		logger.Error("failed to load placements", "err", err)
+	}
+	if err := loadNotifyRules(); err != nil {
+		logger.Error("failed to load notification rules", "err", err)
+	}
+	leading.Store(true)
+	logger.Info("became leader", "instance", instanceID)
+}
+
+// stepDown stops serving and closes the agents' parked tunnels so they
+// redial, reaching the leader.
+func stepDown(reason string) {
+	if !leading.Swap(false) {
+		return
+	}
+	logger.Warn("stepped down as leader", "instance", instanceID, "reason", reason)
+	tunnelMu.Lock()
+	for name, p := range tunnels {
+		for len(p.conns) > 0 {
+			(<-p.conns).Close()
+		}
+		delete(tunnels, name)
+	}
+	tunnelMu.Unlock()
+}
+
+// releaseLease gives the lease up on shutdown, once commands have drained,
+// so a standby takes over without waiting for it to expire.
+func releaseLease() {
+	if leaderLease == "" {
+		return
+	}
+	electMu.Lock()
+	defer electMu.Unlock()
+	resigned = true
+	if rec, err := readLease(); err == nil && rec.Holder == instanceID {
+		stepDown("shutting down")
+		os.Remove(leaderLease)
+	}
+}
+
+// withLeadership answers 503 on a standby, except for /leader.
+func withLeadership(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if leading.Load() || r.URL.Path == "/leader" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Retry-After", fmt.Sprint(int(leaseRenewInterval.Seconds())))
+		if strings.HasPrefix(r.URL.Path, apiVersionPrefix+"/") {
+			writeError(&v1Writer{ResponseWriter: w, path: r.URL.Path}, errStandbyMessage)
+			return
+		}
+		writeError(w, errStandbyMessage)
+	})
+}
+
+// leaderHandler reports the instance's role, 200 for the leader and 503
+// for a standby, for load balancer health checks.
+func leaderHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	role := roleLeader
+	if !leading.Load() {
+		role = roleStandby
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	fmt.Fprintf(w, `{"role":%q}`, role)
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A command can run with a lower CPU priority (nice), a lower IO priority
+// (ionice) and ulimits on its open files, core dumps and CPU seconds, set
+// on /shell or as the session's defaults in /sessions/limits, which a
+// request overrides one by one. They are set by the shell the command runs
+// in before anything else, so every process it starts inherits them. renice
+// and ionice must be installed where the command runs. A shared shell would
+// keep them for every later command, so the tmux backend refuses them.
+//
+// The defaults are stored in SESSIONS_DIR/<session>/limits.json, so they
+// travel with session exports.
+
+const (
+	limitsFile = "limits.json"
+
+	ioniceIdle       = "idle"
+	ioniceBestEffort = "best-effort"
+	ioniceRealtime   = "realtime"
+)
+
+var (
+	errNiceMessage   = paramError("nice", "Invalid 'nice' parameter, use -20 to 19")
+	errIoniceMessage = paramError("ionice", "Invalid 'ionice' parameter, use idle, best-effort[:0-7] or realtime[:0-7]")
+	errNofileMessage = paramError("nofile", "Invalid 'nofile' parameter")
+	errCoreMessage   = paramError("core", "Invalid 'core' parameter")
+	errCPUMessage    = paramError("cpu", "Invalid 'cpu' parameter")
+	errLimitsShared  = newKindError(errConflict, "Resource limits need a backend that starts a shell per command, the tmux shell is shared")
+	errLimitsEmpty   = paramError("nice", "Pass at least one of 'nice', 'ionice', 'nofile', 'core' or 'cpu'")
+)
+
+// ResourceLimits are the priorities and ulimits a command runs with, unset
+// fields are left as the shell has them.
+type ResourceLimits struct {
+	Nice   *int   `json:"nice,omitempty"`   // -20 (highest priority) to 19, below 0 needs root
+	Ionice string `json:"ionice,omitempty"` // idle, best-effort[:0-7] or realtime[:0-7]
+	Nofile *int   `json:"nofile,omitempty"` // open files
+	Core   *int   `json:"core,omitempty"`   // core dump size in KiB, 0 disables them
+	CPU    *int   `json:"cpu,omitempty"`    // CPU seconds before the command is killed
+}
+
+// SessionLimits is a session's default limits.
+type SessionLimits struct {
+	Type    string `json:"type"`
+	Session string `json:"session"`
+	ResourceLimits
+}
+
+// limitsMu serializes the read, modify and write of limits files.
+var limitsMu sync.Mutex
+
+func (l ResourceLimits) empty() bool {
+	return l.Nice == nil && l.Ionice == "" && l.Nofile == nil && l.Core == nil && l.CPU == nil
+}
+
+// validate checks the limits, returning the message of the first bad one.
+func (l ResourceLimits) validate() error {
+	if l.Nice != nil && (*l.Nice < -20 || *l.Nice > 19) {
+		return errNiceMessage
+	}
+	if l.Ionice != "" {
+		if _, _, ok := parseIonice(l.Ionice); !ok {
+			return errIoniceMessage
+		}
+	}
+	if l.Nofile != nil && *l.Nofile < 1 {
+		return errNofileMessage
+	}
+	if l.Core != nil && *l.Core < 0 {
+		return errCoreMessage
+	}
+	if l.CPU != nil && *l.CPU < 1 {
+		return errCPUMessage
+	}
+	return nil
+}
+
+// over returns l with the fields o sets replaced.
+func (l ResourceLimits) over(o ResourceLimits) ResourceLimits {
+	if o.Nice != nil {
+		l.Nice = o.Nice
+	}
+	if o.Ionice != "" {
+		l.Ionice = o.Ionice
+	}
+	if o.Nofile != nil {
+		l.Nofile = o.Nofile
+	}
+	if o.Core != nil {
+		l.Core = o.Core
+	}
+	if o.CPU != nil {
+		l.CPU = o.CPU
+	}
+	return l
+}
+
+// parseIonice returns the ionice class number and level, -1 without one.
+func parseIonice(s string) (int, int, bool) {
+	name, level, hasLevel := strings.Cut(s, ":")
+	class := map[string]int{ioniceRealtime: 1, ioniceBestEffort: 2, ioniceIdle: 3}[name]
+	if class == 0 {
+		return 0, 0, false
+	}
+	if !hasLevel {
+		return class, -1, true
+	}
+	n, err := strconv.Atoi(level)
+	if err != nil || n < 0 || n > 7 || class == 3 {
+		return 0, 0, false
+	}
+	return class, n, true
+}
+
+// prelude returns the shell lines setting the limits on the shell the
+// command runs in, which exit when one can't be set.
+func (l ResourceLimits) prelude() string {
+	var b strings.Builder
+	for _, u := range []struct {
+		flag  string
+		value *int
+	}{{"-n", l.Nofile}, {"-c", l.Core}, {"-t", l.CPU}} {
+		if u.value != nil {
+			fmt.Fprintf(&b, "ulimit %s %d || exit 1\n", u.flag, *u.value)
+		}
+	}
+	if l.Nice != nil {
+		fmt.Fprintf(&b, "renice -n %d -p $$ >/dev/null || exit 1\n", *l.Nice)
+	}
+	if class, level, ok := parseIonice(l.Ionice); ok {
+		if level >= 0 {
+			fmt.Fprintf(&b, "ionice -c %d -n %d -p $$ || exit 1\n", class, level)
+		} else {
+			fmt.Fprintf(&b, "ionice -c %d -p $$ || exit 1\n", class)
+		}
+	}
+	return b.String()
+}
+
+// limitParams reads nice, ionice, nofile, core and cpu from the query
+// string, without validating them.
+func limitParams(r *http.Request) (ResourceLimits, error) {
+	q := r.URL.Query()
+	l := ResourceLimits{Ionice: q.Get("ionice")}
+	for _, p := range []struct {
+		name string
+		dst  **int
+		err  error
+	}{{"nice", &l.Nice, errNiceMessage}, {"nofile", &l.Nofile, errNofileMessage}, {"core", &l.Core, errCoreMessage}, {"cpu", &l.CPU, errCPUMessage}} {
+		if v := q.Get(p.name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return l, p.err
+			}
+			*p.dst = &n
+		}
+	}
+	return l, nil
+}
+
+// readSessionLimits returns the session's default limits.
+func readSessionLimits(session string) (ResourceLimits, error) {
+	var l ResourceLimits
+	data, err := os.ReadFile(filepath.Join(sessionsDir, session, limitsFile))
+	if os.IsNotExist(err) {
+		return l, nil
+	}
+	if err != nil {
+		return l, err
+	}
+	if err := json.Unmarshal(data, &l); err != nil {
+		return l, fmt.Errorf("Failed to read limits: %v", err)
+	}
+	return l, nil
+}
+
+// setSessionLimits changes the fields of the session's defaults o sets, or
+// clears them all when o is nil.
+func setSessionLimits(session string, o *ResourceLimits) (*SessionLimits, error) {
+	limitsMu.Lock()
+	defer limitsMu.Unlock()
+
+	path := filepath.Join(sessionsDir, session, limitsFile)
+	if o == nil {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("Failed to save limits: %v", err)
+		}
+		return &SessionLimits{Type: "limits", Session: session}, nil
+	}
+	l, err := readSessionLimits(session)
+	if err != nil {
+		return nil, err
+	}
+	l = l.over(*o)
+	data, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		return nil, fmt.Errorf("Failed to save limits: %v", err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return nil, fmt.Errorf("Failed to save limits: %v", err)
+	}
+	return &SessionLimits{Type: "limits", Session: session, ResourceLimits: l}, nil
+}
+
+// commandLimits returns the limits the session's command runs with, its
+// own over the session's defaults.
+func commandLimits(session string, own ResourceLimits) (ResourceLimits, error) {
+	defaults, err := readSessionLimits(session)
+	if err != nil {
+		return own, err
+	}
+	l := defaults.over(own)
+	if !l.empty() && activeExecutor.persistent() {
+		return l, errLimitsShared
+	}
+	return l, nil
+}
+
+// sessionLimitsHandler shows (GET), changes (POST) or clears (DELETE) the
+// session's default limits.
+func sessionLimitsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// Validate the hash parameter
+	hashParam := r.URL.Query().Get("hash")
+	if !checkHash(r, hashParam) {
+		writeError(w, errHashMessage)
+		return
+	}
+
+	session := r.URL.Query().Get("session")
+	if !validSessionName(session) {
+		writeError(w, errSessionMessage)
+		return
+	}
+	if !sessionExists(session) {
+		writeError(w, errSessionNotFound)
+		return
+	}
+
+	var resp *SessionLimits
+	switch r.Method {
+	case http.MethodGet:
+		l, err := readSessionLimits(session)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		resp = &SessionLimits{Type: "limits", Session: session, ResourceLimits: l}
+
+	case http.MethodPost, http.MethodPut:
+		l, err := limitParams(r)
+		if err == nil {
+			err = l.validate()
+		}
+		if err == nil && l.empty() {
+			err = errLimitsEmpty
+		}
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		if resp, err = setSessionLimits(session, &l); err != nil {
+			writeError(w, err)
+			return
+		}
+		logFrom(r.Context()).Info("session limits set", "session", session)
+
+	case http.MethodDelete:
+		var err error
+		if resp, err = setSessionLimits(session, nil); err != nil {
+			writeError(w, err)
+			return
+		}
+		logFrom(r.Context()).Info("session limits cleared", "session", session)
+
+	default:
+		writeError(w, errMethodMessage)
+		return
+	}
+
+	jsonResp, err := json.Marshal(resp)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to marshal JSON response: %v", err)
+		writeJsonError(w, msg)
+		return
+	}
+
+	fmt.Fprint(w, string(jsonResp))
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func intp(n int) *int {
+	return &n
+}
+
+func TestParseIonice(t *testing.T) {
+	tests := []struct {
+		in           string
+		class, level int
+		ok           bool
+	}{
+		{"idle", 3, -1, true},
+		{"best-effort", 2, -1, true},
+		{"best-effort:0", 2, 0, true},
+		{"best-effort:7", 2, 7, true},
+		{"realtime", 1, -1, true},
+		{"realtime:4", 1, 4, true},
+		{"best-effort:8", 0, 0, false},
+		{"best-effort:-1", 0, 0, false},
+		{"best-effort:", 0, 0, false},
+		{"best-effort:x", 0, 0, false},
+		{"best-effort:1;reboot", 0, 0, false},
+		{"idle:1", 0, 0, false},
+		{"", 0, 0, false},
+		{"none", 0, 0, false},
+		{"2", 0, 0, false},
+		{"IDLE", 0, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			class, level, ok := parseIonice(tt.in)
+			if ok != tt.ok || class != tt.class || level != tt.level {
+				t.Fatalf("parseIonice(%q) = %d, %d, %v, want %d, %d, %v", tt.in, class, level, ok, tt.class, tt.level, tt.ok)
+			}
+		})
+	}
+}
+
+func TestResourceLimitsValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		limits ResourceLimits
+		err    error
+	}{
+		{"none", ResourceLimits{}, nil},
+		{"lowest nice", ResourceLimits{Nice: intp(-20)}, nil},
+		{"highest nice", ResourceLimits{Nice: intp(19)}, nil},
+		{"nice too low", ResourceLimits{Nice: intp(-21)}, errNiceMessage},
+		{"nice too high", ResourceLimits{Nice: intp(20)}, errNiceMessage},
+		{"ionice", ResourceLimits{Ionice: "best-effort:7"}, nil},
+		{"bad ionice", ResourceLimits{Ionice: "best-effort:8"}, errIoniceMessage},
+		{"nofile", ResourceLimits{Nofile: intp(1)}, nil},
+		{"no nofile", ResourceLimits{Nofile: intp(0)}, errNofileMessage},
+		{"no core", ResourceLimits{Core: intp(0)}, nil},
+		{"negative core", ResourceLimits{Core: intp(-1)}, errCoreMessage},
+		{"cpu", ResourceLimits{CPU: intp(1)}, nil},
+		{"no cpu", ResourceLimits{CPU: intp(0)}, errCPUMessage},
+		{"first bad one", ResourceLimits{Nice: intp(99), CPU: intp(0)}, errNiceMessage},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.limits.validate(); err != tt.err {
+				t.Fatalf("validate() = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestLimitParams(t *testing.T) {
+	tests := []struct {
+		query string
+		err   error
+	}{
+		{"nice=5&ionice=idle&nofile=1024&core=0&cpu=60", nil},
+		{"nice=-5", nil},
+		{"nice=low", errNiceMessage},
+		{"nice=1.5", errNiceMessage},
+		{"nice=5%3Breboot", errNiceMessage},
+		{"nofile=many", errNofileMessage},
+		{"core=", nil},
+		{"core=big", errCoreMessage},
+		{"cpu=1e3", errCPUMessage},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			if _, err := limitParams(httptest.NewRequest("POST", "/shell?"+tt.query, nil)); err != tt.err {
+				t.Fatalf("limitParams() = %v, want %v", err, tt.err)
+			}
+		})
+	}
+
+	l, err := limitParams(httptest.NewRequest("POST", "/shell?nice=5&ionice=realtime:2&cpu=60", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Nice == nil || *l.Nice != 5 || l.Ionice != "realtime:2" || l.CPU == nil || *l.CPU != 60 || l.Nofile != nil || l.Core != nil {
+		t.Fatalf("limitParams() = %+v", l)
+	}
+}
+
+func TestResourceLimitsPrelude(t *testing.T) {
+	tests := []struct {
+		name   string
+		limits ResourceLimits
+		want   string
+	}{
+		{"none", ResourceLimits{}, ""},
+		{"ulimits", ResourceLimits{Nofile: intp(1024), Core: intp(0), CPU: intp(60)},
+			"ulimit -n 1024 || exit 1\nulimit -c 0 || exit 1\nulimit -t 60 || exit 1\n"},
+		{"nice", ResourceLimits{Nice: intp(-5)}, "renice -n -5 -p $$ >/dev/null || exit 1\n"},
+		{"ionice class", ResourceLimits{Ionice: "idle"}, "ionice -c 3 -p $$ || exit 1\n"},
+		{"ionice level", ResourceLimits{Ionice: "best-effort:7"}, "ionice -c 2 -n 7 -p $$ || exit 1\n"},
+		{"bad ionice left out", ResourceLimits{Ionice: "best-effort:1; reboot"}, ""},
+		{"all", ResourceLimits{Nice: intp(10), Ionice: "realtime:0", Nofile: intp(64), Core: intp(1), CPU: intp(5)},
+			"ulimit -n 64 || exit 1\nulimit -c 1 || exit 1\nulimit -t 5 || exit 1\n" +
+				"renice -n 10 -p $$ >/dev/null || exit 1\nionice -c 1 -n 0 -p $$ || exit 1\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.limits.prelude(); got != tt.want {
+				t.Fatalf("prelude() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResourceLimitsOver(t *testing.T) {
+	defaults := ResourceLimits{Nice: intp(10), Ionice: "idle", CPU: intp(60)}
+	l := defaults.over(ResourceLimits{Nice: intp(0), Nofile: intp(256)})
+	if *l.Nice != 0 || l.Ionice != "idle" || *l.CPU != 60 || *l.Nofile != 256 || l.Core != nil {
+		t.Fatalf("over() = %+v", l)
+	}
+	if *defaults.Nice != 10 || defaults.Nofile != nil {
+		t.Fatalf("over() changed the defaults: %+v", defaults)
+	}
+}
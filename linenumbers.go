@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// linenumbers=1 numbers the lines of a command's output as it is saved, so
+// the numbers are part of the ticket and stay the same however the output
+// is read later: trimmed, paged, diffed or in the history. An agent can
+// then point at "line 143 of ticket 7". Numbers are right aligned and
+// separated from the line by a tab, like cat -n.
+
+// numberLines prefixes each line of s with its number.
+func numberLines(s string) string {
+	lines := splitLines(s)
+	width := len(fmt.Sprint(len(lines)))
+	var b strings.Builder
+	for i, line := range lines {
+		fmt.Fprintf(&b, "%*d\t%s", width, i+1, line)
+	}
+	return b.String()
+}
+
+// numberResult numbers the result's output.
+func numberResult(res *CmdResults) {
+	res.Output = numberLines(res.Output)
+	res.Tokens = estimateTokens(res.Output)
+	res.LineNumbers = true
+}
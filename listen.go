@@ -0,0 +1,363 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultSocketMode = 0660
+
+	authHash = "hash" // requests carry HASH or ADMIN_HASH
+	authNone = "none" // every request is trusted as if it carried HASH
+	authMTLS = "mtls" // a verified client certificate stands in for HASH
+)
+
+// listenSpec is one address the server accepts connections on and the auth
+// policy for requests arriving through it.
+type listenSpec struct {
+	Network   string // tcp or unix
+	Addr      string
+	Mode      os.FileMode
+	Auth      string
+	NoAdmin   bool // refuse the dashboard, /admin and /debug endpoints
+	ReusePort bool
+	TLSCert   string
+	TLSKey    string
+	ClientCA  string
+}
+
+// defaultListenSpec applies to systemd sockets and the agent tunnel.
+var defaultListenSpec = &listenSpec{Auth: authHash}
+
+type listenContextKey struct{}
+
+// loadListeners builds the listeners from PORT, UNIX_SOCKET and LISTEN.
+func loadListeners() ([]*listenSpec, error) {
+	var specs []*listenSpec
+	if p := os.Getenv("PORT"); p != "" {
+		specs = append(specs, &listenSpec{Network: "tcp", Addr: ":" + p, Auth: authHash})
+	}
+	if path := os.Getenv("UNIX_SOCKET"); path != "" {
+		mode, err := parseSocketMode(os.Getenv("UNIX_SOCKET_MODE"))
+		if err != nil {
+			return nil, err
+		}
+		specs = append(specs, &listenSpec{Network: "unix", Addr: path, Mode: mode, Auth: authHash})
+	}
+	for _, entry := range strings.Split(os.Getenv("LISTEN"), ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		spec, err := parseListenSpec(entry)
+		if err != nil {
+			return nil, fmt.Errorf("LISTEN %q: %v", strings.TrimSpace(entry), err)
+		}
+		specs = append(specs, spec)
+	}
+	return specs, nil
+}
+
+// parseListenSpec parses an address followed by key=value options, e.g.
+// ":8443 tls_cert=cert.pem tls_key=key.pem admin=false".
+func parseListenSpec(entry string) (*listenSpec, error) {
+	fields := strings.Fields(entry)
+	spec := &listenSpec{Network: "tcp", Addr: fields[0], Mode: defaultSocketMode, Auth: authHash}
+	if path, ok := strings.CutPrefix(spec.Addr, "unix:"); ok {
+		spec.Network, spec.Addr = "unix", path
+		if path == "" {
+			return nil, fmt.Errorf("missing socket path")
+		}
+	} else if _, _, err := net.SplitHostPort(spec.Addr); err != nil {
+		return nil, fmt.Errorf("address must be host:port or unix:/path")
+	}
+
+	for _, opt := range fields[1:] {
+		key, value, _ := strings.Cut(opt, "=")
+		var err error
+		switch key {
+		case "auth":
+			if value != authHash && value != authNone && value != authMTLS {
+				return nil, fmt.Errorf("auth must be hash, none or mtls")
+			}
+			spec.Auth = value
+		case "admin":
+			var admin bool
+			admin, err = strconv.ParseBool(value)
+			spec.NoAdmin = !admin
+		case "reuseport":
+			spec.ReusePort, err = strconv.ParseBool(value)
+		case "mode":
+			spec.Mode, err = parseSocketMode(value)
+		case "tls_cert":
+			spec.TLSCert = value
+		case "tls_key":
+			spec.TLSKey = value
+		case "client_ca":
+			spec.ClientCA = value
+		default:
+			return nil, fmt.Errorf("unknown option %q", key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", key, err)
+		}
+	}
+
+	if (spec.TLSCert == "") != (spec.TLSKey == "") {
+		return nil, fmt.Errorf("tls_cert and tls_key must be set together")
+	}
+	if spec.ClientCA != "" && spec.TLSCert == "" {
+		return nil, fmt.Errorf("client_ca requires tls_cert and tls_key")
+	}
+	if spec.Auth == authMTLS && spec.ClientCA == "" {
+		return nil, fmt.Errorf("auth=mtls requires client_ca")
+	}
+	return spec, nil
+}
+
+func (spec *listenSpec) String() string {
+	if spec.Network == "unix" {
+		return "unix:" + spec.Addr
+	}
+	return spec.Addr
+}
+
+// tlsConfig loads the certificates, nil when the listener is plain HTTP.
+// A client_ca makes a verified client certificate mandatory.
+func (spec *listenSpec) tlsConfig() (*tls.Config, error) {
+	if spec.TLSCert == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(spec.TLSCert, spec.TLSKey)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if spec.ClientCA != "" {
+		pem, err := os.ReadFile(spec.ClientCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", spec.ClientCA)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+// listen opens the listener, wrapped so requests through it carry spec.
+func (spec *listenSpec) listen() (net.Listener, error) {
+	cfg, err := spec.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	var ln net.Listener
+	if spec.Network == "unix" {
+		ln, err = listenUnix(spec.Addr, spec.Mode)
+	} else {
+		lc := net.ListenConfig{}
+		if spec.ReusePort {
+			lc.Control = reusePort
+		}
+		ln, err = lc.Listen(context.Background(), "tcp", spec.Addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ln = &specListener{Listener: ln, spec: spec}
+	if cfg != nil {
+		ln = tls.NewListener(ln, cfg)
+	}
+	return ln, nil
+}
+
+type specListener struct {
+	net.Listener
+	spec *listenSpec
+}
+
+type specConn struct {
+	net.Conn
+	spec *listenSpec
+}
+
+func (l *specListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &specConn{Conn: c, spec: l.spec}, nil
+}
+
+// listenConnContext puts the accepting listener's spec in the context of
+// every request on the connection.
+func listenConnContext(ctx context.Context, c net.Conn) context.Context {
+	if tc, ok := c.(*tls.Conn); ok {
+		c = tc.NetConn()
+	}
+	if sc, ok := c.(*specConn); ok {
+		return context.WithValue(ctx, listenContextKey{}, sc.spec)
+	}
+	return ctx
+}
+
+// listenFrom returns the spec of the listener the request arrived on.
+func listenFrom(ctx context.Context) *listenSpec {
+	if spec, ok := ctx.Value(listenContextKey{}).(*listenSpec); ok {
+		return spec
+	}
+	return defaultListenSpec
+}
+
+// trustedListener reports whether the listener authenticates requests
+// itself, by trusting them all or by a verified client certificate, or the
+// controller vouched for a request through the agent tunnel.
+func trustedListener(r *http.Request) bool {
+	if viaController(r.Context()) {
+		return true
+	}
+	switch listenFrom(r.Context()).Auth {
+	case authNone:
+		return true
+	case authMTLS:
+		return r.TLS != nil && len(r.TLS.VerifiedChains) > 0
+	}
+	return false
+}
+
+// withListenPolicy hides the admin endpoints on listeners with admin=false.
+func withListenPolicy(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if listenFrom(r.Context()).NoAdmin && isAdminPath(r.URL.Path) {
+			writeError(w, errNotFoundMessage)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func isAdminPath(p string) bool {
+	return p == "/admin" || strings.HasPrefix(p, "/admin/") || strings.HasPrefix(p, "/debug/")
+}
+
+// isLoopback reports whether a TCP listen address only accepts local
+// connections.
+func isLoopback(addr string) bool {
+	host, _, _ := net.SplitHostPort(addr)
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// listenUnix listens on a Unix domain socket whose file mode decides which
+// local users may connect.
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	// A socket left behind by an unclean exit blocks the bind
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+func parseSocketMode(v string) (os.FileMode, error) {
+	if v == "" {
+		return defaultSocketMode, nil
+	}
+	m, err := strconv.ParseUint(v, 8, 32)
+	if err != nil || m > 0777 {
+		return 0, fmt.Errorf("UNIX_SOCKET_MODE must be an octal file mode: %q", v)
+	}
+	return os.FileMode(m), nil
+}
+
+// serve runs the server on every configured listener and returns the first
+// error.
+func serve(server *http.Server) error {
+	activated, err := systemdListeners()
+	if err != nil {
+		return err
+	}
+
+	errs := make(chan error, 2+len(activated)+len(listeners))
+	count := 0
+	server.ConnContext = listenConnContext
+
+	// The agent tunnel has no listener to close, so shutting down must end
+	// the wait here too
+	server.RegisterOnShutdown(func() { errs <- http.ErrServerClosed })
+
+	// Sockets passed by systemd replace PORT, UNIX_SOCKET and LISTEN
+	for _, ln := range activated {
+		ln := ln
+		count++
+		logger.Info("starting server", "fqdn", fqdn, "systemd_socket", ln.Addr().String())
+		go func() { errs <- server.Serve(ln) }()
+	}
+
+	for _, spec := range listeners {
+		if len(activated) > 0 {
+			break
+		}
+		ln, err := spec.listen()
+		if err != nil {
+			return fmt.Errorf("failed to listen on %s: %v", spec, err)
+		}
+		if spec.Network == "unix" {
+			defer os.Remove(spec.Addr)
+		}
+		if spec.Auth == authNone && spec.Network == "tcp" && !isLoopback(spec.Addr) {
+			logger.Warn("listener accepts requests without a hash on a non-loopback address", "listen", spec.String())
+		}
+		count++
+		attrs := []any{"fqdn", fqdn, "listen", spec.String(), "tls", spec.TLSCert != "", "auth", spec.Auth, "admin", !spec.NoAdmin}
+		if spec.Network == "unix" {
+			attrs = append(attrs, "mode", fmt.Sprintf("%04o", spec.Mode))
+		}
+		logger.Info("starting server", attrs...)
+		go func() { errs <- server.Serve(ln) }()
+	}
+
+	if controllerURL != "" {
+		handler := server.Handler
+		if handler == nil {
+			handler = http.DefaultServeMux
+		}
+		count++
+		runAgent(handler)
+	}
+
+	if count == 0 {
+		return fmt.Errorf("no listeners configured")
+	}
+	sdNotify("READY=1")
+	runWatchdog()
+	return <-errs
+}
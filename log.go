@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	logCommands atomic.Bool // LOG_COMMANDS, include command lines in logs
+	logLevel    = new(slog.LevelVar)
+)
+
+type loggerContextKey struct{}
+
+// loadLogging configures the global logger from LOG_FORMAT (text or json)
+// and LOG_LEVEL (debug, info, warn or error), writing to w.
+func loadLogging(w io.Writer) error {
+	level, err := parseLogLevel(os.Getenv("LOG_LEVEL"))
+	if err != nil {
+		return err
+	}
+	logLevel.Set(level)
+	opts := &slog.HandlerOptions{Level: logLevel}
+
+	var handler slog.Handler
+	switch format := strings.ToLower(os.Getenv("LOG_FORMAT")); format {
+	case "", "text":
+		handler = slog.NewTextHandler(w, opts)
+	case "json":
+		handler = slog.NewJSONHandler(w, opts)
+	default:
+		return fmt.Errorf("LOG_FORMAT must be text or json: %q", format)
+	}
+
+	logger = slog.New(handler)
+	logCommands.Store(os.Getenv("LOG_COMMANDS") == "true")
+	transcriptLog.Store(os.Getenv("TRANSCRIPT_LOG") == "true")
+	recordSessions.Store(os.Getenv("RECORD_SESSIONS") == "true")
+	return nil
+}
+
+func parseLogLevel(v string) (slog.Level, error) {
+	level := slog.LevelInfo
+	if v != "" {
+		if err := level.UnmarshalText([]byte(v)); err != nil {
+			return level, fmt.Errorf("LOG_LEVEL must be debug, info, warn or error: %q", v)
+		}
+	}
+	return level, nil
+}
+
+// fatal logs at error level and exits, the slog counterpart of log.Fatal.
+func fatal(msg string, args ...any) {
+	logger.Error(msg, args...)
+	os.Exit(1)
+}
+
+// cmdAttr returns the command line as a log attribute, or only its length
+// unless LOG_COMMANDS is enabled since commands often carry secrets.
+func cmdAttr(cmd string) slog.Attr {
+	if logCommands.Load() {
+		return slog.String("cmd", cmd)
+	}
+	return slog.Int("cmd_len", len(cmd))
+}
+
+// logFrom returns the request scoped logger carried by ctx.
+func logFrom(ctx context.Context) *slog.Logger {
+	if l, ok := ctx.Value(loggerContextKey{}).(*slog.Logger); ok {
+		return l
+	}
+	return logger
+}
+
+// logRequest attaches a logger with the request's fields to its context, so
+// handlers can add the session and ticket, and logs each request once it
+// completes. The query string, and with it the hash, is never logged.
+func logRequest(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		l := logger.With("request_id", requestIDFrom(r.Context()), "method", r.Method, "path", r.URL.Path)
+
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		h(sw, r.WithContext(context.WithValue(r.Context(), loggerContextKey{}, l)))
+		l.Debug("request", "session", r.URL.Query().Get("session"), "status", sw.status, "duration_ms", time.Since(start).Milliseconds())
+	}
+}
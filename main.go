@@ -4,28 +4,33 @@ import (
 	"context"
 	"crypto/subtle"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"log"
+	"io/fs"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
-	"github.com/joho/godotenv" // For .env support
+	"github.com/jaredfolkins/grok-async-shell/pkg/cli"
 	"github.com/russross/blackfriday/v2"
 )
 
 var (
-	hashPassword string // Global variable for the hash password
-	fqdn         string // Global variable for the FQDN
-	port         string // Global variable for the port
-	sessionsDir  string // Global variable for the sessions directory
-	logger       = log.New(os.Stdout, "shellHandler: ", log.LstdFlags)
+	hashPassword settingString // Global variable for the hash password
+	fqdn         string        // Global variable for the FQDN
+	port         string        // Global variable for the port
+	sessionsDir  string        // Global variable for the sessions directory
+	initScript   settingString // Global variable for the server-level shell init script
+	dataDir      string        // Global variable for the server state directory
+	unixSocket   string        // Global variable for the optional unix socket path
+	listeners    []*listenSpec // Global variable for the PORT, UNIX_SOCKET and LISTEN listeners
+	logger       = slog.New(slog.NewTextHandler(os.Stdout, nil))
 )
 
 type TicketResponse struct {
@@ -37,32 +42,58 @@ type TicketResponse struct {
 }
 
 type CmdSubmission struct {
-	Type     string `json:"type"`
-	IsCached bool   `json:"cached"`
-	Ticket   int    `json:"ticket"`
-	Session  string `json:"session"`
-	Input    string `json:"input"`
-	Callback string `json:"callback"`
+	Type      string      `json:"type"`
+	IsCached  bool        `json:"cached"`
+	Ticket    int         `json:"ticket"`
+	Session   string      `json:"session"`
+	Input     string      `json:"input"`
+	Alias     string      `json:"alias,omitempty"`
+	Callback  string      `json:"callback"`
+	RequestID string      `json:"request_id,omitempty"`
+	Queued    *QueueState `json:"queued,omitempty"` // when it waits for the session's previous commands
 }
 
 type CmdResults struct {
-	Type    string `json:"type"`
-	Next    string `json:"next"`
-	Ticket  int    `json:"ticket"`
-	Session string `json:"session"`
-	Input   string `json:"input"`
-	Output  string `json:"output"`
+	Type            string            `json:"type"`
+	Next            string            `json:"next"`
+	Ticket          int               `json:"ticket"`
+	Session         string            `json:"session"`
+	Input           string            `json:"input"`
+	Alias           string            `json:"alias,omitempty"`
+	Output          string            `json:"output"`
+	OutputJSON      json.RawMessage   `json:"output_json,omitempty"`
+	Tokens          int               `json:"tokens,omitempty"`
+	LineNumbers     bool              `json:"line_numbers,omitempty"`
+	OmittedLines    int               `json:"omitted_lines,omitempty"`
+	OmittedTokens   int               `json:"omitted_tokens,omitempty"`
+	DiffFrom        int               `json:"diff_from,omitempty"`
+	Filter          string            `json:"filter,omitempty"`
+	Cont            string            `json:"cont,omitempty"`
+	ContinueURL     string            `json:"continue_url,omitempty"`
+	BudgetExhausted bool              `json:"budget_exhausted,omitempty"`
+	Summarized      bool              `json:"summarized,omitempty"`
+	FullOutput      string            `json:"full_output,omitempty"`
+	ExitCode        *int              `json:"exit_code,omitempty"`
+	Usage           *ResourceUsage    `json:"usage,omitempty"`
+	Expect          *ExpectResult     `json:"expect,omitempty"`  // how far the expect steps got
+	Backend         string            `json:"backend,omitempty"` // the SHELL_BACKEND that ran it
+	Artifacts       []Artifact        `json:"artifacts,omitempty"`
+	Iterations      []*WatchIteration `json:"iterations,omitempty"`
+	RequestID       string            `json:"request_id,omitempty"`
 }
 
 const (
-	callback          = "%s/callback?hash=%s&session=%s&ticket=%d"
-	errorMessage      = "An error occurred while processing your request."
-	errHashMessage    = "Invalid or missing 'hash' parameter"
-	errSessionMessage = "Invalid or missing 'session' parameter"
-	errTicketMessage  = "Invalid or missing 'ticket' parameter"
-	errCmdMessage     = "Invalid or missing 'cmd' parameter"
-	errMethodMessage  = "Method not allowed"
-	errServerMessage  = "Server error"
+	callback         = "%s/callback?hash=%s&session=%s&ticket=%d"
+	errorMessage     = "An error occurred while processing your request."
+	errServerMessage = "Server error"
+)
+
+var (
+	errHashMessage    error = &kindError{kind: errUnauthorized, msg: "Invalid or missing 'hash' parameter", param: "hash"}
+	errSessionMessage       = paramError("session", "Invalid or missing 'session' parameter")
+	errTicketMessage        = paramError("ticket", "Invalid or missing 'ticket' parameter")
+	errCmdMessage           = paramError("cmd", "Invalid or missing 'cmd' parameter")
+	errMethodMessage        = newKindError(errMethodNotAllowed, "Method not allowed")
 )
 
 func tm(h http.HandlerFunc) http.HandlerFunc {
@@ -82,82 +113,356 @@ func tm(h http.HandlerFunc) http.HandlerFunc {
 			return
 		case <-ctx.Done():
 			w.WriteHeader(http.StatusGatewayTimeout)
-			msg := "Request timeout exceeded"
-			writeJsonError(w, msg)
+			writeError(w, newKindError(errTimedOut, "Request timeout exceeded"))
 			return
 		}
 	}
 }
 
+// apiRoutes are the JSON endpoints, available both unversioned and under /v1.
+var apiRoutes = []struct {
+	path    string
+	handler http.HandlerFunc
+}{
+	{"/shell", shellHandler},
+	{"/history", historyHandler},
+	{"/history/git", gitHistoryHandler},
+	{"/tickets/prune", ticketsPruneHandler},
+	{"/sessions", sessionsHandler},
+	{"/sessions/rename", sessionRenameHandler},
+	{"/sessions/kill", sessionKillHandler},
+	{"/sessions/restart", sessionRestartHandler},
+	{"/sessions/export", sessionExportHandler},
+	{"/sessions/import", sessionImportHandler},
+	{"/sessions/templates", sessionTemplatesHandler},
+	{"/sessions/limits", sessionLimitsHandler},
+	{"/transcript", transcriptHandler},
+	{"/recording", recordingHandler},
+	{"/callback", callbackHandler},
+	{"/status", callbackHandler},
+	{"/ps", psHandler},
+	{"/ports", portsHandler},
+	{"/stats", statsHandler},
+	{"/queue", queueHandler},
+	{"/artifact", artifactHandler},
+	{"/watch", watchHandler},
+	{"/watch/stop", watchStopHandler},
+	{"/openapi.json", openAPIHandler},
+	{"/version", versionHandler},
+	{"/whoami", whoamiHandler},
+	{"/tools", toolsHandler},
+	{"/manifest.json", manifestHandler},
+	{"/actions.json", actionsHandler},
+	{"/.well-known/ai-plugin.json", aiPluginHandler},
+	{"/rpc", rpcHandler},
+	{"/webhooks", webhooksHandler},
+	{"/notifications", notificationsHandler},
+	{"/approvals", approvalsHandler},
+	{"/agents", agentsHandler},
+	{"/workspaces", workspacesHandler},
+	{"/workspaces/attach", workspaceAttachHandler},
+	{"/notes", notesHandler},
+	{"/aliases", aliasesHandler},
+	{"/search", searchHandler},
+	{"/suggest", suggestHandler},
+	{"/context/auto", briefingHandler},
+	{"/env", envHandler},
+	{"/checkpoints", checkpointsHandler},
+	{"/output", outputHandler},
+}
+
 func main() {
+	args := os.Args[1:]
+	command := "serve"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+
+	switch command {
+	case "serve":
+		runServe(args)
+	case "init":
+		os.Exit(runInit(args, os.Stdout, os.Stderr))
+	case "check":
+		os.Exit(runCheck(args, os.Stdout, os.Stderr))
+	case "version":
+		os.Exit(runVersion(args, os.Stdout, os.Stderr))
+	case "client":
+		os.Exit(cli.Run(args, os.Stdout, os.Stderr))
+	case "help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", command, usage)
+		os.Exit(2)
+	}
+}
+
+// runServe runs the server until it is shut down.
+func runServe(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	mcpStdio := fs.Bool("mcp", false, "serve the Model Context Protocol over stdio instead of HTTP")
+	setup := fs.Bool("setup", false, "without any configuration, write a .env from the flags and defaults instead of prompting")
+	config := registerConfigFlags(fs)
+	fs.Parse(args)
 
+	if err := config.apply(); err != nil {
+		fatal(err.Error())
+	}
+
+	// First run: set up instead of failing on the missing HASH
+	if needsSetup(config) && !*mcpStdio && (*setup || stdinTerminal()) {
+		if err := runSetup(config, os.Stdin, os.Stdout, !*setup); err != nil {
+			fatal(err.Error())
+		}
+	}
 	loadEnv()
 
-	lastCommand = &CmdCache{}
+	if err := loadWebhooks(); err != nil {
+		fatal("failed to load webhooks", "err", err)
+	}
+	if err := loadPlacements(); err != nil {
+		fatal("failed to load placements", "err", err)
+	}
+	loadSlack()
+	loadNATS()
+	loadTracing()
+	if err := loadNotifications(); err != nil {
+		fatal("failed to load notification rules", "err", err)
+	}
+
+	if *mcpStdio {
+		// stdout carries the protocol, keep logs off it
+		if err := loadLogging(os.Stderr); err != nil {
+			fatal(err.Error())
+		}
+		if err := serveMCPStdio(os.Stdin, os.Stdout); err != nil {
+			fatal("MCP server failed", "err", err)
+		}
+		return
+	}
+	if err := loadLeader(); err != nil {
+		fatal(err.Error())
+	}
+
+	reloadOnHangup()
+	reapOrphans()
+	recoverTmux()
+	recoverSessions()
+
 	listenAddr := fmt.Sprintf(":%s", port)
 
+	// A private mux keeps anything registered on http.DefaultServeMux, such
+	// as net/http/pprof's unauthenticated handlers, unreachable
+	mux := http.NewServeMux()
+
 	server := &http.Server{
 		Addr:              listenAddr,
-		Handler:           nil, // uses default mux
+		Handler:           withBasePath(withRequestID(withAudit(withListenPolicy(withLeadership(mux))))),
 		ReadTimeout:       60 * time.Second,
 		WriteTimeout:      60 * time.Second,
 		IdleTimeout:       120 * time.Second,
 		ReadHeaderTimeout: 20 * time.Second,
 	}
 	// Register handlers for the endpoints
-	http.HandleFunc("/", tm(readmeHandler))
-	http.HandleFunc("/shell", tm(shellHandler))
-	http.HandleFunc("/history", tm(historyHandler))
-	http.HandleFunc("/callback", tm(callbackHandler))
-	http.HandleFunc("/context", tm(contextHandler))
-	http.Handle("/assets/", http.StripPrefix("/assets/", http.FileServer(http.Dir("assets"))))
-	// Start the server using the PORT from .env
-	logger.Printf("Starting server with FQDN: %s on port %s", fqdn, port)
-	err := server.ListenAndServe()
-	if err != nil {
-		logger.Fatalf("Server failed: %v", err)
+	mux.HandleFunc("/", tm(readmeHandler))
+
+	// JSON API endpoints are also served under /v1 with the v1 error envelope
+	for _, rt := range apiRoutes {
+		mux.HandleFunc(rt.path, traceRequest(logRequest(compress(rt.path, tm(routeAgent(observe(rt.handler)))))))
+		mux.HandleFunc(apiVersionPrefix+rt.path, traceRequest(logRequest(compress(rt.path, v1(tm(routeAgent(observe(rt.handler))))))))
+	}
+	mux.HandleFunc("/context", tm(routeAgent(contextHandler)))
+	mux.HandleFunc("/swagger", tm(swaggerHandler))
+	mux.HandleFunc("/mcp/sse", mcpSSEHandler)
+	mux.HandleFunc("/events", eventsHandler)
+	mux.HandleFunc("/tail", tailHandler)
+	mux.HandleFunc("/tunnel", tunnelHandler)
+	mux.HandleFunc("/leader", leaderHandler)
+	mux.HandleFunc("/agent/", agentProxyHandler)
+	mux.HandleFunc(proxyPrefix, traceRequest(logRequest(proxyHandler)))
+	mux.HandleFunc("/agents/heartbeat", tm(agentHeartbeatHandler))
+	// Migration acts on the controller even for sessions placed on agents
+	mux.HandleFunc("/sessions/migrate", traceRequest(logRequest(tm(sessionMigrateHandler))))
+	mux.HandleFunc(apiVersionPrefix+"/sessions/migrate", traceRequest(logRequest(v1(tm(sessionMigrateHandler)))))
+	mux.HandleFunc("/slack/command", tm(slackCommandHandler))
+	mux.HandleFunc("/slack/interactive", tm(slackInteractiveHandler))
+	mux.HandleFunc("/mcp/message", tm(mcpMessageHandler))
+	registerDebug(mux)
+	mux.HandleFunc("/admin", admin(dashboardHandler))
+	mux.HandleFunc("/admin/session", admin(dashboardSessionHandler))
+	mux.HandleFunc("/admin/ticket", admin(dashboardTicketHandler))
+	mux.HandleFunc("/admin/approvals", admin(dashboardApprovalsHandler))
+	mux.HandleFunc("/admin/sessions", admin(dashboardSessionsHandler))
+	mux.HandleFunc("/admin/session/export", admin(dashboardSessionExportHandler))
+	mux.HandleFunc("/admin/session/transcript", admin(dashboardTranscriptHandler))
+	mux.HandleFunc("/admin/session/recording", admin(dashboardRecordingHandler))
+	mux.HandleFunc("/admin/reload", admin(reloadHandler))
+	mux.HandleFunc("/admin/metrics", admin(dashboardMetricsHandler))
+	mux.HandleFunc("/admin/audit", admin(dashboardAuditHandler))
+	mux.HandleFunc("/admin/terminal", terminalHandler)
+	mux.HandleFunc("/admin/terminal/ws", terminalWSHandler)
+	mux.Handle("/assets/", http.StripPrefix("/assets/", http.FileServer(http.FS(assetsFS()))))
+	// Start the server using the PORT and/or UNIX_SOCKET from .env
+	done := make(chan struct{})
+	go shutdownOnSignal(server, done)
+	err := serve(server)
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		fatal("server failed", "err", err)
+	}
+	<-done
+}
+
+func Callback(ctx context.Context, session string, ticket int) string {
+	base, hash, extra := linkTarget(ctx)
+	return fmt.Sprintf(callback, base, hash, session, ticket) + extra
+}
+
+// checkHash reports whether hash matches HASH, or the listener vouches for
+// the request, announcing failures to auth.failed webhook subscribers. Without
+// a hash parameter the hash may come as a bearer token, as GPT actions send it.
+func checkHash(r *http.Request, hash string) bool {
+	if trustedListener(r) {
+		auditKey(r, auditKeyListener)
+		return true
+	}
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && hash == "" {
+		hash = token
+	}
+	if subtle.ConstantTimeCompare([]byte(hash), []byte(hashPassword.Load())) == 1 {
+		auditKey(r, auditKeyHash)
+		return true
 	}
+	authFailed(r)
+	return false
 }
 
-func Callback(session string, ticket int) string {
-	return fmt.Sprintf(callback, fqdn, hashPassword, session, ticket)
+// authFailed records a rejected hash.
+func authFailed(r *http.Request) {
+	auditKey(r, auditKeyInvalid)
+	data := map[string]string{"path": r.URL.Path, "remote_addr": r.RemoteAddr, "request_id": requestIDFrom(r.Context())}
+	logFrom(r.Context()).Warn("authentication failed", "remote_addr", r.RemoteAddr)
+	emitEvent(eventAuthFailed, data)
+	publishActivity(eventAuthFailed, "", 0, data)
 }
 
+// loadEnv reads the settings from the environment, see config.go for how
+// flags and files get there.
 func loadEnv() {
-	err := godotenv.Load()
-	if err != nil {
-		logger.Fatalf("Error loading .env file: %v", err)
+	var err error
+	if err := loadLogging(os.Stdout); err != nil {
+		fatal(err.Error())
 	}
 
-	hashPassword = os.Getenv("HASH")
 	fqdn = os.Getenv("FQDN")
 	port = os.Getenv("PORT")
 	sessionsDir = os.Getenv("SESSIONS_DIR")
+	dataDir = os.Getenv("DATA_DIR")
+	unixSocket = os.Getenv("UNIX_SOCKET")
 
 	// Validate environment variables
-	if len(hashPassword) < 32 {
-		logger.Fatalf("HASH must be >= 32 characters: %d", len(hashPassword))
+	if err := loadReloadable(); err != nil {
+		fatal(err.Error())
 	}
 
 	if fqdn == "" {
-		logger.Fatalf("FQDN must be set in .env file")
+		fatal("FQDN must be set")
+	}
+
+	if err := loadBasePath(); err != nil {
+		fatal(err.Error())
+	}
+
+	loadAgent()
+
+	if err := loadRoutingRules(); err != nil {
+		fatal(err.Error())
+	}
+
+	if err := loadShutdown(); err != nil {
+		fatal(err.Error())
+	}
+
+	if err := loadShell(); err != nil {
+		fatal(err.Error())
+	}
+
+	if err := loadShellBackend(); err != nil {
+		fatal(err.Error())
+	}
+
+	if err := loadQueue(); err != nil {
+		fatal(err.Error())
+	}
+
+	if err := loadRecovery(); err != nil {
+		fatal(err.Error())
+	}
+
+	if err := loadOutputCapture(); err != nil {
+		fatal(err.Error())
+	}
+
+	if err := loadTokenizer(); err != nil {
+		fatal(err.Error())
 	}
 
-	if port == "" {
-		logger.Fatalf("PORT must be set in .env file")
+	if err := loadSummarizer(); err != nil {
+		fatal(err.Error())
+	}
+
+	if err := loadSuggester(); err != nil {
+		fatal(err.Error())
+	}
+
+	if err := loadCheckpoints(); err != nil {
+		fatal(err.Error())
+	}
+
+	if err := loadGitHistory(); err != nil {
+		fatal(err.Error())
+	}
+
+	if err := loadEmbeddings(); err != nil {
+		fatal(err.Error())
+	}
+
+	if err := loadStorage(); err != nil {
+		fatal(err.Error())
+	}
+
+	if listeners, err = loadListeners(); err != nil {
+		fatal(err.Error())
+	}
+
+	if len(listeners) == 0 && controllerURL == "" && !socketActivated() {
+		fatal("PORT, UNIX_SOCKET, LISTEN, CONTROLLER_URL or a systemd socket must be set")
 	}
 
 	if sessionsDir == "" {
 		sessionsDir = "sessions" // Default value if not set
-		logger.Printf("SESSIONS_DIR not set, using default: %s", sessionsDir)
+		logger.Info("SESSIONS_DIR not set, using default", "path", sessionsDir)
+	}
+
+	if dataDir == "" {
+		dataDir = "data" // Default value if not set
+		logger.Info("DATA_DIR not set, using default", "path", dataDir)
+	}
+
+	// Initialize data directory
+	if err := os.MkdirAll(dataDir, 0700); err != nil {
+		fatal("failed to initialize data directory", "err", err)
 	}
 
 	// Initialize sessions directory
 	if err := os.MkdirAll(sessionsDir, 0755); err != nil {
-		logger.Fatalf("Failed to initialize sessions directory: %v", err)
+		fatal("failed to initialize sessions directory", "err", err)
 	}
 
 }
+
+// getNextTicket claims the next ticket number by creating its empty ticket
+// file, so concurrent requests, including other instances sharing
+// SESSIONS_DIR, never get the same number.
 func getNextTicket(sessionFolder string) (int, error) {
 	// Create the session folder if it doesn't exist
 	err := os.MkdirAll(sessionFolder, 0755)
@@ -171,8 +476,8 @@ func getNextTicket(sessionFolder string) (int, error) {
 		return 0, fmt.Errorf("failed to read session folder: %v", err)
 	}
 
-	// Find the highest ticket number
-	maxTicket := 0
+	// Find the highest ticket number, pruned ones included
+	maxTicket := readTicketSeq(sessionFolder)
 	for _, file := range files {
 		if !file.IsDir() && filepath.Ext(file.Name()) == ".ticket" {
 			numStr := strings.TrimSuffix(file.Name(), ".ticket")
@@ -183,12 +488,18 @@ func getNextTicket(sessionFolder string) (int, error) {
 		}
 	}
 
-	// Return next ticket number
-	return maxTicket + 1, nil
-}
-
-type JsonErr struct {
-	Error string `json:"error"`
+	// Claim the next free number, O_EXCL fails if someone else got it first
+	for ticket := maxTicket + 1; ; ticket++ {
+		f, err := os.OpenFile(filepath.Join(sessionFolder, fmt.Sprintf("%02d.ticket", ticket)), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			f.Close()
+			indexTicket(sessionFolder, ticket, nil)
+			return ticket, nil
+		}
+		if !os.IsExist(err) {
+			return 0, fmt.Errorf("failed to claim ticket: %v", err)
+		}
+	}
 }
 
 type JsonMsg struct {
@@ -197,333 +508,305 @@ type JsonMsg struct {
 }
 
 func writeJsonMsg(w http.ResponseWriter, status, msg string) {
+	writeJSON(w, http.StatusOK, &JsonMsg{Status: status, Message: msg})
+}
+
+func callbackHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	resp, err := json.Marshal(&JsonMsg{Status: status, Message: msg})
+	if r.Method != http.MethodGet {
+		writeError(w, errMethodMessage)
+		return
+	}
+
+	format, err := responseFormat(r)
 	if err != nil {
-		logger.Printf("Failed to marshal JSON response: %v", err)
-		http.Error(w, fmt.Sprintf("Failed to marshal JSON response: %v", err), http.StatusInternalServerError)
+		writeError(w, err)
 		return
 	}
-	http.Error(w, string(resp), http.StatusOK)
-}
 
-func writeJsonError(w http.ResponseWriter, msg string) {
-	w.Header().Set("Content-Type", "application/json")
-	resp, err := json.Marshal(&JsonErr{Error: msg})
+	maxTokens, err := parseMaxTokens(r)
 	if err != nil {
-		logger.Printf("Failed to marshal JSON response: %v", err)
-		http.Error(w, fmt.Sprintf("Failed to marshal JSON response: %v", err), http.StatusInternalServerError)
+		writeError(w, err)
 		return
 	}
-	http.Error(w, string(resp), http.StatusMethodNotAllowed)
-}
+	diff := r.URL.Query().Get("diff") == "1" || r.URL.Query().Get("diff") == "true"
+	outputJSON := r.URL.Query().Get("output_json") == "1" || r.URL.Query().Get("output_json") == "true"
 
-func callbackHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	if r.Method != http.MethodGet {
-		writeJsonError(w, errMethodMessage)
+	filter, err := requestFilter(r)
+	if err != nil {
+		writeError(w, err)
 		return
 	}
 
 	// Validate the hash parameter
 	ticket, err := strconv.Atoi(r.URL.Query().Get("ticket"))
 	if err != nil {
-		writeJsonError(w, errTicketMessage)
+		writeError(w, errTicketMessage)
 		return
 	}
 
 	// Validate the hash parameter
 	hashParam := r.URL.Query().Get("hash")
-	if subtle.ConstantTimeCompare([]byte(hashParam), []byte(hashPassword)) != 1 {
-		writeJsonError(w, errHashMessage)
+	if !checkHash(r, hashParam) {
+		writeError(w, errHashMessage)
 		return
 	}
 
 	// Check if session is provided in query parameters
 	session := r.URL.Query().Get("session")
 	if session == "" {
-		writeJsonError(w, errSessionMessage)
+		writeError(w, errSessionMessage)
 		return
 	}
 
-	// If session is provided, create the session directory if it doesn't exist
-	sessionFolder := filepath.Join(sessionsDir, session)
-	if _, err := os.Stat(sessionFolder); os.IsNotExist(err) {
-		msg := fmt.Sprintf("Session %s does not exist", sessionFolder)
-		logger.Printf("Session not found!  %s: %v", sessionFolder, err)
-		writeJsonError(w, msg)
-		return
+	// Polling an unchanged ticket is answered 304 when the client sends its
+	// ETag. A queued ticket is unchanged while its place in the queue moves,
+	// and with token budgets the same ticket reads differently as the budget
+	// is spent and resets, so neither is tagged.
+	queue := queuedState(session, ticket)
+	if idx, err := sessionTicketIndex(filepath.Join(sessionsDir, session)); err == nil && queue == nil && !budgetsEnabled() {
+		if meta, ok := idx.get(ticket); ok && notModified(w, r, ticketETag(r, meta)) {
+			return
+		}
 	}
 
-	// Read all ticket files in the session
-	file, err := os.ReadFile(filepath.Join(sessionsDir, session, fmt.Sprintf("%02d.ticket", ticket)))
+	// Read the ticket file
+	file, err := readTicket(session, ticket)
 	if err != nil {
-		msg := fmt.Sprintf("Failed to read ticket file: %v", err)
-		writeJsonError(w, msg)
+		writeError(w, err)
 		return
 	}
 
 	if len(file) == 0 {
 		msg := fmt.Sprintf("No output for ticket %d yet. Refresh the page after waiting a bit!", ticket)
-		writeJsonMsg(w, "working", msg)
+		// Still "working" to clients, which poll the same either way
+		if queue != nil {
+			msg = fmt.Sprintf("Ticket %d is queued behind %d command(s) of session %s", ticket, queue.Position, session)
+			if queue.EstimatedWaitMs > 0 {
+				msg += fmt.Sprintf(", about %s", (time.Duration(queue.EstimatedWaitMs) * time.Millisecond).Round(time.Second))
+			}
+			msg += ". Refresh the page after waiting a bit!"
+		}
+		switch format {
+		case formatJSON:
+			writeJsonMsg(w, "working", msg)
+			return
+		case formatObservation:
+			next := &ObservationTicket{Session: session, Ticket: ticket, Callback: baseURL(r.Context()) + r.URL.RequestURI()}
+			writeObservation(w, &Observation{Status: observationRunning, NextTicket: next, Hint: "The command is still running, fetch next_ticket.callback again after waiting a bit"})
+			return
+		}
+		writeFormatted(w, format, &JsonMsg{Status: "working", Message: msg}, msg+"\n")
 		return
 	}
 
-	fmt.Fprintf(w, "%s\n", file)
-	return
+	if format == formatJSON && maxTokens == 0 && !diff && filter == nil && !outputJSON && !budgetsEnabled() {
+		fmt.Fprintf(w, "%s\n", file)
+		return
+	}
+
+	res := &CmdResults{}
+	if err := json.Unmarshal(file, res); err != nil {
+		msg := fmt.Sprintf("Failed to unmarshal JSON from ticket %d: %v", ticket, err)
+		writeJsonError(w, msg)
+		return
+	}
+	if filter != nil {
+		if err := filterResult(res, filter); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+	if diff {
+		diffResult(res, filter)
+	}
+	maxTokens, exhausted := budgetTokens(res, maxTokens)
+	if maxTokens > 0 {
+		if cut := trimResult(res, maxTokens); res.OmittedTokens > 0 {
+			setContinuation(r.Context(), res, &outputCont{Session: session, Ticket: ticket, Offset: cut, Tokens: maxTokens, Filter: r.URL.Query().Get("filter"), Diff: diff})
+			res.Next = "The middle of this output was omitted. Fetch continue_url to read it in chunks, or review the Input & Output and issue your next command to /shell"
+		}
+	}
+	if exhausted {
+		res.BudgetExhausted = true
+		res.Next = budgetMessage()
+	}
+	if outputJSON && format != formatText && format != formatObservation {
+		jsonResult(res)
+	}
+	writeFormatted(w, format, res, res.Output)
 }
 
 func shellHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	if r.Method != http.MethodGet {
-		writeJsonError(w, errMethodMessage)
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		writeError(w, errMethodMessage)
+		return
+	}
+
+	format, err := responseFormat(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	req, err := parseShellRequest(r)
+	if err != nil {
+		writeError(w, err)
 		return
 	}
 
 	// Validate the hash parameter
-	hashParam := r.URL.Query().Get("hash")
-	if subtle.ConstantTimeCompare([]byte(hashParam), []byte(hashPassword)) != 1 {
-		writeJsonError(w, errHashMessage)
+	if !checkHash(r, req.Hash) {
+		writeError(w, errHashMessage)
 		return
 	}
 
-	// Check if session is provided in query parameters
-	session := r.URL.Query().Get("session")
+	// Check if session is provided
+	session := req.Session
 	if session == "" {
-		writeJsonError(w, errSessionMessage)
+		writeError(w, errSessionMessage)
 		return
 	}
 
-	// Get query parameters
-	cmdParam := r.URL.Query().Get("cmd")
-	if cmdParam == "" {
-		writeJsonError(w, errCmdMessage)
+	// Determine the command to execute
+	inputCmd := req.Cmd
+	if inputCmd == "" {
+		writeError(w, errCmdMessage)
 		return
 	}
 
-	// Determine the command to execute
-	var inputCmd string
-	if cmdParam != "" {
-		var erru error
-		inputCmd, erru = url.QueryUnescape(cmdParam)
-		if erru != nil {
-			msg := fmt.Sprintf("Failed to unescape command: %v", erru)
-			logger.Printf("Failed to unescape command: %v", erru)
-			writeJsonError(w, msg)
-			return
-		}
+	opts, err := req.options()
+	if err != nil {
+		writeError(w, err)
+		return
 	}
 
 	// If session is provided, create the session directory if it doesn't exist
 	sessionFolder := filepath.Join(sessionsDir, session)
-	if _, err := os.Stat(sessionFolder); os.IsNotExist(err) {
-		if err := os.MkdirAll(sessionFolder, 0755); err != nil {
-			msg := fmt.Sprintf("Failed to create session directory %s: %v", sessionFolder, err)
-			logger.Printf(msg)
-			writeJsonError(w, msg)
-			return
-		}
-		logger.Printf("Created new session directory: %s", sessionFolder)
-	}
 
-	isCached := lastCmdMatch(inputCmd)
-	if isCached {
-		resp := NewCmdReponse(session, true)
-		jsonResp, err := json.Marshal(resp)
-		if err != nil {
-			msg := fmt.Sprintf("Failed to marshal JSON response: %v", err)
-			writeJsonError(w, msg)
-			return
-		}
-		fmt.Fprintf(w, string(jsonResp))
+	// Dry run: validate and report without touching the session
+	if req.DryRun {
+		writeDryRun(w, r, session, sessionFolder, inputCmd)
 		return
 	}
 
-	// Get the next ticket number
-	ticket, err := getNextTicket(sessionFolder)
+	csr, err := submitCommand(r.Context(), session, inputCmd, opts)
+	var risky *riskError
+	if errors.As(err, &risky) {
+		writeRiskWarning(w, risky.warning)
+		return
+	}
 	if err != nil {
-		writeJsonError(w, errTicketMessage)
+		writeError(w, err)
 		return
 	}
 
-	csr := &CmdSubmission{
-		Type:     "submission",
-		Ticket:   ticket,
-		Session:  session,
-		Input:    inputCmd,
-		IsCached: isCached,
-		Callback: Callback(session, ticket),
+	// The budget, diff, filter, output_json and observation format carry over
+	// to polling the callback
+	if req.MaxTokens > 0 {
+		csr.Callback += fmt.Sprintf("&max_tokens=%d", req.MaxTokens)
 	}
-
-	updateLastCommandByTicketResponse(csr)
-
-	// LOG
-	logger.Printf("EXECUTING: %s : %s : %s\n", session, inputCmd, Callback(session, ticket))
-
-	go func() {
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
-		defer cancel()
-
-		// Define output filename based on session and ticket
-		outputFile := filepath.Join(sessionFolder, fmt.Sprintf("%02d.ticket", ticket))
-		file, err := os.OpenFile(outputFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
-		if err != nil {
-			msg := fmt.Sprintf("Failed to open output file %s: %v", outputFile, err)
-			logger.Print(msg)
-			file.WriteString(msg)
-			return
-		}
-		defer file.Close()
-
-		// Execute the command using a shell to preserve quotes and complex syntax
-		cmd := exec.CommandContext(ctx, "/bin/bash", "-c", inputCmd) // Use "cmd" /C on Windows if needed
-		output, err := cmd.CombinedOutput()
-		if err != nil {
-			msg := fmt.Sprintf("Command execution failed : %s : %v", string(output), err)
-			logger.Print(msg)
-			// WARNING: don't return
-			// falled through so we can write the error to file
-		}
-
-		cer := &CmdResults{
-			Type:    "result",
-			Next:    "This is your result. Review the Input & Output. You can now issue your next command to /shell",
-			Ticket:  csr.Ticket,
-			Session: csr.Session,
-			Input:   csr.Input,
-			Output:  string(output),
-		}
-
-		jsonResp, err := json.Marshal(cer)
-		if err != nil {
-			msg := fmt.Sprintf("Failed to marshal JSON response: %v", err)
-			logger.Print(msg)
-			file.WriteString(msg)
-			return
-		}
-
-		_, writeErr := file.Write(jsonResp)
-		if writeErr != nil {
-			msg := fmt.Sprintf("Failed to write error to file: %v", writeErr)
-			logger.Print(msg)
-			file.WriteString(msg)
-			return
-		}
-	}()
-
-	jsonResp, err := json.Marshal(csr)
-	if err != nil {
-		msg := fmt.Sprintf("Failed to marshal JSON response: %v", err)
-		writeJsonError(w, msg)
-		return
+	if req.Diff {
+		csr.Callback += "&diff=1"
+	}
+	if req.Filter != "" {
+		csr.Callback += "&filter=" + url.QueryEscape(req.Filter)
+	}
+	if req.OutputJSON {
+		csr.Callback += "&output_json=1"
+	}
+	if format == formatObservation {
+		csr.Callback += "&format=" + formatObservation
 	}
 
-	fmt.Fprintf(w, string(jsonResp))
-	return
+	writeFormatted(w, format, csr, fmt.Sprintf("%d\n", csr.Ticket))
 }
 
 func historyHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	if r.Method != http.MethodGet {
-		writeJsonError(w, errMethodMessage)
+		writeError(w, errMethodMessage)
 		return
 	}
 
+	// History alone also renders as html for humans, and as chat messages
+	format := r.URL.Query().Get("format")
+	if format != formatHTML && format != formatMessages {
+		var err error
+		if format, err = responseFormat(r); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+
 	// Validate the hash parameter
 	hashParam := r.URL.Query().Get("hash")
-	if subtle.ConstantTimeCompare([]byte(hashParam), []byte(hashPassword)) != 1 {
-		writeJsonError(w, errHashMessage)
+	if !checkHash(r, hashParam) {
+		writeError(w, errHashMessage)
 		return
 	}
 
 	// Check if session is provided in query parameters
 	session := r.URL.Query().Get("session")
 	if session == "" {
-		writeJsonError(w, errSessionMessage)
-		return
-	}
-
-	// Check if session exists
-	sessionPath := filepath.Join(sessionsDir, session)
-	if _, err := os.Stat(sessionPath); os.IsNotExist(err) {
-		msg := fmt.Sprintf("Session %s does not exist", session)
-		writeJsonError(w, msg)
+		writeError(w, errSessionMessage)
 		return
 	}
 
-	// Read all ticket files in the session
-	files, err := os.ReadDir(sessionPath)
-	if err != nil {
-		msg := fmt.Sprintf("Failed to read session directory: %v", err)
-		writeJsonError(w, msg)
-		return
-	}
-
-	// Sort files by ticket number
-	tickets := make([]string, 0)
-	for _, file := range files {
-		if !file.IsDir() && filepath.Ext(file.Name()) == ".ticket" {
-			tickets = append(tickets, file.Name())
+	if idx, err := sessionTicketIndex(filepath.Join(sessionsDir, session)); err == nil {
+		if tickets := idx.list(); len(tickets) > 0 && notModified(w, r, historyETag(r, session, tickets, r.URL.Query().Get("notes") == "1")) {
+			return
 		}
 	}
 
-	if len(tickets) == 0 {
-		msg := fmt.Sprintf("No tickets found for session %s", session)
-		writeJsonError(w, msg)
+	responses, err := readHistory(session)
+	if err != nil {
+		writeError(w, err)
 		return
 	}
 
-	var responses []*CmdResults
-	// Display content of all tickets
-	for _, ticket := range tickets {
-		content, err := os.ReadFile(filepath.Join(sessionPath, ticket))
-		if err != nil {
-			logger.Printf("Failed to read ticket %s: %v", ticket, err)
-			continue
-		}
-		resp := &CmdResults{}
-		err = json.Unmarshal(content, resp)
-		if err != nil {
-			logger.Printf("Failed to unmarshal JSON from ticket %s: %v", ticket, err)
-			continue
+	// The session's notes come along with notes=1
+	var notes []*Note
+	if r.URL.Query().Get("notes") == "1" {
+		if notes, err = readNotes(session); err != nil {
+			writeError(w, err)
+			return
 		}
-
-		responses = append(responses, resp)
 	}
 
-	jsonRespones, err := json.Marshal(responses)
-	if err != nil {
-		msg := fmt.Sprintf("Failed to marshal JSON response: %v", err)
-		writeJsonError(w, msg)
-		return
+	switch format {
+	case formatHTML:
+		writeHistoryHTML(w, r, session, responses, notes)
+	case formatMessages:
+		writeHistoryMessages(w, r, responses, notes)
+	default:
+		writeHistory(w, format, responses, notes)
 	}
-
-	fmt.Fprintf(w, string(jsonRespones))
-	return
 }
 
 func readmeHandler(w http.ResponseWriter, r *http.Request) {
 	// Only handle the root path
 	if r.URL.Path != "/" {
-		http.NotFound(w, r)
+		writeError(w, errNotFoundMessage)
 		return
 	}
 
 	// Ensure the request is a GET
 	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, errMethodMessage)
 		return
 	}
 
 	// Read the README.md file
-	content, err := os.ReadFile("README.md")
+	content, err := fs.ReadFile(webFS, "README.md")
 	if err != nil {
-		logger.Printf("Failed to read README.md: %v", err)
-		http.Error(w, "Failed to read documentation", http.StatusInternalServerError)
+		logger.Error("failed to read README.md", "err", err)
+		writeJsonError(w, "Failed to read documentation")
 		return
 	}
 
-	contentStr := strings.ReplaceAll(string(content), "{FQDN}", fqdn)
+	contentStr := strings.ReplaceAll(string(content), "{FQDN}", baseURL(r.Context()))
 
 	// Convert markdown to HTML
 	html := blackfriday.Run([]byte(contentStr))
@@ -533,36 +816,58 @@ func readmeHandler(w http.ResponseWriter, r *http.Request) {
 func contextHandler(w http.ResponseWriter, r *http.Request) {
 	// Only handle the root path
 	if r.URL.Path != "/context" {
-		http.NotFound(w, r)
+		writeError(w, errNotFoundMessage)
 		return
 	}
 
-	// Ensure the request is a GET
-	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	// Validate the hash parameter
+	hashParam := r.URL.Query().Get("hash")
+	if !checkHash(r, hashParam) {
+		writeError(w, errHashMessage)
 		return
 	}
 
-	// Validate the hash parameter
-	hashParam := r.URL.Query().Get("hash")
-	if subtle.ConstantTimeCompare([]byte(hashParam), []byte(hashPassword)) != 1 {
-		http.Error(w, "Invalid or missing 'hash' parameter", http.StatusUnauthorized)
+	// Session documents are managed with POST and DELETE, and listed as JSON
+	session, name := r.URL.Query().Get("session"), r.URL.Query().Get("name")
+	format := r.URL.Query().Get("format")
+	if r.Method != http.MethodGet || format == formatJSON {
+		if r.Method != http.MethodGet && session == "" {
+			writeError(w, errMethodMessage)
+			return
+		}
+		sessionContextHandler(w, r, session, name)
 		return
 	}
 
-	// Read the README.md file
-	content, err := os.ReadFile("CONTEXT.md")
-	if err != nil {
-		logger.Printf("Failed to read CONTEXT.md: %v", err)
-		http.Error(w, "Failed to read documentation", http.StatusInternalServerError)
+	switch format {
+	case "", formatHTML, formatMarkdown, formatText:
+	default:
+		writeError(w, errContextFormatMessage)
+		return
+	}
+	if session != "" && !validSessionName(session) {
+		writeError(w, errSessionMessage)
+		return
+	}
+	if name != "" && !validSessionName(name) {
+		writeError(w, errContextNameMessage)
 		return
 	}
 
-	contentStr := strings.ReplaceAll(string(content), "{FQDN}", fqdn)
+	// Read CONTEXT.md and the session's documents
+	content, err := contextMarkdown(session, name)
+	if err != nil {
+		if errors.Is(err, errNotFound) {
+			writeError(w, err)
+			return
+		}
+		logger.Error("failed to read context", "session", session, "err", err)
+		writeJsonError(w, "Failed to read documentation")
+		return
+	}
 
-	// Convert markdown to HTML
-	html := blackfriday.Run([]byte(contentStr))
-	printHTML(w, string(html))
+	contentStr := strings.ReplaceAll(string(content), "{FQDN}", baseURL(r.Context()))
+	writeContext(w, format, []byte(contentStr))
 }
 
 func printHTML(w http.ResponseWriter, html string) {
@@ -574,61 +879,19 @@ func printHTML(w http.ResponseWriter, html string) {
 	<html>
 	<head>
 		<title>LLMASS - LLM Asynchronous Shell Scheduler</title>
-		<link rel="stylesheet" href="/assets/style.css">
+		<link rel="stylesheet" href="%[1]s/assets/style.css">
 	</head>
 	<body>
 		<div class="main">
 			<div class="header">
-				<a class="header-link" href="/">
-					<img src="/assets/logo.png" alt="LLMAS Logo" width="200" height="200">
+				<a class="header-link" href="%[1]s/">
+					<img src="%[1]s/assets/logo.png" alt="LLMAS Logo" width="200" height="200">
 				</a>
 			</div>
 			<div class="content">
-			%s
+			%[2]s
 			</div>
 		</div>
 	</body>
-	</html>`, html)
-}
-
-type CmdCache struct {
-	Ticket   int
-	Input    string
-	Callback string
-	IsCached bool
-	Time     time.Time
-	mu       sync.Mutex
-}
-
-var lastCommand *CmdCache
-
-func lastCmdMatch(command string) bool {
-	lastCommand.mu.Lock()
-	defer lastCommand.mu.Unlock()
-	if lastCommand != nil && lastCommand.Input == command && time.Since(lastCommand.Time) < time.Minute {
-		return true
-	}
-	return false
-}
-func updateLastCommandByTicketResponse(resp *CmdSubmission) {
-	lastCommand.mu.Lock()
-	defer lastCommand.mu.Unlock()
-	lastCommand.Callback = resp.Callback
-	lastCommand.IsCached = resp.IsCached
-	lastCommand.Input = resp.Input
-	lastCommand.Ticket = resp.Ticket
-	lastCommand.Time = time.Now()
-}
-
-func NewCmdReponse(session string, isCached bool) *CmdSubmission {
-	lastCommand.mu.Lock()
-	defer lastCommand.mu.Unlock()
-	return &CmdSubmission{
-		Type:     "submission",
-		IsCached: isCached,
-		Session:  session,
-		Ticket:   lastCommand.Ticket,
-		Input:    lastCommand.Input,
-		Callback: lastCommand.Callback,
-	}
+	</html>`, basePath, html)
 }
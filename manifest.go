@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// /manifest.json describes what this server offers in one machine readable
+// document, so an agent pointed at the FQDN can discover how to use it
+// without hand written prompt text. The parameters come from the OpenAPI
+// document, the manifest adds the workflow, auth and examples around them.
+
+const manifestHashPlaceholder = "YOUR_HASH"
+
+// manifestCapabilities are the operations an agent needs, in the order it
+// typically uses them.
+var manifestCapabilities = []struct {
+	name        string
+	method      string
+	path        string
+	description string
+	example     string // query string appended to the URL
+}{
+	{"run_command", http.MethodGet, "/shell", "Execute a shell command in a session. Returns a ticket right away, the command runs in the background.", "session=recon&cmd=uname%20-a"},
+	{"check_status", http.MethodGet, "/callback", "Fetch the result of a ticket. Returns a working status while the command is still running.", "session=recon&ticket=1"},
+	{"get_history", http.MethodGet, "/history", "Fetch every command and output in a session.", "session=recon&format=json"},
+	{"read_output", http.MethodGet, "/output", "Page through a large output a chunk at a time, following the cont token of each chunk.", "session=recon&ticket=1&max_tokens=2000"},
+	{"list_sessions", http.MethodGet, "/sessions", "List the sessions with their ticket counts.", ""},
+	{"whoami", http.MethodGet, "/whoami", "Check what your hash may do before trying it: its role, scopes, sessions and remaining token budgets.", ""},
+	{"list_processes", http.MethodGet, "/ps", "List a session's running commands and their process trees.", "session=recon"},
+	{"answer_prompts", http.MethodGet, "/shell", "Run an interactive command, typing each send once the output matches the expect before it.", "session=recon&cmd=ssh%20admin%4010.0.0.5%20uptime&expect=password%3A%20&send=hunter2"},
+	{"kill_session", http.MethodPost, "/sessions/kill", "Kill a session's running commands and watches.", "session=recon"},
+	{"set_session_limits", http.MethodPost, "/sessions/limits", "Set the niceness, IO priority and ulimits a session's commands run with by default.", "session=recon&nice=10&ionice=idle&nofile=1024&cpu=600"},
+	{"restart_shell", http.MethodPost, "/sessions/restart", "Replace a wedged shell with a fresh one in the same directory.", "session=recon"},
+	{"watch_command", http.MethodGet, "/watch", "Re-run a command on an interval, collecting every iteration in one ticket.", "session=recon&cmd=uptime&interval=10"},
+	{"download_artifact", http.MethodGet, "/artifact", "Download a file a command registered through $LLMASS_ARTIFACTS.", "session=recon&ticket=1&name=report.txt"},
+	{"search_history", http.MethodGet, "/search", "Find past tickets by words, or with mode=semantic by meaning.", "session=recon&q=configure%20nginx&mode=semantic"},
+	{"suggest_commands", http.MethodGet, "/suggest", "Ask for candidate commands reaching a goal. Nothing is run, review the suggestions and submit one with run_command.", "session=recon&goal=find%20the%20largest%20log%20files"},
+	{"save_note", http.MethodPost, "/notes", "Save a note to the session's scratchpad, memory that persists between invocations.", "session=recon&text=ssh%20listens%20on%202222"},
+	{"get_notes", http.MethodGet, "/notes", "Fetch the notes saved to a session's scratchpad.", "session=recon"},
+	{"set_alias", http.MethodPost, "/aliases", "Define a session alias, a command starting with its name runs the expansion instead.", "session=recon&name=test&command=go%20test%20.%2F...%20-count%3D1"},
+	{"get_briefing", http.MethodGet, "/context/auto", "Fetch where a session stands when resuming work: host and shell, running commands, the last tickets with trimmed outputs, and notes.", "session=recon&format=text"},
+	{"list_ports", http.MethodGet, "/ports", "List the ports your session's processes listen on, such as a dev server, with links a human can open through the proxy.", "session=recon"},
+	{"tail_file", http.MethodGet, "/tail", "Read the last lines of a file, such as a log a running command writes, without a ticket. follow=1 streams appends as Server-Sent Events.", "session=recon&path=build.log&lines=50"},
+	{"get_git_history", http.MethodGet, "/history/git", "List the commits of a session's git history, when GIT_HISTORY is enabled, or show one as a patch with commit.", "session=recon&limit=10"},
+	{"prune_tickets", http.MethodPost, "/tickets/prune", "Delete, or archive with archive=1, a session's finished tickets by number range (from, to), age (before) or size (larger); try dryrun=1 first.", "session=recon&before=720h&dryrun=1"},
+	{"get_queue", http.MethodGet, "/queue", "Show the command a session runs and the ones queued behind it, with their positions and estimated waits.", "session=recon"},
+	{"get_stats", http.MethodGet, "/stats", "Aggregate past commands per session and overall: counts, failure rate, average and percentile durations, busiest hours and cache hit rate.", "session=recon"},
+	{"get_env", http.MethodGet, "/env", "Check where commands run without creating a ticket: working directory, PATH, well known variables, shell pid and uptime.", "session=recon"},
+	{"get_context", http.MethodGet, "/context", "Fetch the operating instructions, with the session's own context documents.", "session=recon&format=markdown"},
+}
+
+type ManifestParam struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Required    bool   `json:"required"`
+	Type        string `json:"type"`
+}
+
+type ManifestCapability struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	Method      string          `json:"method"`
+	URL         string          `json:"url"`
+	Parameters  []ManifestParam `json:"parameters"`
+	Example     string          `json:"example"`
+}
+
+type ManifestAuth struct {
+	Type        string `json:"type"`
+	Parameter   string `json:"parameter"`
+	Description string `json:"description"`
+}
+
+// Manifest is the /manifest.json document.
+type Manifest struct {
+	Name          string               `json:"name"`
+	Description   string               `json:"description"`
+	URL           string               `json:"url"`
+	Auth          ManifestAuth         `json:"auth"`
+	Workflow      []string             `json:"workflow"`
+	Capabilities  []ManifestCapability `json:"capabilities"`
+	Documentation map[string]string    `json:"documentation"`
+}
+
+// manifestParams lists an operation's query parameters from the OpenAPI
+// document, the hash is covered by auth.
+func manifestParams(spec obj, path, method string) []ManifestParam {
+	params := []ManifestParam{}
+	item, _ := spec["paths"].(obj)[path].(obj)
+	op, _ := item[strings.ToLower(method)].(obj)
+	list, _ := op["parameters"].([]obj)
+	for _, p := range list {
+		if p["name"] == "hash" {
+			continue
+		}
+		schema, _ := p["schema"].(obj)
+		typ, _ := schema["type"].(string)
+		desc, _ := p["description"].(string)
+		req, _ := p["required"].(bool)
+		params = append(params, ManifestParam{Name: p["name"].(string), Description: desc, Required: req, Type: typ})
+	}
+	return params
+}
+
+func buildManifest(base string) *Manifest {
+	spec := openAPISpec(base)
+	m := &Manifest{
+		Name:        "llmass",
+		Description: "LLM Asynchronous Shell Scheduler: run shell commands on this host over HTTP. Commands are asynchronous, each returns a ticket whose result is polled from a callback URL.",
+		URL:         base,
+		Auth: ManifestAuth{
+			Type:        "query",
+			Parameter:   "hash",
+			Description: "Every request carries the hash you were given as the hash query parameter. Never use the example hash from the documentation.",
+		},
+		Workflow: []string{
+			"Pick a session name and reuse it, the session keeps your command history.",
+			"Submit a command with run_command and keep the ticket and callback URL from the response.",
+			"Poll the callback with exponential back-off until the type is result, then read output and exit_code.",
+			"URL encode commands, they run as scripts in the server's shell.",
+		},
+		Documentation: map[string]string{
+			"readme":  base + "/",
+			"context": base + "/context",
+			"openapi": base + "/openapi.json",
+			"tools":   base + "/tools",
+		},
+	}
+	for _, c := range manifestCapabilities {
+		example := fmt.Sprintf("%s%s?hash=%s", base, c.path, manifestHashPlaceholder)
+		if c.example != "" {
+			example += "&" + c.example
+		}
+		if c.method != http.MethodGet {
+			example = fmt.Sprintf("curl -X %s %q", c.method, example)
+		} else {
+			example = fmt.Sprintf("curl %q", example)
+		}
+		m.Capabilities = append(m.Capabilities, ManifestCapability{
+			Name:        c.name,
+			Description: c.description,
+			Method:      c.method,
+			URL:         base + c.path,
+			Parameters:  manifestParams(spec, c.path, c.method),
+			Example:     example,
+		})
+	}
+	return m
+}
+
+func manifestHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodGet {
+		writeError(w, errMethodMessage)
+		return
+	}
+
+	jsonResp, err := json.MarshalIndent(buildManifest(baseURL(r.Context())), "", "  ")
+	if err != nil {
+		msg := fmt.Sprintf("Failed to marshal JSON response: %v", err)
+		writeJsonError(w, msg)
+		return
+	}
+
+	fmt.Fprint(w, string(jsonResp))
+}
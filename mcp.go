@@ -0,0 +1,691 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	mcpProtocolVersion = "2024-11-05"
+	mcpMaxFileSize     = 1 << 20
+	mcpDefaultWait     = 30 * time.Second
+
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+	rpcInternalError  = -32603
+)
+
+var (
+	errMCPSessionMessage = newKindError(errNotFound, "Unknown MCP sessionId")
+)
+
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+func newRPCError(id json.RawMessage, code int, msg string) *rpcResponse {
+	if id == nil {
+		id = json.RawMessage("null")
+	}
+	return &rpcResponse{JSONRPC: "2.0", ID: id, Error: &rpcError{Code: code, Message: msg}}
+}
+
+type mcpTool struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	InputSchema obj    `json:"inputSchema"`
+	call        func(ctx context.Context, args json.RawMessage) (string, error)
+}
+
+type mcpContent struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+type mcpCallResult struct {
+	Content []mcpContent `json:"content"`
+	IsError bool         `json:"isError,omitempty"`
+}
+
+func stringProp(desc string) obj  { return obj{"type": "string", "description": desc} }
+func integerProp(desc string) obj { return obj{"type": "integer", "description": desc} }
+
+func inputSchema(props obj, required ...string) obj {
+	return obj{"type": "object", "properties": props, "required": required}
+}
+
+// expectProp describes the expect steps of run_command, see expect.go.
+var expectProp = obj{
+	"type":        "array",
+	"description": "Steps answering the command's prompts: each waits until the output matches expect, then types send followed by Enter.",
+	"items": inputSchema(obj{
+		"expect":  stringProp("Regular expression the output must match."),
+		"send":    stringProp("Text typed followed by Enter."),
+		"timeout": integerProp("Seconds to wait for the match (default 30)."),
+	}, "expect", "send"),
+}
+
+// mcpTools are the LLMASS operations exposed to MCP clients.
+var mcpTools = []*mcpTool{
+	{
+		Name:        "run_command",
+		Description: "Execute a shell command in a session. By default waits for the result, otherwise returns a ticket to poll with check_status.",
+		InputSchema: inputSchema(obj{
+			"session":      stringProp("Session name, reuse it to keep context."),
+			"cmd":          stringProp("The shell command to execute."),
+			"timeout":      integerProp("Seconds before the command is killed."),
+			"cwd":          stringProp("Working directory for the command."),
+			"confirm":      obj{"type": "boolean", "description": "Run a command the server flagged as risky, after checking it."},
+			"env":          obj{"type": "object", "additionalProperties": obj{"type": "string"}, "description": "Extra environment variables."},
+			"nice":         integerProp("CPU niceness from -20 to 19, higher runs at a lower priority."),
+			"ionice":       stringProp("IO priority: idle, best-effort[:0-7] or realtime[:0-7]."),
+			"nofile":       integerProp("Open files limit."),
+			"core":         integerProp("Core dump size limit in KiB, 0 disables core dumps."),
+			"cpu":          integerProp("CPU seconds before the command is killed."),
+			"expect":       expectProp,
+			"wait":         obj{"type": "boolean", "description": "Wait for the command to finish (default true)."},
+			"wait_seconds": integerProp("Maximum seconds to wait before returning the ticket (default 30)."),
+		}, "session", "cmd"),
+		call: mcpRunCommand,
+	},
+	{
+		Name:        "check_status",
+		Description: "Fetch the result of a ticket. Returns a working status while the command is still running.",
+		InputSchema: inputSchema(obj{
+			"session": stringProp("Session name."),
+			"ticket":  integerProp("Ticket number returned by run_command."),
+		}, "session", "ticket"),
+		call: mcpCheckStatus,
+	},
+	{
+		Name:        "get_history",
+		Description: "Fetch every command and output in a session.",
+		InputSchema: inputSchema(obj{"session": stringProp("Session name.")}, "session"),
+		call:        mcpGetHistory,
+	},
+	{
+		Name:        "search_history",
+		Description: "Find past tickets by words, or with mode semantic by meaning, such as \"when did I configure nginx?\".",
+		InputSchema: inputSchema(obj{
+			"q":       stringProp("What to look for."),
+			"session": stringProp("Search this session only, every session when omitted."),
+			"mode":    stringProp("text (default) or semantic."),
+		}, "q"),
+		call: mcpSearchHistory,
+	},
+	{
+		Name:        "suggest_commands",
+		Description: "Ask for candidate shell commands reaching a goal, with the session's recent commands as context. Nothing is run, review the suggestions and run the one you choose.",
+		InputSchema: inputSchema(obj{
+			"goal":    stringProp("What to achieve, in plain words."),
+			"session": stringProp("Session whose recent commands and notes give context, optional."),
+		}, "goal"),
+		call: mcpSuggestCommands,
+	},
+	{
+		Name:        "save_note",
+		Description: "Save a note to the session's scratchpad, memory that persists between your invocations.",
+		InputSchema: inputSchema(obj{
+			"session": stringProp("Session name."),
+			"text":    stringProp("The note, free-form text."),
+		}, "session", "text"),
+		call: mcpSaveNote,
+	},
+	{
+		Name:        "get_notes",
+		Description: "Fetch the notes saved to the session's scratchpad.",
+		InputSchema: inputSchema(obj{"session": stringProp("Session name.")}, "session"),
+		call:        mcpGetNotes,
+	},
+	{
+		Name:        "get_briefing",
+		Description: "Fetch where a session stands when resuming work: host and shell, running commands, the last tickets with trimmed outputs, and notes.",
+		InputSchema: inputSchema(obj{"session": stringProp("Session name.")}, "session"),
+		call:        mcpGetBriefing,
+	},
+	{
+		Name:        "read_file",
+		Description: "Read a file from the host. Binary content is returned base64 encoded.",
+		InputSchema: inputSchema(obj{"path": stringProp("Absolute path of the file.")}, "path"),
+		call:        mcpReadFile,
+	},
+	{
+		Name:        "write_file",
+		Description: "Write a file on the host, creating parent directories.",
+		InputSchema: inputSchema(obj{
+			"path":     stringProp("Absolute path of the file."),
+			"content":  stringProp("File content."),
+			"encoding": stringProp("Set to base64 when content is base64 encoded."),
+		}, "path", "content"),
+		call: mcpWriteFile,
+	},
+}
+
+func toJSONText(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", fmt.Errorf("Failed to marshal JSON response: %v", err)
+	}
+	return string(b), nil
+}
+
+// waitTicket polls the ticket until it has output or ctx is done.
+func waitTicket(ctx context.Context, session string, ticket int) ([]byte, error) {
+	for {
+		file, err := readTicket(session, ticket)
+		if err != nil || len(file) > 0 {
+			return file, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, nil
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
+}
+
+func mcpRunCommand(ctx context.Context, args json.RawMessage) (string, error) {
+	var p struct {
+		ShellRequest
+		Wait        *bool `json:"wait"`
+		WaitSeconds int   `json:"wait_seconds"`
+	}
+	if err := json.Unmarshal(args, &p); err != nil {
+		return "", err
+	}
+	if p.Session == "" {
+		return "", errSessionMessage
+	}
+	if p.Cmd == "" {
+		return "", errCmdMessage
+	}
+
+	opts, err := p.options()
+	if err != nil {
+		return "", err
+	}
+
+	csr, err := submitCommand(ctx, p.Session, p.Cmd, opts)
+	if err != nil {
+		return "", err
+	}
+	if p.Wait != nil && !*p.Wait {
+		return toJSONText(csr)
+	}
+
+	wait := mcpDefaultWait
+	if p.WaitSeconds > 0 {
+		wait = time.Duration(p.WaitSeconds) * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, wait)
+	defer cancel()
+
+	file, err := waitTicket(ctx, csr.Session, csr.Ticket)
+	if err != nil {
+		return "", err
+	}
+	if len(file) == 0 {
+		// Still running, hand back the ticket to poll
+		return toJSONText(csr)
+	}
+	return string(file), nil
+}
+
+func mcpCheckStatus(ctx context.Context, args json.RawMessage) (string, error) {
+	var p struct {
+		Session string `json:"session"`
+		Ticket  int    `json:"ticket"`
+	}
+	if err := json.Unmarshal(args, &p); err != nil {
+		return "", err
+	}
+	if p.Session == "" {
+		return "", errSessionMessage
+	}
+
+	file, err := readTicket(p.Session, p.Ticket)
+	if err != nil {
+		return "", err
+	}
+	if len(file) == 0 {
+		msg := fmt.Sprintf("No output for ticket %d yet. Check again after waiting a bit!", p.Ticket)
+		return toJSONText(&JsonMsg{Status: "working", Message: msg})
+	}
+	return string(file), nil
+}
+
+func mcpGetHistory(ctx context.Context, args json.RawMessage) (string, error) {
+	var p struct {
+		Session string `json:"session"`
+	}
+	if err := json.Unmarshal(args, &p); err != nil {
+		return "", err
+	}
+	if p.Session == "" {
+		return "", errSessionMessage
+	}
+
+	responses, err := readHistory(p.Session)
+	if err != nil {
+		return "", err
+	}
+	return toJSONText(responses)
+}
+
+func mcpSearchHistory(ctx context.Context, args json.RawMessage) (string, error) {
+	var p struct {
+		Q       string `json:"q"`
+		Session string `json:"session"`
+		Mode    string `json:"mode"`
+	}
+	if err := json.Unmarshal(args, &p); err != nil {
+		return "", err
+	}
+	if strings.TrimSpace(p.Q) == "" {
+		return "", errQueryMessage
+	}
+	if p.Session != "" && !validSessionName(p.Session) {
+		return "", errSessionMessage
+	}
+
+	tickets, err := searchTickets(p.Session)
+	if err != nil {
+		return "", err
+	}
+	var hits []SearchHit
+	switch p.Mode {
+	case "", searchText:
+		p.Mode, hits = searchText, textSearch(tickets, p.Q)
+	case searchSemantic:
+		if embeddingsURL == "" {
+			return "", errSemanticMessage
+		}
+		if hits, err = semanticSearch(ctx, tickets, p.Q); err != nil {
+			return "", err
+		}
+	default:
+		return "", errSearchModeMessage
+	}
+	return toJSONText(&SearchResults{Query: p.Q, Mode: p.Mode, Hits: rankHits(ctx, hits, defaultSearchLimit)})
+}
+
+func mcpSuggestCommands(ctx context.Context, args json.RawMessage) (string, error) {
+	var p struct {
+		Goal    string `json:"goal"`
+		Session string `json:"session"`
+	}
+	if err := json.Unmarshal(args, &p); err != nil {
+		return "", err
+	}
+	if strings.TrimSpace(p.Goal) == "" {
+		return "", errGoalMessage
+	}
+	if p.Session != "" && !validSessionName(p.Session) {
+		return "", errSessionMessage
+	}
+	if suggestURL == "" {
+		return "", errSuggestOffMessage
+	}
+
+	suggestions, err := suggestCommands(ctx, p.Session, strings.TrimSpace(p.Goal), defaultSuggestions)
+	if err != nil {
+		return "", err
+	}
+	return toJSONText(&SuggestResults{
+		Type:        "suggestions",
+		Next:        "These commands were not run. Review them, then run the one you choose",
+		Session:     p.Session,
+		Goal:        strings.TrimSpace(p.Goal),
+		Suggestions: suggestions,
+	})
+}
+
+func mcpSaveNote(ctx context.Context, args json.RawMessage) (string, error) {
+	var p struct {
+		Session string `json:"session"`
+		Text    string `json:"text"`
+	}
+	if err := json.Unmarshal(args, &p); err != nil {
+		return "", err
+	}
+	if !validSessionName(p.Session) {
+		return "", errSessionMessage
+	}
+	if strings.TrimSpace(p.Text) == "" || len(p.Text) > maxNoteBytes {
+		return "", errNoteMessage
+	}
+
+	note, err := addNote(p.Session, p.Text)
+	if err != nil {
+		return "", err
+	}
+	return toJSONText(note)
+}
+
+func mcpGetNotes(ctx context.Context, args json.RawMessage) (string, error) {
+	var p struct {
+		Session string `json:"session"`
+	}
+	if err := json.Unmarshal(args, &p); err != nil {
+		return "", err
+	}
+	if !validSessionName(p.Session) {
+		return "", errSessionMessage
+	}
+
+	notes, err := readNotes(p.Session)
+	if err != nil {
+		return "", err
+	}
+	return toJSONText(notes)
+}
+
+func mcpGetBriefing(ctx context.Context, args json.RawMessage) (string, error) {
+	var p struct {
+		Session string `json:"session"`
+	}
+	if err := json.Unmarshal(args, &p); err != nil {
+		return "", err
+	}
+	if !validSessionName(p.Session) {
+		return "", errSessionMessage
+	}
+
+	b, err := buildBriefing(ctx, p.Session, defaultBriefingTickets, defaultBriefingTokens)
+	if err != nil {
+		return "", err
+	}
+	return briefingText(b), nil
+}
+
+func mcpReadFile(ctx context.Context, args json.RawMessage) (string, error) {
+	var p struct {
+		Path string `json:"path"`
+	}
+	if err := json.Unmarshal(args, &p); err != nil {
+		return "", err
+	}
+
+	info, err := os.Stat(p.Path)
+	if err != nil {
+		return "", err
+	}
+	if info.Size() > mcpMaxFileSize {
+		return "", fmt.Errorf("file exceeds %d bytes", mcpMaxFileSize)
+	}
+
+	content, err := os.ReadFile(p.Path)
+	if err != nil {
+		return "", err
+	}
+	if !utf8.Valid(content) {
+		return "base64:" + base64.StdEncoding.EncodeToString(content), nil
+	}
+	return string(content), nil
+}
+
+func mcpWriteFile(ctx context.Context, args json.RawMessage) (string, error) {
+	var p struct {
+		Path     string `json:"path"`
+		Content  string `json:"content"`
+		Encoding string `json:"encoding"`
+	}
+	if err := json.Unmarshal(args, &p); err != nil {
+		return "", err
+	}
+	if p.Path == "" {
+		return "", fmt.Errorf("path is required")
+	}
+
+	content := []byte(p.Content)
+	if p.Encoding == "base64" {
+		var err error
+		if content, err = base64.StdEncoding.DecodeString(p.Content); err != nil {
+			return "", err
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(p.Path), 0755); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(p.Path, content, 0644); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Wrote %d bytes to %s", len(content), p.Path), nil
+}
+
+// mcpHandle dispatches one MCP message, returning nil for notifications.
+func mcpHandle(ctx context.Context, req *rpcRequest) *rpcResponse {
+	if req.ID == nil {
+		return nil // notifications such as notifications/initialized
+	}
+
+	result := func(v interface{}) *rpcResponse {
+		return &rpcResponse{JSONRPC: "2.0", ID: req.ID, Result: v}
+	}
+
+	switch req.Method {
+	case "initialize":
+		return result(obj{
+			"protocolVersion": mcpProtocolVersion,
+			"capabilities":    obj{"tools": obj{}},
+			"serverInfo":      obj{"name": "llmass", "version": version},
+		})
+	case "ping":
+		return result(obj{})
+	case "tools/list":
+		return result(obj{"tools": mcpTools})
+	case "tools/call":
+		var p struct {
+			Name      string          `json:"name"`
+			Arguments json.RawMessage `json:"arguments"`
+		}
+		if err := json.Unmarshal(req.Params, &p); err != nil {
+			return newRPCError(req.ID, rpcInvalidParams, err.Error())
+		}
+		if len(p.Arguments) == 0 {
+			p.Arguments = json.RawMessage("{}")
+		}
+		for _, t := range mcpTools {
+			if t.Name != p.Name {
+				continue
+			}
+			text, err := t.call(ctx, p.Arguments)
+			if err != nil {
+				return result(&mcpCallResult{Content: []mcpContent{{Type: "text", Text: err.Error()}}, IsError: true})
+			}
+			return result(&mcpCallResult{Content: []mcpContent{{Type: "text", Text: text}}})
+		}
+		return newRPCError(req.ID, rpcInvalidParams, fmt.Sprintf("Unknown tool %s", p.Name))
+	}
+	return newRPCError(req.ID, rpcMethodNotFound, fmt.Sprintf("Method %s not found", req.Method))
+}
+
+// mcpDecode parses a single message, returning an error response if it is
+// not valid JSON-RPC.
+func mcpDecode(line []byte) (*rpcRequest, *rpcResponse) {
+	req := &rpcRequest{}
+	if err := json.Unmarshal(line, req); err != nil {
+		if json.Valid(line) {
+			return nil, newRPCError(nil, rpcInvalidRequest, "Invalid JSON-RPC request")
+		}
+		return nil, newRPCError(nil, rpcParseError, err.Error())
+	}
+	if req.JSONRPC != "2.0" || req.Method == "" {
+		return nil, newRPCError(req.ID, rpcInvalidRequest, "Invalid JSON-RPC request")
+	}
+	return req, nil
+}
+
+// serveMCPStdio speaks newline delimited MCP on stdin/stdout until EOF.
+func serveMCPStdio(in io.Reader, out io.Writer) error {
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), maxRequestBody)
+	enc := json.NewEncoder(out)
+
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		req, resp := mcpDecode(line)
+		if req != nil {
+			resp = mcpHandle(context.Background(), req)
+		}
+		if resp == nil {
+			continue
+		}
+		if err := enc.Encode(resp); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+var (
+	mcpSSEMu      sync.Mutex
+	mcpSSEStreams = map[string]chan *rpcResponse{}
+)
+
+// mcpSSEHandler opens the server-to-client half of the MCP HTTP+SSE
+// transport and announces where to POST messages.
+func mcpSSEHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, errMethodMessage)
+		return
+	}
+
+	// Validate the hash parameter
+	hashParam := r.URL.Query().Get("hash")
+	if !checkHash(r, hashParam) {
+		writeError(w, errHashMessage)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJsonError(w, "Streaming unsupported")
+		return
+	}
+
+	// The stream outlives the server's write timeout
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	id := hex.EncodeToString(buf)
+	ch := make(chan *rpcResponse, 16)
+
+	mcpSSEMu.Lock()
+	mcpSSEStreams[id] = ch
+	mcpSSEMu.Unlock()
+	defer func() {
+		mcpSSEMu.Lock()
+		delete(mcpSSEStreams, id)
+		mcpSSEMu.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	fmt.Fprintf(w, "event: endpoint\ndata: %s/mcp/message?sessionId=%s&hash=%s\n\n", basePath, id, hashPassword.Load())
+	flusher.Flush()
+
+	keepalive := time.NewTicker(30 * time.Second)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			fmt.Fprint(w, ": ping\n\n")
+			flusher.Flush()
+		case resp := <-ch:
+			data, err := json.Marshal(resp)
+			if err != nil {
+				logger.Error("failed to marshal MCP response", "err", err)
+				continue
+			}
+			fmt.Fprintf(w, "event: message\ndata: %s\n\n", data)
+			flusher.Flush()
+		}
+	}
+}
+
+// mcpMessageHandler accepts client-to-server MCP messages and replies over
+// the matching SSE stream.
+func mcpMessageHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodPost {
+		writeError(w, errMethodMessage)
+		return
+	}
+
+	// Validate the hash parameter
+	hashParam := r.URL.Query().Get("hash")
+	if !checkHash(r, hashParam) {
+		writeError(w, errHashMessage)
+		return
+	}
+
+	mcpSSEMu.Lock()
+	ch, ok := mcpSSEStreams[r.URL.Query().Get("sessionId")]
+	mcpSSEMu.Unlock()
+	if !ok {
+		writeError(w, errMCPSessionMessage)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxRequestBody))
+	if err != nil {
+		writeError(w, errBodyMessage)
+		return
+	}
+
+	req, resp := mcpDecode(body)
+	w.WriteHeader(http.StatusAccepted)
+
+	go func() {
+		if req != nil {
+			resp = mcpHandle(context.Background(), req)
+		}
+		if resp == nil {
+			return
+		}
+		select {
+		case ch <- resp:
+		case <-time.After(time.Minute):
+			logger.Warn("dropped MCP response, stream is not being read")
+		}
+	}()
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// /history?format=messages renders a session as the tool call and tool
+// result pairs an agent would have exchanged with the run_command tool, in
+// OpenAI chat format or with provider=anthropic in Anthropic's, ready to
+// replay into a conversation or to use as a fine-tuning example.
+
+const (
+	formatMessages = "messages"
+)
+
+var (
+	errProviderMessage = paramError("provider", "Invalid 'provider' parameter, use openai or anthropic")
+)
+
+type openAIToolCall struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Function struct {
+		Name      string `json:"name"`
+		Arguments string `json:"arguments"`
+	} `json:"function"`
+}
+
+type openAIMessage struct {
+	Role       string           `json:"role"`
+	Content    *string          `json:"content"`
+	ToolCalls  []openAIToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string           `json:"tool_call_id,omitempty"`
+}
+
+type anthropicBlock struct {
+	Type      string      `json:"type"`
+	ID        string      `json:"id,omitempty"`
+	Name      string      `json:"name,omitempty"`
+	Input     interface{} `json:"input,omitempty"`
+	ToolUseID string      `json:"tool_use_id,omitempty"`
+	Content   string      `json:"content,omitempty"`
+	IsError   bool        `json:"is_error,omitempty"`
+}
+
+type anthropicMessage struct {
+	Role    string           `json:"role"`
+	Content []anthropicBlock `json:"content"`
+}
+
+// toolResultText is the tool result content of a ticket, its output and a
+// nonzero exit code.
+func toolResultText(res *CmdResults) string {
+	text := res.Output
+	if res.ExitCode != nil && *res.ExitCode != 0 {
+		if text != "" && !strings.HasSuffix(text, "\n") {
+			text += "\n"
+		}
+		text += fmt.Sprintf("[exit code %d]", *res.ExitCode)
+	}
+	return text
+}
+
+// historyMessages converts tickets into messages for provider.
+func historyMessages(responses []*CmdResults, provider string) ([]interface{}, error) {
+	messages := []interface{}{}
+	for _, res := range responses {
+		id := fmt.Sprintf("call_%d", res.Ticket)
+		input := map[string]string{"session": res.Session, "cmd": res.Input}
+		text := toolResultText(res)
+		failed := res.ExitCode != nil && *res.ExitCode != 0
+
+		switch provider {
+		case "anthropic":
+			messages = append(messages,
+				&anthropicMessage{Role: "assistant", Content: []anthropicBlock{{Type: "tool_use", ID: id, Name: "run_command", Input: input}}},
+				&anthropicMessage{Role: "user", Content: []anthropicBlock{{Type: "tool_result", ToolUseID: id, Content: text, IsError: failed}}},
+			)
+		case "", "openai":
+			args, err := json.Marshal(input)
+			if err != nil {
+				return nil, err
+			}
+			call := openAIToolCall{ID: id, Type: "function"}
+			call.Function.Name, call.Function.Arguments = "run_command", string(args)
+			messages = append(messages,
+				&openAIMessage{Role: "assistant", ToolCalls: []openAIToolCall{call}},
+				&openAIMessage{Role: "tool", Content: &text, ToolCallID: id},
+			)
+		default:
+			return nil, errProviderMessage
+		}
+	}
+	return messages, nil
+}
+
+// writeHistoryMessages writes the session as {"messages": [...]}, the shape
+// of a chat fine-tuning example. Notes become the system prompt, a leading
+// system message for OpenAI and the top level system field for Anthropic.
+func writeHistoryMessages(w http.ResponseWriter, r *http.Request, responses []*CmdResults, notes []*Note) {
+	provider := r.URL.Query().Get("provider")
+	messages, err := historyMessages(responses, provider)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	resp := obj{"messages": messages}
+	if len(notes) > 0 {
+		system := "Your notes from this session:\n\n" + notesText(notes)
+		if provider == "anthropic" {
+			resp["system"] = system
+		} else {
+			resp["messages"] = append([]interface{}{&openAIMessage{Role: "system", Content: &system}}, messages...)
+		}
+	}
+
+	jsonResp, err := json.Marshal(resp)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to marshal JSON response: %v", err)
+		writeJsonError(w, msg)
+		return
+	}
+
+	fmt.Fprint(w, string(jsonResp))
+}
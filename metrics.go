@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// metricsHours is how far back the in-memory metrics store reaches.
+const metricsHours = 24
+
+// metricsBucket aggregates the commands that finished in one hour.
+type metricsBucket struct {
+	Hour      time.Time
+	Commands  int
+	Failures  int
+	Durations []int64 // wall milliseconds
+	Sessions  map[string]struct{}
+}
+
+var (
+	metricsMu      sync.Mutex
+	metricsBuckets []*metricsBucket // oldest first
+)
+
+// recordCommand adds a finished command to the metrics store.
+func recordCommand(session string, cer *CmdResults) {
+	now := time.Now().UTC()
+	hour := now.Truncate(time.Hour)
+
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+
+	if n := len(metricsBuckets); n == 0 || !metricsBuckets[n-1].Hour.Equal(hour) {
+		metricsBuckets = append(metricsBuckets, &metricsBucket{Hour: hour, Sessions: map[string]struct{}{}})
+	}
+	cutoff := hour.Add(-(metricsHours - 1) * time.Hour)
+	for len(metricsBuckets) > 0 && metricsBuckets[0].Hour.Before(cutoff) {
+		metricsBuckets = metricsBuckets[1:]
+	}
+
+	b := metricsBuckets[len(metricsBuckets)-1]
+	b.Commands++
+	if cer.ExitCode == nil || *cer.ExitCode != 0 {
+		b.Failures++
+	}
+	if cer.Usage != nil {
+		b.Durations = append(b.Durations, cer.Usage.WallMs)
+	}
+	b.Sessions[session] = struct{}{}
+}
+
+// MetricsHour is one hour of the metrics dashboard.
+type MetricsHour struct {
+	Hour        time.Time
+	Commands    int
+	FailureRate float64 // percent
+	P95Ms       int64
+	Sessions    int
+}
+
+// metricsSnapshot returns the last metricsHours hours, oldest first, with
+// empty hours filled in.
+func metricsSnapshot() []MetricsHour {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+
+	byHour := map[time.Time]*metricsBucket{}
+	for _, b := range metricsBuckets {
+		byHour[b.Hour] = b
+	}
+
+	now := time.Now().UTC().Truncate(time.Hour)
+	hours := make([]MetricsHour, metricsHours)
+	for i := range hours {
+		h := now.Add(-time.Duration(metricsHours-1-i) * time.Hour)
+		hours[i].Hour = h
+		b, ok := byHour[h]
+		if !ok {
+			continue
+		}
+		hours[i].Commands = b.Commands
+		hours[i].Sessions = len(b.Sessions)
+		if b.Commands > 0 {
+			hours[i].FailureRate = 100 * float64(b.Failures) / float64(b.Commands)
+		}
+		hours[i].P95Ms = percentile(b.Durations, 95)
+	}
+	return hours
+}
+
+// percentile uses the nearest-rank method.
+func percentile(values []int64, p float64) int64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := append([]int64(nil), values...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	return sorted[rank-1]
+}
+
+// chartBar is one bar of an SVG bar chart.
+type chartBar struct {
+	X, Y, Width, Height float64
+	Label               string
+}
+
+// Chart is a server-rendered SVG bar chart, one bar per hour.
+type Chart struct {
+	Title  string
+	Max    string
+	Width  float64
+	Height float64
+	Bars   []chartBar
+}
+
+const (
+	chartWidth  = 860
+	chartHeight = 120
+)
+
+func newChart(title string, hours []MetricsHour, value func(MetricsHour) float64, format func(float64) string) Chart {
+	c := Chart{Title: title, Width: chartWidth, Height: chartHeight}
+	max := 0.0
+	for _, h := range hours {
+		max = math.Max(max, value(h))
+	}
+	c.Max = format(max)
+
+	slot := chartWidth / float64(len(hours))
+	for i, h := range hours {
+		v := value(h)
+		height := 0.0
+		if max > 0 {
+			height = v / max * chartHeight
+		}
+		c.Bars = append(c.Bars, chartBar{
+			X:      float64(i)*slot + 1,
+			Y:      chartHeight - height,
+			Width:  slot - 2,
+			Height: height,
+			Label:  fmt.Sprintf("%s: %s", h.Hour.Format("Jan 2 15:00"), format(v)),
+		})
+	}
+	return c
+}
+
+func dashboardMetricsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, errMethodMessage)
+		return
+	}
+
+	hours := metricsSnapshot()
+	count := func(v float64) string { return fmt.Sprintf("%.0f", v) }
+	renderDashboard(w, r, "metrics", "Metrics", map[string]interface{}{
+		"Hours": metricsHours,
+		"Charts": []Chart{
+			newChart("Commands / hour", hours, func(h MetricsHour) float64 { return float64(h.Commands) }, count),
+			newChart("Failure rate", hours, func(h MetricsHour) float64 { return h.FailureRate }, func(v float64) string { return fmt.Sprintf("%.1f%%", v) }),
+			newChart("p95 duration", hours, func(h MetricsHour) float64 { return float64(h.P95Ms) }, func(v float64) string {
+				return (time.Duration(v) * time.Millisecond).Round(time.Millisecond).String()
+			}),
+			newChart("Active sessions", hours, func(h MetricsHour) float64 { return float64(h.Sessions) }, count),
+		},
+	})
+}
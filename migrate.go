@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Migration moves a session to another agent for maintenance, or off an
+// agent that died. The controller exports the session from where it lives,
+// the controller itself or its placed agent, imports it on the target and
+// places the session there. When the old host is gone, a previously saved
+// export can be sent as the request body instead.
+
+var (
+	errMigrateToMessage   = paramError("to", "Invalid or disconnected 'to' agent")
+	errMigrateSameMessage = newKindError(errConflict, "Session is already on that agent")
+)
+
+// sessionMigrateHandler moves a session to the agent named by to.
+func sessionMigrateHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodPost {
+		writeError(w, errMethodMessage)
+		return
+	}
+
+	// Validate the hash parameter
+	hashParam := r.URL.Query().Get("hash")
+	if !checkHash(r, hashParam) {
+		writeError(w, errHashMessage)
+		return
+	}
+
+	q := r.URL.Query()
+	session, to := q.Get("session"), q.Get("to")
+	if !validSessionName(session) {
+		writeError(w, errSessionMessage)
+		return
+	}
+	tunnelMu.Lock()
+	_, connected := tunnels[to]
+	tunnelMu.Unlock()
+	if !connected {
+		writeError(w, errMigrateToMessage)
+		return
+	}
+	if rule := routingRuleFor(session); rule != nil && !rule.allows(to) {
+		writeError(w, errRoutingMessage)
+		return
+	}
+	from := placedAgent(session)
+	if from == to {
+		writeError(w, errMigrateSameMessage)
+		return
+	}
+
+	// The archive is buffered on disk, sessions carry artifacts and recordings
+	archive, err := os.CreateTemp("", "llmass-migrate-*.tar.gz")
+	if err != nil {
+		writeJsonError(w, fmt.Sprintf("Failed to create temporary file: %v", err))
+		return
+	}
+	defer os.Remove(archive.Name())
+	defer archive.Close()
+
+	ctx := r.Context()
+	log := logFrom(ctx).With("session", session, "from", from, "to", to)
+	uploaded, err := io.Copy(archive, http.MaxBytesReader(w, r.Body, maxImportBytes))
+	if err != nil {
+		writeError(w, fmt.Errorf("%w: %v", errArchiveMessage, err))
+		return
+	}
+	if uploaded == 0 {
+		if err := fetchSessionArchive(ctx, from, session, archive); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+	if _, err := archive.Seek(0, io.SeekStart); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	resp, err := agentRequest(ctx, to, http.MethodPost, "/sessions/import", url.Values{"session": {session}}, archive)
+	if err == nil {
+		err = agentError(resp)
+	}
+	if err != nil {
+		log.Error("failed to import session on agent", "err", err)
+		writeError(w, err)
+		return
+	}
+	setPlacement(session, to)
+	log.Info("session migrated", "uploaded", uploaded > 0)
+
+	// The old copy goes once the new one is in place, unless asked to keep it
+	// or it was uploaded because the old host is unreachable
+	if uploaded == 0 && q.Get("keep") != "1" {
+		if err := removeMigratedSession(ctx, from, session); err != nil {
+			log.Warn("failed to remove migrated session from its old host", "err", err)
+		}
+	}
+	writeSessionAction(w, &SessionAction{Type: "session", Session: session, Action: "migrate", To: to})
+}
+
+// fetchSessionArchive writes the archive of session from the agent it's
+// placed on, or the controller when from is "". Sessions with running
+// commands can't be moved.
+func fetchSessionArchive(ctx context.Context, from, session string, w io.Writer) error {
+	if from == "" {
+		if !sessionExists(session) {
+			return errSessionNotFound
+		}
+		if len(runningForSession(session)) > 0 || workingElsewhere(session) {
+			return errSessionRunning
+		}
+		return writeSessionArchive(w, session)
+	}
+
+	q := url.Values{"session": {session}}
+	resp, err := agentRequest(ctx, from, http.MethodGet, "/ps", q, nil)
+	if err != nil {
+		return fmt.Errorf("Agent %s is unreachable, send a saved export of the session as the request body: %v", from, err)
+	}
+	ps := &PsResults{}
+	err = json.NewDecoder(resp.Body).Decode(ps)
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("Failed to read agent response: %v", err)
+	}
+	if len(ps.Commands) > 0 {
+		return errSessionRunning
+	}
+
+	resp, err = agentRequest(ctx, from, http.MethodGet, "/sessions/export", q, nil)
+	if err != nil {
+		return fmt.Errorf("Agent %s is unreachable, send a saved export of the session as the request body: %v", from, err)
+	}
+	defer resp.Body.Close()
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		return agentError(resp)
+	}
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// removeMigratedSession deletes the old copy of a migrated session.
+func removeMigratedSession(ctx context.Context, from, session string) error {
+	if from == "" {
+		return deleteSession(session)
+	}
+	resp, err := agentRequest(ctx, from, http.MethodDelete, "/sessions", url.Values{"session": {session}}, nil)
+	if err != nil {
+		return err
+	}
+	return agentError(resp)
+}
+
+// agentError closes resp and returns the error an agent's JSON response
+// carries, if any.
+func agentError(resp *http.Response) error {
+	defer resp.Body.Close()
+	body := &JsonErr{}
+	if err := json.NewDecoder(resp.Body).Decode(body); err != nil {
+		return fmt.Errorf("Failed to read agent response: %v", err)
+	}
+	if body.Error != "" {
+		return fmt.Errorf("%s", body.Error)
+	}
+	return nil
+}
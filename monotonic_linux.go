@@ -0,0 +1,19 @@
+package main
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+const clockMonotonic = 1
+
+// monotonicUsec is CLOCK_MONOTONIC in microseconds, which systemd expects
+// with RELOADING=1.
+func monotonicUsec() int64 {
+	var ts syscall.Timespec
+	_, _, errno := syscall.Syscall(syscall.SYS_CLOCK_GETTIME, clockMonotonic, uintptr(unsafe.Pointer(&ts)), 0)
+	if errno != 0 {
+		return 0
+	}
+	return int64(ts.Sec)*1e6 + int64(ts.Nsec)/1e3
+}
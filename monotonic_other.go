@@ -0,0 +1,8 @@
+//go:build !linux
+
+package main
+
+// monotonicUsec is only needed by systemd, which is linux only.
+func monotonicUsec() int64 {
+	return 0
+}
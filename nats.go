@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The NATS integration takes commands from a subject and publishes their
+// results back, for automation systems that already speak NATS. It uses the
+// plain text NATS client protocol directly: CONNECT, SUB, PUB, PING/PONG.
+
+const (
+	defaultNATSSubject        = "llmass.commands"
+	defaultNATSQueue          = "llmass"
+	defaultNATSResultsSubject = "llmass.results"
+	natsMaxLine               = 4096
+	natsDefaultMaxPayload     = 1 << 20
+)
+
+var (
+	natsURL            string // NATS_URL, enables the integration
+	natsSubject        string // NATS_SUBJECT commands are read from
+	natsQueue          string // NATS_QUEUE group, so instances share the work
+	natsResultsSubject string // NATS_RESULTS_SUBJECT results are published to
+
+	natsMu      sync.Mutex
+	natsConn    *natsClient
+	natsPending = map[string]string{} // session/ticket -> correlation id of bus commands
+)
+
+// BusCommand is a command message, the /shell JSON body plus an optional
+// id echoed in the replies.
+type BusCommand struct {
+	ID string `json:"id,omitempty"`
+	ShellRequest
+}
+
+// BusReply acknowledges a BusCommand on its reply subject.
+type BusReply struct {
+	ID    string `json:"id,omitempty"`
+	Error string `json:"error,omitempty"`
+	*CmdSubmission
+}
+
+// BusResult is published to NATS_RESULTS_SUBJECT when a bus command ends.
+type BusResult struct {
+	ID string `json:"id,omitempty"`
+	*CmdResults
+}
+
+// loadNATS reads the optional NATS settings and starts the subscriber.
+func loadNATS() {
+	natsURL = os.Getenv("NATS_URL")
+	if natsURL == "" {
+		return
+	}
+	if u, err := url.Parse(natsURL); err != nil || (u.Scheme != "nats" && u.Scheme != "tls") || u.Host == "" {
+		fatal("NATS_URL must be a nats:// or tls:// URL", "url", natsURL)
+	}
+	natsSubject = settingOr("NATS_SUBJECT", defaultNATSSubject)
+	natsQueue = settingOr("NATS_QUEUE", defaultNATSQueue)
+	natsResultsSubject = settingOr("NATS_RESULTS_SUBJECT", defaultNATSResultsSubject)
+
+	onEvent(func(event string, data interface{}) {
+		if cer, ok := data.(*CmdResults); ok && event == eventTicketCompleted {
+			natsPublishResult(cer)
+		}
+	})
+	go runNATS()
+	logger.Info("nats integration enabled", "subject", natsSubject, "queue", natsQueue, "results", natsResultsSubject)
+}
+
+// runNATS keeps a subscription open, reconnecting with backoff.
+func runNATS() {
+	backoff := time.Second
+	for {
+		c, err := dialNATS()
+		if err == nil {
+			backoff = time.Second
+			natsMu.Lock()
+			natsConn = c
+			natsMu.Unlock()
+			err = c.run(handleBusCommand)
+			natsMu.Lock()
+			natsConn = nil
+			natsMu.Unlock()
+		}
+		logger.Warn("nats connection lost", "err", err, "retry_in", backoff)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > tunnelMaxWait {
+			backoff = tunnelMaxWait
+		}
+	}
+}
+
+// handleBusCommand submits a command message and acknowledges it on the
+// message's reply subject.
+func handleBusCommand(payload []byte, reply string) {
+	cmd := &BusCommand{}
+	ack := &BusReply{}
+	defer func() {
+		if reply == "" {
+			return
+		}
+		body, err := json.Marshal(ack)
+		if err == nil {
+			err = natsPublish(reply, body)
+		}
+		if err != nil {
+			logger.Error("failed to reply to nats command", "err", err)
+		}
+	}()
+
+	if err := json.Unmarshal(payload, cmd); err != nil {
+		ack.Error = errBodyMessage.Error()
+		return
+	}
+	ack.ID = cmd.ID
+	if subtle.ConstantTimeCompare([]byte(cmd.Hash), []byte(hashPassword.Load())) != 1 {
+		logger.Warn("nats command with invalid hash", "id", cmd.ID)
+		ack.Error = errHashMessage.Error()
+		return
+	}
+	if !validSessionName(cmd.Session) {
+		ack.Error = errSessionMessage.Error()
+		return
+	}
+	if cmd.Cmd == "" {
+		ack.Error = errCmdMessage.Error()
+		return
+	}
+	opts, err := cmd.options()
+	if err != nil {
+		ack.Error = err.Error()
+		return
+	}
+
+	id := cmd.ID
+	if !validRequestID(id) {
+		id = newID()
+	}
+	ctx := context.WithValue(context.Background(), requestIDContextKey{}, id)
+
+	// Hold the lock so the completion can't be published before it's pending
+	natsMu.Lock()
+	defer natsMu.Unlock()
+	csr, err := submitCommand(ctx, cmd.Session, cmd.Cmd, opts)
+	if err != nil {
+		ack.Error = err.Error()
+		return
+	}
+	ack.CmdSubmission = csr
+	if !csr.IsCached {
+		natsPending[watchKey(csr.Session, csr.Ticket)] = cmd.ID
+	}
+}
+
+// natsPublishResult publishes the result of a command that came from NATS.
+func natsPublishResult(cer *CmdResults) {
+	key := watchKey(cer.Session, cer.Ticket)
+	natsMu.Lock()
+	id, ok := natsPending[key]
+	delete(natsPending, key)
+	natsMu.Unlock()
+	if !ok {
+		return
+	}
+
+	body, err := json.Marshal(&BusResult{ID: id, CmdResults: cer})
+	if err != nil {
+		logger.Error("failed to marshal nats result", "err", err)
+		return
+	}
+	if err := natsPublish(natsResultsSubject, body); err != nil {
+		logger.Error("failed to publish nats result", "session", cer.Session, "ticket", cer.Ticket, "err", err)
+	}
+}
+
+func natsPublish(subject string, body []byte) error {
+	natsMu.Lock()
+	c := natsConn
+	natsMu.Unlock()
+	if c == nil {
+		return fmt.Errorf("not connected to nats")
+	}
+	return c.publish(subject, body)
+}
+
+// natsClient is one connection to a NATS server.
+type natsClient struct {
+	conn       net.Conn
+	r          *bufio.Reader
+	writeMu    sync.Mutex
+	maxPayload int
+}
+
+func dialNATS() (*natsClient, error) {
+	u, err := url.Parse(natsURL)
+	if err != nil {
+		return nil, err
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host += ":4222"
+	}
+
+	conn, err := net.DialTimeout("tcp", host, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	c := &natsClient{conn: conn, r: bufio.NewReaderSize(conn, natsMaxLine), maxPayload: natsDefaultMaxPayload}
+
+	// The server greets with INFO before anything else
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	line, err := c.readLine()
+	if err != nil || !strings.HasPrefix(line, "INFO ") {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected nats greeting %q: %v", line, err)
+	}
+	var info struct {
+		MaxPayload  int  `json:"max_payload"`
+		TLSRequired bool `json:"tls_required"`
+	}
+	json.Unmarshal([]byte(strings.TrimPrefix(line, "INFO ")), &info)
+	if info.MaxPayload > 0 {
+		c.maxPayload = info.MaxPayload
+	}
+	if u.Scheme == "tls" || info.TLSRequired {
+		tc := tls.Client(conn, &tls.Config{ServerName: u.Hostname()})
+		if err := tc.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		c.conn = tc
+		c.r = bufio.NewReaderSize(tc, natsMaxLine)
+	}
+
+	connect := map[string]interface{}{"verbose": false, "pedantic": false, "name": "llmass", "lang": "go", "protocol": 0}
+	if u.User != nil {
+		if pass, ok := u.User.Password(); ok {
+			connect["user"], connect["pass"] = u.User.Username(), pass
+		} else {
+			connect["auth_token"] = u.User.Username()
+		}
+	}
+	opts, _ := json.Marshal(connect)
+	if err := c.write(fmt.Sprintf("CONNECT %s\r\nSUB %s %s 1\r\nPING\r\n", opts, natsSubject, natsQueue)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// The PONG confirms CONNECT and SUB were accepted
+	for {
+		line, err := c.readLine()
+		if err != nil {
+			c.conn.Close()
+			return nil, err
+		}
+		if strings.HasPrefix(line, "-ERR") {
+			c.conn.Close()
+			return nil, fmt.Errorf("nats: %s", line)
+		}
+		if line == "PONG" {
+			break
+		}
+	}
+	c.conn.SetDeadline(time.Time{})
+	logger.Info("connected to nats", "server", u.Host)
+	return c, nil
+}
+
+func (c *natsClient) readLine() (string, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func (c *natsClient) write(s string) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_, err := io.WriteString(c.conn, s)
+	return err
+}
+
+func (c *natsClient) publish(subject string, body []byte) error {
+	if len(body) > c.maxPayload {
+		return fmt.Errorf("message of %d bytes exceeds the server's max_payload of %d", len(body), c.maxPayload)
+	}
+	return c.write(fmt.Sprintf("PUB %s %d\r\n%s\r\n", subject, len(body), body))
+}
+
+// run reads messages until the connection fails, handing each MSG to fn.
+func (c *natsClient) run(fn func(payload []byte, reply string)) error {
+	defer c.conn.Close()
+	for {
+		line, err := c.readLine()
+		if err != nil {
+			return err
+		}
+		switch {
+		case line == "PING":
+			if err := c.write("PONG\r\n"); err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "MSG "):
+			// MSG <subject> <sid> [reply-to] <#bytes>
+			fields := strings.Fields(line)
+			if len(fields) != 4 && len(fields) != 5 {
+				return fmt.Errorf("malformed nats message %q", line)
+			}
+			size, err := strconv.Atoi(fields[len(fields)-1])
+			if err != nil || size < 0 || size > c.maxPayload {
+				return fmt.Errorf("malformed nats message %q", line)
+			}
+			payload := make([]byte, size+2)
+			if _, err := io.ReadFull(c.r, payload); err != nil {
+				return err
+			}
+			reply := ""
+			if len(fields) == 5 {
+				reply = fields[3]
+			}
+			go fn(payload[:size], reply)
+		case strings.HasPrefix(line, "-ERR"):
+			return fmt.Errorf("nats: %s", line)
+		}
+	}
+}
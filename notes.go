@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Notes are a session's scratchpad: free-form text an agent keeps as memory
+// between invocations, such as findings, credentials it discovered or its
+// plan. They are stored next to the tickets in SESSIONS_DIR/<session>/
+// notes.json, so they travel with session exports, and /history?notes=1
+// includes them.
+
+const (
+	notesFile    = "notes.json"
+	maxNoteBytes = 64 << 10
+)
+
+var (
+	errNoteMessage   = paramError("text", "Invalid or missing 'text' note parameter")
+	errNoteIDMessage = paramError("id", "Invalid or missing 'id' note parameter")
+	errNoteNotFound  = newKindError(errNotFound, "Note not found")
+)
+
+// Note is one entry of a session's scratchpad.
+type Note struct {
+	Type    string    `json:"type"`
+	ID      int       `json:"id"`
+	Session string    `json:"session"`
+	Text    string    `json:"text"`
+	Created time.Time `json:"created"`
+}
+
+// notesMu serializes the read, modify and write of notes files.
+var notesMu sync.Mutex
+
+// readNotes returns the session's notes, oldest first.
+func readNotes(session string) ([]*Note, error) {
+	data, err := os.ReadFile(filepath.Join(sessionsDir, session, notesFile))
+	if os.IsNotExist(err) {
+		return []*Note{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	notes := []*Note{}
+	if err := json.Unmarshal(data, &notes); err != nil {
+		return nil, fmt.Errorf("Failed to read notes: %v", err)
+	}
+	return notes, nil
+}
+
+// saveNotes replaces the session's notes, the caller holds notesMu.
+func saveNotes(session string, notes []*Note) error {
+	dir := filepath.Join(sessionsDir, session)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(notes, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, notesFile+".tmp")
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, notesFile))
+}
+
+// addNote appends a note numbered after the session's last one.
+func addNote(session, text string) (*Note, error) {
+	notesMu.Lock()
+	defer notesMu.Unlock()
+
+	notes, err := readNotes(session)
+	if err != nil {
+		return nil, err
+	}
+	note := &Note{Type: "note", ID: 1, Session: session, Text: text, Created: time.Now().UTC()}
+	if len(notes) > 0 {
+		note.ID = notes[len(notes)-1].ID + 1
+	}
+	if err := saveNotes(session, append(notes, note)); err != nil {
+		return nil, fmt.Errorf("Failed to save notes: %v", err)
+	}
+	return note, nil
+}
+
+// deleteNote removes a note and returns it.
+func deleteNote(session string, id int) (*Note, error) {
+	notesMu.Lock()
+	defer notesMu.Unlock()
+
+	notes, err := readNotes(session)
+	if err != nil {
+		return nil, err
+	}
+	for i, note := range notes {
+		if note.ID != id {
+			continue
+		}
+		if err := saveNotes(session, append(notes[:i], notes[i+1:]...)); err != nil {
+			return nil, fmt.Errorf("Failed to save notes: %v", err)
+		}
+		return note, nil
+	}
+	return nil, errNoteNotFound
+}
+
+// noteText reads a note from a JSON {"text": ...} body, or the text
+// parameter for clients that only send query strings.
+func noteText(r *http.Request) (string, error) {
+	text := r.URL.Query().Get("text")
+	if text == "" {
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxNoteBytes+1))
+		if err != nil {
+			return "", fmt.Errorf("%w: %v", errBodyMessage, err)
+		}
+		if len(strings.TrimSpace(string(body))) > 0 {
+			req := &struct {
+				Text string `json:"text"`
+			}{}
+			if err := json.Unmarshal(body, req); err != nil {
+				return "", fmt.Errorf("%w: %v", errBodyMessage, err)
+			}
+			text = req.Text
+		}
+	}
+	if strings.TrimSpace(text) == "" || len(text) > maxNoteBytes {
+		return "", errNoteMessage
+	}
+	return text, nil
+}
+
+// notesText renders notes for the plain text history.
+func notesText(notes []*Note) string {
+	var b strings.Builder
+	for _, note := range notes {
+		fmt.Fprintf(&b, "# note %d, %s\n%s", note.ID, note.Created.Format(time.RFC3339), note.Text)
+		if !strings.HasSuffix(note.Text, "\n") {
+			b.WriteString("\n")
+		}
+	}
+	return b.String()
+}
+
+func notesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// Validate the hash parameter
+	hashParam := r.URL.Query().Get("hash")
+	if !checkHash(r, hashParam) {
+		writeError(w, errHashMessage)
+		return
+	}
+
+	session := r.URL.Query().Get("session")
+	if !validSessionName(session) {
+		writeError(w, errSessionMessage)
+		return
+	}
+
+	var resp interface{}
+	switch r.Method {
+	case http.MethodGet:
+		notes, err := readNotes(session)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		resp = notes
+
+	case http.MethodPost:
+		text, err := noteText(r)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		note, err := addNote(session, text)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		logFrom(r.Context()).Info("note added", "session", session, "id", note.ID, "size", len(text))
+		resp = note
+
+	case http.MethodDelete:
+		id, err := strconv.Atoi(r.URL.Query().Get("id"))
+		if err != nil {
+			writeError(w, errNoteIDMessage)
+			return
+		}
+		note, err := deleteNote(session, id)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		logFrom(r.Context()).Info("note deleted", "session", session, "id", id)
+		resp = note
+
+	default:
+		writeError(w, errMethodMessage)
+		return
+	}
+
+	jsonResp, err := json.Marshal(resp)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to marshal JSON response: %v", err)
+		writeJsonError(w, msg)
+		return
+	}
+
+	fmt.Fprint(w, string(jsonResp))
+}
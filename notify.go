@@ -0,0 +1,446 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Notification rules are evaluated as tickets complete. A rule's conditions
+// all have to hold: the session, a nonzero exit code, a minimum duration and
+// a regular expression the output has to match. Its actions are any of an
+// email, a signed webhook POST, a Slack message and a note in the session's
+// scratchpad, so the agent finds out too when it next reads its notes. When
+// several rules match a ticket, each recipient, webhook URL and channel is
+// notified once, and one note is added.
+
+const (
+	notifyFile           = "notifications.json"
+	eventNotifyMatched   = "notification.matched"
+	defaultSMTPPort      = "587"
+	notifyOutputLength   = 4000
+	maxNotifyOutputRegex = 1024
+)
+
+var (
+	errToMessage      = paramError("to", "Invalid or missing 'to' parameter")
+	errSMTPMessage    = newKindError(errUnavailable, "Email notifications require SMTP_HOST and SMTP_FROM")
+	errNotifySlackOff = newKindError(errUnavailable, "Slack notifications require SLACK_BOT_TOKEN")
+	errNotifyNotFound = newKindError(errNotFound, "Notification rule not found")
+	errNotifyOutput   = paramError("output", "Invalid 'output' regular expression")
+	errNotifyWebhook  = paramError("webhook", "Invalid 'webhook' URL")
+	errNotifyActions  = paramError("to", "A notification rule needs 'to', 'webhook', 'slack' or 'annotate'")
+)
+
+var (
+	smtpHost     string // SMTP_HOST, enables email notifications
+	smtpPort     string // SMTP_PORT, defaults to 587
+	smtpUsername string // SMTP_USERNAME
+	smtpPassword string // SMTP_PASSWORD
+	smtpFrom     string // SMTP_FROM
+
+	notifyMu    sync.Mutex
+	notifyRules []*NotifyRule
+)
+
+// NotifyRule acts when a matching ticket completes. An empty Session
+// matches every session; the conditions are all required.
+type NotifyRule struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name,omitempty"`
+	Session     string    `json:"session,omitempty"`
+	OnFailure   bool      `json:"on_failure,omitempty"`   // only when the exit code is nonzero
+	MinDuration int       `json:"min_duration,omitempty"` // only when the command ran at least this many seconds
+	Output      string    `json:"output,omitempty"`       // only when the output matches this regular expression
+	To          []string  `json:"to,omitempty"`           // email addresses
+	Webhook     string    `json:"webhook,omitempty"`      // URL POSTed a notification.matched event
+	Secret      string    `json:"secret,omitempty"`       // signs the webhook body like a subscription's
+	Slack       string    `json:"slack,omitempty"`        // channel to post to
+	Annotate    bool      `json:"annotate,omitempty"`     // add a note to the session
+	Created     time.Time `json:"created"`
+
+	outputRe *regexp.Regexp
+}
+
+// NotifyMatch is the data of a notification.matched webhook event.
+type NotifyMatch struct {
+	Rules   []string    `json:"rules"`
+	Reasons []string    `json:"reasons"`
+	Ticket  *CmdResults `json:"ticket"`
+}
+
+// match reports whether the ticket satisfies the rule, and why.
+func (nr *NotifyRule) match(cer *CmdResults) ([]string, bool) {
+	if nr.Session != "" && nr.Session != cer.Session {
+		return nil, false
+	}
+	var reasons []string
+	if nr.OnFailure {
+		if cer.ExitCode == nil || *cer.ExitCode == 0 {
+			return nil, false
+		}
+		reasons = append(reasons, fmt.Sprintf("exit code %d", *cer.ExitCode))
+	}
+	if nr.MinDuration > 0 {
+		if cer.Usage == nil || cer.Usage.WallMs < int64(nr.MinDuration)*1000 {
+			return nil, false
+		}
+		reasons = append(reasons, fmt.Sprintf("ran %s", time.Duration(cer.Usage.WallMs)*time.Millisecond))
+	}
+	if nr.outputRe != nil {
+		// A summarized ticket keeps what the command printed aside
+		output := cer.Output
+		if cer.FullOutput != "" {
+			output = cer.FullOutput
+		}
+		if !nr.outputRe.MatchString(output) {
+			return nil, false
+		}
+		reasons = append(reasons, fmt.Sprintf("output matched %q", nr.Output))
+	}
+	if len(reasons) == 0 {
+		reasons = append(reasons, "completed")
+	}
+	return reasons, true
+}
+
+// label names the rule in notifications.
+func (nr *NotifyRule) label() string {
+	if nr.Name != "" {
+		return nr.Name
+	}
+	return nr.ID
+}
+
+// validate checks a rule submitted to /notifications and compiles its
+// output expression.
+func (nr *NotifyRule) validate() error {
+	if nr.Session != "" && !validSessionName(nr.Session) {
+		return errSessionMessage
+	}
+	if nr.MinDuration < 0 {
+		return errDurationMessage
+	}
+	if nr.Output != "" {
+		re, err := regexp.Compile(nr.Output)
+		if err != nil || len(nr.Output) > maxNotifyOutputRegex {
+			return errNotifyOutput
+		}
+		nr.outputRe = re
+	}
+	if len(nr.To) == 0 && nr.Webhook == "" && nr.Slack == "" && !nr.Annotate {
+		return errNotifyActions
+	}
+	if len(nr.To) > 0 && smtpHost == "" {
+		return errSMTPMessage
+	}
+	for _, addr := range nr.To {
+		if a, err := mail.ParseAddress(addr); err != nil || a.Address != addr {
+			return errToMessage
+		}
+	}
+	if nr.Webhook != "" {
+		if u, err := url.Parse(nr.Webhook); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errNotifyWebhook
+		}
+	}
+	if nr.Slack != "" && slackToken == "" {
+		return errNotifySlackOff
+	}
+	return nil
+}
+
+// loadNotifyRules restores the rules persisted in DATA_DIR.
+func loadNotifyRules() error {
+	data, err := os.ReadFile(filepath.Join(dataDir, notifyFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	notifyMu.Lock()
+	defer notifyMu.Unlock()
+	if err := json.Unmarshal(data, &notifyRules); err != nil {
+		return err
+	}
+	for _, nr := range notifyRules {
+		if nr.Output == "" {
+			continue
+		}
+		re, err := regexp.Compile(nr.Output)
+		if err != nil {
+			return fmt.Errorf("notification rule %s: %v", nr.ID, err)
+		}
+		nr.outputRe = re
+	}
+	return nil
+}
+
+// loadNotifications reads the SMTP settings and persisted rules, and
+// subscribes to ticket completions to evaluate them.
+func loadNotifications() error {
+	smtpHost = os.Getenv("SMTP_HOST")
+	smtpPort = os.Getenv("SMTP_PORT")
+	smtpUsername = os.Getenv("SMTP_USERNAME")
+	smtpPassword = os.Getenv("SMTP_PASSWORD")
+	smtpFrom = os.Getenv("SMTP_FROM")
+	if smtpPort == "" {
+		smtpPort = defaultSMTPPort
+	}
+
+	if err := loadNotifyRules(); err != nil {
+		return err
+	}
+
+	if smtpHost != "" {
+		if smtpFrom == "" {
+			return fmt.Errorf("SMTP_FROM must be set when SMTP_HOST is set")
+		}
+		logger.Info("email notifications enabled", "smtp_host", smtpHost, "smtp_port", smtpPort)
+	}
+	onEvent(func(event string, data interface{}) {
+		if cer, ok := data.(*CmdResults); ok && event == eventTicketCompleted {
+			notifyCompletion(cer)
+		}
+	})
+	return nil
+}
+
+// saveNotifications persists the rules, the caller holds notifyMu.
+func saveNotifications() error {
+	data, err := json.MarshalIndent(notifyRules, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(dataDir, notifyFile+".tmp")
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dataDir, notifyFile))
+}
+
+// notifyCompletion runs the actions of the rules the ticket matches.
+func notifyCompletion(cer *CmdResults) {
+	var (
+		rules    []string
+		reasons  []string
+		to       []string
+		webhooks []*Webhook
+		channels []string
+		annotate bool
+		seen     = map[string]bool{}
+	)
+	notifyMu.Lock()
+	for _, nr := range notifyRules {
+		why, ok := nr.match(cer)
+		if !ok {
+			continue
+		}
+		rules = append(rules, nr.label())
+		for _, r := range why {
+			if !seen["reason:"+r] {
+				seen["reason:"+r] = true
+				reasons = append(reasons, r)
+			}
+		}
+		for _, addr := range nr.To {
+			if !seen["to:"+addr] {
+				seen["to:"+addr] = true
+				to = append(to, addr)
+			}
+		}
+		if nr.Webhook != "" && !seen["webhook:"+nr.Webhook] {
+			seen["webhook:"+nr.Webhook] = true
+			webhooks = append(webhooks, &Webhook{ID: "rule " + nr.ID, URL: nr.Webhook, Secret: nr.Secret})
+		}
+		if nr.Slack != "" && !seen["slack:"+nr.Slack] {
+			seen["slack:"+nr.Slack] = true
+			channels = append(channels, nr.Slack)
+		}
+		annotate = annotate || nr.Annotate
+	}
+	notifyMu.Unlock()
+
+	if len(rules) == 0 {
+		return
+	}
+	summary := fmt.Sprintf("ticket %d matched %s (%s)", cer.Ticket, strings.Join(rules, ", "), strings.Join(reasons, ", "))
+
+	if len(to) > 0 && smtpHost != "" {
+		if err := sendMail(to, completionSubject(cer), completionBody(cer)); err != nil {
+			logger.Error("failed to email notification", "session", cer.Session, "ticket", cer.Ticket, "err", err)
+		}
+	}
+
+	if len(webhooks) > 0 {
+		body, err := json.Marshal(&WebhookEvent{ID: newID(), Event: eventNotifyMatched, Time: time.Now().UTC(),
+			Data: &NotifyMatch{Rules: rules, Reasons: reasons, Ticket: cer}})
+		if err != nil {
+			logger.Error("failed to marshal notification", "session", cer.Session, "ticket", cer.Ticket, "err", err)
+		} else {
+			for _, wh := range webhooks {
+				go deliverWebhook(wh, eventNotifyMatched, body)
+			}
+		}
+	}
+
+	for _, channel := range channels {
+		text := fmt.Sprintf("*%s* %s: `%s`\n```%s```", cer.Session, summary, cer.Input, truncateOutput(cer.Output, slackMaxOutput))
+		if err := slackPost(obj{"channel": channel, "text": text}); err != nil {
+			logger.Error("failed to post Slack notification", "channel", channel, "err", err)
+		}
+	}
+
+	if annotate {
+		if _, err := addNote(cer.Session, fmt.Sprintf("Notification: %s: %s", summary, cer.Input)); err != nil {
+			logger.Error("failed to annotate session", "session", cer.Session, "ticket", cer.Ticket, "err", err)
+		}
+	}
+}
+
+func completionSubject(cer *CmdResults) string {
+	status := "finished"
+	if cer.ExitCode != nil && *cer.ExitCode != 0 {
+		status = fmt.Sprintf("failed (exit %d)", *cer.ExitCode)
+	}
+	return fmt.Sprintf("[llmass] %s ticket %d %s", cer.Session, cer.Ticket, status)
+}
+
+func completionBody(cer *CmdResults) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Session: %s\nTicket: %d\nCommand: %s\n", cer.Session, cer.Ticket, cer.Input)
+	if cer.ExitCode != nil {
+		fmt.Fprintf(&b, "Exit code: %d\n", *cer.ExitCode)
+	}
+	if cer.Usage != nil {
+		fmt.Fprintf(&b, "Duration: %s\n", time.Duration(cer.Usage.WallMs)*time.Millisecond)
+	}
+	fmt.Fprintf(&b, "\n%s\n", truncateOutput(cer.Output, notifyOutputLength))
+	return b.String()
+}
+
+func sendMail(to []string, subject, body string) error {
+	var auth smtp.Auth
+	if smtpUsername != "" {
+		auth = smtp.PlainAuth("", smtpUsername, smtpPassword, smtpHost)
+	}
+
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\n", smtpFrom)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+
+	return smtp.SendMail(smtpHost+":"+smtpPort, auth, smtpFrom, to, []byte(msg.String()))
+}
+
+// notificationsHandler lists (GET), registers (POST) and deletes (DELETE)
+// notification rules.
+func notificationsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// Validate the hash parameter
+	hashParam := r.URL.Query().Get("hash")
+	if !checkHash(r, hashParam) {
+		writeError(w, errHashMessage)
+		return
+	}
+
+	var resp interface{}
+	switch r.Method {
+	case http.MethodGet:
+		notifyMu.Lock()
+		list := make([]NotifyRule, 0, len(notifyRules))
+		for _, nr := range notifyRules {
+			c := *nr
+			c.Secret = ""
+			list = append(list, c)
+		}
+		notifyMu.Unlock()
+		resp = list
+
+	case http.MethodPost:
+		nr := &NotifyRule{}
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxRequestBody))
+		if err != nil || json.Unmarshal(body, nr) != nil {
+			writeError(w, errBodyMessage)
+			return
+		}
+		if err := nr.validate(); err != nil {
+			writeError(w, err)
+			return
+		}
+		nr.ID = newID()
+		nr.Created = time.Now().UTC()
+
+		notifyMu.Lock()
+		notifyRules = append(notifyRules, nr)
+		err = saveNotifications()
+		notifyMu.Unlock()
+		if err != nil {
+			msg := fmt.Sprintf("Failed to save notification rules: %v", err)
+			logger.Error(msg)
+			writeJsonError(w, msg)
+			return
+		}
+		c := *nr
+		c.Secret = ""
+		resp = c
+
+	case http.MethodDelete:
+		id := r.URL.Query().Get("id")
+		notifyMu.Lock()
+		found := false
+		for i, nr := range notifyRules {
+			if nr.ID == id {
+				notifyRules = append(notifyRules[:i], notifyRules[i+1:]...)
+				found = true
+				break
+			}
+		}
+		var err error
+		if found {
+			err = saveNotifications()
+		}
+		notifyMu.Unlock()
+		if !found {
+			writeError(w, errNotifyNotFound)
+			return
+		}
+		if err != nil {
+			msg := fmt.Sprintf("Failed to save notification rules: %v", err)
+			logger.Error(msg)
+			writeJsonError(w, msg)
+			return
+		}
+		writeJsonMsg(w, "deleted", fmt.Sprintf("Notification rule %s deleted", id))
+		return
+
+	default:
+		writeError(w, errMethodMessage)
+		return
+	}
+
+	jsonResp, err := json.Marshal(resp)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to marshal JSON response: %v", err)
+		writeJsonError(w, msg)
+		return
+	}
+
+	fmt.Fprint(w, string(jsonResp))
+}
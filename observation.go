@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// format=observation answers any JSON endpoint with the same small envelope,
+// meant to be dropped verbatim into a tool-calling model's tool result: a
+// status, the exit code, whether the output was cut, stdout, stderr, and the
+// ticket to fetch next. Every field is always present so the model never has
+// to guess at a shape. Errors come back in it too, with their message in
+// stderr.
+
+const (
+	formatObservation = "observation"
+
+	observationOK      = "ok"      // the request or command succeeded
+	observationFailed  = "failed"  // the command exited non-zero
+	observationRunning = "running" // the command has not finished, fetch next_ticket
+	observationError   = "error"   // the request itself failed
+)
+
+// Observation is the format=observation envelope.
+type Observation struct {
+	Status     string             `json:"status"`
+	ExitCode   *int               `json:"exit_code"`
+	Truncated  bool               `json:"truncated"`
+	Stdout     string             `json:"stdout"`
+	Stderr     string             `json:"stderr"`
+	NextTicket *ObservationTicket `json:"next_ticket"`
+	Hint       string             `json:"hint"`
+}
+
+// ObservationTicket is the ticket to fetch next and its URL.
+type ObservationTicket struct {
+	Session  string `json:"session"`
+	Ticket   int    `json:"ticket"`
+	Callback string `json:"callback"`
+}
+
+// observationWriter holds a response back so it can be written as an
+// observation once the handler is done, whatever the handler wrote.
+type observationWriter struct {
+	http.ResponseWriter
+	buf    bytes.Buffer
+	status int
+	obs    *Observation
+}
+
+func (w *observationWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *observationWriter) Write(p []byte) (int, error) {
+	return w.buf.Write(p)
+}
+
+// observe serves h with format=observation applied to anything it answers.
+func observe(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("format") != formatObservation {
+			h(w, r)
+			return
+		}
+		ow := &observationWriter{ResponseWriter: w}
+		h(ow, r)
+		ow.finish()
+	}
+}
+
+// finish writes the observation, wrapping the handler's own response when it
+// didn't set one.
+func (w *observationWriter) finish() {
+	if w.status == http.StatusNotModified {
+		w.ResponseWriter.WriteHeader(w.status)
+		return
+	}
+	obs := w.obs
+	if obs == nil {
+		body := strings.TrimSpace(w.buf.String())
+		if w.status >= http.StatusBadRequest {
+			msg, code := bodyError(body)
+			if code == "" {
+				code = statusCode(w.status)
+			}
+			obs = errorObservation(msg, code)
+		} else {
+			obs = &Observation{Status: observationOK, Stdout: body}
+		}
+	}
+	status := w.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	jsonResp, err := json.Marshal(obs)
+	if err != nil {
+		logger.Error("failed to marshal JSON response", "err", err)
+		writeJSON(w.ResponseWriter, http.StatusInternalServerError, &JsonErr{Error: fmt.Sprintf("Failed to marshal JSON response: %v", err), Code: "internal_error"})
+		return
+	}
+	w.ResponseWriter.Header().Del("Content-Length")
+	w.ResponseWriter.Header().Set("Content-Type", "application/json")
+	w.ResponseWriter.WriteHeader(status)
+	fmt.Fprintf(w.ResponseWriter, "%s\n", jsonResp)
+}
+
+// bodyError returns the message and code of a JSON error response, or the
+// body.
+func bodyError(body string) (string, string) {
+	var legacy JsonErr
+	if json.Unmarshal([]byte(body), &legacy) == nil && legacy.Error != "" {
+		return legacy.Error, legacy.Code
+	}
+	var versioned V1ErrorResponse
+	if json.Unmarshal([]byte(body), &versioned) == nil && versioned.Error.Message != "" {
+		return versioned.Error.Message, versioned.Error.Code
+	}
+	return body, ""
+}
+
+func errorObservation(msg, code string) *Observation {
+	obs := &Observation{Status: observationError, Stderr: msg, Hint: "The request failed, correct it and try again"}
+	switch code {
+	case "unavailable", "timeout":
+		obs.Hint = "The server can't answer this now, try again later"
+	case "confirmation_required":
+		obs.Hint = "The command was not run, resubmit it with confirm=1 if it is intended"
+	}
+	return obs
+}
+
+// writeObservation hands the observation to the observationWriter, or writes
+// it outright when the handler isn't wrapped by observe.
+func writeObservation(w http.ResponseWriter, obs *Observation) {
+	if ow, ok := w.(*observationWriter); ok {
+		ow.obs = obs
+		return
+	}
+	jsonResp, err := json.Marshal(obs)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to marshal JSON response: %v", err)
+		writeJsonError(w, msg)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, "%s\n", jsonResp)
+}
+
+// observationOf converts a response into an observation, text being the
+// endpoint's plain representation.
+func observationOf(v interface{}, text string) *Observation {
+	switch v := v.(type) {
+	case *Observation:
+		return v
+	case *CmdResults:
+		return resultObservation(v)
+	case *CmdSubmission:
+		return &Observation{
+			Status:     observationRunning,
+			NextTicket: &ObservationTicket{Session: v.Session, Ticket: v.Ticket, Callback: v.Callback},
+			Hint:       "The command was submitted, fetch next_ticket.callback for its result",
+		}
+	}
+	if text == "" {
+		data, _ := json.Marshal(v)
+		text = string(data)
+	}
+	return &Observation{Status: observationOK, Stdout: text}
+}
+
+// resultObservation converts a finished ticket. Stdout and stderr share the
+// output, they are only told apart when TRANSCRIPT_LOG recorded them and the
+// output was returned whole.
+func resultObservation(res *CmdResults) *Observation {
+	obs := &Observation{
+		Status:    observationOK,
+		ExitCode:  res.ExitCode,
+		Truncated: res.OmittedTokens > 0 || res.BudgetExhausted || res.Summarized,
+		Stdout:    res.Output,
+		Hint:      res.Next,
+	}
+	if res.ExitCode != nil && *res.ExitCode != 0 {
+		obs.Status = observationFailed
+	}
+	if res.ContinueURL != "" {
+		obs.NextTicket = &ObservationTicket{Session: res.Session, Ticket: res.Ticket, Callback: res.ContinueURL}
+	}
+	if !obs.Truncated && res.Filter == "" && res.DiffFrom == 0 {
+		if stdout, stderr, ok := transcriptStreams(res.Session, res.Ticket); ok && len(stdout)+len(stderr) == len(res.Output) {
+			obs.Stdout, obs.Stderr = stdout, stderr
+		}
+	}
+	return obs
+}
+
+// transcriptStreams reads a ticket's stdout and stderr back from the
+// session's transcript.
+func transcriptStreams(session string, ticket int) (string, string, bool) {
+	f, err := os.Open(filepath.Join(sessionsDir, session, transcriptFile))
+	if err != nil {
+		return "", "", false
+	}
+	defer f.Close()
+
+	var stdout, stderr strings.Builder
+	found := false
+	prefix := " " + strconv.Itoa(ticket) + " "
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64<<10), 64<<20)
+	for scanner.Scan() {
+		// <time> <ticket> <stream> <quoted payload>
+		_, rest, ok := strings.Cut(scanner.Text(), " ")
+		if !ok || !strings.HasPrefix(" "+rest, prefix) {
+			continue
+		}
+		stream, quoted, _ := strings.Cut(strings.TrimPrefix(" "+rest, prefix), " ")
+		payload, err := strconv.Unquote(quoted)
+		if err != nil {
+			continue
+		}
+		switch stream {
+		case "out":
+			stdout.WriteString(payload)
+		case "err":
+			stderr.WriteString(payload)
+		default:
+			continue
+		}
+		found = true
+	}
+	if scanner.Err() != nil {
+		return "", "", false
+	}
+	return stdout.String(), stderr.String(), found
+}
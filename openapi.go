@@ -0,0 +1,661 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+)
+
+type obj = map[string]interface{}
+
+// apiSchemas lists the response and request types published under
+// components/schemas, keyed by the Go type name.
+var apiSchemas = []interface{}{
+	CmdSubmission{},
+	CmdResults{},
+	ShellRequest{},
+	DryRunResult{},
+	PsResults{},
+	SessionInfo{},
+	AgentInfo{},
+	SessionAction{},
+	SessionLimits{},
+	Workspace{},
+	ContextDoc{},
+	Note{},
+	Alias{},
+	SearchResults{},
+	SuggestResults{},
+	Briefing{},
+	EnvSnapshot{},
+	Stats{},
+	SessionQueue{},
+	QueuedCommand{},
+	QueueState{},
+	GitCommit{},
+	TicketPrune{},
+	SessionPort{},
+	Checkpoint{},
+	Observation{},
+	OutputChunk{},
+	Manifest{},
+	VersionInfo{},
+	WhoAmI{},
+	AIPlugin{},
+	RiskWarning{},
+	WorkspaceAction{},
+	Webhook{},
+	WebhookEvent{},
+	NotifyRule{},
+	NotifyMatch{},
+	Approval{},
+	ApprovalDecision{},
+	Activity{},
+	TailEvent{},
+	JsonErr{},
+	V1ErrorResponse{},
+	JsonMsg{},
+}
+
+// schemaBuilder derives JSON schemas from Go types using their json tags.
+// Named structs are emitted once under components/schemas and referenced,
+// which also keeps recursive types like ProcInfo finite.
+type schemaBuilder struct {
+	components obj
+}
+
+func (b *schemaBuilder) schemaFor(t reflect.Type) obj {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == reflect.TypeOf(time.Time{}) {
+		return obj{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return obj{"type": "string"}
+	case reflect.Bool:
+		return obj{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return obj{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return obj{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return obj{"type": "array", "items": b.schemaFor(t.Elem())}
+	case reflect.Map:
+		return obj{"type": "object", "additionalProperties": b.schemaFor(t.Elem())}
+	case reflect.Interface:
+		return obj{}
+	case reflect.Struct:
+		if t.Name() == "" {
+			props := obj{}
+			b.addStructFields(t, props)
+			return obj{"type": "object", "properties": props}
+		}
+		if _, ok := b.components[t.Name()]; !ok {
+			props := obj{}
+			b.components[t.Name()] = obj{"type": "object", "properties": props}
+			b.addStructFields(t, props)
+		}
+		return ref(t.Name())
+	}
+	return obj{}
+}
+
+func (b *schemaBuilder) addStructFields(t reflect.Type, props obj) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Anonymous && f.Type.Kind() == reflect.Struct {
+			b.addStructFields(f.Type, props)
+			continue
+		}
+		if f.PkgPath != "" {
+			continue // unexported
+		}
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		props[name] = b.schemaFor(f.Type)
+	}
+}
+
+func ref(name string) obj {
+	return obj{"$ref": "#/components/schemas/" + name}
+}
+
+func queryParam(name, desc string, required bool, typ string) obj {
+	return obj{"name": name, "in": "query", "description": desc, "required": required, "schema": obj{"type": typ}}
+}
+
+var (
+	agentParamSpec     = queryParam("agent", "Route the request to this connected agent instead of running it on the controller.", false, "string")
+	placementParamSpec = queryParam("placement", "Place a new session on the least loaded live agent with these labels, e.g. os=linux,gpu=true.", false, "string")
+	formatParamSpec    = queryParam("format", "json (default), text, ndjson, or observation for a tool result envelope.", false, "string")
+	hashParamSpec      = queryParam("hash", "Must match the server HASH.", true, "string")
+	sessionParamSpec   = queryParam("session", "The session name.", true, "string")
+	ticketParamSpec    = queryParam("ticket", "The ticket number.", true, "integer")
+	workspaceParamSpec = queryParam("name", "The shared workspace name.", true, "string")
+)
+
+// errorResponse is any error, its status and code come from its kind.
+var errorResponse = obj{"description": "Error, with a code matching the HTTP status", "content": obj{"application/json": obj{"schema": ref("JsonErr")}}}
+
+func jsonResponses(schema string) obj {
+	return obj{
+		"200":     obj{"description": "OK", "content": obj{"application/json": obj{"schema": ref(schema)}}},
+		"default": errorResponse,
+	}
+}
+
+func operation(summary string, params []obj, responses obj) obj {
+	return obj{"summary": summary, "parameters": params, "responses": responses}
+}
+
+// openAPISpec builds the OpenAPI 3 document for every endpoint.
+func openAPISpec(base string) obj {
+	b := &schemaBuilder{components: obj{}}
+	for _, s := range apiSchemas {
+		b.schemaFor(reflect.TypeOf(s))
+	}
+
+	shellParams := []obj{
+		hashParamSpec, sessionParamSpec,
+		queryParam("cmd", "Url encoded shell command to execute.", true, "string"),
+		queryParam("dryrun", "Set to 1 to validate the command without running it.", false, "string"),
+		queryParam("confirm", "Set to true to run a command CONFIRM_RISK holds back as risky.", false, "string"),
+		queryParam("max_tokens", "Trim the output the callback returns to about this many tokens, keeping its head and tail.", false, "integer"),
+		queryParam("diff", "Set to 1 to have the callback return only the lines changed since the session last ran the same command.", false, "string"),
+		queryParam("filter", "Filter the output the callback returns: grep:REGEX, grep-v:REGEX, jq:PATH or cols:LIST.", false, "string"),
+		queryParam("output_json", "Set to 1 to have the callback return output that is JSON as an object in output_json.", false, "string"),
+		queryParam("linenumbers", "Set to 1 to number the output lines in the ticket, so they can be referred to as line N of the ticket.", false, "string"),
+		queryParam("summarize", "Set to 0 to keep an output over SUMMARIZE_TOKENS instead of summarizing it.", false, "string"),
+		queryParam("timeout", "Seconds before the command is killed.", false, "integer"),
+		queryParam("cwd", "Working directory for the command.", false, "string"),
+		queryParam("env", "Extra environment variable as KEY=VALUE, repeatable.", false, "string"),
+		queryParam("nice", "CPU niceness from -20 to 19, over the session's default.", false, "integer"),
+		queryParam("ionice", "IO priority: idle, best-effort[:0-7] or realtime[:0-7].", false, "string"),
+		queryParam("nofile", "Open files limit (ulimit -n).", false, "integer"),
+		queryParam("core", "Core dump size limit in KiB (ulimit -c), 0 disables core dumps.", false, "integer"),
+		queryParam("cpu", "CPU seconds limit (ulimit -t).", false, "integer"),
+		queryParam("expect", "Regular expression the output must match before the send of the same position is typed, repeatable.", false, "string"),
+		queryParam("send", "Text typed followed by Enter once the expect of the same position matched, repeatable.", false, "string"),
+		queryParam("expect_timeout", "Seconds each expect waits for its match, default 30.", false, "integer"),
+		formatParamSpec, agentParamSpec, placementParamSpec,
+	}
+
+	resultParams := []obj{
+		hashParamSpec, sessionParamSpec, ticketParamSpec,
+		queryParam("max_tokens", "Trim the output to about this many tokens, keeping its head and tail around a marker of what was omitted.", false, "integer"),
+		queryParam("diff", "Set to 1 to return only the lines changed since the session last ran the same command, diff_from names that ticket.", false, "string"),
+		queryParam("output_json", "Set to 1 to return output that is JSON objects or arrays as a nested value in output_json instead of a string in output.", false, "string"),
+		queryParam("filter", "Filter the output: grep:REGEX keeps matching lines, grep-v:REGEX drops them, jq:PATH picks values from JSON, cols:LIST keeps columns such as 1,3 or 2-4.", false, "string"),
+		formatParamSpec, agentParamSpec,
+	}
+
+	// Risky commands held back by CONFIRM_RISK answer 428 with a warning
+	submitResponses := jsonResponses("CmdSubmission")
+	submitResponses["428"] = obj{"description": "Confirmation required", "content": obj{"application/json": obj{"schema": ref("RiskWarning")}}}
+
+	// Results answer 304 to an If-None-Match naming their ETag
+	resultResponses := jsonResponses("CmdResults")
+	resultResponses["304"] = obj{"description": "Not modified since the ETag in If-None-Match"}
+
+	paths := obj{
+		"/shell": obj{
+			"get": operation("Execute a shell command", shellParams, submitResponses),
+			"post": obj{
+				"summary":     "Execute a shell command from a JSON body",
+				"requestBody": obj{"required": true, "content": obj{"application/json": obj{"schema": ref("ShellRequest")}}},
+				"responses":   submitResponses,
+			},
+		},
+		"/callback": obj{
+			"get": operation("Fetch the result of a ticket", resultParams, resultResponses),
+		},
+		"/status": obj{
+			"get": operation("Fetch the result of a ticket (alias of /callback)", resultParams, resultResponses),
+		},
+		"/history": obj{
+			"get": operation("Fetch every ticket in a session", []obj{hashParamSpec, sessionParamSpec,
+				queryParam("format", "json (default), text, ndjson, observation, html, or messages for chat tool call and result pairs.", false, "string"),
+				queryParam("provider", "With format=messages, openai (default) or anthropic.", false, "string"),
+				queryParam("notes", "Set to 1 to include the session's notes; json then answers {\"tickets\", \"notes\"}.", false, "string"),
+			}, obj{
+				"200":     obj{"description": "OK", "content": obj{"application/json": obj{"schema": obj{"type": "array", "items": ref("CmdResults")}}}},
+				"304":     obj{"description": "Not modified since the ETag in If-None-Match"},
+				"default": errorResponse,
+			}),
+		},
+		"/history/git": obj{
+			"get": operation("List a session's git history, or show one commit as a patch", []obj{hashParamSpec, sessionParamSpec,
+				queryParam("limit", "Commits to list, newest first (default 50, at most 1000).", false, "integer"),
+				queryParam("commit", "A commit hash or prefix to show as a text/plain patch.", false, "string"),
+			}, obj{
+				"200":     obj{"description": "OK", "content": obj{"application/json": obj{"schema": obj{"type": "array", "items": ref("GitCommit")}}, "text/plain": obj{"schema": obj{"type": "string"}}}},
+				"default": errorResponse,
+			}),
+			"post": operation("Commit a snapshot of the session to its git history", []obj{hashParamSpec, sessionParamSpec,
+				queryParam("message", "Commit message (default Snapshot).", false, "string"),
+			}, jsonResponses("GitCommit")),
+		},
+		"/tickets/prune": obj{
+			"post": operation("Delete or archive a session's tickets by range, age or size", []obj{hashParamSpec, sessionParamSpec,
+				queryParam("from", "First ticket number to prune, inclusive.", false, "integer"),
+				queryParam("to", "Last ticket number to prune, inclusive.", false, "integer"),
+				queryParam("before", "Only tickets that finished before this RFC 3339 time, or longer ago than a duration such as 720h.", false, "string"),
+				queryParam("larger", "Only tickets taking more than this many bytes with their artifacts.", false, "integer"),
+				queryParam("archive", "Set to 1 to move the tickets into an archive in the session instead of deleting them.", false, "string"),
+				queryParam("dryrun", "Set to 1 to report what would be pruned without touching anything.", false, "string"),
+				queryParam("format", "json (default), text, ndjson or observation.", false, "string"),
+			}, jsonResponses("TicketPrune")),
+		},
+		"/sessions": obj{
+			"get": operation("List sessions", []obj{hashParamSpec}, obj{
+				"200":     obj{"description": "OK", "content": obj{"application/json": obj{"schema": obj{"type": "array", "items": ref("SessionInfo")}}}},
+				"default": errorResponse,
+			}),
+			"post": operation("Create a session", []obj{hashParamSpec, sessionParamSpec,
+				queryParam("template", "A folder in DATA_DIR/session-templates to copy into the session.", false, "string"),
+				placementParamSpec,
+			}, jsonResponses("SessionAction")),
+			"delete": operation("Kill a session's commands and delete it", []obj{hashParamSpec, sessionParamSpec}, jsonResponses("SessionAction")),
+		},
+		"/sessions/rename": obj{
+			"post": operation("Rename a session with no running commands", []obj{hashParamSpec, sessionParamSpec,
+				queryParam("to", "The new session name.", true, "string"),
+			}, jsonResponses("SessionAction")),
+		},
+		"/sessions/import": obj{
+			"post": obj{
+				"summary":     "Create a session from a /sessions/export archive",
+				"parameters":  []obj{hashParamSpec, sessionParamSpec},
+				"requestBody": obj{"required": true, "content": obj{"application/gzip": obj{"schema": obj{"type": "string", "format": "binary"}}}},
+				"responses":   jsonResponses("SessionAction"),
+			},
+		},
+		"/sessions/migrate": obj{
+			"post": obj{
+				"summary": "Move a session to another agent",
+				"parameters": []obj{hashParamSpec, sessionParamSpec,
+					queryParam("to", "The agent to move the session to.", true, "string"),
+					queryParam("keep", "1 to keep the old copy.", false, "string"),
+				},
+				"requestBody": obj{"required": false, "content": obj{"application/gzip": obj{"schema": obj{"type": "string", "format": "binary"}}}},
+				"responses":   jsonResponses("SessionAction"),
+			},
+		},
+		"/sessions/kill": obj{
+			"post": operation("Kill a session's running commands and watches", []obj{hashParamSpec, sessionParamSpec}, jsonResponses("SessionAction")),
+		},
+		"/sessions/restart": obj{
+			"post": operation("Kill a session's commands and replace its shell with one in the same directory", []obj{hashParamSpec, sessionParamSpec}, jsonResponses("SessionAction")),
+		},
+		"/sessions/export": obj{
+			"get": operation("Download a session as a .tar.gz", []obj{hashParamSpec, sessionParamSpec}, obj{
+				"200":     obj{"description": "OK", "content": obj{"application/gzip": obj{"schema": obj{"type": "string", "format": "binary"}}}},
+				"default": errorResponse,
+			}),
+		},
+		"/transcript": obj{
+			"get": operation("Fetch a session's raw shell I/O transcript", []obj{hashParamSpec, sessionParamSpec,
+				queryParam("download", "1 to download as an attachment.", false, "string"),
+			}, obj{
+				"200":     obj{"description": "OK", "content": obj{"text/plain": obj{"schema": obj{"type": "string"}}}},
+				"default": errorResponse,
+			}),
+		},
+		"/recording": obj{
+			"get": operation("Fetch a session's asciicast v2 recording", []obj{hashParamSpec, sessionParamSpec}, obj{
+				"200":     obj{"description": "OK", "content": obj{"application/x-asciicast": obj{"schema": obj{"type": "string"}}}},
+				"default": errorResponse,
+			}),
+		},
+		"/sessions/limits": obj{
+			"get": operation("Fetch the resource limits a session's commands run with by default", []obj{hashParamSpec, sessionParamSpec}, jsonResponses("SessionLimits")),
+			"post": operation("Change a session's default resource limits, the ones not passed are kept", []obj{hashParamSpec, sessionParamSpec,
+				queryParam("nice", "CPU niceness from -20 to 19.", false, "integer"),
+				queryParam("ionice", "IO priority: idle, best-effort[:0-7] or realtime[:0-7].", false, "string"),
+				queryParam("nofile", "Open files limit (ulimit -n).", false, "integer"),
+				queryParam("core", "Core dump size limit in KiB (ulimit -c), 0 disables core dumps.", false, "integer"),
+				queryParam("cpu", "CPU seconds limit (ulimit -t).", false, "integer"),
+			}, jsonResponses("SessionLimits")),
+			"delete": operation("Clear a session's default resource limits", []obj{hashParamSpec, sessionParamSpec}, jsonResponses("SessionLimits")),
+		},
+		"/sessions/templates": obj{
+			"get": operation("List session templates", []obj{hashParamSpec}, obj{
+				"200":     obj{"description": "OK", "content": obj{"application/json": obj{"schema": obj{"type": "array", "items": obj{"type": "string"}}}}},
+				"default": errorResponse,
+			}),
+		},
+		"/watch": obj{
+			"get": operation("Re-run a command at an interval", []obj{
+				hashParamSpec, sessionParamSpec,
+				queryParam("cmd", "Url encoded shell command to re-run.", true, "string"),
+				queryParam("interval", "Seconds between runs.", false, "number"),
+				queryParam("duration", "Seconds to keep watching.", false, "number"),
+				queryParam("confirm", "Set to true to watch a command CONFIRM_RISK holds back as risky.", false, "string"),
+			}, submitResponses),
+		},
+		"/watch/stop": obj{
+			"get": operation("Stop a running watch", []obj{hashParamSpec, sessionParamSpec, ticketParamSpec}, jsonResponses("JsonMsg")),
+		},
+		"/webhooks": obj{
+			"get": operation("List webhook subscriptions", []obj{hashParamSpec}, obj{
+				"200": obj{"description": "OK", "content": obj{"application/json": obj{"schema": obj{"type": "array", "items": ref("Webhook")}}}},
+			}),
+			"post": obj{
+				"summary":     "Register a webhook subscription",
+				"parameters":  []obj{hashParamSpec},
+				"requestBody": obj{"required": true, "content": obj{"application/json": obj{"schema": ref("Webhook")}}},
+				"responses":   jsonResponses("Webhook"),
+			},
+			"delete": operation("Delete a webhook subscription", []obj{hashParamSpec, queryParam("id", "Subscription id.", true, "string")}, jsonResponses("JsonMsg")),
+		},
+		"/events": obj{
+			"get": operation("Stream all activity as Server-Sent Events", []obj{
+				hashParamSpec,
+				queryParam("session", "Only stream events for this session.", false, "string"),
+			}, obj{
+				"200":     obj{"description": "A text/event-stream of Activity events", "content": obj{"text/event-stream": obj{"schema": ref("Activity")}}},
+				"default": errorResponse,
+			}),
+		},
+		"/tail": obj{
+			"get": operation("Stream what is appended to a file, like tail -f, as Server-Sent Events", []obj{
+				hashParamSpec, sessionParamSpec,
+				queryParam("path", "The file, relative to the directory the session's next command starts in.", true, "string"),
+				queryParam("lines", "Start with the file's last lines, 10 by default, 0 for only new data.", false, "integer"),
+				queryParam("follow", "Set to 1 to keep streaming appends; otherwise the stream ends at the end of the file.", false, "string"),
+				queryParam("format", "text for the raw bytes instead of events.", false, "string"),
+			}, obj{
+				"200":     obj{"description": "A text/event-stream of TailEvent events", "content": obj{"text/event-stream": obj{"schema": ref("TailEvent")}}},
+				"default": errorResponse,
+			}),
+		},
+		"/notifications": obj{
+			"get": operation("List notification rules", []obj{hashParamSpec}, obj{
+				"200": obj{"description": "OK", "content": obj{"application/json": obj{"schema": obj{"type": "array", "items": ref("NotifyRule")}}}},
+			}),
+			"post": obj{
+				"summary":     "Register a notification rule",
+				"parameters":  []obj{hashParamSpec},
+				"requestBody": obj{"required": true, "content": obj{"application/json": obj{"schema": ref("NotifyRule")}}},
+				"responses":   jsonResponses("NotifyRule"),
+			},
+			"delete": operation("Delete a notification rule", []obj{hashParamSpec, queryParam("id", "Rule id.", true, "string")}, jsonResponses("JsonMsg")),
+		},
+		"/approvals": obj{
+			"get": operation("List commands waiting for approval", []obj{hashParamSpec}, obj{
+				"200": obj{"description": "OK", "content": obj{"application/json": obj{"schema": obj{"type": "array", "items": ref("Approval")}}}},
+			}),
+			"post": operation("Approve or reject a pending command", []obj{
+				hashParamSpec,
+				queryParam("id", "Approval id.", true, "string"),
+				queryParam("action", "approve or reject.", true, "string"),
+			}, jsonResponses("ApprovalDecision")),
+		},
+		"/agents": obj{
+			"get": operation("List agents with their heartbeat, capacity and sessions", []obj{hashParamSpec}, obj{
+				"200":     obj{"description": "OK", "content": obj{"application/json": obj{"schema": obj{"type": "array", "items": ref("AgentInfo")}}}},
+				"default": errorResponse,
+			}),
+		},
+		"/workspaces": obj{
+			"get": operation("List shared workspaces and the sessions attached to them", []obj{hashParamSpec}, obj{
+				"200":     obj{"description": "OK", "content": obj{"application/json": obj{"schema": obj{"type": "array", "items": ref("Workspace")}}}},
+				"default": errorResponse,
+			}),
+			"post":   operation("Create a shared workspace", []obj{hashParamSpec, workspaceParamSpec}, jsonResponses("WorkspaceAction")),
+			"delete": operation("Delete a shared workspace and its files", []obj{hashParamSpec, workspaceParamSpec}, jsonResponses("WorkspaceAction")),
+		},
+		"/workspaces/attach": obj{
+			"post":   operation("Attach a shared workspace to a session", []obj{hashParamSpec, sessionParamSpec, workspaceParamSpec}, jsonResponses("WorkspaceAction")),
+			"delete": operation("Detach a shared workspace from a session", []obj{hashParamSpec, sessionParamSpec, workspaceParamSpec}, jsonResponses("WorkspaceAction")),
+		},
+		"/notes": obj{
+			"get": operation("List a session's notes", []obj{hashParamSpec, sessionParamSpec}, obj{
+				"200":     obj{"description": "OK", "content": obj{"application/json": obj{"schema": obj{"type": "array", "items": ref("Note")}}}},
+				"default": errorResponse,
+			}),
+			"post": obj{
+				"summary":    "Add a note to a session's scratchpad",
+				"parameters": []obj{hashParamSpec, sessionParamSpec, queryParam("text", "The note, instead of a JSON {\"text\"} body.", false, "string")},
+				"requestBody": obj{"required": false, "content": obj{"application/json": obj{"schema": obj{
+					"type": "object", "properties": obj{"text": obj{"type": "string"}},
+				}}}},
+				"responses": jsonResponses("Note"),
+			},
+			"delete": operation("Delete a note", []obj{hashParamSpec, sessionParamSpec, queryParam("id", "The note to delete.", true, "integer")}, jsonResponses("Note")),
+		},
+		"/aliases": obj{
+			"get": operation("List a session's command aliases", []obj{hashParamSpec, sessionParamSpec}, obj{
+				"200":     obj{"description": "OK", "content": obj{"application/json": obj{"schema": obj{"type": "array", "items": ref("Alias")}}}},
+				"default": errorResponse,
+			}),
+			"post": obj{
+				"summary": "Define or replace a command alias, expanded when a command starts with its name",
+				"parameters": []obj{hashParamSpec, sessionParamSpec,
+					queryParam("name", "The alias, letters, digits, _, . and -.", false, "string"),
+					queryParam("command", "What the alias expands to, instead of a JSON {\"name\", \"command\"} body.", false, "string"),
+				},
+				"requestBody": obj{"required": false, "content": obj{"application/json": obj{"schema": obj{
+					"type": "object", "properties": obj{"name": obj{"type": "string"}, "command": obj{"type": "string"}},
+				}}}},
+				"responses": jsonResponses("Alias"),
+			},
+			"delete": operation("Delete a command alias", []obj{hashParamSpec, sessionParamSpec, queryParam("name", "The alias to delete.", true, "string")}, jsonResponses("Alias")),
+		},
+		"/checkpoints": obj{
+			"get": operation("List a session's checkpoints, oldest first", []obj{hashParamSpec, sessionParamSpec}, obj{
+				"200":     obj{"description": "OK", "content": obj{"application/json": obj{"schema": obj{"type": "array", "items": ref("Checkpoint")}}}},
+				"default": errorResponse,
+			}),
+			"post": operation("Fold the tickets since the last checkpoint into a new one", []obj{hashParamSpec, sessionParamSpec,
+				queryParam("method", "rules or llm, llm when SUMMARIZE_URL is set.", false, "string"),
+			}, jsonResponses("Checkpoint")),
+		},
+		"/output": obj{
+			"get": operation("Page through a ticket's output", []obj{hashParamSpec,
+				queryParam("cont", "Continuation token from cont of a result or chunk, replaces the other parameters.", false, "string"),
+				queryParam("session", "Session of the ticket, for the first chunk.", false, "string"),
+				queryParam("ticket", "Ticket to read, for the first chunk.", false, "integer"),
+				queryParam("max_tokens", "About how many tokens each chunk holds, default 2000.", false, "integer"),
+				queryParam("filter", "Filter applied to the output before paging, as on /status.", false, "string"),
+				queryParam("diff", "Set to 1 to page through the lines changed since the previous run, as on /status.", false, "string"),
+			}, jsonResponses("OutputChunk")),
+		},
+		"/search": obj{
+			"get": operation("Search past tickets", []obj{hashParamSpec,
+				queryParam("q", "What to look for, words or with mode=semantic a question.", true, "string"),
+				queryParam("session", "Search this session only, every session when omitted.", false, "string"),
+				queryParam("mode", "text (default) matches words, semantic ranks by embedding similarity and needs EMBEDDINGS_URL.", false, "string"),
+				queryParam("limit", "Maximum hits, default 10, at most 100.", false, "integer"),
+			}, jsonResponses("SearchResults")),
+		},
+		"/suggest": obj{
+			"get": operation("Suggest commands for a goal, without running them", []obj{hashParamSpec,
+				queryParam("goal", "What to achieve, in plain words.", true, "string"),
+				queryParam("session", "Give the model this session's recent commands and notes as context.", false, "string"),
+				queryParam("n", "Maximum suggestions, default 3, at most 10.", false, "integer"),
+			}, jsonResponses("SuggestResults")),
+		},
+		"/ps": obj{
+			"get": operation("List the process tree of running commands", []obj{hashParamSpec, sessionParamSpec}, jsonResponses("PsResults")),
+		},
+		"/ports": obj{
+			"get": operation("List the TCP ports the session's processes listen on, with links to open them through /proxy", []obj{hashParamSpec, sessionParamSpec}, obj{
+				"200":     obj{"description": "OK", "content": obj{"application/json": obj{"schema": obj{"type": "array", "items": ref("SessionPort")}}}},
+				"default": errorResponse,
+			}),
+		},
+		"/stats": obj{
+			"get": operation("Aggregate the ticket store: command counts, failure rate, durations, busiest hours and cache hit rate, per session and overall", []obj{hashParamSpec,
+				queryParam("session", "Only this session, every session when omitted.", false, "string"),
+				queryParam("format", "json (default), text or observation.", false, "string"),
+			}, jsonResponses("Stats")),
+		},
+		"/queue": obj{
+			"get": operation("List the command each session runs and the ones queued behind it, with their estimated waits", []obj{hashParamSpec,
+				queryParam("session", "Only this session, every session with commands queued or running when omitted.", false, "string"),
+				queryParam("format", "json (default), text or observation.", false, "string"),
+			}, obj{
+				"200": obj{"description": "OK", "content": obj{"application/json": obj{"schema": obj{
+					"oneOf": []obj{ref("SessionQueue"), {"type": "array", "items": ref("SessionQueue")}},
+				}}}},
+				"default": errorResponse,
+			}),
+		},
+		"/artifact": obj{
+			"get": operation("Download a ticket artifact", []obj{
+				hashParamSpec, sessionParamSpec, ticketParamSpec,
+				queryParam("name", "Artifact name as listed in the ticket.", true, "string"),
+			}, obj{
+				"200":     obj{"description": "The artifact", "content": obj{"application/octet-stream": obj{"schema": obj{"type": "string", "format": "binary"}}}},
+				"default": errorResponse,
+			}),
+		},
+		"/rpc": obj{
+			"post": obj{
+				"summary":    "JSON-RPC 2.0 endpoint with batch support (methods: execute, status, history, ps)",
+				"parameters": []obj{hashParamSpec},
+				"requestBody": obj{"required": true, "content": obj{"application/json": obj{"schema": obj{
+					"oneOf": []obj{{"type": "object"}, {"type": "array", "items": obj{"type": "object"}}},
+				}}}},
+				"responses": obj{
+					"200": obj{"description": "JSON-RPC response or batch of responses", "content": obj{"application/json": obj{"schema": obj{}}}},
+					"204": obj{"description": "Only notifications were sent"},
+				},
+			},
+		},
+		"/manifest.json": obj{
+			"get": operation("Machine readable description of the server's capabilities, auth and workflow", nil, obj{
+				"200": obj{"description": "OK", "content": obj{"application/json": obj{"schema": ref("Manifest")}}},
+			}),
+		},
+		"/whoami": obj{
+			"get": operation("The presented key's role, scopes, sessions and remaining token budgets", []obj{hashParamSpec}, jsonResponses("WhoAmI")),
+		},
+		"/version": obj{
+			"get": operation("Server version, build information and the features this instance has enabled", nil, obj{
+				"200": obj{"description": "OK", "content": obj{"application/json": obj{"schema": ref("VersionInfo")}}},
+			}),
+		},
+		"/actions.json": obj{
+			"get": operation("The API trimmed for import as a custom GPT action, authenticated with the hash as a bearer token", nil, obj{
+				"200": obj{"description": "OpenAPI document", "content": obj{"application/json": obj{"schema": obj{"type": "object"}}}},
+			}),
+		},
+		"/.well-known/ai-plugin.json": obj{
+			"get": operation("ChatGPT plugin manifest pointing at /actions.json", nil, obj{
+				"200": obj{"description": "OK", "content": obj{"application/json": obj{"schema": ref("AIPlugin")}}},
+			}),
+		},
+		"/tools": obj{
+			"get": operation("Tool definitions for OpenAI and Anthropic", []obj{
+				queryParam("provider", "openai or anthropic, both when omitted.", false, "string"),
+			}, obj{
+				"200": obj{"description": "Tool definitions", "content": obj{"application/json": obj{"schema": obj{"type": "object"}}}},
+			}),
+		},
+		"/context/auto": obj{
+			"get": operation("A compact briefing of a session for resuming work: host and shell, running commands, the last tickets with trimmed outputs, and notes", []obj{hashParamSpec, sessionParamSpec,
+				queryParam("n", "How many recent tickets, default 5, at most 50.", false, "integer"),
+				queryParam("max_tokens", "Trim each ticket's output to about this many tokens, default 200.", false, "integer"),
+				queryParam("format", "json (default), text or observation.", false, "string"),
+			}, jsonResponses("Briefing")),
+		},
+		"/env": obj{
+			"get": operation("Snapshot where the session's commands run: cwd, PATH, well known variables, shell pid and uptimes, without creating a ticket", []obj{hashParamSpec, sessionParamSpec,
+				queryParam("format", "json (default), text or observation.", false, "string"),
+			}, jsonResponses("EnvSnapshot")),
+		},
+		"/context": obj{
+			"get": operation("Initial context for the LLM, with the session's context documents", []obj{hashParamSpec,
+				queryParam("session", "Append this session's context documents.", false, "string"),
+				queryParam("name", "Only this session context document.", false, "string"),
+				queryParam("format", "html (default), markdown, text, or json to list the session's documents.", false, "string"),
+			}, obj{
+				"200": obj{"description": "Rendered CONTEXT.md and session documents", "content": obj{
+					"text/html":     obj{"schema": obj{"type": "string"}},
+					"text/markdown": obj{"schema": obj{"type": "string"}},
+					"text/plain":    obj{"schema": obj{"type": "string"}},
+				}},
+			}),
+			"post": obj{
+				"summary":     "Create or replace a session context document",
+				"parameters":  []obj{hashParamSpec, sessionParamSpec, queryParam("name", "The document name, CONTEXT when omitted.", false, "string")},
+				"requestBody": obj{"required": true, "content": obj{"text/markdown": obj{"schema": obj{"type": "string"}}}},
+				"responses":   jsonResponses("ContextDoc"),
+			},
+			"delete": operation("Delete a session context document", []obj{hashParamSpec, sessionParamSpec,
+				queryParam("name", "The document name, CONTEXT when omitted.", false, "string"),
+			}, jsonResponses("ContextDoc")),
+		},
+		"/": obj{
+			"get": operation("Documentation", nil, obj{
+				"200": obj{"description": "Rendered README.md", "content": obj{"text/html": obj{"schema": obj{"type": "string"}}}},
+			}),
+		},
+	}
+
+	return obj{
+		"openapi": "3.0.3",
+		"info": obj{
+			"title":       "LLMASS - LLM Asynchronous Shell Scheduler",
+			"description": "Execute shell commands asynchronously over HTTP. Commands return a ticket whose result is fetched from the callback.",
+			"version":     version,
+		},
+		"servers":    []obj{{"url": base}, {"url": base + apiVersionPrefix, "description": "Versioned API, errors use V1ErrorResponse"}},
+		"paths":      paths,
+		"components": obj{"schemas": b.components},
+	}
+}
+
+func openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodGet {
+		writeError(w, errMethodMessage)
+		return
+	}
+
+	jsonResp, err := json.MarshalIndent(openAPISpec(baseURL(r.Context())), "", "  ")
+	if err != nil {
+		msg := fmt.Sprintf("Failed to marshal JSON response: %v", err)
+		writeJsonError(w, msg)
+		return
+	}
+
+	fmt.Fprint(w, string(jsonResp))
+}
+
+func swaggerHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, errMethodMessage)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, `<!DOCTYPE html>
+	<html>
+	<head>
+		<title>LLMASS - API</title>
+		<link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+	</head>
+	<body>
+		<div id="swagger-ui"></div>
+		<script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js"></script>
+		<script>
+			window.ui = SwaggerUIBundle({url: "%s/openapi.json", dom_id: "#swagger-ui"});
+		</script>
+	</body>
+	</html>`, basePath)
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// /output pages through a ticket's output in chunks of about max_tokens
+// tokens. Each chunk carries a continuation token, cont, naming where the
+// next one starts, and the result of a /status?max_tokens= call that left
+// part of the output out carries one for the omitted part, so an agent can
+// read arbitrarily large outputs deliberately, a chunk at a time.
+
+const (
+	defaultChunkTokens = 2000
+	continueURL        = "%s/output?hash=%s&cont=%s"
+)
+
+var (
+	errContMessage = paramError("cont", "Invalid 'cont' parameter")
+)
+
+// outputCont is the position a continuation token resumes from. The filter
+// and diff of the first call are kept so offsets point into the same text.
+type outputCont struct {
+	Session string `json:"s"`
+	Ticket  int    `json:"t"`
+	Offset  int    `json:"o"`
+	Tokens  int    `json:"n"`
+	Filter  string `json:"f,omitempty"`
+	Diff    bool   `json:"d,omitempty"`
+}
+
+// OutputChunk is a part of a ticket's output.
+type OutputChunk struct {
+	Type            string `json:"type"`
+	Next            string `json:"next"`
+	Session         string `json:"session"`
+	Ticket          int    `json:"ticket"`
+	Offset          int    `json:"offset"`
+	Size            int    `json:"size"`
+	Output          string `json:"output"`
+	Tokens          int    `json:"tokens,omitempty"`
+	Cont            string `json:"cont,omitempty"`
+	ContinueURL     string `json:"continue_url,omitempty"`
+	BudgetExhausted bool   `json:"budget_exhausted,omitempty"`
+}
+
+func (c *outputCont) encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCont(token string) (*outputCont, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, errContMessage
+	}
+	c := &outputCont{}
+	if err := json.Unmarshal(data, c); err != nil || !validSessionName(c.Session) || c.Ticket <= 0 || c.Offset < 0 || c.Tokens <= 0 {
+		return nil, errContMessage
+	}
+	return c, nil
+}
+
+func ContinueURL(ctx context.Context, cont string) string {
+	base, hash, extra := linkTarget(ctx)
+	return fmt.Sprintf(continueURL, base, hash, cont) + extra
+}
+
+// setContinuation points a result at the rest of its output.
+func setContinuation(ctx context.Context, res *CmdResults, c *outputCont) {
+	res.Cont = c.encode()
+	res.ContinueURL = ContinueURL(ctx, res.Cont)
+}
+
+// ticketOutput returns the ticket's output as the first call saw it, after
+// its filter and diff.
+func ticketOutput(c *outputCont) (string, error) {
+	file, err := readTicket(c.Session, c.Ticket)
+	if err != nil {
+		return "", err
+	}
+	if len(file) == 0 {
+		return "", notFoundf("No output for ticket %d yet. Refresh the page after waiting a bit!", c.Ticket)
+	}
+	res := &CmdResults{}
+	if err := json.Unmarshal(file, res); err != nil {
+		return "", fmt.Errorf("Failed to unmarshal JSON from ticket %d: %v", c.Ticket, err)
+	}
+
+	filter, err := parseFilter(c.Filter)
+	if err != nil {
+		return "", err
+	}
+	if filter != nil {
+		if err := filterResult(res, filter); err != nil {
+			return "", err
+		}
+	}
+	if c.Diff {
+		diffResult(res, filter)
+	}
+	return res.Output, nil
+}
+
+// chunkEnd returns the length of the chunk of about maxTokens starting s,
+// ending on a line break when there is one and taking at least one rune.
+func chunkEnd(s string, maxTokens int) int {
+	end := searchCut(len(s), func(i int) bool { return countTokens(s[:i]) > maxTokens })
+	if end < len(s) {
+		if nl := strings.LastIndexByte(s[:end], '\n'); nl >= 0 {
+			end = nl + 1
+		}
+	}
+	for end > 0 && end < len(s) && !utf8.RuneStart(s[end]) {
+		end--
+	}
+	if end == 0 && s != "" {
+		_, end = utf8.DecodeRuneInString(s)
+	}
+	return end
+}
+
+func outputHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodGet {
+		writeError(w, errMethodMessage)
+		return
+	}
+
+	// Validate the hash parameter
+	hashParam := r.URL.Query().Get("hash")
+	if !checkHash(r, hashParam) {
+		writeError(w, errHashMessage)
+		return
+	}
+
+	// A continuation token, or the first chunk of a ticket
+	var c *outputCont
+	if token := r.URL.Query().Get("cont"); token != "" {
+		var err error
+		if c, err = decodeCont(token); err != nil {
+			writeError(w, err)
+			return
+		}
+	} else {
+		c = &outputCont{Session: r.URL.Query().Get("session"), Tokens: defaultChunkTokens, Filter: r.URL.Query().Get("filter")}
+		c.Diff = r.URL.Query().Get("diff") == "1" || r.URL.Query().Get("diff") == "true"
+		if !validSessionName(c.Session) {
+			writeError(w, errSessionMessage)
+			return
+		}
+		ticket, err := strconv.Atoi(r.URL.Query().Get("ticket"))
+		if err != nil || ticket <= 0 {
+			writeError(w, errTicketMessage)
+			return
+		}
+		c.Ticket = ticket
+		maxTokens, err := parseMaxTokens(r)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		if maxTokens > 0 {
+			c.Tokens = maxTokens
+		}
+	}
+
+	output, err := ticketOutput(c)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if c.Offset > len(output) {
+		writeError(w, errContMessage)
+		return
+	}
+
+	rest := output[c.Offset:]
+	end := chunkEnd(rest, c.Tokens)
+	exhausted := false
+	if budgetsEnabled() {
+		var granted int
+		if granted, exhausted = budgetLimit(c.Session, countTokens(rest[:end])); exhausted {
+			end = chunkEnd(rest, granted)
+		}
+	}
+	chunk := &OutputChunk{
+		Type:    "chunk",
+		Next:    "This is the end of the output. You can now issue your next command to /shell",
+		Session: c.Session,
+		Ticket:  c.Ticket,
+		Offset:  c.Offset,
+		Size:    len(output),
+		Output:  rest[:end],
+		Tokens:  estimateTokens(rest[:end]),
+	}
+	if c.Offset+end < len(output) {
+		next := *c
+		next.Offset += end
+		chunk.Cont = next.encode()
+		chunk.ContinueURL = ContinueURL(r.Context(), chunk.Cont)
+		chunk.Next = fmt.Sprintf("This is bytes %d to %d of %d of the output. Fetch continue_url for the next chunk, or issue your next command to /shell", c.Offset, c.Offset+end, len(output))
+	}
+	if exhausted {
+		chunk.BudgetExhausted = true
+		chunk.Next = budgetMessage()
+	}
+
+	jsonResp, err := json.Marshal(chunk)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to marshal JSON response: %v", err)
+		writeJsonError(w, msg)
+		return
+	}
+
+	fmt.Fprint(w, string(jsonResp))
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"sync"
+)
+
+// Output reaches the server through the pipes os/exec copies from and the
+// files tmux commands write to. Both are copied through pooled bufio.Readers
+// rather than the fresh 32 KiB buffer io.Copy allocates on every call, which
+// adds up with many commands printing a little at a time, and with tmux
+// output polled ten times a second.
+
+const outputReadSize = 32 << 10
+
+var outputReaders = sync.Pool{New: func() interface{} {
+	return bufio.NewReaderSize(nil, outputReadSize)
+}}
+
+// copyOutput copies r to w through a pooled buffer.
+func copyOutput(w io.Writer, r io.Reader) (int64, error) {
+	br := outputReaders.Get().(*bufio.Reader)
+	// Hidden behind a plain Reader, an *os.File would copy itself with a
+	// buffer of its own
+	br.Reset(struct{ io.Reader }{r})
+	defer func() {
+		br.Reset(nil)
+		outputReaders.Put(br)
+	}()
+	return br.WriteTo(w)
+}
+
+// outputWriter has os/exec copy a command's output with copyOutput, io.Copy
+// hands the pipe to ReadFrom.
+type outputWriter struct {
+	io.Writer
+}
+
+func (o outputWriter) ReadFrom(r io.Reader) (int64, error) {
+	return copyOutput(o.Writer, r)
+}
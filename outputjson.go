@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+)
+
+// output_json=1 returns an output that is JSON as a nested object in
+// output_json instead of an escaped string in output, so an agent can
+// address its fields directly. Several values, like NDJSON, become an array.
+// Anything else, including JSON after trimming by max_tokens or with stderr
+// mixed in, stays in output. Given to /shell it carries over to the
+// callback URL.
+
+// parseOutputJSON returns s compacted when it holds JSON objects or arrays,
+// in an array when there are several.
+func parseOutputJSON(s string) (json.RawMessage, bool) {
+	s = strings.TrimSpace(s)
+	if s == "" || s[0] != '{' && s[0] != '[' {
+		return nil, false
+	}
+
+	dec := json.NewDecoder(strings.NewReader(s))
+	var values []json.RawMessage
+	for {
+		var v json.RawMessage
+		err := dec.Decode(&v)
+		if err == io.EOF {
+			break
+		}
+		if err != nil || v[0] != '{' && v[0] != '[' {
+			return nil, false
+		}
+		values = append(values, v)
+	}
+
+	raw := values[0]
+	if len(values) > 1 {
+		var err error
+		if raw, err = json.Marshal(values); err != nil {
+			return nil, false
+		}
+	}
+	var b bytes.Buffer
+	if json.Compact(&b, raw) != nil {
+		return nil, false
+	}
+	return b.Bytes(), true
+}
+
+// jsonResult moves the outputs that are JSON into output_json.
+func jsonResult(res *CmdResults) {
+	if v, ok := parseOutputJSON(res.Output); ok {
+		res.OutputJSON, res.Output = v, ""
+	}
+	for _, it := range res.Iterations {
+		if v, ok := parseOutputJSON(it.Output); ok {
+			it.OutputJSON, it.Output = v, ""
+		}
+	}
+}
@@ -0,0 +1,299 @@
+// Package cli implements the llmass command-line client.
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jaredfolkins/grok-async-shell/pkg/client"
+)
+
+const usage = `Usage: llmass [flags] <command> [args]
+
+Commands:
+  exec -s SESSION [-timeout N] [-cwd DIR] [-nowait] -- CMD...
+  status -s SESSION TICKET
+  history -s SESSION
+  sessions
+  tail -s SESSION [-n N] [-f]
+
+Flags:
+  -url URL    server URL (env LLMASS_URL)
+  -hash HASH  server hash (env LLMASS_HASH)
+  -json       print raw JSON instead of human friendly output
+
+Credentials may also be stored as {"url": "...", "hash": "..."} in
+~/.config/llmass/config.json.
+`
+
+type config struct {
+	URL  string `json:"url"`
+	Hash string `json:"hash"`
+}
+
+// loadConfig reads the config file, then lets the environment override it.
+func loadConfig() config {
+	var cfg config
+	if dir, err := os.UserConfigDir(); err == nil {
+		if data, err := os.ReadFile(filepath.Join(dir, "llmass", "config.json")); err == nil {
+			json.Unmarshal(data, &cfg)
+		}
+	}
+	if v := os.Getenv("LLMASS_URL"); v != "" {
+		cfg.URL = v
+	}
+	if v := os.Getenv("LLMASS_HASH"); v != "" {
+		cfg.Hash = v
+	}
+	return cfg
+}
+
+type cli struct {
+	client *client.Client
+	json   bool
+	stdout io.Writer
+}
+
+// Run executes the CLI with args (without the program name) and returns the
+// process exit code.
+func Run(args []string, stdout, stderr io.Writer) int {
+	cfg := loadConfig()
+
+	fs := flag.NewFlagSet("llmass", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() { fmt.Fprint(stderr, usage) }
+	url := fs.String("url", cfg.URL, "server URL")
+	hash := fs.String("hash", cfg.Hash, "server hash")
+	asJSON := fs.Bool("json", false, "print raw JSON")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+	if *url == "" || *hash == "" {
+		fmt.Fprintln(stderr, "llmass: server URL and hash are required, set LLMASS_URL and LLMASS_HASH")
+		return 2
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	c := &cli{client: client.New(*url, *hash), json: *asJSON, stdout: stdout}
+	cmd, rest := fs.Arg(0), fs.Args()[1:]
+
+	var err error
+	switch cmd {
+	case "exec":
+		err = c.exec(ctx, rest)
+	case "status":
+		err = c.status(ctx, rest)
+	case "history":
+		err = c.history(ctx, rest)
+	case "sessions":
+		err = c.sessions(ctx)
+	case "tail":
+		err = c.tail(ctx, rest)
+	default:
+		fmt.Fprintf(stderr, "llmass: unknown command %q\n", cmd)
+		fs.Usage()
+		return 2
+	}
+
+	if err != nil {
+		fmt.Fprintf(stderr, "llmass: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+func (c *cli) printJSON(v interface{}) error {
+	enc := json.NewEncoder(c.stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func (c *cli) printResult(r *client.Result) {
+	fmt.Fprintf(c.stdout, "#%d $ %s\n%s", r.Ticket, r.Input, r.Output)
+	if r.Output != "" && !strings.HasSuffix(r.Output, "\n") {
+		fmt.Fprintln(c.stdout)
+	}
+}
+
+func sessionFlags(name string) (*flag.FlagSet, *string) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	session := fs.String("s", "", "session name")
+	return fs, session
+}
+
+func (c *cli) exec(ctx context.Context, args []string) error {
+	fs, session := sessionFlags("exec")
+	timeout := fs.Int("timeout", 0, "seconds before the command is killed")
+	cwd := fs.String("cwd", "", "working directory")
+	nowait := fs.Bool("nowait", false, "print the ticket and return immediately")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *session == "" || fs.NArg() == 0 {
+		return errors.New("exec requires -s SESSION and a command")
+	}
+
+	sub, err := c.client.Execute(ctx, client.ExecRequest{
+		Session: *session,
+		Cmd:     strings.Join(fs.Args(), " "),
+		Timeout: *timeout,
+		Cwd:     *cwd,
+	})
+	if err != nil {
+		return err
+	}
+	if *nowait {
+		if c.json {
+			return c.printJSON(sub)
+		}
+		fmt.Fprintf(c.stdout, "session %s ticket %d\n", sub.Session, sub.Ticket)
+		return nil
+	}
+
+	res, err := c.client.Wait(ctx, sub.Session, sub.Ticket, time.Second)
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.printJSON(res)
+	}
+	fmt.Fprint(c.stdout, res.Output)
+	return nil
+}
+
+func (c *cli) status(ctx context.Context, args []string) error {
+	fs, session := sessionFlags("status")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *session == "" || fs.NArg() != 1 {
+		return errors.New("status requires -s SESSION and a TICKET")
+	}
+	ticket, err := strconv.Atoi(fs.Arg(0))
+	if err != nil {
+		return fmt.Errorf("invalid ticket %q", fs.Arg(0))
+	}
+
+	res, err := c.client.Status(ctx, *session, ticket)
+	if errors.Is(err, client.ErrWorking) {
+		if c.json {
+			return c.printJSON(map[string]string{"status": "working"})
+		}
+		fmt.Fprintf(c.stdout, "ticket %d is still working\n", ticket)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.printJSON(res)
+	}
+	c.printResult(res)
+	return nil
+}
+
+func (c *cli) history(ctx context.Context, args []string) error {
+	fs, session := sessionFlags("history")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *session == "" {
+		return errors.New("history requires -s SESSION")
+	}
+
+	results, err := c.client.History(ctx, *session)
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.printJSON(results)
+	}
+	for _, r := range results {
+		c.printResult(r)
+	}
+	return nil
+}
+
+func (c *cli) sessions(ctx context.Context) error {
+	sessions, err := c.client.Sessions(ctx)
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.printJSON(sessions)
+	}
+
+	tw := tabwriter.NewWriter(c.stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SESSION\tTICKETS\tMODIFIED")
+	for _, s := range sessions {
+		fmt.Fprintf(tw, "%s\t%d\t%s\n", s.Name, s.Tickets, s.Modified.Local().Format(time.DateTime))
+	}
+	return tw.Flush()
+}
+
+// tail prints the last n tickets and, with -f, keeps printing new ones as
+// they complete.
+func (c *cli) tail(ctx context.Context, args []string) error {
+	fs, session := sessionFlags("tail")
+	n := fs.Int("n", 5, "number of tickets to show")
+	follow := fs.Bool("f", false, "follow new tickets")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *session == "" {
+		return errors.New("tail requires -s SESSION")
+	}
+
+	seen := map[int]bool{}
+	first := true
+	for {
+		results, err := c.client.History(ctx, *session)
+		var apiErr *client.APIError
+		if err != nil && !(errors.As(err, &apiErr) && *follow) {
+			return err
+		}
+
+		start := 0
+		if first && len(results) > *n {
+			start = len(results) - *n
+		}
+		for _, r := range results[start:] {
+			if seen[r.Ticket] {
+				continue
+			}
+			seen[r.Ticket] = true
+			if c.json {
+				json.NewEncoder(c.stdout).Encode(r)
+			} else {
+				c.printResult(r)
+			}
+		}
+		first = false
+
+		if !*follow {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(2 * time.Second):
+		}
+	}
+}
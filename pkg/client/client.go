@@ -0,0 +1,264 @@
+// Package client is a Go client for the LLMASS HTTP API.
+//
+//	c := client.New("https://llmass.example.com", os.Getenv("LLMASS_HASH"))
+//	sub, err := c.Execute(ctx, client.ExecRequest{Session: "build", Cmd: "make"})
+//	res, err := c.Wait(ctx, sub.Session, sub.Ticket, time.Second)
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrWorking is returned by Status while the ticket's command is running.
+var ErrWorking = errors.New("llmass: ticket is still working")
+
+// APIError is an error reported by the server.
+type APIError struct {
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%s (HTTP %d)", e.Message, e.StatusCode)
+}
+
+// ExecRequest is the body of a /shell submission.
+type ExecRequest struct {
+	Session string            `json:"session"`
+	Cmd     string            `json:"cmd"`
+	Timeout int               `json:"timeout,omitempty"` // seconds
+	Env     map[string]string `json:"env,omitempty"`
+	Cwd     string            `json:"cwd,omitempty"`
+	DryRun  bool              `json:"dryrun,omitempty"`
+}
+
+// Submission is returned when a command has been scheduled.
+type Submission struct {
+	Type     string `json:"type"`
+	IsCached bool   `json:"cached"`
+	Ticket   int    `json:"ticket"`
+	Session  string `json:"session"`
+	Input    string `json:"input"`
+	Callback string `json:"callback"`
+	Queued   *Queue `json:"queued,omitempty"`
+}
+
+// Queue is where a command waits behind the session's previous commands.
+type Queue struct {
+	Position        int   `json:"position"`
+	EstimatedWaitMs int64 `json:"estimated_wait_ms,omitempty"`
+}
+
+type Usage struct {
+	WallMs    int64 `json:"wall_ms"`
+	UserCPUMs int64 `json:"user_cpu_ms"`
+	SysCPUMs  int64 `json:"sys_cpu_ms"`
+	MaxRSSKB  int64 `json:"max_rss_kb"`
+}
+
+type Artifact struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+	URL  string `json:"url"`
+}
+
+// Result is a completed ticket.
+type Result struct {
+	Type      string     `json:"type"`
+	Next      string     `json:"next"`
+	Ticket    int        `json:"ticket"`
+	Session   string     `json:"session"`
+	Input     string     `json:"input"`
+	Output    string     `json:"output"`
+	Tokens    int        `json:"tokens,omitempty"`
+	Usage     *Usage     `json:"usage,omitempty"`
+	Backend   string     `json:"backend,omitempty"`
+	Artifacts []Artifact `json:"artifacts,omitempty"`
+}
+
+type Session struct {
+	Name     string    `json:"name"`
+	Tickets  int       `json:"tickets"`
+	Modified time.Time `json:"modified"`
+	Backend  string    `json:"backend,omitempty"`
+}
+
+// Client talks to one LLMASS server. The zero value is not usable, use New.
+type Client struct {
+	BaseURL    string
+	Hash       string
+	HTTPClient *http.Client
+
+	// MaxRetries is how often idempotent requests are retried after a
+	// network error or a 5xx/429 response. Execute is never retried.
+	MaxRetries int
+	// Backoff is the delay before the first retry, doubled for each retry.
+	Backoff time.Duration
+}
+
+func New(baseURL, hash string) *Client {
+	return &Client{
+		BaseURL:    strings.TrimRight(baseURL, "/"),
+		Hash:       hash,
+		HTTPClient: &http.Client{Timeout: 60 * time.Second},
+		MaxRetries: 3,
+		Backoff:    500 * time.Millisecond,
+	}
+}
+
+// Execute schedules a command and returns its ticket.
+func (c *Client) Execute(ctx context.Context, req ExecRequest) (*Submission, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	sub := &Submission{}
+	if err := c.do(ctx, http.MethodPost, "/shell", nil, body, 0, sub); err != nil {
+		return nil, err
+	}
+	return sub, nil
+}
+
+// Status returns the ticket's result, or ErrWorking if it hasn't finished.
+func (c *Client) Status(ctx context.Context, session string, ticket int) (*Result, error) {
+	q := url.Values{"session": {session}, "ticket": {strconv.Itoa(ticket)}}
+	var raw json.RawMessage
+	if err := c.do(ctx, http.MethodGet, "/callback", q, nil, c.MaxRetries, &raw); err != nil {
+		return nil, err
+	}
+
+	var msg struct {
+		Status string `json:"status"`
+	}
+	if json.Unmarshal(raw, &msg) == nil && msg.Status == "working" {
+		return nil, ErrWorking
+	}
+
+	res := &Result{}
+	if err := json.Unmarshal(raw, res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Wait polls Status every interval until the ticket completes or ctx is done.
+func (c *Client) Wait(ctx context.Context, session string, ticket int, interval time.Duration) (*Result, error) {
+	for {
+		res, err := c.Status(ctx, session, ticket)
+		if !errors.Is(err, ErrWorking) {
+			return res, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
+
+// History returns every ticket in the session.
+func (c *Client) History(ctx context.Context, session string) ([]*Result, error) {
+	var results []*Result
+	q := url.Values{"session": {session}}
+	if err := c.do(ctx, http.MethodGet, "/history", q, nil, c.MaxRetries, &results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// Sessions lists every session on the server.
+func (c *Client) Sessions(ctx context.Context) ([]Session, error) {
+	var sessions []Session
+	if err := c.do(ctx, http.MethodGet, "/sessions", nil, nil, c.MaxRetries, &sessions); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+func (c *Client) do(ctx context.Context, method, path string, q url.Values, body []byte, retries int, out interface{}) error {
+	if q == nil {
+		q = url.Values{}
+	}
+	q.Set("hash", c.Hash)
+	u := c.BaseURL + "/v1" + path + "?" + q.Encode()
+
+	backoff := c.Backoff
+	for attempt := 0; ; attempt++ {
+		err := c.once(ctx, method, u, body, out)
+		if err == nil || attempt >= retries || !retryable(err) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func (c *Client) once(ctx context.Context, method, u string, body []byte, out interface{}) error {
+	var rd io.Reader
+	if body != nil {
+		rd = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, rd)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var envelope struct {
+			Error struct {
+				Code    string `json:"code"`
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		apiErr := &APIError{StatusCode: resp.StatusCode}
+		if json.Unmarshal(data, &envelope) == nil && envelope.Error.Message != "" {
+			apiErr.Code = envelope.Error.Code
+			apiErr.Message = envelope.Error.Message
+		} else {
+			apiErr.Message = strings.TrimSpace(string(data))
+		}
+		return apiErr
+	}
+
+	return json.Unmarshal(data, out)
+}
+
+// retryable reports whether err is worth another attempt.
+func retryable(err error) bool {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode >= 500 || apiErr.StatusCode == http.StatusTooManyRequests
+	}
+	// Transport errors are retried, cancellation is not
+	var urlErr *url.Error
+	return errors.As(err, &urlErr) && !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+}
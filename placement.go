@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Placement picks the agent a new session lives on. A request naming a
+// session nobody has placed yet, with placement=os=linux,gpu=true and no
+// agent, goes to the live agent matching every label with the most free
+// capacity and the least load. The session then keeps routing to that
+// agent, across controller restarts, without an agent parameter.
+
+const (
+	placementsFile = "placements.json"
+)
+
+var (
+	errPlacementMessage   = paramError("placement", "Invalid or missing 'placement' parameter")
+	errNoPlacementMessage = newKindError(errUnavailable, "No live agent matches the 'placement' constraints")
+)
+
+var (
+	placementsMu sync.Mutex
+	placements   = map[string]string{} // session -> agent
+)
+
+// parseLabels parses comma separated key=value pairs, as used by
+// AGENT_LABELS and the placement parameter.
+func parseLabels(s string) (map[string]string, error) {
+	labels := map[string]string{}
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(pair, "=")
+		k, v = strings.TrimSpace(k), strings.TrimSpace(v)
+		if !ok || k == "" {
+			return nil, fmt.Errorf("label %q is not key=value", pair)
+		}
+		labels[k] = v
+	}
+	return labels, nil
+}
+
+// matches reports whether the agent has every label in want. os and arch
+// are labels every agent has.
+func (rec *agentRecord) matches(want map[string]string) bool {
+	for k, v := range want {
+		var have string
+		switch k {
+		case "os":
+			have = rec.OS
+		case "arch":
+			have = rec.Arch
+		default:
+			have = rec.Labels[k]
+		}
+		if have != v {
+			return false
+		}
+	}
+	return true
+}
+
+// placeSession chooses an agent for session and records the placement.
+func placeSession(session string, want map[string]string) (string, error) {
+	type candidate struct {
+		name      string
+		available int
+		load      float64
+		sessions  int
+	}
+
+	agentsMu.Lock()
+	var candidates []candidate
+	for name, rec := range agents {
+		if time.Since(rec.lastSeen) > agentDeadAfter || !rec.matches(want) {
+			continue
+		}
+		c := candidate{name: name, available: rec.Capacity - rec.Running, load: rec.Load1, sessions: len(rec.Sessions)}
+		if rec.CPUs > 0 {
+			c.load /= float64(rec.CPUs)
+		}
+		candidates = append(candidates, c)
+	}
+	if len(candidates) == 0 {
+		agentsMu.Unlock()
+		return "", errNoPlacementMessage
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if a.available != b.available {
+			return a.available > b.available
+		}
+		if a.load != b.load {
+			return a.load < b.load
+		}
+		if a.sessions != b.sessions {
+			return a.sessions < b.sessions
+		}
+		return a.name < b.name
+	})
+	name := candidates[0].name
+	// Count the session now so placements before the next heartbeat spread out
+	rec := agents[name]
+	rec.Sessions = append(rec.Sessions, session)
+	agentsMu.Unlock()
+
+	placementsMu.Lock()
+	defer placementsMu.Unlock()
+	if placed, ok := placements[session]; ok {
+		return placed, nil
+	}
+	placements[session] = name
+	if err := savePlacements(); err != nil {
+		logger.Error("failed to save placements", "err", err)
+	}
+	logger.Info("placed session", "session", session, "agent", name, "placement", want)
+	return name, nil
+}
+
+// placedAgent returns the agent session was placed on, "" if none.
+func placedAgent(session string) string {
+	placementsMu.Lock()
+	defer placementsMu.Unlock()
+	return placements[session]
+}
+
+// setPlacement records that session lives on agent, as after a migration.
+func setPlacement(session, agent string) {
+	placementsMu.Lock()
+	defer placementsMu.Unlock()
+	placements[session] = agent
+	if err := savePlacements(); err != nil {
+		logger.Error("failed to save placements", "err", err)
+	}
+}
+
+// forgetPlacement drops a deleted session's placement.
+func forgetPlacement(session string) {
+	placementsMu.Lock()
+	defer placementsMu.Unlock()
+	if _, ok := placements[session]; !ok {
+		return
+	}
+	delete(placements, session)
+	if err := savePlacements(); err != nil {
+		logger.Error("failed to save placements", "err", err)
+	}
+}
+
+// loadPlacements restores placements persisted in DATA_DIR.
+func loadPlacements() error {
+	data, err := os.ReadFile(filepath.Join(dataDir, placementsFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	placementsMu.Lock()
+	defer placementsMu.Unlock()
+	placements = map[string]string{}
+	return json.Unmarshal(data, &placements)
+}
+
+// savePlacements persists placements, the caller holds placementsMu.
+func savePlacements() error {
+	data, err := json.MarshalIndent(placements, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(dataDir, placementsFile+".tmp")
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dataDir, placementsFile))
+}
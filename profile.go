@@ -0,0 +1,54 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// sessionInitFile is the optional per-session rc file, sourced after the
+// server-level INIT_SCRIPT so a session can override PATH, aliases, etc.
+const sessionInitFile = "init.sh"
+
+// initFiles returns the rc files that exist for the given session folder,
+// in the order they should be sourced.
+func initFiles(sessionFolder string) []string {
+	var files []string
+	candidates := []string{initScript.Load(), filepath.Join(sessionFolder, sessionInitFile)}
+	for _, f := range candidates {
+		if f == "" {
+			continue
+		}
+		abs, err := filepath.Abs(f)
+		if err != nil {
+			logger.Warn("failed to resolve init file", "path", f, "err", err)
+			continue
+		}
+		if _, err := os.Stat(abs); err != nil {
+			continue
+		}
+		files = append(files, abs)
+	}
+	return files
+}
+
+// wrapCommand prefixes the command with the init files so every shell
+// starts from the same profile before running the LLM's input.
+func wrapCommand(sessionFolder, inputCmd string) string {
+	var b strings.Builder
+	source := ". "
+	if shellIsBash() {
+		b.WriteString("shopt -s expand_aliases\n")
+		source = "source "
+	}
+	for _, f := range initFiles(sessionFolder) {
+		b.WriteString(source + shellQuote(f) + "\n")
+	}
+	b.WriteString(inputCmd)
+	return b.String()
+}
+
+// shellQuote single-quotes s for safe use in a POSIX shell script.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// /proxy/<session>/<port>/... forwards HTTP requests, websockets included,
+// to a port a process of the session listens on, so an agent can start a dev
+// server and a human can open it. Every command runs with LLMASS_SESSION
+// set, which is how a server left running in the background is told apart
+// from the rest of the host: only ports held by a process carrying the
+// session's name are reachable.
+//
+// A browser can't add the hash to every request a page makes, so the first
+// request trades it for a cookie scoped to the session and port, and is
+// redirected to the same URL without it. Absolute redirects from the
+// service are rewritten under the prefix; absolute links in its pages
+// aren't, so it should use relative ones or honor X-Forwarded-Prefix.
+
+const (
+	sessionNameEnv   = "LLMASS_SESSION"
+	proxyPrefix      = "/proxy/"
+	proxyCookie      = "llmass_proxy"
+	tcpStateListen   = "0A"
+	proxyCookieHours = 12
+)
+
+var (
+	errPortMessage  = paramError("port", "Invalid or missing port")
+	errProxyMessage = newKindError(errBadGateway, "Failed to reach the session's service")
+)
+
+// SessionPort is a TCP port a process of the session listens on.
+type SessionPort struct {
+	Port    int    `json:"port"`
+	Address string `json:"address"`
+	Pid     int    `json:"pid"`
+	Command string `json:"command"`
+	URL     string `json:"url"`
+}
+
+// listenSocket is a listening socket from /proc/net/tcp or tcp6.
+type listenSocket struct {
+	IP   net.IP
+	Port int
+}
+
+// listenSockets maps the inodes of the host's listening TCP sockets to
+// their addresses.
+func listenSockets() map[string]listenSocket {
+	sockets := map[string]listenSocket{}
+	for _, name := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+		f, err := os.Open(name)
+		if err != nil {
+			continue
+		}
+		sc := bufio.NewScanner(f)
+		sc.Scan() // header
+		for sc.Scan() {
+			fields := strings.Fields(sc.Text())
+			if len(fields) < 10 || fields[3] != tcpStateListen {
+				continue
+			}
+			hexIP, hexPort, ok := strings.Cut(fields[1], ":")
+			port, err := strconv.ParseUint(hexPort, 16, 16)
+			if !ok || err != nil {
+				continue
+			}
+			ip, err := hex.DecodeString(hexIP)
+			if err != nil || (len(ip) != net.IPv4len && len(ip) != net.IPv6len) {
+				continue
+			}
+			// The kernel prints each 32 bit word in host order, little
+			// endian on the platforms this runs on
+			for i := 0; i < len(ip); i += 4 {
+				ip[i], ip[i+1], ip[i+2], ip[i+3] = ip[i+3], ip[i+2], ip[i+1], ip[i]
+			}
+			sockets[fields[9]] = listenSocket{IP: net.IP(ip), Port: int(port)}
+		}
+		f.Close()
+	}
+	return sockets
+}
+
+// sessionPids returns the processes started by the session's commands.
+func sessionPids(session string) []int {
+	marker := []byte("\x00" + sessionNameEnv + "=" + session + "\x00")
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil
+	}
+	var pids []int
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		environ, err := os.ReadFile(filepath.Join("/proc", e.Name(), "environ"))
+		if err != nil {
+			continue
+		}
+		if bytes.Contains(append([]byte{0}, environ...), marker) {
+			pids = append(pids, pid)
+		}
+	}
+	return pids
+}
+
+// sessionPorts returns the ports the session's processes listen on, one
+// per port.
+func sessionPorts(session string) []SessionPort {
+	sockets := listenSockets()
+	seen := map[int]bool{}
+	ports := []SessionPort{}
+	for _, pid := range sessionPids(session) {
+		fdDir := filepath.Join("/proc", strconv.Itoa(pid), "fd")
+		fds, err := os.ReadDir(fdDir)
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			link, err := os.Readlink(filepath.Join(fdDir, fd.Name()))
+			inode, ok := strings.CutPrefix(link, "socket:[")
+			if err != nil || !ok {
+				continue
+			}
+			s, ok := sockets[strings.TrimSuffix(inode, "]")]
+			if !ok || seen[s.Port] {
+				continue
+			}
+			seen[s.Port] = true
+			p := SessionPort{Port: s.Port, Address: net.JoinHostPort(s.IP.String(), strconv.Itoa(s.Port)), Pid: pid}
+			if proc, err := readProc(pid); err == nil {
+				p.Command = proc.Command
+			}
+			ports = append(ports, p)
+		}
+	}
+	sort.Slice(ports, func(i, j int) bool { return ports[i].Port < ports[j].Port })
+	return ports
+}
+
+// proxyTarget returns the address to dial for the session's port, false
+// when no process of the session listens on it. A wildcard address is
+// reached over loopback.
+func proxyTarget(session string, port int) (string, bool) {
+	for _, p := range sessionPorts(session) {
+		if p.Port != port {
+			continue
+		}
+		host, _, _ := net.SplitHostPort(p.Address)
+		switch ip := net.ParseIP(host); {
+		case ip.Equal(net.IPv4zero):
+			host = "127.0.0.1"
+		case ip.Equal(net.IPv6unspecified):
+			host = "::1"
+		}
+		return net.JoinHostPort(host, strconv.Itoa(port)), true
+	}
+	return "", false
+}
+
+// proxyToken is the cookie value for the session's port, derived from HASH
+// so rotating it signs every browser out.
+func proxyToken(session string, port int) string {
+	mac := hmac.New(sha256.New, []byte(hashPassword.Load()))
+	fmt.Fprintf(mac, "proxy:%s:%d", session, port)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// proxyLink is the URL a human opens to reach the session's port.
+func proxyLink(base, hash, session string, port int) string {
+	return fmt.Sprintf("%s%s%s/%d/?hash=%s", base, proxyPrefix, url.PathEscape(session), port, url.QueryEscape(hash))
+}
+
+func proxyHandler(w http.ResponseWriter, r *http.Request) {
+	session, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, proxyPrefix), "/")
+	portParam, path, hasSlash := strings.Cut(rest, "/")
+	if !validSessionName(session) {
+		writeError(w, errSessionMessage)
+		return
+	}
+	port, err := strconv.Atoi(portParam)
+	if err != nil || port < 1 || port > 65535 {
+		writeError(w, errPortMessage)
+		return
+	}
+	prefix := proxyPrefix + session + "/" + portParam
+
+	// The hash, once, or the cookie it was traded for
+	token := proxyToken(session, port)
+	cookie, err := r.Cookie(proxyCookie)
+	if err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(token)) != 1 {
+		hashParam := r.URL.Query().Get("hash")
+		if !checkHash(r, hashParam) {
+			writeError(w, errHashMessage)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     proxyCookie,
+			Value:    token,
+			Path:     basePath + prefix + "/",
+			MaxAge:   proxyCookieHours * 3600,
+			HttpOnly: true,
+			Secure:   r.TLS != nil,
+			SameSite: http.SameSiteLaxMode,
+		})
+		if hashParam != "" && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+			q := r.URL.Query()
+			q.Del("hash")
+			target := &url.URL{Path: basePath + prefix + "/" + path, RawQuery: q.Encode()}
+			http.Redirect(w, r, target.String(), http.StatusFound)
+			return
+		}
+	}
+	// Relative links resolve against the directory
+	if !hasSlash {
+		http.Redirect(w, r, basePath+prefix+"/", http.StatusMovedPermanently)
+		return
+	}
+
+	if !sessionExists(session) {
+		writeError(w, errSessionNotFound)
+		return
+	}
+	addr, ok := proxyTarget(session, port)
+	if !ok {
+		writeError(w, notFoundf("No process of session %s listens on port %d", session, port))
+		return
+	}
+
+	// Dev servers stream and keep websockets open
+	rc := http.NewResponseController(w)
+	rc.SetReadDeadline(time.Time{})
+	rc.SetWriteDeadline(time.Time{})
+
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(&url.URL{Scheme: "http", Host: addr})
+			pr.Out.URL.Path, pr.Out.URL.RawPath = "/"+path, ""
+			q := pr.Out.URL.Query()
+			q.Del("hash")
+			pr.Out.URL.RawQuery = q.Encode()
+			pr.SetXForwarded()
+			pr.Out.Header.Set("X-Forwarded-Prefix", basePath+prefix)
+
+			// The service doesn't get the server's cookie
+			pr.Out.Header.Del("Cookie")
+			for _, c := range pr.In.Cookies() {
+				if c.Name != proxyCookie {
+					pr.Out.AddCookie(c)
+				}
+			}
+		},
+		ModifyResponse: func(resp *http.Response) error {
+			if loc := resp.Header.Get("Location"); strings.HasPrefix(loc, "/") && !strings.HasPrefix(loc, "//") {
+				resp.Header.Set("Location", basePath+prefix+loc)
+			}
+			return nil
+		},
+		FlushInterval: -1,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			logFrom(r.Context()).Warn("proxy to session failed", "session", session, "port", port, "err", err)
+			w.Header().Set("Content-Type", "application/json")
+			writeError(w, errProxyMessage)
+		},
+	}
+	proxy.ServeHTTP(w, r)
+}
+
+// portsHandler lists the ports the session's processes listen on, with the
+// links to open them through /proxy.
+func portsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodGet {
+		writeError(w, errMethodMessage)
+		return
+	}
+
+	// Validate the hash parameter
+	hashParam := r.URL.Query().Get("hash")
+	if !checkHash(r, hashParam) {
+		writeError(w, errHashMessage)
+		return
+	}
+
+	session := r.URL.Query().Get("session")
+	if !validSessionName(session) {
+		writeError(w, errSessionMessage)
+		return
+	}
+	if !sessionExists(session) {
+		writeError(w, errSessionNotFound)
+		return
+	}
+
+	ports := sessionPorts(session)
+	for i := range ports {
+		ports[i].URL = proxyLink(baseURL(r.Context()), hashPassword.Load(), session, ports[i].Port)
+	}
+
+	jsonResp, err := json.Marshal(ports)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to marshal JSON response: %v", err)
+		writeJsonError(w, msg)
+		return
+	}
+
+	fmt.Fprint(w, string(jsonResp))
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const clockTicks = 100 // USER_HZ on linux
+
+type ProcInfo struct {
+	Pid        int         `json:"pid"`
+	PPid       int         `json:"ppid"`
+	Sid        int         `json:"-"`
+	State      string      `json:"state"`
+	Command    string      `json:"command"`
+	CPUSeconds float64     `json:"cpu_seconds"`
+	RSSKB      int64       `json:"rss_kb"`
+	Children   []*ProcInfo `json:"children,omitempty"`
+}
+
+type PsEntry struct {
+	runningCmd
+	Tree *ProcInfo `json:"tree,omitempty"`
+}
+
+type PsResults struct {
+	Type     string    `json:"type"`
+	Session  string    `json:"session"`
+	Commands []PsEntry `json:"commands"`
+}
+
+// readProc parses /proc/<pid>/stat and cmdline into a ProcInfo.
+func readProc(pid int) (*ProcInfo, error) {
+	dir := filepath.Join("/proc", strconv.Itoa(pid))
+	stat, err := os.ReadFile(filepath.Join(dir, "stat"))
+	if err != nil {
+		return nil, err
+	}
+
+	// comm is wrapped in parens and may itself contain spaces
+	open := bytes.IndexByte(stat, '(')
+	end := bytes.LastIndexByte(stat, ')')
+	if open < 0 || end < open {
+		return nil, fmt.Errorf("malformed stat for pid %d", pid)
+	}
+	comm := string(stat[open+1 : end])
+	fields := strings.Fields(string(stat[end+1:]))
+	if len(fields) < 22 {
+		return nil, fmt.Errorf("short stat for pid %d", pid)
+	}
+
+	ppid, _ := strconv.Atoi(fields[1])
+	sid, _ := strconv.Atoi(fields[3])
+	utime, _ := strconv.ParseInt(fields[11], 10, 64)
+	stime, _ := strconv.ParseInt(fields[12], 10, 64)
+	rss, _ := strconv.ParseInt(fields[21], 10, 64)
+
+	command := comm
+	if cmdline, err := os.ReadFile(filepath.Join(dir, "cmdline")); err == nil && len(cmdline) > 0 {
+		command = strings.TrimSpace(strings.ReplaceAll(string(cmdline), "\x00", " "))
+	}
+
+	return &ProcInfo{
+		Pid:        pid,
+		PPid:       ppid,
+		Sid:        sid,
+		State:      fields[0],
+		Command:    command,
+		CPUSeconds: float64(utime+stime) / clockTicks,
+		RSSKB:      rss * int64(os.Getpagesize()) / 1024,
+	}, nil
+}
+
+// processTable snapshots every process visible in /proc keyed by pid.
+func processTable() map[int]*ProcInfo {
+	procs := make(map[int]*ProcInfo)
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		logger.Error("failed to read /proc", "err", err)
+		return procs
+	}
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		p, err := readProc(pid)
+		if err != nil {
+			continue
+		}
+		procs[pid] = p
+	}
+	return procs
+}
+
+// buildTree links the processes beneath root, returning nil if root is gone.
+func buildTree(procs map[int]*ProcInfo, root int) *ProcInfo {
+	children := make(map[int][]*ProcInfo)
+	for _, p := range procs {
+		children[p.PPid] = append(children[p.PPid], p)
+	}
+
+	var link func(p *ProcInfo) *ProcInfo
+	link = func(p *ProcInfo) *ProcInfo {
+		node := *p
+		node.Children = nil
+		kids := children[p.Pid]
+		sort.Slice(kids, func(i, j int) bool { return kids[i].Pid < kids[j].Pid })
+		for _, c := range kids {
+			node.Children = append(node.Children, link(c))
+		}
+		return &node
+	}
+
+	p, ok := procs[root]
+	if !ok {
+		return nil
+	}
+	return link(p)
+}
+
+// sessionProcesses snapshots the process trees of the session's commands.
+func sessionProcesses(session string) *PsResults {
+	results := &PsResults{Type: "ps", Session: session, Commands: []PsEntry{}}
+	cmds := runningForSession(session)
+	if len(cmds) > 0 {
+		procs := processTable()
+		for _, rc := range cmds {
+			results.Commands = append(results.Commands, PsEntry{runningCmd: rc, Tree: buildTree(procs, rc.Pid)})
+		}
+	}
+	return results
+}
+
+func psHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodGet {
+		writeError(w, errMethodMessage)
+		return
+	}
+
+	// Validate the hash parameter
+	hashParam := r.URL.Query().Get("hash")
+	if !checkHash(r, hashParam) {
+		writeError(w, errHashMessage)
+		return
+	}
+
+	// Check if session is provided in query parameters
+	session := r.URL.Query().Get("session")
+	if session == "" {
+		writeError(w, errSessionMessage)
+		return
+	}
+
+	jsonResp, err := json.Marshal(sessionProcesses(session))
+	if err != nil {
+		msg := fmt.Sprintf("Failed to marshal JSON response: %v", err)
+		writeJsonError(w, msg)
+		return
+	}
+
+	fmt.Fprint(w, string(jsonResp))
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// With SHELL_BACKEND=pty a command's stdin, stdout and stderr are a pseudo
+// terminal, so colors, progress bars and isatty checks behave as in a
+// terminal. Its output is read from the master end with the terminal's line
+// endings turned back into \n. A command that reads from its terminal waits
+// until its timeout, there is nobody to type.
+
+// ptyDrain is how long the output is read after the command exits, a
+// background process still holding the terminal doesn't keep it open.
+const ptyDrain = 200 * time.Millisecond
+
+// ptyCopy copies a command's terminal into its output writer.
+type ptyCopy struct {
+	master, tty *os.File
+	done        chan struct{}
+}
+
+// attachPty puts the command on a new pseudo terminal, copying what it
+// writes to the command's Stdout.
+func attachPty(cmd *exec.Cmd) (*ptyCopy, error) {
+	master, tty, err := openPty()
+	if err != nil {
+		return nil, err
+	}
+	out := &crlfWriter{w: cmd.Stdout}
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = tty, tty, tty
+	cmd.SysProcAttr = ptyAttr()
+	p := &ptyCopy{master: master, tty: tty, done: make(chan struct{})}
+	go func() {
+		io.Copy(out, master)
+		out.flush()
+		close(p.done)
+	}()
+	return p, nil
+}
+
+// started closes the server's end of the terminal once the command has it,
+// or failed to start.
+func (p *ptyCopy) started() {
+	p.tty.Close()
+}
+
+// drain waits for the output left on the terminal once the command exited.
+func (p *ptyCopy) drain() {
+	p.tty.Close()
+	p.master.SetReadDeadline(time.Now().Add(ptyDrain))
+	<-p.done
+	p.master.Close()
+}
+
+// crlfWriter turns a terminal's \r\n line endings back into \n, holding a
+// trailing \r back until the next write tells.
+type crlfWriter struct {
+	w  io.Writer
+	cr bool
+}
+
+func (c *crlfWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	if c.cr {
+		p = append([]byte{'\r'}, p...)
+		c.cr = false
+	}
+	if len(p) > 0 && p[len(p)-1] == '\r' {
+		p, c.cr = p[:len(p)-1], true
+	}
+	if _, err := c.w.Write(bytes.ReplaceAll(p, []byte("\r\n"), []byte("\n"))); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// flush writes the \r held back, once the terminal has nothing more to tell.
+func (c *crlfWriter) flush() {
+	if c.cr {
+		c.w.Write([]byte{'\r'})
+		c.cr = false
+	}
+}
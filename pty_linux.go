@@ -0,0 +1,62 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+// ptyRows and ptyCols size the terminal, wide enough that tools don't wrap.
+const (
+	ptyRows = 50
+	ptyCols = 200
+)
+
+// openPty opens a pseudo terminal, the master end is pollable so reads
+// honor deadlines.
+func openPty() (master, tty *os.File, err error) {
+	master, err = os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	var n uint32
+	err = ptyIoctl(master, syscall.TIOCSPTLCK, unsafe.Pointer(new(int32)))
+	if err == nil {
+		err = ptyIoctl(master, syscall.TIOCGPTN, unsafe.Pointer(&n))
+	}
+	if err == nil {
+		size := [4]uint16{ptyRows, ptyCols, 0, 0}
+		err = ptyIoctl(master, syscall.TIOCSWINSZ, unsafe.Pointer(&size))
+	}
+	if err == nil {
+		tty, err = os.OpenFile("/dev/pts/"+strconv.Itoa(int(n)), os.O_RDWR|syscall.O_NOCTTY, 0)
+	}
+	if err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+	return master, tty, nil
+}
+
+func ptyIoctl(f *os.File, req uintptr, arg unsafe.Pointer) error {
+	conn, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var errno syscall.Errno
+	if err := conn.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, req, uintptr(arg))
+	}); err != nil {
+		return err
+	}
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// ptyAttr makes the tty the controlling terminal of the command's session.
+func ptyAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setsid: true, Setctty: true}
+}
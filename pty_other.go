@@ -0,0 +1,18 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// openPty is only implemented on linux.
+func openPty() (master, tty *os.File, err error) {
+	return nil, nil, fmt.Errorf("SHELL_BACKEND=pty is only supported on linux")
+}
+
+func ptyAttr() *syscall.SysProcAttr {
+	return nil
+}
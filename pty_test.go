@@ -0,0 +1,36 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCRLFWriter(t *testing.T) {
+	tests := []struct {
+		name   string
+		chunks []string
+		want   string
+	}{
+		{"line endings", []string{"a\r\nb\r\n"}, "a\nb\n"},
+		{"split line ending", []string{"a\r", "\nb\r\n"}, "a\nb\n"},
+		{"progress", []string{"10%\r", "50%\r", "done\r\n"}, "10%\r50%\rdone\n"},
+		{"trailing carriage return", []string{"a\r\n", "50%\r"}, "a\n50%\r"},
+		{"lone carriage return", []string{"\r"}, "\r"},
+		{"empty write", []string{"a\r", "", "\n"}, "a\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			c := &crlfWriter{w: &out}
+			for _, chunk := range tt.chunks {
+				if n, err := c.Write([]byte(chunk)); err != nil || n != len(chunk) {
+					t.Fatalf("Write(%q) = %d, %v", chunk, n, err)
+				}
+			}
+			c.flush()
+			if out.String() != tt.want {
+				t.Fatalf("output = %q, want %q", out.String(), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A session's commands take turns in a first in, first out queue when they
+// share a shell: a command typed into the tmux shell while another runs
+// would race it for the shell's stdin. /shell answers a command that has to
+// wait with its place in the queue and an estimate of the wait, /status
+// reports it as queued until its turn, and /queue lists what each session
+// runs and has waiting. SERIALIZE_COMMANDS=1 queues the exec backend's
+// commands too, which otherwise run side by side in shells of their own.
+//
+// The estimate is a moving average of the session's recent command
+// durations, seeded from its tickets, so it's a guess for a session whose
+// commands vary.
+
+const (
+	queueAvgWeight   = 0.2 // of the newest duration in the moving average
+	errQueueCanceled = "Canceled while queued"
+)
+
+var serializeCommands bool // SERIALIZE_COMMANDS
+
+// QueueState is where a submitted command stands in its session's queue.
+type QueueState struct {
+	Position        int   `json:"position"`                    // 1 runs next
+	EstimatedWaitMs int64 `json:"estimated_wait_ms,omitempty"` // omitted without an estimate
+}
+
+// QueuedCommand is a command of a session's queue, running or waiting.
+type QueuedCommand struct {
+	Ticket          int        `json:"ticket"`
+	Input           string     `json:"input"`
+	Position        int        `json:"position"` // 0 runs
+	Queued          time.Time  `json:"queued"`
+	Started         *time.Time `json:"started,omitempty"`
+	EstimatedWaitMs int64      `json:"estimated_wait_ms,omitempty"`
+}
+
+// SessionQueue is a session's queue as /queue shows it.
+type SessionQueue struct {
+	Type     string           `json:"type"`
+	Session  string           `json:"session"`
+	Running  *QueuedCommand   `json:"running,omitempty"`
+	Waiting  []*QueuedCommand `json:"waiting"`
+	AvgMs    int64            `json:"avg_ms,omitempty"`
+	Serial   bool             `json:"serial"`
+	Commands int              `json:"commands"`
+}
+
+// queueTurn is one command's place in its session's queue.
+type queueTurn struct {
+	q        *cmdQueue
+	ticket   int
+	input    string
+	queued   time.Time
+	started  time.Time
+	ready    chan struct{} // closed when it's the command's turn
+	canceled chan struct{} // closed when the session is killed while it waits
+}
+
+// cmdQueue is a session's queue, turns[0] holds the shell once ready.
+type cmdQueue struct {
+	mu      sync.Mutex
+	session string
+	turns   []*queueTurn
+	avgMs   float64
+	seeded  bool
+}
+
+var cmdQueues sync.Map // session -> *cmdQueue
+
+func loadQueue() error {
+	serializeCommands = os.Getenv("SERIALIZE_COMMANDS") == "1"
+	return nil
+}
+
+// queued reports whether the session's commands take turns, as they do in
+// a shared shell.
+func queued() bool {
+	return activeExecutor.persistent() || serializeCommands
+}
+
+func sessionQueue(session string) *cmdQueue {
+	v, ok := cmdQueues.Load(session)
+	if !ok {
+		v, _ = cmdQueues.LoadOrStore(session, &cmdQueue{session: session})
+	}
+	return v.(*cmdQueue)
+}
+
+// enqueueCommand takes the command's place at the end of the session's
+// queue, its turn right away when the queue is empty.
+func enqueueCommand(session string, ticket int, input string) *queueTurn {
+	q := sessionQueue(session)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	t := &queueTurn{q: q, ticket: ticket, input: input, queued: time.Now(), ready: make(chan struct{}), canceled: make(chan struct{})}
+	q.turns = append(q.turns, t)
+	if len(q.turns) == 1 {
+		t.started = t.queued
+		close(t.ready)
+	}
+	return t
+}
+
+// wait blocks until it's the command's turn. When ctx is done or the
+// session killed first the command leaves the queue.
+func (t *queueTurn) wait(ctx context.Context) error {
+	select {
+	case <-t.ready:
+		return nil
+	case <-ctx.Done():
+		t.release()
+		return ctx.Err()
+	case <-t.canceled:
+		t.release()
+		return fmt.Errorf(errQueueCanceled)
+	}
+}
+
+// release leaves the queue, handing the turn to the next command when it
+// was this one's.
+func (t *queueTurn) release() {
+	q := t.q
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, o := range q.turns {
+		if o != t {
+			continue
+		}
+		q.turns = append(q.turns[:i], q.turns[i+1:]...)
+		if i > 0 {
+			return
+		}
+		ms := float64(time.Since(t.started).Milliseconds())
+		if q.avgMs == 0 {
+			q.avgMs = ms
+		} else {
+			q.avgMs += queueAvgWeight * (ms - q.avgMs)
+		}
+		if len(q.turns) > 0 {
+			next := q.turns[0]
+			next.started = time.Now()
+			close(next.ready)
+		}
+		return
+	}
+}
+
+// estimate returns the expected wait of the command at index i, the caller
+// holds q.mu. The average is seeded from the session's tickets once.
+func (q *cmdQueue) estimate(i int) int64 {
+	if i == 0 {
+		return 0
+	}
+	if q.avgMs == 0 && !q.seeded {
+		q.seeded = true
+		if s, err := sessionStats(q.session); err == nil {
+			s.finish()
+			q.avgMs = float64(s.AvgMs)
+		}
+	}
+	if q.avgMs == 0 {
+		return 0
+	}
+	avg := time.Duration(q.avgMs) * time.Millisecond
+	wait := max(avg-time.Since(q.turns[0].started), 0) + time.Duration(i-1)*avg
+	return wait.Milliseconds()
+}
+
+// state returns where the command stands, nil once it's its turn.
+func (t *queueTurn) state() *QueueState {
+	q := t.q
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, o := range q.turns {
+		if o == t && i > 0 {
+			return &QueueState{Position: i, EstimatedWaitMs: q.estimate(i)}
+		}
+	}
+	return nil
+}
+
+// queuedState returns where the session's ticket waits, nil when it isn't
+// waiting.
+func queuedState(session string, ticket int) *QueueState {
+	v, ok := cmdQueues.Load(session)
+	if !ok {
+		return nil
+	}
+	q := v.(*cmdQueue)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, t := range q.turns {
+		if t.ticket == ticket && i > 0 {
+			return &QueueState{Position: i, EstimatedWaitMs: q.estimate(i)}
+		}
+	}
+	return nil
+}
+
+// cancelQueued drops the session's waiting commands, returning how many.
+func cancelQueued(session string) int {
+	v, ok := cmdQueues.Load(session)
+	if !ok {
+		return 0
+	}
+	q := v.(*cmdQueue)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	n := 0
+	for _, t := range q.turns[min(1, len(q.turns)):] {
+		select {
+		case <-t.canceled:
+		default:
+			close(t.canceled)
+			n++
+		}
+	}
+	return n
+}
+
+// snapshot describes the queue.
+func (q *cmdQueue) snapshot() *SessionQueue {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	sq := &SessionQueue{Type: "queue", Session: q.session, Waiting: []*QueuedCommand{}, AvgMs: int64(q.avgMs), Serial: queued(), Commands: len(q.turns)}
+	for i, t := range q.turns {
+		qc := &QueuedCommand{Ticket: t.ticket, Input: t.input, Position: i, Queued: t.queued.UTC(), EstimatedWaitMs: q.estimate(i)}
+		if i == 0 {
+			started := t.started.UTC()
+			qc.Started = &started
+			sq.Running = qc
+			continue
+		}
+		sq.Waiting = append(sq.Waiting, qc)
+	}
+	return sq
+}
+
+// queueText renders the queues, a line per command.
+func queueText(queues []*SessionQueue) string {
+	var b strings.Builder
+	for _, sq := range queues {
+		if sq.Running != nil {
+			fmt.Fprintf(&b, "%s: running ticket %d since %s: %s\n", sq.Session, sq.Running.Ticket, sq.Running.Started.Format(time.RFC3339), sq.Running.Input)
+		}
+		for _, qc := range sq.Waiting {
+			fmt.Fprintf(&b, "%s: #%d ticket %d, about %s: %s\n", sq.Session, qc.Position, qc.Ticket, time.Duration(qc.EstimatedWaitMs)*time.Millisecond, qc.Input)
+		}
+	}
+	return b.String()
+}
+
+// queueHandler shows the session's queue, or every session's with commands
+// queued or running.
+func queueHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodGet {
+		writeError(w, errMethodMessage)
+		return
+	}
+
+	format, err := responseFormat(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// Validate the hash parameter
+	hashParam := r.URL.Query().Get("hash")
+	if !checkHash(r, hashParam) {
+		writeError(w, errHashMessage)
+		return
+	}
+
+	session := r.URL.Query().Get("session")
+	if session != "" {
+		if !validSessionName(session) {
+			writeError(w, errSessionMessage)
+			return
+		}
+		if !sessionExists(session) {
+			writeError(w, errSessionNotFound)
+			return
+		}
+		sq := sessionQueue(session).snapshot()
+		writeFormatted(w, format, sq, queueText([]*SessionQueue{sq}))
+		return
+	}
+
+	queues := []*SessionQueue{}
+	cmdQueues.Range(func(_, v interface{}) bool {
+		if sq := v.(*cmdQueue).snapshot(); sq.Commands > 0 {
+			queues = append(queues, sq)
+		}
+		return true
+	})
+	sort.Slice(queues, func(i, j int) bool { return queues[i].Session < queues[j].Session })
+	writeFormatted(w, format, queues, queueText(queues))
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	recordingFile      = "session.cast"
+	recordingWidth     = 120
+	recordingHeight    = 40
+	recordingIdleLimit = 2.0 // seconds, collapses the gaps between commands
+)
+
+var recordSessions atomic.Bool // RECORD_SESSIONS, keep an asciicast of every session
+
+// castHeader is the first line of an asciicast v2 file.
+type castHeader struct {
+	Version       int     `json:"version"`
+	Width         int     `json:"width"`
+	Height        int     `json:"height"`
+	Timestamp     int64   `json:"timestamp"`
+	IdleTimeLimit float64 `json:"idle_time_limit,omitempty"`
+	Title         string  `json:"title,omitempty"`
+}
+
+var (
+	castMu     sync.Mutex
+	castStarts = map[string]time.Time{} // recording path -> header timestamp
+)
+
+// recording appends one ticket's terminal output to the session's
+// SESSIONS_DIR/<session>/session.cast, so the whole session replays as a
+// single asciicast.
+type recording struct {
+	path  string
+	start time.Time
+}
+
+// openRecording returns nil when RECORD_SESSIONS is off or the recording
+// can't be started.
+func openRecording(sessionFolder, session string) *recording {
+	if !recordSessions.Load() {
+		return nil
+	}
+	path := filepath.Join(sessionFolder, recordingFile)
+
+	castMu.Lock()
+	defer castMu.Unlock()
+	start, ok := castStarts[path]
+	if _, err := os.Stat(path); err != nil {
+		ok = false // removed since, start over
+	}
+	if !ok {
+		var err error
+		if start, err = castStart(path, session); err != nil {
+			logger.Error("failed to start recording", "dir", sessionFolder, "err", err)
+			return nil
+		}
+		castStarts[path] = start
+	}
+	return &recording{path: path, start: start}
+}
+
+// castStart reads an existing recording's start time, or writes the header
+// of a new one.
+func castStart(path, session string) (time.Time, error) {
+	if f, err := os.Open(path); err == nil {
+		defer f.Close()
+		var h castHeader
+		line, err := bufio.NewReader(f).ReadBytes('\n')
+		if err == nil && json.Unmarshal(line, &h) == nil && h.Version == 2 {
+			return time.Unix(h.Timestamp, 0), nil
+		}
+		return time.Time{}, fmt.Errorf("%s is not an asciicast v2 recording", path)
+	}
+
+	now := time.Now()
+	header, err := json.Marshal(&castHeader{
+		Version:       2,
+		Width:         recordingWidth,
+		Height:        recordingHeight,
+		Timestamp:     now.Unix(),
+		IdleTimeLimit: recordingIdleLimit,
+		Title:         session,
+	})
+	if err != nil {
+		return time.Time{}, err
+	}
+	if err := os.WriteFile(path, append(header, '\n'), 0600); err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(now.Unix(), 0), nil
+}
+
+// output appends an "o" event.
+func (rec *recording) output(data string) {
+	// Timestamped under the lock so concurrent tickets stay in order
+	castMu.Lock()
+	defer castMu.Unlock()
+	event, err := json.Marshal([]interface{}{time.Since(rec.start).Seconds(), "o", data})
+	if err != nil {
+		return
+	}
+	f, err := os.OpenFile(rec.path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		logger.Error("failed to write recording", "path", rec.path, "err", err)
+		return
+	}
+	defer f.Close()
+	f.Write(append(event, '\n'))
+}
+
+// Write records command output with terminal line endings.
+func (rec *recording) Write(p []byte) (int, error) {
+	rec.output(crlf(string(p)))
+	return len(p), nil
+}
+
+func (rec *recording) prompt(session string, ticket int, input string) {
+	rec.output(fmt.Sprintf("\x1b[1;32m%s #%d $\x1b[0m %s\r\n", session, ticket, crlf(input)))
+}
+
+func (rec *recording) exit(code int) {
+	if code != 0 {
+		rec.output(fmt.Sprintf("\x1b[31m[exit %d]\x1b[0m\r\n", code))
+	}
+}
+
+// forgetRecording drops the cached start time of a deleted or renamed
+// session's recording.
+func forgetRecording(sessionFolder string) {
+	castMu.Lock()
+	delete(castStarts, filepath.Join(sessionFolder, recordingFile))
+	castMu.Unlock()
+}
+
+// recordingHandler serves a session's asciicast for asciinema play or any
+// compatible player.
+func recordingHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodGet {
+		writeError(w, errMethodMessage)
+		return
+	}
+
+	// Validate the hash parameter
+	hashParam := r.URL.Query().Get("hash")
+	if !checkHash(r, hashParam) {
+		writeError(w, errHashMessage)
+		return
+	}
+
+	session := r.URL.Query().Get("session")
+	if !validSessionName(session) {
+		writeError(w, errSessionMessage)
+		return
+	}
+	serveRecording(w, session)
+}
+
+func serveRecording(w http.ResponseWriter, session string) {
+	f, err := os.Open(filepath.Join(sessionsDir, session, recordingFile))
+	if err != nil {
+		writeError(w, notFoundf("No recording for session %s, is RECORD_SESSIONS enabled?", session))
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", "application/x-asciicast")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=%q", session+".cast"))
+	io.Copy(w, f)
+}
+
+func dashboardRecordingHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, errMethodMessage)
+		return
+	}
+	session := r.URL.Query().Get("session")
+	if !validSessionName(session) {
+		writeError(w, errSessionMessage)
+		return
+	}
+	if r.URL.Query().Get("format") == "cast" {
+		serveRecording(w, session)
+		return
+	}
+
+	_, err := os.Stat(filepath.Join(sessionsDir, session, recordingFile))
+	renderDashboard(w, r, "recording", "Recording "+session, map[string]interface{}{
+		"Session":   session,
+		"Available": err == nil,
+	})
+}
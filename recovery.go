@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// At startup the server goes through SESSIONS_DIR once. It indexes every
+// session's tickets, and completes the empty tickets of commands the previous
+// server process was running when it stopped, which nothing would ever
+// finish, so their pollers learn to run them again. With RESPAWN_SHELLS it
+// also starts the tmux shells of the sessions active in that window, so an
+// agent resuming work doesn't wait for one.
+
+const errRestartedMessage = "Interrupted: the command was still running when the server stopped"
+
+var respawnShells time.Duration // RESPAWN_SHELLS, 0 starts shells on demand only
+
+func loadRecovery() error {
+	respawnShells = 0
+	s := os.Getenv("RESPAWN_SHELLS")
+	if s == "" {
+		return nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return fmt.Errorf("RESPAWN_SHELLS must be a duration such as 24h: %q", s)
+	}
+	if shellBackend != backendTmux {
+		return fmt.Errorf("RESPAWN_SHELLS needs SHELL_BACKEND=tmux")
+	}
+	respawnShells = d
+	return nil
+}
+
+// recoverSessions scans SESSIONS_DIR. It runs after recoverTmux, whose
+// resumed commands keep their tickets, and before the server listens.
+func recoverSessions() {
+	entries, err := os.ReadDir(sessionsDir)
+	if err != nil {
+		logger.Warn("failed to scan sessions", "dir", sessionsDir, "err", err)
+		return
+	}
+	start := time.Now()
+	sessions, interrupted := 0, 0
+	var respawn []string
+	for _, e := range entries {
+		if !e.IsDir() || !validSessionName(e.Name()) {
+			continue
+		}
+		session, dir := e.Name(), filepath.Join(sessionsDir, e.Name())
+		sessions++
+
+		// Another instance sharing the folder may be running its commands,
+		// and no index is kept
+		if sharedStorage {
+			continue
+		}
+		interrupted += interruptTickets(session, dir, errRestartedMessage, "This command was interrupted when the server restarted. Issue it again to /shell if it is still needed", func(ticket int) bool {
+			return tmuxJobPending(dir, ticket)
+		})
+		idx, err := sessionTicketIndex(dir)
+		if err != nil {
+			continue
+		}
+		if respawnShells > 0 {
+			if tickets := idx.list(); len(tickets) > 0 && time.Since(tickets[len(tickets)-1].Modified) < respawnShells {
+				respawn = append(respawn, session)
+			}
+		}
+	}
+	logger.Info("recovered sessions", "sessions", sessions, "interrupted", interrupted, "ms", time.Since(start).Milliseconds())
+
+	if len(respawn) > 0 {
+		go func() {
+			for _, session := range respawn {
+				if err := tmuxEnsure(session); err != nil {
+					logger.Warn("failed to respawn shell", "session", session, "err", err)
+				}
+			}
+			logger.Info("respawned shells", "sessions", len(respawn))
+		}()
+	}
+}
+
+// tmuxJobPending reports whether the ticket is a command recoverTmux resumed.
+func tmuxJobPending(sessionFolder string, ticket int) bool {
+	if shellBackend != backendTmux {
+		return false
+	}
+	_, err := os.Stat(tmuxJobPath(sessionFolder, ticket, ".json"))
+	return err == nil
+}
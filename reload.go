@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// settingString is a string setting that a reload may swap while requests
+// are reading it.
+type settingString struct {
+	v atomic.Value
+}
+
+func (s *settingString) Load() string {
+	v, _ := s.v.Load().(string)
+	return v
+}
+
+func (s *settingString) Store(v string) {
+	s.v.Store(v)
+}
+
+// reloadableKeys are the settings a reload applies. Everything else, such
+// as the listeners and directories, needs a restart.
+var reloadableKeys = []string{
+	"HASH", "ADMIN_HASH", "INIT_SCRIPT", "WEB_DIR",
+	"LOG_LEVEL", "LOG_COMMANDS", "TRANSCRIPT_LOG", "RECORD_SESSIONS",
+	"CONFIRM_RISK", "RISK_RULES", "SESSION_TOKEN_BUDGET", "HASH_TOKEN_BUDGET",
+	"CACHE_RULES",
+}
+
+// loadReloadable validates the reloadable settings and, only when they are
+// all valid, applies them.
+func loadReloadable() error {
+	hash := os.Getenv("HASH")
+	if len(hash) < 32 {
+		return fmt.Errorf("HASH must be >= 32 characters")
+	}
+	admin := os.Getenv("ADMIN_HASH")
+	if admin != "" && len(admin) < 32 {
+		return fmt.Errorf("ADMIN_HASH must be >= 32 characters")
+	}
+	script := os.Getenv("INIT_SCRIPT")
+	if script != "" {
+		if _, err := os.Stat(script); err != nil {
+			return fmt.Errorf("INIT_SCRIPT is not readable: %v", err)
+		}
+	}
+	web := os.Getenv("WEB_DIR")
+	if err := checkWebDir(web); err != nil {
+		return fmt.Errorf("WEB_DIR is not usable: %v", err)
+	}
+	level, err := parseLogLevel(os.Getenv("LOG_LEVEL"))
+	if err != nil {
+		return err
+	}
+	risk, err := parseRiskPolicy()
+	if err != nil {
+		return err
+	}
+	sessionBudget, hashBudget, err := parseTokenBudgets()
+	if err != nil {
+		return err
+	}
+	cache, err := parseCachePolicy()
+	if err != nil {
+		return err
+	}
+
+	hashPassword.Store(hash)
+	adminHash.Store(admin)
+	initScript.Store(script)
+	setWebDir(web)
+	logLevel.Set(level)
+	logCommands.Store(os.Getenv("LOG_COMMANDS") == "true")
+	transcriptLog.Store(os.Getenv("TRANSCRIPT_LOG") == "true")
+	recordSessions.Store(os.Getenv("RECORD_SESSIONS") == "true")
+	activeRisk.Store(risk)
+	setTokenBudgets(sessionBudget, hashBudget)
+	cacheRules.Store(&cache)
+	return nil
+}
+
+// ReloadResult reports which settings a reload changed, by name only.
+type ReloadResult struct {
+	Type            string   `json:"type"`
+	Changed         []string `json:"changed"`
+	RestartRequired []string `json:"restart_required"`
+}
+
+var reloadMu sync.Mutex
+
+// reloadConfig re-reads the .env and config file and applies the reloadable
+// settings. Running commands and open connections are untouched.
+func reloadConfig() (*ReloadResult, error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	sdNotify(fmt.Sprintf("RELOADING=1\nMONOTONIC_USEC=%d", monotonicUsec()))
+	defer sdNotify("READY=1")
+
+	// A reload that fails leaves the environment and files as they were
+	before := environ()
+	fileKeys, loaded := activeConfig.fileKeys, activeConfig.loaded
+	rollback := func() {
+		restoreEnv(before)
+		activeConfig.fileKeys, activeConfig.loaded = fileKeys, loaded
+	}
+	if err := activeConfig.reload(); err != nil {
+		rollback()
+		return nil, err
+	}
+	after := environ()
+
+	res := &ReloadResult{Type: "reload", Changed: []string{}, RestartRequired: []string{}}
+	reloadable := map[string]bool{}
+	for _, k := range reloadableKeys {
+		reloadable[k] = true
+	}
+	for k := range union(before, after) {
+		if before[k] == after[k] {
+			continue
+		}
+		if reloadable[k] {
+			res.Changed = append(res.Changed, k)
+		} else {
+			res.RestartRequired = append(res.RestartRequired, k)
+		}
+	}
+	sort.Strings(res.Changed)
+	sort.Strings(res.RestartRequired)
+
+	if err := loadReloadable(); err != nil {
+		rollback()
+		return nil, err
+	}
+	logger.Info("configuration reloaded", "changed", res.Changed, "restart_required", res.RestartRequired)
+	return res, nil
+}
+
+func environ() map[string]string {
+	env := map[string]string{}
+	for _, kv := range os.Environ() {
+		k, v, _ := strings.Cut(kv, "=")
+		env[k] = v
+	}
+	return env
+}
+
+// restoreEnv sets the process environment back to env.
+func restoreEnv(env map[string]string) {
+	for k := range environ() {
+		if _, ok := env[k]; !ok {
+			os.Unsetenv(k)
+		}
+	}
+	for k, v := range env {
+		if os.Getenv(k) != v {
+			os.Setenv(k, v)
+		}
+	}
+}
+
+func union(a, b map[string]string) map[string]bool {
+	keys := map[string]bool{}
+	for k := range a {
+		keys[k] = true
+	}
+	for k := range b {
+		keys[k] = true
+	}
+	return keys
+}
+
+// reloadOnHangup reloads the configuration on every SIGHUP.
+func reloadOnHangup() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	go func() {
+		for range ch {
+			if _, err := reloadConfig(); err != nil {
+				logger.Error("configuration reload failed, keeping the current settings", "err", err)
+			}
+		}
+	}()
+}
+
+// reloadHandler reloads the configuration (POST), with the admin hash.
+func reloadHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodPost {
+		writeError(w, errMethodMessage)
+		return
+	}
+
+	res, err := reloadConfig()
+	if err != nil {
+		writeJsonError(w, fmt.Sprintf("Reload failed, keeping the current settings: %v", err))
+		return
+	}
+
+	jsonResp, err := json.Marshal(res)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to marshal JSON response: %v", err)
+		writeJsonError(w, msg)
+		return
+	}
+
+	fmt.Fprint(w, string(jsonResp))
+}
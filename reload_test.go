@@ -0,0 +1,69 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReloadRollback(t *testing.T) {
+	env := environ()
+	oldConfig := activeConfig
+	t.Cleanup(func() {
+		restoreEnv(env)
+		activeConfig = oldConfig
+	})
+
+	envFile := filepath.Join(t.TempDir(), ".env")
+	hash := strings.Repeat("a", 32)
+	write := func(content string) {
+		if err := os.WriteFile(envFile, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("HASH=" + hash + "\nLLMASS_TEST_KEPT=1\nLLMASS_TEST_DROPPED=1\n")
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	c := registerConfigFlags(fs)
+	if err := fs.Parse([]string{"-env-file", envFile}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.apply(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"invalid setting", "HASH=" + hash + "\nLLMASS_TEST_KEPT=2\nLLMASS_TEST_ADDED=1\nCONFIRM_RISK=maybe\n"},
+		{"missing hash", "LLMASS_TEST_KEPT=2\nLLMASS_TEST_ADDED=1\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			write(tt.content)
+			if _, err := reloadConfig(); err == nil {
+				t.Fatal("reloadConfig() = nil, want an error")
+			}
+			if got := os.Getenv("HASH"); got != hash {
+				t.Errorf("HASH = %q, want %q", got, hash)
+			}
+			if got := os.Getenv("LLMASS_TEST_KEPT"); got != "1" {
+				t.Errorf("LLMASS_TEST_KEPT = %q, want 1", got)
+			}
+			if got := os.Getenv("LLMASS_TEST_DROPPED"); got != "1" {
+				t.Errorf("LLMASS_TEST_DROPPED = %q, want 1", got)
+			}
+			if _, set := os.LookupEnv("LLMASS_TEST_ADDED"); set {
+				t.Error("LLMASS_TEST_ADDED is set")
+			}
+			if len(c.fileKeys) != 3 {
+				t.Errorf("file keys = %q, want the 3 of the first file", c.fileKeys)
+			}
+		})
+	}
+}
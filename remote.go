@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// The docker, ssh and k8s backends run every command in a fresh
+// REMOTE_SHELL (default bash) of a container, a host or a pod, through the
+// docker, ssh or kubectl client on the server. The client is the command's
+// process: its output is the command's, a timeout or /sessions/kill stops it,
+// which may leave the remote command running. The init files are read on the
+// server and sent along with the command, as the remote can't reach them,
+// and so are the cwd and env of the request. Artifacts and workspaces stay
+// on the server, out of a remote command's reach. A command on a pseudo
+// terminal, as one with expect steps is, gets a remote one too, so what
+// only prompts on a terminal prompts there.
+//
+// DOCKER_CONTAINER, SSH_HOST and K8S_POD may hold {session}, replaced with
+// the session's name, to give each session a target of its own.
+
+// remote runs scripts somewhere else through a client on the server.
+type remote interface {
+	// load reads the remote's settings and checks for its client.
+	load() error
+	// command returns the client process that runs script for the session
+	// with the remote shell, on a remote terminal with tty.
+	command(ctx context.Context, session, script string, tty bool) *exec.Cmd
+	// target returns where the session's scripts run.
+	target(session string) string
+}
+
+var remoteShell = "bash" // REMOTE_SHELL
+
+// loadRemote reads REMOTE_SHELL and the setting naming the remote, and
+// checks its client is installed.
+func loadRemote(backend, client, target string) (string, error) {
+	remoteShell = settingOr("REMOTE_SHELL", "bash")
+	value := os.Getenv(target)
+	if value == "" {
+		return "", fmt.Errorf("SHELL_BACKEND=%s needs %s", backend, target)
+	}
+	if _, err := exec.LookPath(client); err != nil {
+		return "", fmt.Errorf("SHELL_BACKEND=%s needs %s: %v", backend, client, err)
+	}
+	return value, nil
+}
+
+// remoteTarget fills in {session}.
+func remoteTarget(target, session string) string {
+	return strings.ReplaceAll(target, "{session}", session)
+}
+
+// checkTarget makes cmd fail to start when its target would be read as one
+// of the client's options.
+func checkTarget(cmd *exec.Cmd, target string) *exec.Cmd {
+	if strings.HasPrefix(target, "-") {
+		cmd.Err = fmt.Errorf("the remote target %q can't start with -", target)
+	}
+	return cmd
+}
+
+// remoteScript is inputCmd with what a local shell would have around it: the
+// working directory, the variables and the init files' contents.
+func remoteScript(sessionFolder, inputCmd, cwd string, env map[string]string) string {
+	var b strings.Builder
+	if filepath.Base(remoteShell) == "bash" {
+		b.WriteString("shopt -s expand_aliases\n")
+	}
+	if cwd != "" {
+		b.WriteString("cd " + shellQuote(cwd) + " || exit 1\n")
+	}
+	keys := make([]string, 0, len(env))
+	for k := range env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		b.WriteString("export " + k + "=" + shellQuote(env[k]) + "\n")
+	}
+	for _, f := range initFiles(sessionFolder) {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			logger.Warn("failed to read init file", "path", f, "err", err)
+			continue
+		}
+		b.Write(data)
+		b.WriteString("\n")
+	}
+	b.WriteString(inputCmd)
+	return b.String()
+}
+
+// dockerRemote runs commands in a container with docker exec.
+type dockerRemote struct {
+	container string // DOCKER_CONTAINER
+	user      string // DOCKER_USER
+}
+
+func (d *dockerRemote) load() error {
+	container, err := loadRemote(backendDocker, "docker", "DOCKER_CONTAINER")
+	if err != nil {
+		return err
+	}
+	d.container, d.user = container, os.Getenv("DOCKER_USER")
+	return nil
+}
+
+func (d *dockerRemote) command(ctx context.Context, session, script string, tty bool) *exec.Cmd {
+	args := []string{"exec"}
+	if tty {
+		args = append(args, "--interactive", "--tty")
+	}
+	if d.user != "" {
+		args = append(args, "--user", d.user)
+	}
+	target := d.target(session)
+	args = append(args, "--", target, remoteShell, "-c", script)
+	return checkTarget(exec.CommandContext(ctx, "docker", args...), target)
+}
+
+func (d *dockerRemote) target(session string) string {
+	return remoteTarget(d.container, session)
+}
+
+// sshRemote runs commands on a host with ssh. The remote login shell parses
+// the command line, so the script is quoted for a POSIX shell.
+type sshRemote struct {
+	host string   // SSH_HOST, [user@]host
+	args []string // SSH_ARGS, such as -p 2222 -i key
+}
+
+func (s *sshRemote) load() error {
+	host, err := loadRemote(backendSSH, "ssh", "SSH_HOST")
+	if err != nil {
+		return err
+	}
+	s.host, s.args = host, strings.Fields(os.Getenv("SSH_ARGS"))
+	return nil
+}
+
+func (s *sshRemote) command(ctx context.Context, session, script string, tty bool) *exec.Cmd {
+	args := []string{"-o", "BatchMode=yes"}
+	if tty {
+		args = append(args, "-tt")
+	}
+	args = append(args, s.args...)
+	target := s.target(session)
+	args = append(args, "--", target, shellQuote(remoteShell)+" -c "+shellQuote(script))
+	return checkTarget(exec.CommandContext(ctx, "ssh", args...), target)
+}
+
+func (s *sshRemote) target(session string) string {
+	return remoteTarget(s.host, session)
+}
+
+// k8sRemote runs commands in a pod with kubectl exec.
+type k8sRemote struct {
+	pod       string // K8S_POD
+	namespace string // K8S_NAMESPACE
+	container string // K8S_CONTAINER
+}
+
+func (k *k8sRemote) load() error {
+	pod, err := loadRemote(backendK8s, "kubectl", "K8S_POD")
+	if err != nil {
+		return err
+	}
+	k.pod, k.namespace, k.container = pod, os.Getenv("K8S_NAMESPACE"), os.Getenv("K8S_CONTAINER")
+	return nil
+}
+
+func (k *k8sRemote) command(ctx context.Context, session, script string, tty bool) *exec.Cmd {
+	args := []string{"exec"}
+	if tty {
+		args = append(args, "--stdin", "--tty")
+	}
+	if k.namespace != "" {
+		args = append(args, "--namespace", k.namespace)
+	}
+	if k.container != "" {
+		args = append(args, "--container", k.container)
+	}
+	// kubectl reads -- as the start of the command, the pod can't follow it
+	target := k.target(session)
+	args = append(args, target, "--", remoteShell, "-c", script)
+	return checkTarget(exec.CommandContext(ctx, "kubectl", args...), target)
+}
+
+func (k *k8sRemote) target(session string) string {
+	return remoteTarget(k.pod, session)
+}
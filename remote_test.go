@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestRemoteCommandTTY(t *testing.T) {
+	tests := []struct {
+		name   string
+		remote remote
+		tty    string
+	}{
+		{"docker", &dockerRemote{container: "box"}, "--interactive --tty"},
+		{"ssh", &sshRemote{host: "host"}, "-tt"},
+		{"k8s", &k8sRemote{pod: "pod"}, "--stdin --tty"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plain := strings.Join(tt.remote.command(context.Background(), "s", "true", false).Args, " ")
+			if strings.Contains(plain, tt.tty) {
+				t.Errorf("command without a terminal = %q, has %q", plain, tt.tty)
+			}
+			onTTY := strings.Join(tt.remote.command(context.Background(), "s", "true", true).Args, " ")
+			if !strings.Contains(onTTY, tt.tty) {
+				t.Errorf("command on a terminal = %q, want %q", onTTY, tt.tty)
+			}
+		})
+	}
+}
+
+func TestRemoteCommandTarget(t *testing.T) {
+	remotes := map[string]remote{
+		"docker": &dockerRemote{container: "{session}"},
+		"ssh":    &sshRemote{host: "{session}"},
+		"k8s":    &k8sRemote{pod: "{session}"},
+	}
+	for name, r := range remotes {
+		t.Run(name, func(t *testing.T) {
+			// The client may not be installed here, which sets Err too
+			refused := func(cmd *exec.Cmd) bool {
+				return cmd.Err != nil && strings.Contains(cmd.Err.Error(), "can't start with -")
+			}
+			if cmd := r.command(context.Background(), "box", "true", false); refused(cmd) {
+				t.Fatalf("command for box: %v", cmd.Err)
+			}
+			cmd := r.command(context.Background(), "-oProxyCommand=touch /tmp/pwned", "true", false)
+			if !refused(cmd) {
+				t.Fatalf("command for a session read as an option = %q, want it refused", cmd.Args)
+			}
+		})
+	}
+
+	// ssh and docker stop reading options before the target
+	for name, r := range map[string]remote{"docker": remotes["docker"], "ssh": remotes["ssh"]} {
+		args := r.command(context.Background(), "box", "true", false).Args
+		for i, a := range args {
+			if a == "box" && (i == 0 || args[i-1] != "--") {
+				t.Errorf("%s args = %q, want -- before the target", name, args)
+			}
+		}
+	}
+}
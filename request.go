@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultCmdTimeout = 5 * time.Minute
+	maxCmdTimeout     = 1 * time.Hour
+	maxRequestBody    = 1 << 20
+)
+
+var (
+	errTimeoutMessage = paramError("timeout", "Invalid 'timeout' parameter")
+	errEnvMessage     = paramError("env", "Invalid 'env' parameter")
+	errBodyMessage    = newKindError(errInvalidParameter, "Invalid JSON request body")
+)
+
+// envKeyPattern is a variable name the shell exports as it is.
+var envKeyPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// validEnvKey reports whether k can be exported without quoting, as the
+// shells the command runs in are told to.
+func validEnvKey(k string) bool {
+	return envKeyPattern.MatchString(k)
+}
+
+// ShellRequest is a /shell submission, decoded from either the JSON body of
+// a POST or the query string of a GET.
+type ShellRequest struct {
+	Hash    string            `json:"hash"`
+	Session string            `json:"session"`
+	Cmd     string            `json:"cmd"`
+	Timeout int               `json:"timeout"` // seconds
+	Env     map[string]string `json:"env"`
+	Cwd     string            `json:"cwd"`
+	DryRun  bool              `json:"dryrun"`
+	Confirm bool              `json:"confirm"` // runs a command CONFIRM_RISK holds back
+	// MaxTokens trims the output the callback returns
+	MaxTokens int `json:"max_tokens,omitempty"`
+	// Diff has the callback return only the lines changed since the last run
+	Diff bool `json:"diff,omitempty"`
+	// Filter is applied to the output the callback returns, see filter.go
+	Filter string `json:"filter,omitempty"`
+	// OutputJSON has the callback return JSON output as an object
+	OutputJSON bool `json:"output_json,omitempty"`
+	// LineNumbers numbers the output lines as they are saved
+	LineNumbers bool `json:"linenumbers,omitempty"`
+	// Summarize false keeps an output over SUMMARIZE_TOKENS as is
+	Summarize *bool `json:"summarize,omitempty"`
+	// ResourceLimits are nice, ionice, nofile, core and cpu, see limits.go
+	ResourceLimits
+	// Expect drives an interactive command, see expect.go
+	Expect []ExpectStep `json:"expect,omitempty"`
+}
+
+// execOptions tune how a single command is executed.
+type execOptions struct {
+	Timeout     time.Duration
+	Env         map[string]string
+	Cwd         string
+	NoSummary   bool
+	Confirmed   bool   // skips the CONFIRM_RISK check
+	Rerun       bool   // runs a repeat of the last command instead of answering with its ticket
+	LineNumbers bool   // numbers the output lines in the ticket
+	Alias       string // what was typed, when the command is an alias's expansion
+	Limits      ResourceLimits
+	Expect      []ExpectStep
+
+	turn *queueTurn // the command's place in the session's queue, taken on submission
+}
+
+// parseShellRequest decodes the request without validating it.
+func parseShellRequest(r *http.Request) (*ShellRequest, error) {
+	q := r.URL.Query()
+	if r.Method == http.MethodPost {
+		req := &ShellRequest{}
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxRequestBody))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", errBodyMessage, err)
+		}
+		if err := json.Unmarshal(body, req); err != nil {
+			return nil, fmt.Errorf("%w: %v", errBodyMessage, err)
+		}
+		if req.Hash == "" {
+			req.Hash = q.Get("hash")
+		}
+		return req, nil
+	}
+
+	req := &ShellRequest{
+		Hash:        q.Get("hash"),
+		Session:     q.Get("session"),
+		Cwd:         q.Get("cwd"),
+		DryRun:      q.Get("dryrun") == "1",
+		Confirm:     q.Get("confirm") == "true" || q.Get("confirm") == "1",
+		Diff:        q.Get("diff") == "1" || q.Get("diff") == "true",
+		Filter:      q.Get("filter"),
+		OutputJSON:  q.Get("output_json") == "1" || q.Get("output_json") == "true",
+		LineNumbers: q.Get("linenumbers") == "1" || q.Get("linenumbers") == "true",
+	}
+
+	if s := q.Get("summarize"); s != "" {
+		summarize := s != "0"
+		req.Summarize = &summarize
+	}
+
+	if cmdParam := q.Get("cmd"); cmdParam != "" {
+		inputCmd, err := url.QueryUnescape(cmdParam)
+		if err != nil {
+			logger.Debug("failed to unescape command", "err", err)
+			return nil, paramError("cmd", fmt.Sprintf("Failed to unescape command: %v", err))
+		}
+		req.Cmd = inputCmd
+	}
+
+	if t := q.Get("max_tokens"); t != "" {
+		n, err := strconv.Atoi(t)
+		if err != nil {
+			return nil, errMaxTokensMessage
+		}
+		req.MaxTokens = n
+	}
+
+	if t := q.Get("timeout"); t != "" {
+		n, err := strconv.Atoi(t)
+		if err != nil {
+			return nil, errTimeoutMessage
+		}
+		req.Timeout = n
+	}
+
+	limits, err := limitParams(r)
+	if err != nil {
+		return nil, err
+	}
+	req.ResourceLimits = limits
+
+	if req.Expect, err = expectParams(r); err != nil {
+		return nil, err
+	}
+
+	// env is repeatable as env=KEY=VALUE
+	for _, kv := range q["env"] {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			return nil, errEnvMessage
+		}
+		if req.Env == nil {
+			req.Env = map[string]string{}
+		}
+		req.Env[k] = v
+	}
+
+	return req, nil
+}
+
+// options validates the execution settings of the request.
+func (req *ShellRequest) options() (execOptions, error) {
+	opts := execOptions{Timeout: defaultCmdTimeout, Env: req.Env, Cwd: req.Cwd}
+	opts.NoSummary = req.Summarize != nil && !*req.Summarize
+	opts.Confirmed = req.Confirm
+	opts.Rerun = req.Diff
+	opts.LineNumbers = req.LineNumbers
+	if req.MaxTokens < 0 {
+		return opts, errMaxTokensMessage
+	}
+	if _, err := parseFilter(req.Filter); err != nil {
+		return opts, err
+	}
+	if req.Timeout != 0 {
+		opts.Timeout = time.Duration(req.Timeout) * time.Second
+		if req.Timeout < 0 || opts.Timeout > maxCmdTimeout {
+			return opts, errTimeoutMessage
+		}
+	}
+	for k := range req.Env {
+		if !validEnvKey(k) {
+			return opts, errEnvMessage
+		}
+	}
+	if err := req.ResourceLimits.validate(); err != nil {
+		return opts, err
+	}
+	opts.Limits = req.ResourceLimits
+	if err := validateExpect(req.Expect); err != nil {
+		return opts, err
+	}
+	opts.Expect = req.Expect
+	return opts, nil
+}
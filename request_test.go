@@ -0,0 +1,34 @@
+package main
+
+import "testing"
+
+func TestShellRequestEnv(t *testing.T) {
+	tests := []struct {
+		key string
+		ok  bool
+	}{
+		{"PATH", true},
+		{"_private", true},
+		{"GO111MODULE", true},
+		{"", false},
+		{"1ST", false},
+		{"A=B", false},
+		{"X;rm -rf ~;Y", false},
+		{"$(id)", false},
+		{"A B", false},
+		{"A\x00", false},
+		{"ÄPFEL", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			req := &ShellRequest{Env: map[string]string{tt.key: "value; with $(shell)"}}
+			_, err := req.options()
+			if tt.ok && err != nil {
+				t.Fatalf("options() = %v, want nil", err)
+			}
+			if !tt.ok && err != errEnvMessage {
+				t.Fatalf("options() = %v, want %v", err, errEnvMessage)
+			}
+		})
+	}
+}
@@ -0,0 +1,21 @@
+//go:build linux && (386 || amd64 || arm || arm64 || ppc64le || riscv64 || s390x)
+
+package main
+
+import "syscall"
+
+// soReusePort is SO_REUSEPORT, which the frozen syscall package lacks.
+const soReusePort = 0xf
+
+// reusePort sets SO_REUSEPORT so a replacement process can bind the port
+// while this one drains.
+func reusePort(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
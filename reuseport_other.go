@@ -0,0 +1,13 @@
+//go:build !(linux && (386 || amd64 || arm || arm64 || ppc64le || riscv64 || s390x))
+
+package main
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// reusePort is only implemented on common linux architectures.
+func reusePort(network, address string, c syscall.RawConn) error {
+	return fmt.Errorf("reuseport is only supported on linux")
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync/atomic"
+)
+
+// Commands are classified by risk with the built-in heuristics below and
+// the rules in the RISK_RULES file. With CONFIRM_RISK=high (or medium) a
+// command at that level is not run until it is resubmitted with
+// confirm=true; the first submission answers 428 with a warning naming the
+// risk, giving agent frameworks an "are you sure" step. Commands a human
+// typed or approved, from Slack, the terminal or the approvals queue, count
+// as confirmed.
+
+const (
+	riskMedium = "medium"
+	riskHigh   = "high"
+
+	errConfirmMessage = "Confirmation required"
+)
+
+type riskRule struct {
+	Pattern string `json:"pattern"`
+	Risk    string `json:"risk"`
+	Reason  string `json:"reason"`
+	re      *regexp.Regexp
+}
+
+var builtinRiskRules = []*riskRule{
+	{Pattern: `\brm\s+(-\S+\s+)*-\S*[rR]\S*\s+(\S+\s+)*(/|/\*|~/?|\$HOME/?)(\s|;|&|\||$)`, Risk: riskHigh, Reason: "recursively deletes the root or home directory"},
+	{Pattern: `\bmkfs(\.\w+)?\b|\bwipefs\b`, Risk: riskHigh, Reason: "formats or wipes a filesystem"},
+	{Pattern: `\bdd\b.*\bof=/dev/|>\s*/dev/(sd|hd|vd|xvd|nvme|mmcblk)`, Risk: riskHigh, Reason: "writes to a raw disk device"},
+	{Pattern: `\b(shutdown|reboot|halt|poweroff)\b|\binit\s+[06]\b`, Risk: riskHigh, Reason: "shuts down or reboots the host"},
+	{Pattern: `:\(\)\s*\{\s*:\s*\|\s*:\s*&\s*\}`, Risk: riskHigh, Reason: "is a fork bomb"},
+	{Pattern: `\brm\s+(-\S+\s+)*-\S*[rRf]`, Risk: riskMedium, Reason: "deletes files recursively or forcibly"},
+	{Pattern: `\bshred\b`, Risk: riskMedium, Reason: "destroys file contents"},
+	{Pattern: `\bchmod\s+(-\S+\s+)*-\S*R|\bchown\s+(-\S+\s+)*-\S*R`, Risk: riskMedium, Reason: "changes permissions recursively"},
+	{Pattern: `\bkill(all)?\s+(-\S+\s+)*-(9|KILL)\b|\bpkill\b`, Risk: riskMedium, Reason: "kills processes"},
+	{Pattern: `\b(iptables|ip6tables|nft|ufw)\b.*(\s-F\b|--flush|\sflush\b|\sdisable\b)`, Risk: riskMedium, Reason: "flushes or disables the firewall"},
+	{Pattern: `\bsystemctl\s+(stop|disable|mask)\b`, Risk: riskMedium, Reason: "stops or disables a service"},
+	{Pattern: `\b(curl|wget)\b[^|]*\|\s*(sudo\s+)?(ba|z|da)?sh\b`, Risk: riskMedium, Reason: "pipes a download into a shell"},
+	{Pattern: `\bgit\s+push\b.*(\s-f\b|--force)`, Risk: riskMedium, Reason: "force pushes"},
+	{Pattern: `(?i)\b(drop|truncate)\s+(table|database|schema)\b`, Risk: riskMedium, Reason: "drops database objects"},
+	{Pattern: `\b(userdel|passwd|visudo)\b|\bcrontab\s+-r\b`, Risk: riskMedium, Reason: "changes accounts or scheduled jobs"},
+}
+
+// riskPolicy is the loaded CONFIRM_RISK and rules, swapped whole by a
+// reload while commands are being classified.
+type riskPolicy struct {
+	rules   []*riskRule
+	confirm string // CONFIRM_RISK, "" never asks for confirmation
+}
+
+var activeRisk atomic.Pointer[riskPolicy]
+
+// currentRiskPolicy returns the policy in effect, an empty one before any
+// is loaded.
+func currentRiskPolicy() *riskPolicy {
+	if p := activeRisk.Load(); p != nil {
+		return p
+	}
+	return &riskPolicy{}
+}
+
+// confirmRisk returns the CONFIRM_RISK in effect.
+func confirmRisk() string {
+	return currentRiskPolicy().confirm
+}
+
+// RiskAssessment is the risk of a command and the rules that matched.
+type RiskAssessment struct {
+	Risk    string   `json:"risk"`
+	Reasons []string `json:"reasons"`
+}
+
+// RiskWarning answers a command that needs confirm=true.
+type RiskWarning struct {
+	Type    string   `json:"type"`
+	Next    string   `json:"next"`
+	Session string   `json:"session"`
+	Input   string   `json:"input"`
+	Risk    string   `json:"risk"`
+	Reasons []string `json:"reasons"`
+}
+
+type riskError struct {
+	warning *RiskWarning
+}
+
+func (e *riskError) Error() string {
+	return fmt.Sprintf("%s: the command is %s risk, it %s. Resubmit it with confirm=true to run it",
+		errConfirmMessage, e.warning.Risk, strings.Join(e.warning.Reasons, ", "))
+}
+
+func (e *riskError) Is(target error) bool {
+	return target == errConfirmRequired
+}
+
+func validRisk(level string) bool {
+	return level == riskMedium || level == riskHigh
+}
+
+// riskAtLeast reports whether level is as risky as min.
+func riskAtLeast(level, min string) bool {
+	return level == riskHigh || level == min
+}
+
+// parseRiskPolicy reads CONFIRM_RISK and the extra rules in the RISK_RULES
+// JSON file, an array of {"pattern", "risk", "reason"}.
+func parseRiskPolicy() (*riskPolicy, error) {
+	p := &riskPolicy{confirm: os.Getenv("CONFIRM_RISK")}
+	if p.confirm != "" && !validRisk(p.confirm) {
+		return nil, fmt.Errorf("CONFIRM_RISK must be medium or high: %q", p.confirm)
+	}
+
+	var extra []*riskRule
+	if path := os.Getenv("RISK_RULES"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("RISK_RULES: %v", err)
+		}
+		if err := json.Unmarshal(data, &extra); err != nil {
+			return nil, fmt.Errorf("RISK_RULES: %v", err)
+		}
+	}
+	// The built-in rules are copied, the policy in effect still reads them
+	for _, rule := range append(extra, builtinRiskRules...) {
+		rule := *rule
+		re, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("RISK_RULES: bad pattern %q: %v", rule.Pattern, err)
+		}
+		if !validRisk(rule.Risk) {
+			return nil, fmt.Errorf("RISK_RULES: %q must have risk medium or high", rule.Pattern)
+		}
+		if rule.Reason == "" {
+			rule.Reason = "matches " + rule.Pattern
+		}
+		rule.re = re
+		p.rules = append(p.rules, &rule)
+	}
+	return p, nil
+}
+
+// loadRiskPolicy parses the risk policy and puts it in effect.
+func loadRiskPolicy() error {
+	p, err := parseRiskPolicy()
+	if err != nil {
+		return err
+	}
+	activeRisk.Store(p)
+	return nil
+}
+
+// classifyCommand returns the command's risk, nil when no rule matches.
+func classifyCommand(cmd string) *RiskAssessment {
+	var a *RiskAssessment
+	for _, rule := range currentRiskPolicy().rules {
+		if !rule.re.MatchString(cmd) {
+			continue
+		}
+		if a == nil {
+			a = &RiskAssessment{Risk: rule.Risk}
+		}
+		if rule.Risk == riskHigh {
+			a.Risk = riskHigh
+		}
+		a.Reasons = append(a.Reasons, rule.Reason)
+	}
+	return a
+}
+
+// checkRisk returns a *riskError when the command needs confirmation.
+func checkRisk(session, cmd string, opts execOptions) error {
+	confirm := confirmRisk()
+	if confirm == "" || opts.Confirmed {
+		return nil
+	}
+	a := classifyCommand(cmd)
+	if a == nil || !riskAtLeast(a.Risk, confirm) {
+		return nil
+	}
+	return &riskError{warning: &RiskWarning{
+		Type:    "confirm",
+		Next:    "This command is risky and was not run. Check it is what you intend, then resubmit it unchanged with confirm=true",
+		Session: session,
+		Input:   cmd,
+		Risk:    a.Risk,
+		Reasons: a.Reasons,
+	}}
+}
+
+// writeRiskWarning answers 428 Precondition Required with the warning.
+func writeRiskWarning(w http.ResponseWriter, warning *RiskWarning) {
+	jsonResp, err := json.Marshal(warning)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to marshal JSON response: %v", err)
+		writeJsonError(w, msg)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusPreconditionRequired)
+	fmt.Fprint(w, string(jsonResp))
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// Routing rules pin sessions to agents by name: with
+// ROUTING_RULES=prod-* env=prod, a new session named prod-api is placed on
+// an agent labelled env=prod, and naming any other agent for it is refused.
+
+var errRoutingMessage = newKindError(errForbidden, "A routing rule restricts this session to agents with other labels")
+
+type routingRule struct {
+	Pattern string
+	Labels  map[string]string
+}
+
+var routingRules []*routingRule // ROUTING_RULES, first match applies
+
+// loadRoutingRules parses ROUTING_RULES: comma separated rules, each a
+// session name glob followed by the key=value labels its agents must have.
+func loadRoutingRules() error {
+	var rules []*routingRule
+	for _, entry := range strings.Split(os.Getenv("ROUTING_RULES"), ",") {
+		fields := strings.Fields(entry)
+		if len(fields) == 0 {
+			continue
+		}
+		if _, err := path.Match(fields[0], ""); err != nil {
+			return fmt.Errorf("ROUTING_RULES: bad pattern %q", fields[0])
+		}
+		labels, err := parseLabels(strings.Join(fields[1:], ","))
+		if err != nil {
+			return fmt.Errorf("ROUTING_RULES: %v", err)
+		}
+		if len(labels) == 0 {
+			return fmt.Errorf("ROUTING_RULES: %q has no labels", fields[0])
+		}
+		rules = append(rules, &routingRule{Pattern: fields[0], Labels: labels})
+	}
+	routingRules = rules
+	return nil
+}
+
+// routingRuleFor returns the first rule whose pattern matches session.
+func routingRuleFor(session string) *routingRule {
+	if session == "" {
+		return nil
+	}
+	for _, rule := range routingRules {
+		if ok, _ := path.Match(rule.Pattern, session); ok {
+			return rule
+		}
+	}
+	return nil
+}
+
+// allows reports whether the named agent has the rule's labels, going by
+// its last heartbeat.
+func (rule *routingRule) allows(agent string) bool {
+	agentsMu.Lock()
+	defer agentsMu.Unlock()
+	rec, ok := agents[agent]
+	return ok && rec.matches(rule.Labels)
+}
+
+// constrain adds the rule's labels to placement constraints, failing when
+// they ask for something else.
+func (rule *routingRule) constrain(want map[string]string) error {
+	for k, v := range rule.Labels {
+		if have, ok := want[k]; ok && have != v {
+			return errRoutingMessage
+		}
+		want[k] = v
+	}
+	return nil
+}
+
+// createsSession reports whether the request may create the session it
+// names, the point where routing rules apply.
+func createsSession(r *http.Request) bool {
+	switch strings.TrimPrefix(r.URL.Path, apiVersionPrefix) {
+	case "/shell", "/watch", "/sessions/import":
+		return true
+	case "/sessions":
+		return r.Method == http.MethodPost
+	}
+	return false
+}
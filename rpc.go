@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+)
+
+type rpcMethod func(ctx context.Context, params json.RawMessage) (interface{}, error)
+
+// rpcMethods are the operations available on /rpc, mirroring the REST
+// endpoints.
+var rpcMethods = map[string]rpcMethod{
+	"execute": rpcExecute,
+	"status":  rpcStatus,
+	"history": rpcHistory,
+	"ps":      rpcPs,
+}
+
+type rpcSessionParams struct {
+	Session string `json:"session"`
+	Ticket  int    `json:"ticket"`
+}
+
+func decodeSessionParams(params json.RawMessage) (*rpcSessionParams, error) {
+	p := &rpcSessionParams{}
+	if len(params) > 0 {
+		if err := json.Unmarshal(params, p); err != nil {
+			return nil, err
+		}
+	}
+	if p.Session == "" {
+		return nil, errSessionMessage
+	}
+	return p, nil
+}
+
+func rpcExecute(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	req := &ShellRequest{}
+	if len(params) > 0 {
+		if err := json.Unmarshal(params, req); err != nil {
+			return nil, err
+		}
+	}
+	if req.Session == "" {
+		return nil, errSessionMessage
+	}
+	if req.Cmd == "" {
+		return nil, errCmdMessage
+	}
+
+	opts, err := req.options()
+	if err != nil {
+		return nil, err
+	}
+	if req.DryRun {
+		return dryRun(ctx, req.Session, filepath.Join(sessionsDir, req.Session), req.Cmd), nil
+	}
+	return submitCommand(ctx, req.Session, req.Cmd, opts)
+}
+
+func rpcStatus(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	p, err := decodeSessionParams(params)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := readTicket(p.Session, p.Ticket)
+	if err != nil {
+		return nil, err
+	}
+	if len(file) == 0 {
+		msg := fmt.Sprintf("No output for ticket %d yet. Check again after waiting a bit!", p.Ticket)
+		return &JsonMsg{Status: "working", Message: msg}, nil
+	}
+	return json.RawMessage(file), nil
+}
+
+func rpcHistory(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	p, err := decodeSessionParams(params)
+	if err != nil {
+		return nil, err
+	}
+	return readHistory(p.Session)
+}
+
+func rpcPs(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	p, err := decodeSessionParams(params)
+	if err != nil {
+		return nil, err
+	}
+	return sessionProcesses(p.Session), nil
+}
+
+// rpcDispatch runs one JSON-RPC message, returning nil for notifications.
+func rpcDispatch(ctx context.Context, raw json.RawMessage) *rpcResponse {
+	req, errResp := mcpDecode(raw)
+	if errResp != nil {
+		return errResp
+	}
+
+	method, ok := rpcMethods[req.Method]
+	if !ok {
+		if req.ID == nil {
+			return nil
+		}
+		return newRPCError(req.ID, rpcMethodNotFound, fmt.Sprintf("Method %s not found", req.Method))
+	}
+
+	result, err := method(ctx, req.Params)
+	if req.ID == nil {
+		return nil
+	}
+	if err != nil {
+		return newRPCError(req.ID, rpcInvalidParams, err.Error())
+	}
+	return &rpcResponse{JSONRPC: "2.0", ID: req.ID, Result: result}
+}
+
+func rpcHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodPost {
+		writeError(w, errMethodMessage)
+		return
+	}
+
+	// Validate the hash parameter
+	hashParam := r.URL.Query().Get("hash")
+	if !checkHash(r, hashParam) {
+		writeError(w, errHashMessage)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxRequestBody))
+	if err != nil {
+		writeError(w, errBodyMessage)
+		return
+	}
+
+	var resp interface{}
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		var batch []json.RawMessage
+		if err := json.Unmarshal(trimmed, &batch); err != nil {
+			resp = newRPCError(nil, rpcParseError, err.Error())
+		} else if len(batch) == 0 {
+			resp = newRPCError(nil, rpcInvalidRequest, "Empty batch")
+		} else {
+			responses := make([]*rpcResponse, 0, len(batch))
+			for _, raw := range batch {
+				if rr := rpcDispatch(r.Context(), raw); rr != nil {
+					responses = append(responses, rr)
+				}
+			}
+			if len(responses) > 0 {
+				resp = responses
+			}
+		}
+	} else if rr := rpcDispatch(r.Context(), trimmed); rr != nil {
+		resp = rr
+	}
+
+	// A request made only of notifications gets no body
+	if resp == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	jsonResp, err := json.Marshal(resp)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to marshal JSON response: %v", err)
+		writeJsonError(w, msg)
+		return
+	}
+
+	fmt.Fprint(w, string(jsonResp))
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"hash/fnv"
+	"sort"
+	"sync"
+	"time"
+)
+
+// runningShards spreads the running commands over independently locked
+// maps, so hundreds of sessions starting and finishing commands at once
+// don't queue on one lock. A session always lands on the same shard.
+const runningShards = 64
+
+// runningCmd describes a command whose process is still alive.
+type runningCmd struct {
+	Ticket  int       `json:"ticket"`
+	Input   string    `json:"input"`
+	Pid     int       `json:"pid"`
+	Started time.Time `json:"started"`
+}
+
+type runningShard struct {
+	mu       sync.Mutex
+	sessions map[string]map[int]*runningCmd // session -> ticket -> command
+}
+
+var running [runningShards]runningShard
+
+func init() {
+	for i := range running {
+		running[i].sessions = map[string]map[int]*runningCmd{}
+	}
+}
+
+func runningShardFor(session string) *runningShard {
+	h := fnv.New32a()
+	h.Write([]byte(session))
+	return &running[h.Sum32()%runningShards]
+}
+
+func trackRunning(session string, rc *runningCmd) {
+	s := runningShardFor(session)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sessions[session] == nil {
+		s.sessions[session] = map[int]*runningCmd{}
+	}
+	s.sessions[session][rc.Ticket] = rc
+}
+
+func untrackRunning(session string, ticket int) {
+	s := runningShardFor(session)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions[session], ticket)
+	if len(s.sessions[session]) == 0 {
+		delete(s.sessions, session)
+	}
+}
+
+// runningForSession returns a snapshot of the session's live commands
+// ordered by ticket.
+func runningForSession(session string) []runningCmd {
+	s := runningShardFor(session)
+	s.mu.Lock()
+	cmds := make([]runningCmd, 0, len(s.sessions[session]))
+	for _, rc := range s.sessions[session] {
+		cmds = append(cmds, *rc)
+	}
+	s.mu.Unlock()
+	sort.Slice(cmds, func(i, j int) bool { return cmds[i].Ticket < cmds[j].Ticket })
+	return cmds
+}
+
+// eachRunning calls fn with every live command, one shard locked at a time.
+func eachRunning(fn func(session string, rc runningCmd)) {
+	for i := range running {
+		s := &running[i]
+		s.mu.Lock()
+		for session, cmds := range s.sessions {
+			for _, rc := range cmds {
+				fn(session, *rc)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// runningCount returns how many commands are live.
+func runningCount() int {
+	n := 0
+	for i := range running {
+		s := &running[i]
+		s.mu.Lock()
+		for _, cmds := range s.sessions {
+			n += len(cmds)
+		}
+		s.mu.Unlock()
+	}
+	return n
+}
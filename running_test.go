@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// benchSessions is how many sessions the benchmarks spread their work over.
+const benchSessions = 512
+
+func benchSessionNames() []string {
+	names := make([]string, benchSessions)
+	for i := range names {
+		names[i] = fmt.Sprintf("bench-%d", i)
+	}
+	return names
+}
+
+// runningParallel runs fn in parallel, each goroutine walking the sessions
+// from its own offset so they start and finish commands all over the table.
+func runningParallel(b *testing.B, fn func(session string, ticket int)) {
+	names := benchSessionNames()
+	var worker int64
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := int(atomic.AddInt64(&worker, 1)) * 7919
+		for pb.Next() {
+			fn(names[i%len(names)], i)
+			i++
+		}
+	})
+}
+
+func BenchmarkTrackRunning(b *testing.B) {
+	runningParallel(b, func(session string, ticket int) {
+		trackRunning(session, &runningCmd{Ticket: ticket, Input: "sleep 1", Started: time.Now()})
+		untrackRunning(session, ticket)
+	})
+}
+
+func BenchmarkRunningForSession(b *testing.B) {
+	for i, session := range benchSessionNames() {
+		trackRunning(session, &runningCmd{Ticket: i, Input: "sleep 1"})
+		defer untrackRunning(session, i)
+	}
+	runningParallel(b, func(session string, _ int) {
+		runningForSession(session)
+	})
+}
+
+// BenchmarkRunningSingleLock is the same work as BenchmarkTrackRunning on
+// one map behind one lock, the table before it was sharded, to compare
+// against.
+func BenchmarkRunningSingleLock(b *testing.B) {
+	var mu sync.Mutex
+	sessions := map[string]map[int]*runningCmd{}
+	runningParallel(b, func(session string, ticket int) {
+		mu.Lock()
+		if sessions[session] == nil {
+			sessions[session] = map[int]*runningCmd{}
+		}
+		sessions[session][ticket] = &runningCmd{Ticket: ticket, Input: "sleep 1", Started: time.Now()}
+		mu.Unlock()
+
+		mu.Lock()
+		delete(sessions[session], ticket)
+		if len(sessions[session]) == 0 {
+			delete(sessions, session)
+		}
+		mu.Unlock()
+	})
+}
+
+func BenchmarkPublishActivityUnwatched(b *testing.B) {
+	runningParallel(b, func(session string, ticket int) {
+		publishActivity(eventCommandOutput, session, ticket, nil)
+	})
+}
+
+func BenchmarkPublishActivity(b *testing.B) {
+	ch := subscribeActivity()
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ch:
+			case <-done:
+				return
+			}
+		}
+	}()
+	defer func() {
+		close(done)
+		unsubscribeActivity(ch)
+	}()
+	runningParallel(b, func(session string, ticket int) {
+		publishActivity(eventCommandOutput, session, ticket, nil)
+	})
+}
+
+func TestRunningSharded(t *testing.T) {
+	names := benchSessionNames()
+	var wg sync.WaitGroup
+	for i, session := range names {
+		wg.Add(1)
+		go func(i int, session string) {
+			defer wg.Done()
+			trackRunning(session, &runningCmd{Ticket: 2, Input: "b"})
+			trackRunning(session, &runningCmd{Ticket: 1, Input: "a"})
+		}(i, session)
+	}
+	wg.Wait()
+
+	if n := runningCount(); n != 2*len(names) {
+		t.Fatalf("runningCount() = %d, want %d", n, 2*len(names))
+	}
+	cmds := runningForSession(names[0])
+	if len(cmds) != 2 || cmds[0].Ticket != 1 || cmds[1].Ticket != 2 {
+		t.Fatalf("runningForSession() = %+v, want tickets 1 and 2 in order", cmds)
+	}
+
+	for _, session := range names {
+		untrackRunning(session, 1)
+		untrackRunning(session, 2)
+	}
+	if n := runningCount(); n != 0 {
+		t.Fatalf("runningCount() after untracking = %d, want 0", n)
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// /search finds past tickets, in one session or all of them. The default
+// text mode matches the words of q in commands and outputs, mode=semantic
+// ranks tickets by the similarity of their embeddings to q, answering
+// questions like "when did I configure nginx?" that share no words with the
+// command that did it.
+
+const (
+	searchText     = "text"
+	searchSemantic = "semantic"
+
+	defaultSearchLimit = 10
+	maxSearchLimit     = 100
+	maxSnippet         = 200
+)
+
+var (
+	errQueryMessage      = paramError("q", "Invalid or missing 'q' parameter")
+	errSearchModeMessage = paramError("mode", "Invalid 'mode' parameter, use text or semantic")
+	errLimitMessage      = paramError("limit", "Invalid 'limit' parameter")
+	errSemanticMessage   = paramError("mode", "Semantic search is not enabled, set EMBEDDINGS_URL")
+)
+
+// SearchHit is a ticket matching a search.
+type SearchHit struct {
+	Session  string  `json:"session"`
+	Ticket   int     `json:"ticket"`
+	Input    string  `json:"input"`
+	Snippet  string  `json:"snippet"`
+	Score    float64 `json:"score"`
+	ExitCode *int    `json:"exit_code,omitempty"`
+	Callback string  `json:"callback"`
+}
+
+// SearchResults answers /search.
+type SearchResults struct {
+	Query string      `json:"query"`
+	Mode  string      `json:"mode"`
+	Hits  []SearchHit `json:"hits"`
+}
+
+// searchTickets returns the finished tickets of the session, or of every
+// session when it is empty.
+func searchTickets(session string) ([]*CmdResults, error) {
+	if session != "" {
+		return readHistory(session)
+	}
+	sessions, err := listSessions()
+	if err != nil {
+		return nil, err
+	}
+	var tickets []*CmdResults
+	for _, s := range sessions {
+		if s.Tickets == 0 {
+			continue
+		}
+		responses, err := readHistory(s.Name)
+		if err != nil {
+			logger.Warn("failed to read session for search", "session", s.Name, "err", err)
+			continue
+		}
+		tickets = append(tickets, responses...)
+	}
+	return tickets, nil
+}
+
+// snippet returns the first line of the ticket containing one of words, or
+// the start of its output.
+func snippet(res *CmdResults, words []string) string {
+	line := ""
+	for _, l := range strings.Split(res.Output, "\n") {
+		lower := strings.ToLower(l)
+		for _, word := range words {
+			if strings.Contains(lower, word) {
+				line = l
+				break
+			}
+		}
+		if line != "" {
+			break
+		}
+	}
+	if line == "" {
+		line = strings.TrimSpace(res.Output)
+		if i := strings.IndexByte(line, '\n'); i >= 0 {
+			line = line[:i]
+		}
+	}
+	line = strings.TrimSpace(line)
+	if len(line) > maxSnippet {
+		line = strings.ToValidUTF8(line[:maxSnippet], "") + "..."
+	}
+	return line
+}
+
+// textSearch scores tickets by the share of the query's words they contain.
+func textSearch(tickets []*CmdResults, query string) []SearchHit {
+	words := strings.Fields(strings.ToLower(query))
+	var hits []SearchHit
+	for _, res := range tickets {
+		text := strings.ToLower(res.Input + "\n" + res.Output)
+		matched := 0
+		for _, word := range words {
+			if strings.Contains(text, word) {
+				matched++
+			}
+		}
+		if matched == 0 {
+			continue
+		}
+		hits = append(hits, SearchHit{
+			Session:  res.Session,
+			Ticket:   res.Ticket,
+			Input:    res.Input,
+			Snippet:  snippet(res, words),
+			Score:    float64(matched) / float64(len(words)),
+			ExitCode: res.ExitCode,
+		})
+	}
+	return hits
+}
+
+// semanticSearch scores tickets by the cosine similarity of their
+// embeddings to the query's.
+func semanticSearch(ctx context.Context, tickets []*CmdResults, query string) ([]SearchHit, error) {
+	q, err := embedTexts(ctx, []string{query})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to embed query: %w", err)
+	}
+
+	var hits []SearchHit
+	for i, vector := range ticketVectors(ctx, tickets) {
+		if vector == nil {
+			continue
+		}
+		res := tickets[i]
+		hits = append(hits, SearchHit{
+			Session:  res.Session,
+			Ticket:   res.Ticket,
+			Input:    res.Input,
+			Snippet:  snippet(res, nil),
+			Score:    cosineSimilarity(q[0], vector),
+			ExitCode: res.ExitCode,
+		})
+	}
+	return hits, nil
+}
+
+// rankHits orders hits best first, the newest of equal scores first, and
+// keeps the top limit with their callback URLs.
+func rankHits(ctx context.Context, hits []SearchHit, limit int) []SearchHit {
+	sort.SliceStable(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+		return hits[i].Ticket > hits[j].Ticket
+	})
+	if len(hits) > limit {
+		hits = hits[:limit]
+	}
+	for i := range hits {
+		hits[i].Callback = Callback(ctx, hits[i].Session, hits[i].Ticket)
+	}
+	if hits == nil {
+		hits = []SearchHit{}
+	}
+	return hits
+}
+
+func searchHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodGet {
+		writeError(w, errMethodMessage)
+		return
+	}
+
+	// Validate the hash parameter
+	hashParam := r.URL.Query().Get("hash")
+	if !checkHash(r, hashParam) {
+		writeError(w, errHashMessage)
+		return
+	}
+
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	if query == "" {
+		writeError(w, errQueryMessage)
+		return
+	}
+
+	session := r.URL.Query().Get("session")
+	if session != "" && !validSessionName(session) {
+		writeError(w, errSessionMessage)
+		return
+	}
+
+	mode := r.URL.Query().Get("mode")
+	switch mode {
+	case "":
+		mode = searchText
+	case searchText:
+	case searchSemantic:
+		if embeddingsURL == "" {
+			writeError(w, errSemanticMessage)
+			return
+		}
+	default:
+		writeError(w, errSearchModeMessage)
+		return
+	}
+
+	limit := defaultSearchLimit
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 || n > maxSearchLimit {
+			writeError(w, errLimitMessage)
+			return
+		}
+		limit = n
+	}
+
+	tickets, err := searchTickets(session)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	var hits []SearchHit
+	if mode == searchSemantic {
+		if hits, err = semanticSearch(r.Context(), tickets, query); err != nil {
+			writeError(w, err)
+			return
+		}
+	} else {
+		hits = textSearch(tickets, query)
+	}
+
+	hits = rankHits(r.Context(), hits, limit)
+	logFrom(r.Context()).Info("searched history", "session", session, "mode", mode, "tickets", len(tickets), "hits", len(hits))
+
+	jsonResp, err := json.Marshal(&SearchResults{Query: query, Mode: mode, Hits: hits})
+	if err != nil {
+		msg := fmt.Sprintf("Failed to marshal JSON response: %v", err)
+		writeJsonError(w, msg)
+		return
+	}
+
+	fmt.Fprint(w, string(jsonResp))
+}
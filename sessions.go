@@ -0,0 +1,746 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+type SessionInfo struct {
+	Name     string    `json:"name"`
+	Tickets  int       `json:"tickets"`
+	Modified time.Time `json:"modified"`
+	Backend  string    `json:"backend,omitempty"` // of the last command
+}
+
+// listSessions returns every session folder with its ticket count.
+func listSessions() ([]SessionInfo, error) {
+	entries, err := os.ReadDir(sessionsDir)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read sessions directory: %v", err)
+	}
+
+	sessions := make([]SessionInfo, 0, len(entries))
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		s := SessionInfo{Name: e.Name(), Modified: info.ModTime(), Backend: sessionBackend(filepath.Join(sessionsDir, e.Name()))}
+		if idx, err := sessionTicketIndex(filepath.Join(sessionsDir, e.Name())); err == nil {
+			s.Tickets = len(idx.list())
+		}
+		sessions = append(sessions, s)
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].Name < sessions[j].Name })
+	return sessions, nil
+}
+
+// sessionsHandler lists sessions (GET), creates one from an optional
+// template (POST) and deletes one with its commands (DELETE).
+func sessionsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// Validate the hash parameter
+	hashParam := r.URL.Query().Get("hash")
+	if !checkHash(r, hashParam) {
+		writeError(w, errHashMessage)
+		return
+	}
+
+	session := r.URL.Query().Get("session")
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		template := r.URL.Query().Get("template")
+		if err := createSession(session, template); err != nil {
+			writeError(w, err)
+			return
+		}
+		logFrom(r.Context()).Info("session created", "session", session, "template", template)
+		writeSessionAction(w, &SessionAction{Type: "session", Session: session, Action: "create"})
+		return
+	case http.MethodDelete:
+		if err := deleteSession(session); err != nil {
+			writeError(w, err)
+			return
+		}
+		logFrom(r.Context()).Info("session deleted", "session", session)
+		writeSessionAction(w, &SessionAction{Type: "session", Session: session, Action: "delete"})
+		return
+	default:
+		writeError(w, errMethodMessage)
+		return
+	}
+
+	sessions, err := listSessions()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	jsonResp, err := json.Marshal(sessions)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to marshal JSON response: %v", err)
+		writeJsonError(w, msg)
+		return
+	}
+
+	fmt.Fprint(w, string(jsonResp))
+}
+
+const (
+	sessionTemplatesDir = "session-templates"
+
+	errInterruptedMessage = "Interrupted: the command was still running when the session was exported"
+
+	maxImportBytes = 1 << 30
+)
+
+var (
+	errTemplateMessage      = paramError("template", "Invalid 'template' parameter")
+	errSessionExists        = newKindError(errConflict, "Session already exists")
+	errSessionNotFound      = newKindError(errNotFound, "Session does not exist")
+	errSessionRunning       = newKindError(errConflict, "Session has running commands, kill them first")
+	errSessionToMessage     = paramError("to", "Invalid or missing 'to' session name")
+	errTemplateNotFound     = newKindError(errNotFound, "Session template does not exist")
+	errSessionActionMessage = paramError("action", "Invalid or missing 'action' parameter, use create, rename, kill, restart or delete")
+	errArchiveMessage       = newKindError(errInvalidParameter, "Invalid session archive")
+)
+
+// validSessionName rejects names that would escape SESSIONS_DIR.
+func validSessionName(name string) bool {
+	return name != "" && name != "." && name != ".." && filepath.Base(name) == name
+}
+
+// listSessionTemplates returns the folders in DATA_DIR/session-templates.
+// Each one seeds a new session, typically with an init.sh.
+func listSessionTemplates() []string {
+	entries, err := os.ReadDir(filepath.Join(dataDir, sessionTemplatesDir))
+	if err != nil {
+		return []string{}
+	}
+	names := []string{}
+	for _, e := range entries {
+		if e.IsDir() {
+			names = append(names, e.Name())
+		}
+	}
+	return names
+}
+
+// createSession makes an empty session, copying in the template's files.
+func createSession(session, template string) error {
+	if !validSessionName(session) {
+		return errSessionMessage
+	}
+	if template != "" && !validSessionName(template) {
+		return errTemplateMessage
+	}
+
+	dir := filepath.Join(sessionsDir, session)
+	if _, err := os.Stat(dir); err == nil {
+		return errSessionExists
+	}
+
+	var src string
+	if template != "" {
+		src = filepath.Join(dataDir, sessionTemplatesDir, template)
+		if info, err := os.Stat(src); err != nil || !info.IsDir() {
+			return errTemplateNotFound
+		}
+	}
+
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return fmt.Errorf("Failed to create session directory %s: %v", dir, err)
+	}
+	if src != "" {
+		if err := copyDir(dir, src); err != nil {
+			os.RemoveAll(dir)
+			return fmt.Errorf("Failed to copy session template: %v", err)
+		}
+	}
+
+	emitEvent(eventSessionCreated, map[string]string{"session": session})
+	publishActivity(eventSessionCreated, session, 0, nil)
+	return nil
+}
+
+// copyDir copies the regular files and folders under src into dst.
+func copyDir(dst, src string) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case d.IsDir():
+			return os.MkdirAll(target, 0755)
+		case !info.Mode().IsRegular():
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(target, data, info.Mode().Perm())
+	})
+}
+
+func sessionExists(session string) bool {
+	info, err := os.Stat(filepath.Join(sessionsDir, session))
+	return err == nil && info.IsDir()
+}
+
+// renameSession moves an idle session to a new name.
+func renameSession(session, to string) error {
+	if !validSessionName(session) {
+		return errSessionMessage
+	}
+	if !validSessionName(to) {
+		return errSessionToMessage
+	}
+	if !sessionExists(session) {
+		return errSessionNotFound
+	}
+	if _, err := os.Stat(filepath.Join(sessionsDir, to)); err == nil {
+		return errSessionExists
+	}
+	if len(runningForSession(session)) > 0 || workingElsewhere(session) {
+		return errSessionRunning
+	}
+	if err := activeExecutor.rename(session, to); err != nil {
+		return fmt.Errorf("Failed to rename session: %v", err)
+	}
+	if err := os.Rename(filepath.Join(sessionsDir, session), filepath.Join(sessionsDir, to)); err != nil {
+		activeExecutor.rename(to, session)
+		return fmt.Errorf("Failed to rename session: %v", err)
+	}
+	moveGitHistory(session, to)
+	forgetRecording(filepath.Join(sessionsDir, session))
+	forgetTicketIndex(filepath.Join(sessionsDir, session))
+	forgetCachedRuns(session)
+	return nil
+}
+
+// killSession stops the session's watches, drops its queued commands and
+// kills every running command with its children, returning how many
+// commands were killed or dropped.
+func killSession(session string) int {
+	watchMu.Lock()
+	for key, cancel := range watches {
+		if strings.HasPrefix(key, session+"/") {
+			cancel()
+		}
+	}
+	watchMu.Unlock()
+
+	// Dropped first, so none takes the turn of a command killed below
+	dropped := cancelQueued(session)
+	cmds := runningForSession(session)
+	if len(cmds) == 0 {
+		return dropped
+	}
+	procs := processTable()
+	for _, rc := range cmds {
+		// Children first so they are not reparented and missed
+		var kill func(p *ProcInfo)
+		kill = func(p *ProcInfo) {
+			for _, c := range p.Children {
+				kill(c)
+			}
+			syscall.Kill(p.Pid, syscall.SIGKILL)
+		}
+		tree := buildTree(procs, rc.Pid)
+		if tree == nil {
+			continue
+		}
+		// A persistent shell outlives its commands
+		if activeExecutor.persistent() {
+			for _, c := range tree.Children {
+				kill(c)
+			}
+			continue
+		}
+		kill(tree)
+	}
+	return len(cmds) + dropped
+}
+
+// restartSession kills the session's commands and, with a persistent shell,
+// replaces its shell with one in the same directory. It returns how many
+// commands were killed and the new shell's directory.
+func restartSession(session string) (int, string, error) {
+	if !validSessionName(session) {
+		return 0, "", errSessionMessage
+	}
+	if !sessionExists(session) {
+		return 0, "", errSessionNotFound
+	}
+	// Commands on other instances can't be killed from here
+	if workingElsewhere(session) {
+		return 0, "", errSessionRunning
+	}
+	killed := killSession(session)
+	// Every command of a process backend starts in a fresh shell already
+	cwd, err := activeExecutor.restart(session)
+	if err != nil {
+		return killed, "", fmt.Errorf("Failed to restart the shell: %v", err)
+	}
+	return killed, cwd, nil
+}
+
+// deleteSession kills the session's commands and removes its folder.
+func deleteSession(session string) error {
+	if !validSessionName(session) {
+		return errSessionMessage
+	}
+	if !sessionExists(session) {
+		return errSessionNotFound
+	}
+	// Commands on other instances can't be killed from here
+	if workingElsewhere(session) {
+		return errSessionRunning
+	}
+	killSession(session)
+	activeExecutor.remove(session)
+	if err := os.RemoveAll(filepath.Join(sessionsDir, session)); err != nil {
+		return fmt.Errorf("Failed to delete session: %v", err)
+	}
+	forgetRecording(filepath.Join(sessionsDir, session))
+	forgetTicketIndex(filepath.Join(sessionsDir, session))
+	forgetCachedRuns(session)
+	return nil
+}
+
+// exportSession streams the session folder as a gzipped tarball.
+func exportSession(w http.ResponseWriter, session string) error {
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", session+".tar.gz"))
+	return writeSessionArchive(w, session)
+}
+
+// writeSessionArchive writes the session folder to w as a gzipped tarball
+// with paths under the session name.
+func writeSessionArchive(w io.Writer, session string) error {
+	dir := filepath.Join(sessionsDir, session)
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || path == dir {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil || !(info.Mode().IsRegular() || info.IsDir()) {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(filepath.Join(session, rel))
+		if err := tw.WriteHeader(hdr); err != nil || info.IsDir() {
+			return err
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// importSession creates session from an archive written by exportSession,
+// whatever name the session was exported under. The init.sh that sets the
+// session's environment and working directory comes along with the
+// tickets. Tickets still running at export are completed as interrupted,
+// since their commands stayed behind.
+func importSession(session string, r io.Reader) error {
+	if !validSessionName(session) {
+		return errSessionMessage
+	}
+	dir := filepath.Join(sessionsDir, session)
+	if err := os.Mkdir(dir, 0755); err != nil {
+		if os.IsExist(err) {
+			return errSessionExists
+		}
+		return fmt.Errorf("Failed to create session directory %s: %v", dir, err)
+	}
+	if err := extractSessionArchive(dir, r); err != nil {
+		os.RemoveAll(dir)
+		return fmt.Errorf("%w: %v", errArchiveMessage, err)
+	}
+	interruptTickets(session, dir, errInterruptedMessage, "This command was interrupted when the session moved hosts. Issue it again to /shell if it is still needed", nil)
+
+	emitEvent(eventSessionCreated, map[string]string{"session": session})
+	publishActivity(eventSessionCreated, session, 0, nil)
+	return nil
+}
+
+// extractSessionArchive unpacks the regular files and folders of a session
+// archive into dir, dropping the leading session name from each path.
+func extractSessionArchive(dir string, r io.Reader) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		_, rel, _ := strings.Cut(strings.TrimSuffix(hdr.Name, "/"), "/")
+		if rel == "" {
+			continue
+		}
+		if !filepath.IsLocal(filepath.FromSlash(rel)) {
+			return fmt.Errorf("unsafe path %q", hdr.Name)
+		}
+		path := filepath.Join(dir, filepath.FromSlash(rel))
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(path, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, hdr.FileInfo().Mode().Perm())
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, tr)
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				return err
+			}
+			os.Chtimes(path, hdr.ModTime, hdr.ModTime)
+		default:
+			return fmt.Errorf("unsupported entry %q", hdr.Name)
+		}
+	}
+}
+
+// interruptTickets completes the session's empty tickets in dir with output,
+// skipping those owned reports as still running, and returns how many it
+// completed.
+func interruptTickets(session, dir, output, next string, owned func(ticket int) bool) int {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0
+	}
+	n := 0
+	for _, e := range entries {
+		num, ok := strings.CutSuffix(e.Name(), ".ticket")
+		ticket, err := strconv.Atoi(num)
+		if !ok || err != nil || (owned != nil && owned(ticket)) {
+			continue
+		}
+		if info, err := e.Info(); err != nil || info.Size() != 0 {
+			continue
+		}
+		exitCode := -1
+		data, _ := json.Marshal(&CmdResults{
+			Type:     "result",
+			Next:     next,
+			Ticket:   ticket,
+			Session:  session,
+			Output:   output,
+			Tokens:   estimateTokens(output),
+			ExitCode: &exitCode,
+		})
+		if err := writeTicket(dir, ticket, data); err != nil {
+			logger.Warn("failed to complete interrupted ticket", "session", session, "ticket", ticket, "err", err)
+			continue
+		}
+		n++
+	}
+	return n
+}
+
+// SessionAction is the result of a session management call.
+type SessionAction struct {
+	Type    string `json:"type"`
+	Session string `json:"session"`
+	Action  string `json:"action"`
+	To      string `json:"to,omitempty"`
+	Killed  int    `json:"killed,omitempty"`
+	Cwd     string `json:"cwd,omitempty"` // the restarted shell's directory
+}
+
+func writeSessionAction(w http.ResponseWriter, resp *SessionAction) {
+	jsonResp, err := json.Marshal(resp)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to marshal JSON response: %v", err)
+		writeJsonError(w, msg)
+		return
+	}
+
+	fmt.Fprint(w, string(jsonResp))
+}
+
+// sessionRenameHandler renames a session with no running commands.
+func sessionRenameHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodPost {
+		writeError(w, errMethodMessage)
+		return
+	}
+
+	// Validate the hash parameter
+	hashParam := r.URL.Query().Get("hash")
+	if !checkHash(r, hashParam) {
+		writeError(w, errHashMessage)
+		return
+	}
+
+	session, to := r.URL.Query().Get("session"), r.URL.Query().Get("to")
+	if err := renameSession(session, to); err != nil {
+		writeError(w, err)
+		return
+	}
+	logFrom(r.Context()).Info("session renamed", "session", session, "to", to)
+	writeSessionAction(w, &SessionAction{Type: "session", Session: session, Action: "rename", To: to})
+}
+
+// sessionKillHandler kills the session's running commands and watches.
+func sessionKillHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodPost {
+		writeError(w, errMethodMessage)
+		return
+	}
+
+	// Validate the hash parameter
+	hashParam := r.URL.Query().Get("hash")
+	if !checkHash(r, hashParam) {
+		writeError(w, errHashMessage)
+		return
+	}
+
+	session := r.URL.Query().Get("session")
+	if !validSessionName(session) {
+		writeError(w, errSessionMessage)
+		return
+	}
+	killed := killSession(session)
+	logFrom(r.Context()).Info("session killed", "session", session, "killed", killed)
+	writeSessionAction(w, &SessionAction{Type: "session", Session: session, Action: "kill", Killed: killed})
+}
+
+// sessionRestartHandler replaces a wedged shell.
+func sessionRestartHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodPost {
+		writeError(w, errMethodMessage)
+		return
+	}
+
+	// Validate the hash parameter
+	hashParam := r.URL.Query().Get("hash")
+	if !checkHash(r, hashParam) {
+		writeError(w, errHashMessage)
+		return
+	}
+
+	session := r.URL.Query().Get("session")
+	killed, cwd, err := restartSession(session)
+	if err != nil {
+		logFrom(r.Context()).Error("failed to restart session", "session", session, "err", err)
+		writeError(w, err)
+		return
+	}
+	logFrom(r.Context()).Info("session restarted", "session", session, "killed", killed, "cwd", cwd)
+	writeSessionAction(w, &SessionAction{Type: "session", Session: session, Action: "restart", Killed: killed, Cwd: cwd})
+}
+
+// sessionExportHandler downloads a session's tickets and files.
+func sessionExportHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodGet {
+		writeError(w, errMethodMessage)
+		return
+	}
+
+	// Validate the hash parameter
+	hashParam := r.URL.Query().Get("hash")
+	if !checkHash(r, hashParam) {
+		writeError(w, errHashMessage)
+		return
+	}
+
+	session := r.URL.Query().Get("session")
+	if !validSessionName(session) {
+		writeError(w, errSessionMessage)
+		return
+	}
+	if !sessionExists(session) {
+		writeError(w, errSessionNotFound)
+		return
+	}
+	if err := exportSession(w, session); err != nil {
+		logFrom(r.Context()).Error("failed to export session", "session", session, "err", err)
+	}
+}
+
+// sessionImportHandler creates a session from an exported archive in the
+// request body.
+func sessionImportHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodPost {
+		writeError(w, errMethodMessage)
+		return
+	}
+
+	// Validate the hash parameter
+	hashParam := r.URL.Query().Get("hash")
+	if !checkHash(r, hashParam) {
+		writeError(w, errHashMessage)
+		return
+	}
+
+	session := r.URL.Query().Get("session")
+	if err := importSession(session, http.MaxBytesReader(w, r.Body, maxImportBytes)); err != nil {
+		writeError(w, err)
+		return
+	}
+	logFrom(r.Context()).Info("session imported", "session", session)
+	writeSessionAction(w, &SessionAction{Type: "session", Session: session, Action: "import"})
+}
+
+// sessionTemplatesHandler lists the templates new sessions can start from.
+func sessionTemplatesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodGet {
+		writeError(w, errMethodMessage)
+		return
+	}
+
+	// Validate the hash parameter
+	hashParam := r.URL.Query().Get("hash")
+	if !checkHash(r, hashParam) {
+		writeError(w, errHashMessage)
+		return
+	}
+
+	jsonResp, err := json.Marshal(listSessionTemplates())
+	if err != nil {
+		msg := fmt.Sprintf("Failed to marshal JSON response: %v", err)
+		writeJsonError(w, msg)
+		return
+	}
+
+	fmt.Fprint(w, string(jsonResp))
+}
+
+// dashboardSessionsHandler applies the session management forms and
+// returns to the relevant page.
+func dashboardSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, errMethodMessage)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		writeError(w, errBodyMessage)
+		return
+	}
+
+	hash := r.URL.Query().Get("hash")
+	session := r.PostForm.Get("session")
+	log := logFrom(r.Context()).With("session", session)
+	next := adminLink(hash, "/admin/session", "session", session)
+
+	var err error
+	switch action := r.PostForm.Get("action"); action {
+	case "create":
+		err = createSession(session, r.PostForm.Get("template"))
+	case "rename":
+		to := r.PostForm.Get("to")
+		if err = renameSession(session, to); err == nil {
+			next = adminLink(hash, "/admin/session", "session", to)
+		}
+	case "kill":
+		if !validSessionName(session) {
+			err = errSessionMessage
+			break
+		}
+		log.Info("session killed", "killed", killSession(session))
+	case "restart":
+		var killed int
+		var cwd string
+		if killed, cwd, err = restartSession(session); err == nil {
+			log.Info("session restarted", "killed", killed, "cwd", cwd)
+		}
+	case "delete":
+		err = deleteSession(session)
+		next = adminLink(hash, "/admin")
+	default:
+		err = errSessionActionMessage
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	log.Info("session updated from dashboard", "action", r.PostForm.Get("action"))
+	http.Redirect(w, r, next, http.StatusSeeOther)
+}
+
+func dashboardSessionExportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, errMethodMessage)
+		return
+	}
+	session := r.URL.Query().Get("session")
+	if !validSessionName(session) || !sessionExists(session) {
+		writeError(w, errSessionNotFound)
+		return
+	}
+	if err := exportSession(w, session); err != nil {
+		logFrom(r.Context()).Error("failed to export session", "session", session, "err", err)
+	}
+}
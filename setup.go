@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// setupPrompts are the settings first-run setup asks for, the defaults come
+// from the flags and environment when set.
+var setupPrompts = []struct{ key, prompt, def string }{
+	{"FQDN", "Public URL", "http://localhost:8083"},
+	{"PORT", "TCP port", "8083"},
+	{"SESSIONS_DIR", "Sessions directory", "sessions"},
+	{"DATA_DIR", "Data directory", "data"},
+}
+
+// needsSetup reports whether the server was started without any
+// configuration: no HASH and no .env or config file.
+func needsSetup(c *cliConfig) bool {
+	return os.Getenv("HASH") == "" && len(c.loaded) == 0
+}
+
+// stdinTerminal reports whether stdin is a terminal someone can answer
+// prompts on.
+func stdinTerminal() bool {
+	info, err := os.Stdin.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// runSetup writes a starter .env with random hashes, creates the
+// directories and prints what to give the LLM. With interactive false the
+// answers come from the flags and defaults without prompting.
+func runSetup(c *cliConfig, in io.Reader, out io.Writer, interactive bool) error {
+	values := map[string]string{}
+	for _, p := range setupPrompts {
+		values[p.key] = settingOr(p.key, p.def)
+	}
+
+	if interactive {
+		scanner := bufio.NewScanner(in)
+		ask := func(prompt, def string) string {
+			fmt.Fprintf(out, "%s [%s]: ", prompt, def)
+			if !scanner.Scan() {
+				return def
+			}
+			if answer := strings.TrimSpace(scanner.Text()); answer != "" {
+				return answer
+			}
+			return def
+		}
+
+		// No answer, as from /dev/null, counts as a no
+		fmt.Fprintf(out, "No configuration found. Create %s now? [Y/n]: ", *c.envFile)
+		answered := scanner.Scan()
+		if !answered {
+			fmt.Fprintln(out)
+		}
+		if !answered || strings.HasPrefix(strings.ToLower(strings.TrimSpace(scanner.Text())), "n") {
+			return fmt.Errorf("no configuration found, run \"llmass init\" or \"llmass serve -setup\", or set HASH")
+		}
+		for _, p := range setupPrompts {
+			values[p.key] = ask(p.prompt, values[p.key])
+		}
+	}
+
+	settings, err := starterSettings(values["FQDN"], values["PORT"], values["SESSIONS_DIR"], values["DATA_DIR"])
+	if err != nil {
+		return fmt.Errorf("failed to generate hash: %v", err)
+	}
+	path, err := writeStarterConfig(*c.envFile, "env", settings, false)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(values["SESSIONS_DIR"], 0755); err != nil {
+		return fmt.Errorf("failed to create sessions directory: %v", err)
+	}
+	if err := os.MkdirAll(values["DATA_DIR"], 0700); err != nil {
+		return fmt.Errorf("failed to create data directory: %v", err)
+	}
+	if err := c.reload(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "\nWrote %s with a new HASH and ADMIN_HASH, keep it private.\n", path)
+	printUsageSnippet(out, strings.TrimRight(values["FQDN"], "/"), os.Getenv("HASH"))
+	return nil
+}
+
+// printUsageSnippet prints instructions to paste into the LLM's prompt.
+func printUsageSnippet(out io.Writer, base, hash string) {
+	fmt.Fprintf(out, `
+Paste this into your LLM's instructions:
+
+  You can run shell commands on a Linux host through the LLMASS server at %[1]s.
+  Authenticate every request with the query parameter hash=%[2]s
+  Read %[1]s/context?hash=%[2]s for how to use it.
+  Run a command: %[1]s/shell?hash=%[2]s&session=main&cmd=uptime
+  Then fetch the returned callback URL, backing off, until the ticket is complete.
+  Tool definitions for function calling: %[1]s/tools?hash=%[2]s
+
+`, base, hash)
+}
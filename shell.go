@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// defaultShells are tried in order when SHELL_PATH is unset: bash where the
+// OS keeps it, then the POSIX sh every system has.
+var defaultShells = []string{"/bin/bash", "/usr/bin/bash", "/usr/local/bin/bash", "/bin/sh"}
+
+const defaultShellArgs = "-c"
+
+var (
+	shellPath string   // SHELL_PATH, resolved to an executable
+	shellArgs []string // SHELL_ARGS, the command script follows them
+)
+
+// loadShell resolves SHELL_PATH, falling back to the first default shell
+// present, and splits SHELL_ARGS on whitespace.
+func loadShell() error {
+	path, args, err := resolveShell(os.Getenv("SHELL_PATH"), os.Getenv("SHELL_ARGS"))
+	if err != nil {
+		return err
+	}
+	shellPath, shellArgs = path, args
+	return nil
+}
+
+func resolveShell(path, args string) (string, []string, error) {
+	if args == "" {
+		args = defaultShellArgs
+	}
+	if path != "" {
+		resolved, err := exec.LookPath(path)
+		if err != nil {
+			return "", nil, fmt.Errorf("SHELL_PATH is not executable: %v", err)
+		}
+		return resolved, strings.Fields(args), nil
+	}
+	for _, candidate := range defaultShells {
+		if resolved, err := exec.LookPath(candidate); err == nil {
+			return resolved, strings.Fields(args), nil
+		}
+	}
+	return "", nil, fmt.Errorf("no shell found in %s, set SHELL_PATH", strings.Join(defaultShells, ", "))
+}
+
+// shellIsBash reports whether bash-only profile lines such as shopt can be
+// used.
+func shellIsBash() bool {
+	return strings.Contains(filepath.Base(shellPath), "bash")
+}
+
+// shellCommand runs script with the configured shell.
+func shellCommand(ctx context.Context, script string, extra ...string) *exec.Cmd {
+	args := append(append(extra, shellArgs...), script)
+	return exec.CommandContext(ctx, shellPath, args...)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultDrainTimeout = 30 * time.Second
+	killGracePeriod     = 5 * time.Second
+)
+
+var (
+	errDrainingMessage = newKindError(errUnavailable, "Server is shutting down and not accepting new commands")
+)
+
+var (
+	drainTimeout = defaultDrainTimeout // DRAIN_TIMEOUT
+
+	drainMu  sync.Mutex
+	draining bool
+	inflight sync.WaitGroup // commands and watches still to persist a ticket
+)
+
+// loadShutdown reads DRAIN_TIMEOUT, in seconds.
+func loadShutdown() error {
+	v := os.Getenv("DRAIN_TIMEOUT")
+	if v == "" {
+		return nil
+	}
+	n, err := strconv.ParseFloat(v, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("DRAIN_TIMEOUT must be a number of seconds: %q", v)
+	}
+	drainTimeout = time.Duration(n * float64(time.Second))
+	return nil
+}
+
+// beginCommand registers a command about to start, or refuses it once the
+// server is draining. Every true return must be paired with endCommand.
+func beginCommand() bool {
+	drainMu.Lock()
+	defer drainMu.Unlock()
+	if draining {
+		return false
+	}
+	inflight.Add(1)
+	return true
+}
+
+func endCommand() {
+	inflight.Done()
+}
+
+// waitInflight waits up to d for the running commands, reporting whether
+// they all finished.
+func waitInflight(d time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		inflight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(d):
+		return false
+	}
+}
+
+// shutdownOnSignal drains the server on SIGTERM or SIGINT: new commands are
+// refused while polling keeps working, watches stop, running commands get
+// DRAIN_TIMEOUT to finish before they are killed, and once every ticket is
+// persisted the HTTP server closes. done is closed when it is safe to exit.
+func shutdownOnSignal(server *http.Server, done chan<- struct{}) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-ch
+	signal.Stop(ch)
+	defer close(done)
+
+	sdNotify("STOPPING=1")
+	drainMu.Lock()
+	draining = true
+	drainMu.Unlock()
+
+	running := allRunning()
+	logger.Info("shutting down, draining commands", "signal", sig.String(), "running", len(running), "drain_timeout", drainTimeout)
+
+	watchMu.Lock()
+	for _, cancel := range watches {
+		cancel()
+	}
+	watchMu.Unlock()
+
+	// Commands in a persistent shell outlive the server, the next one writes
+	// their tickets
+	if activeExecutor.persistent() {
+		logger.Info("leaving commands running in the shells", "backend", shellBackend, "running", len(running))
+	} else if !waitInflight(drainTimeout) {
+		sessions := map[string]bool{}
+		for _, rc := range allRunning() {
+			sessions[rc.Session] = true
+		}
+		for session := range sessions {
+			logger.Warn("drain timeout reached, killing commands", "session", session, "killed", killSession(session))
+		}
+		if !waitInflight(killGracePeriod) {
+			logger.Error("commands still running after kill, their tickets may be incomplete")
+		}
+	}
+
+	releaseLease()
+	ctx, cancel := context.WithTimeout(context.Background(), killGracePeriod)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		logger.Warn("closing connections", "err", err)
+	}
+	logger.Info("shutdown complete")
+}
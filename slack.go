@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	slackAPI       = "https://slack.com/api/chat.postMessage"
+	slackMaxSkew   = 5 * time.Minute
+	slackMaxOutput = 2500
+)
+
+var (
+	errSlackSignature = newKindError(errUnauthorized, "Invalid Slack signature")
+)
+
+var (
+	slackToken         string   // SLACK_BOT_TOKEN, enables the integration
+	slackSigningSecret string   // SLACK_SIGNING_SECRET
+	slackChannel       string   // SLACK_CHANNEL for completions and approvals
+	slackAllowed       []string // SLACK_ALLOWED_COMMANDS, comma separated prefixes
+
+)
+
+// loadSlack reads the optional Slack settings and subscribes to ticket
+// completions when a bot token is configured.
+func loadSlack() {
+	slackToken = os.Getenv("SLACK_BOT_TOKEN")
+	slackSigningSecret = os.Getenv("SLACK_SIGNING_SECRET")
+	slackChannel = os.Getenv("SLACK_CHANNEL")
+	for _, p := range strings.Split(os.Getenv("SLACK_ALLOWED_COMMANDS"), ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			slackAllowed = append(slackAllowed, p)
+		}
+	}
+
+	if slackToken == "" {
+		return
+	}
+	if slackSigningSecret == "" || slackChannel == "" {
+		fatal("SLACK_SIGNING_SECRET and SLACK_CHANNEL must be set when SLACK_BOT_TOKEN is set")
+	}
+
+	onEvent(func(event string, data interface{}) {
+		if cer, ok := data.(*CmdResults); ok && event == eventTicketCompleted {
+			slackPostCompletion(cer)
+		}
+	})
+	logger.Info("slack integration enabled", "channel", slackChannel)
+}
+
+func slackPost(msg obj) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, slackAPI, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	req.Header.Set("Authorization", "Bearer "+slackToken)
+
+	client := &http.Client{Timeout: webhookTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		OK    bool   `json:"ok"`
+		Error string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return err
+	}
+	if !result.OK {
+		return fmt.Errorf("slack: %s", result.Error)
+	}
+	return nil
+}
+
+func truncateOutput(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "\n... (truncated)"
+}
+
+func slackPostCompletion(cer *CmdResults) {
+	text := fmt.Sprintf("*%s* ticket %d finished: `%s`\n```%s```",
+		cer.Session, cer.Ticket, cer.Input, truncateOutput(cer.Output, slackMaxOutput))
+	if err := slackPost(obj{"channel": slackChannel, "text": text}); err != nil {
+		logger.Error("failed to post Slack completion", "err", err)
+	}
+}
+
+// verifySlack checks the request signature Slack computes from the signing
+// secret, returning the body on success.
+func verifySlack(r *http.Request) ([]byte, bool) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxRequestBody))
+	if err != nil {
+		return nil, false
+	}
+
+	ts := r.Header.Get("X-Slack-Request-Timestamp")
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil || time.Since(time.Unix(sec, 0)).Abs() > slackMaxSkew {
+		return nil, false
+	}
+
+	mac := hmac.New(sha256.New, []byte(slackSigningSecret))
+	fmt.Fprintf(mac, "v0:%s:%s", ts, body)
+	expected := "v0=" + hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(expected), []byte(r.Header.Get("X-Slack-Signature"))) {
+		return nil, false
+	}
+	return body, true
+}
+
+func slackAllowedCommand(cmd string) bool {
+	for _, p := range slackAllowed {
+		if cmd == p || strings.HasPrefix(cmd, p+" ") {
+			return true
+		}
+	}
+	return false
+}
+
+func writeSlackText(w http.ResponseWriter, text string) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(obj{"response_type": "ephemeral", "text": text})
+}
+
+// slackCommandHandler serves the `/llmass <session> <command>` slash command.
+// Allowed commands run immediately, everything else is posted to the channel
+// for approval.
+func slackCommandHandler(w http.ResponseWriter, r *http.Request) {
+	if slackToken == "" || r.Method != http.MethodPost {
+		writeError(w, errNotFoundMessage)
+		return
+	}
+
+	body, ok := verifySlack(r)
+	if !ok {
+		writeError(w, errSlackSignature)
+		return
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		writeError(w, errBodyMessage)
+		return
+	}
+
+	session, cmd, _ := strings.Cut(strings.TrimSpace(form.Get("text")), " ")
+	cmd = strings.TrimSpace(cmd)
+	if session == "" || cmd == "" {
+		writeSlackText(w, "Usage: /llmass <session> <command>")
+		return
+	}
+
+	if slackAllowedCommand(cmd) {
+		csr, err := submitCommand(r.Context(), session, cmd, execOptions{Timeout: defaultCmdTimeout, Confirmed: true})
+		if err != nil {
+			writeSlackText(w, err.Error())
+			return
+		}
+		writeSlackText(w, fmt.Sprintf("Submitted ticket %d in session %s", csr.Ticket, csr.Session))
+		return
+	}
+
+	id := requestApproval(session, cmd, form.Get("user_name"), "slack").ID
+
+	msg := obj{
+		"channel": slackChannel,
+		"text":    fmt.Sprintf("%s wants to run `%s` in session %s", form.Get("user_name"), cmd, session),
+		"blocks": []obj{
+			{"type": "section", "text": obj{"type": "mrkdwn", "text": fmt.Sprintf("*%s* wants to run in session *%s*:\n```%s```", form.Get("user_name"), session, cmd)}},
+			{"type": "actions", "elements": []obj{
+				{"type": "button", "style": "primary", "text": obj{"type": "plain_text", "text": "Approve"}, "action_id": "approve", "value": id},
+				{"type": "button", "style": "danger", "text": obj{"type": "plain_text", "text": "Reject"}, "action_id": "reject", "value": id},
+			}},
+		},
+	}
+	if err := slackPost(msg); err != nil {
+		logger.Error("failed to post Slack approval", "err", err)
+		cancelApproval(id)
+		writeSlackText(w, "Failed to request approval")
+		return
+	}
+	writeSlackText(w, "This command needs approval, a request was posted to the channel")
+}
+
+// slackInteractiveHandler receives Approve/Reject button clicks.
+func slackInteractiveHandler(w http.ResponseWriter, r *http.Request) {
+	if slackToken == "" || r.Method != http.MethodPost {
+		writeError(w, errNotFoundMessage)
+		return
+	}
+
+	body, ok := verifySlack(r)
+	if !ok {
+		writeError(w, errSlackSignature)
+		return
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		writeError(w, errBodyMessage)
+		return
+	}
+
+	var payload struct {
+		User struct {
+			Username string `json:"username"`
+		} `json:"user"`
+		ResponseURL string `json:"response_url"`
+		Actions     []struct {
+			ActionID string `json:"action_id"`
+			Value    string `json:"value"`
+		} `json:"actions"`
+	}
+	if err := json.Unmarshal([]byte(form.Get("payload")), &payload); err != nil || len(payload.Actions) == 0 {
+		writeError(w, errBodyMessage)
+		return
+	}
+	action := payload.Actions[0]
+
+	d, err := decideApproval(r.Context(), action.Value, action.ActionID == "approve", payload.User.Username)
+
+	var text string
+	switch {
+	case d == nil:
+		text = "This request was already handled"
+	case err != nil:
+		text = fmt.Sprintf("Approved by %s but failed: %v", payload.User.Username, err)
+	case d.Approved:
+		text = fmt.Sprintf("Approved by %s: `%s` is ticket %d in session %s", payload.User.Username, d.Approval.Cmd, d.Submission.Ticket, d.Submission.Session)
+	default:
+		text = fmt.Sprintf("Rejected by %s: `%s`", payload.User.Username, d.Approval.Cmd)
+	}
+
+	// Replace the buttons with the outcome
+	if payload.ResponseURL != "" {
+		resp, err := json.Marshal(obj{"replace_original": true, "text": text})
+		if err == nil {
+			client := &http.Client{Timeout: webhookTimeout}
+			if res, err := client.Post(payload.ResponseURL, "application/json", bytes.NewReader(resp)); err == nil {
+				res.Body.Close()
+			}
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+}
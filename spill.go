@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// A command's output is held in memory up to OUTPUT_MEMORY_LIMIT bytes. Past
+// it the output spills to a file in the session, so a command printing
+// gigabytes can't run the server out of memory. The ticket then keeps the
+// head and tail of the output around a marker, and the whole of it, up to
+// maxSpillSize, becomes the ticket's output.log artifact.
+
+const (
+	defaultOutputMemoryLimit = 8 << 20
+	maxSpillSize             = 1 << 30 // written to disk, the rest is dropped
+	spillArtifactName        = "output.log"
+)
+
+var outputMemoryLimit = defaultOutputMemoryLimit // OUTPUT_MEMORY_LIMIT, in bytes
+
+func loadOutputCapture() error {
+	outputMemoryLimit = defaultOutputMemoryLimit
+	if s := os.Getenv("OUTPUT_MEMORY_LIMIT"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1024 {
+			return fmt.Errorf("OUTPUT_MEMORY_LIMIT must be a number of bytes, at least 1024: %q", s)
+		}
+		outputMemoryLimit = n
+	}
+	return nil
+}
+
+// spillBuffer captures output in memory until it passes the limit, then in a
+// file in dir. Writes never fail, so a full disk doesn't fail the command.
+type spillBuffer struct {
+	dir    string
+	limit  int
+	failed bool   // couldn't create the file
+	head   []byte // the first half of the limit, kept once spilled
+	mem    bytes.Buffer
+	file   *os.File
+	spilt  int64 // bytes written to file
+	size   int64 // bytes written in all
+}
+
+func newSpillBuffer(dir string) *spillBuffer {
+	return &spillBuffer{dir: dir, limit: outputMemoryLimit}
+}
+
+func (b *spillBuffer) Write(p []byte) (int, error) {
+	b.size += int64(len(p))
+	if b.file == nil {
+		if b.mem.Len()+len(p) <= b.limit || b.failed || !b.spill(p) {
+			// Without a file only what fits is kept
+			if room := b.limit - b.mem.Len(); room > 0 {
+				b.mem.Write(p[:min(room, len(p))])
+			}
+		}
+		return len(p), nil
+	}
+	if b.spilt < maxSpillSize {
+		n, _ := b.file.Write(p)
+		b.spilt += int64(n)
+	}
+	return len(p), nil
+}
+
+// spill moves the output so far and p to a file, reporting whether it
+// could.
+func (b *spillBuffer) spill(p []byte) bool {
+	f, err := os.CreateTemp(b.dir, ".output-*")
+	if err != nil {
+		logger.Warn("failed to spill output to disk", "dir", b.dir, "err", err)
+		b.failed = true // and don't try again for every write
+		return false
+	}
+	b.mem.Write(p)
+	n, _ := f.Write(b.mem.Bytes())
+	b.file, b.spilt = f, int64(n)
+	b.head = append([]byte(nil), b.mem.Bytes()[:b.limit/2]...)
+	b.mem = bytes.Buffer{}
+	return true
+}
+
+// Bytes returns the output for the ticket: all of it while it fit in
+// memory, otherwise its head and tail.
+func (b *spillBuffer) Bytes() []byte {
+	if b.file == nil {
+		if omitted := b.size - int64(b.mem.Len()); omitted > 0 {
+			return append(b.mem.Bytes(), fmt.Sprintf("\n[... %d bytes of output dropped ...]\n", omitted)...)
+		}
+		return b.mem.Bytes()
+	}
+
+	tail := make([]byte, min(int64(b.limit/2), b.spilt))
+	n, _ := b.file.ReadAt(tail, b.spilt-int64(len(tail)))
+	tail = tail[:n]
+	omitted := b.size - int64(len(b.head)) - int64(len(tail))
+	var out bytes.Buffer
+	out.WriteString(strings.ToValidUTF8(string(b.head), ""))
+	fmt.Fprintf(&out, "\n[... %d bytes of output omitted, the full output is the %s artifact ...]\n", omitted, spillArtifactName)
+	out.WriteString(strings.ToValidUTF8(string(tail), ""))
+	return out.Bytes()
+}
+
+// keep makes the spilled output an artifact of the ticket, nil when the
+// output never spilled.
+func (b *spillBuffer) keep(ctx context.Context, sessionFolder, session string, ticket int) *Artifact {
+	if b.file == nil {
+		return nil
+	}
+	defer b.discard()
+
+	dest := ticketArtifactsDir(sessionFolder, ticket)
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		logger.Warn("failed to keep spilled output", "err", err)
+		return nil
+	}
+	// A watch spills once per iteration
+	name := spillArtifactName
+	for i := 1; ; i++ {
+		if _, err := os.Stat(filepath.Join(dest, name)); os.IsNotExist(err) {
+			break
+		}
+		name = fmt.Sprintf("output-%d.log", i)
+	}
+	b.file.Close()
+	os.Chmod(b.file.Name(), 0644)
+	if err := os.Rename(b.file.Name(), filepath.Join(dest, name)); err != nil {
+		logger.Warn("failed to keep spilled output", "err", err)
+		return nil
+	}
+	return &Artifact{Name: name, Size: b.spilt, URL: ArtifactURL(ctx, session, ticket, name)}
+}
+
+// discard removes the spill file, if any.
+func (b *spillBuffer) discard() {
+	if b.file != nil {
+		b.file.Close()
+		os.Remove(b.file.Name())
+	}
+}
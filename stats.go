@@ -0,0 +1,286 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// /stats aggregates the ticket store: how many commands each session ran,
+// how many failed, how long they took and at which hours of the day they
+// finished. Cached answers to repeated commands don't create tickets, so
+// cache hits are counted in memory since the server started, and the hit
+// rate is of the submissions since then.
+
+const statsBusiestHours = 3
+
+// StatsSummary aggregates the commands of one session, or of all of them.
+type StatsSummary struct {
+	Session      string      `json:"session,omitempty"`
+	Commands     int         `json:"commands"`
+	Failures     int         `json:"failures"`
+	FailureRate  float64     `json:"failure_rate"` // percent
+	Running      int         `json:"running"`
+	AvgMs        int64       `json:"avg_ms"`
+	P50Ms        int64       `json:"p50_ms"`
+	P90Ms        int64       `json:"p90_ms"`
+	P95Ms        int64       `json:"p95_ms"`
+	P99Ms        int64       `json:"p99_ms"`
+	MaxMs        int64       `json:"max_ms"`
+	Hours        [24]int     `json:"hours"` // commands finished per hour of the day, UTC
+	BusiestHours []StatsHour `json:"busiest_hours"`
+	CacheHits    int         `json:"cache_hits"`
+	CacheHitRate float64     `json:"cache_hit_rate"` // percent of submissions since cache_since
+	First        *time.Time  `json:"first,omitempty"`
+	Last         *time.Time  `json:"last,omitempty"`
+
+	durations   []int64
+	submissions int
+}
+
+// StatsHour is an hour of the day and the commands that finished in it.
+type StatsHour struct {
+	Hour     int `json:"hour"`
+	Commands int `json:"commands"`
+}
+
+// Stats is the /stats document.
+type Stats struct {
+	Type       string          `json:"type"`
+	CacheSince time.Time       `json:"cache_since"`
+	Global     *StatsSummary   `json:"global"`
+	Sessions   []*StatsSummary `json:"sessions"`
+}
+
+// submissionCount is a session's submissions since the server started.
+type submissionCount struct {
+	Submissions int
+	CacheHits   int
+}
+
+var (
+	submissionsMu sync.Mutex
+	submissions   = map[string]*submissionCount{}
+)
+
+// countSubmission records a command submitted to the session, answered
+// from the cache or with a new ticket.
+func countSubmission(session string, cached bool) {
+	submissionsMu.Lock()
+	defer submissionsMu.Unlock()
+	c := submissions[session]
+	if c == nil {
+		c = &submissionCount{}
+		submissions[session] = c
+	}
+	c.Submissions++
+	if cached {
+		c.CacheHits++
+	}
+}
+
+// add counts a finished command.
+func (s *StatsSummary) add(finished time.Time, exitCode *int, usage *ResourceUsage) {
+	s.Commands++
+	if exitCode == nil || *exitCode != 0 {
+		s.Failures++
+	}
+	if usage != nil {
+		s.durations = append(s.durations, usage.WallMs)
+	}
+	s.Hours[finished.UTC().Hour()]++
+	if s.First == nil || finished.Before(*s.First) {
+		first := finished.UTC()
+		s.First = &first
+	}
+	if s.Last == nil || finished.After(*s.Last) {
+		last := finished.UTC()
+		s.Last = &last
+	}
+}
+
+// merge adds another summary's counts, for the global one.
+func (s *StatsSummary) merge(o *StatsSummary) {
+	s.Commands += o.Commands
+	s.Failures += o.Failures
+	s.Running += o.Running
+	s.durations = append(s.durations, o.durations...)
+	for h, n := range o.Hours {
+		s.Hours[h] += n
+	}
+	if o.First != nil && (s.First == nil || o.First.Before(*s.First)) {
+		s.First = o.First
+	}
+	if o.Last != nil && (s.Last == nil || o.Last.After(*s.Last)) {
+		s.Last = o.Last
+	}
+	s.CacheHits += o.CacheHits
+	s.submissions += o.submissions
+}
+
+// finish derives the rates, durations and busiest hours from the counts.
+func (s *StatsSummary) finish() {
+	if s.Commands > 0 {
+		s.FailureRate = 100 * float64(s.Failures) / float64(s.Commands)
+	}
+	if s.submissions > 0 {
+		s.CacheHitRate = 100 * float64(s.CacheHits) / float64(s.submissions)
+	}
+	if len(s.durations) > 0 {
+		var total int64
+		for _, d := range s.durations {
+			total += d
+			s.MaxMs = max(s.MaxMs, d)
+		}
+		s.AvgMs = total / int64(len(s.durations))
+		s.P50Ms = percentile(s.durations, 50)
+		s.P90Ms = percentile(s.durations, 90)
+		s.P95Ms = percentile(s.durations, 95)
+		s.P99Ms = percentile(s.durations, 99)
+	}
+
+	s.BusiestHours = []StatsHour{}
+	for h, n := range s.Hours {
+		if n > 0 {
+			s.BusiestHours = append(s.BusiestHours, StatsHour{Hour: h, Commands: n})
+		}
+	}
+	sort.SliceStable(s.BusiestHours, func(i, j int) bool { return s.BusiestHours[i].Commands > s.BusiestHours[j].Commands })
+	if len(s.BusiestHours) > statsBusiestHours {
+		s.BusiestHours = s.BusiestHours[:statsBusiestHours]
+	}
+}
+
+// sessionStats reads the session's finished tickets. A ticket's
+// modification time is when its command finished.
+func sessionStats(session string) (*StatsSummary, error) {
+	sessionFolder := filepath.Join(sessionsDir, session)
+	idx, err := sessionTicketIndex(sessionFolder)
+	if err != nil {
+		return nil, notFoundf("Session %s does not exist", session)
+	}
+	s := &StatsSummary{Session: session, Running: len(runningForSession(session))}
+	for _, meta := range idx.list() {
+		// Still running
+		if meta.Size == 0 {
+			continue
+		}
+		content, err := os.ReadFile(filepath.Join(sessionFolder, fmt.Sprintf("%02d.ticket", meta.Ticket)))
+		if err != nil {
+			logger.Warn("failed to read ticket", "session", session, "ticket", meta.Ticket, "err", err)
+			continue
+		}
+		var res struct {
+			Type     string         `json:"type"`
+			ExitCode *int           `json:"exit_code"`
+			Usage    *ResourceUsage `json:"usage"`
+		}
+		// Watches and shell deaths aren't commands
+		if json.Unmarshal(content, &res) != nil || res.Type != "result" {
+			continue
+		}
+		s.add(meta.Modified, res.ExitCode, res.Usage)
+	}
+
+	submissionsMu.Lock()
+	if c := submissions[session]; c != nil {
+		s.CacheHits, s.submissions = c.CacheHits, c.Submissions
+	}
+	submissionsMu.Unlock()
+	return s, nil
+}
+
+// collectStats aggregates the given sessions, or every one when session is
+// empty.
+func collectStats(session string) (*Stats, error) {
+	var names []string
+	if session != "" {
+		names = []string{session}
+	} else {
+		sessions, err := listSessions()
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range sessions {
+			names = append(names, s.Name)
+		}
+	}
+
+	stats := &Stats{Type: "stats", CacheSince: startTime.UTC(), Global: &StatsSummary{}, Sessions: []*StatsSummary{}}
+	for _, name := range names {
+		s, err := sessionStats(name)
+		if err != nil {
+			return nil, err
+		}
+		stats.Global.merge(s)
+		s.finish()
+		stats.Sessions = append(stats.Sessions, s)
+	}
+	stats.Global.finish()
+	return stats, nil
+}
+
+// statsText renders the stats as plain text, a line per session.
+func statsText(stats *Stats) string {
+	var b strings.Builder
+	line := func(name string, s *StatsSummary) {
+		hours := make([]string, 0, len(s.BusiestHours))
+		for _, h := range s.BusiestHours {
+			hours = append(hours, fmt.Sprintf("%02d:00 (%d)", h.Hour, h.Commands))
+		}
+		fmt.Fprintf(&b, "%s: %d commands, %.1f%% failed, %d running, avg %dms, p50 %dms, p95 %dms, p99 %dms, cache hits %d (%.1f%%), busiest %s\n",
+			name, s.Commands, s.FailureRate, s.Running, s.AvgMs, s.P50Ms, s.P95Ms, s.P99Ms, s.CacheHits, s.CacheHitRate, strings.Join(hours, ", "))
+	}
+	line("all", stats.Global)
+	for _, s := range stats.Sessions {
+		line(s.Session, s)
+	}
+	return b.String()
+}
+
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodGet {
+		writeError(w, errMethodMessage)
+		return
+	}
+
+	format, err := responseFormat(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// Validate the hash parameter
+	hashParam := r.URL.Query().Get("hash")
+	if !checkHash(r, hashParam) {
+		writeError(w, errHashMessage)
+		return
+	}
+
+	// Without a session every session is aggregated
+	session := r.URL.Query().Get("session")
+	if session != "" {
+		if !validSessionName(session) {
+			writeError(w, errSessionMessage)
+			return
+		}
+		if !sessionExists(session) {
+			writeError(w, errSessionNotFound)
+			return
+		}
+	}
+
+	stats, err := collectStats(session)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeFormatted(w, format, stats, statsText(stats))
+}
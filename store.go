@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// sharedStorage is set with SHARED_STORAGE=true when several instances
+// behind a load balancer share SESSIONS_DIR on a network filesystem.
+var sharedStorage bool
+
+func loadStorage() error {
+	v := os.Getenv("SHARED_STORAGE")
+	if v == "" {
+		sharedStorage = false
+		return nil
+	}
+	shared, err := strconv.ParseBool(v)
+	if err != nil {
+		return fmt.Errorf("SHARED_STORAGE must be true or false: %q", v)
+	}
+	sharedStorage = shared
+	return nil
+}
+
+// workingElsewhere reports whether another instance sharing SESSIONS_DIR
+// is running a command in the session: a ticket file is still empty but no
+// local command owns it.
+func workingElsewhere(session string) bool {
+	if !sharedStorage {
+		return false
+	}
+	local := map[int]bool{}
+	for _, rc := range runningForSession(session) {
+		local[rc.Ticket] = true
+	}
+	entries, err := os.ReadDir(filepath.Join(sessionsDir, session))
+	if err != nil {
+		return false
+	}
+	for _, e := range entries {
+		num, ok := strings.CutSuffix(e.Name(), ".ticket")
+		ticket, err := strconv.Atoi(num)
+		if !ok || err != nil || local[ticket] {
+			continue
+		}
+		if info, err := e.Info(); err == nil && info.Size() == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// readTicket returns the raw ticket file, which is empty while the command
+// is still running.
+func readTicket(session string, ticket int) ([]byte, error) {
+	sessionFolder := filepath.Join(sessionsDir, session)
+	if _, err := os.Stat(sessionFolder); os.IsNotExist(err) {
+		logger.Debug("session not found", "session", session)
+		return nil, notFoundf("Session %s does not exist", session)
+	}
+
+	// A running command's ticket is polled the most, and is known to be empty
+	if idx, err := sessionTicketIndex(sessionFolder); err == nil {
+		if meta, ok := idx.get(ticket); ok && meta.Size == 0 {
+			return []byte{}, nil
+		}
+	}
+
+	file, err := os.ReadFile(filepath.Join(sessionFolder, fmt.Sprintf("%02d.ticket", ticket)))
+	if os.IsNotExist(err) {
+		return nil, notFoundf("Ticket %d does not exist in session %s", ticket, session)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read ticket file: %v", err)
+	}
+	return file, nil
+}
+
+// readHistory returns every completed ticket in the session.
+func readHistory(session string) ([]*CmdResults, error) {
+	// Check if session exists
+	sessionPath := filepath.Join(sessionsDir, session)
+	if _, err := os.Stat(sessionPath); os.IsNotExist(err) {
+		return nil, notFoundf("Session %s does not exist", session)
+	}
+
+	idx, err := sessionTicketIndex(sessionPath)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read session directory: %v", err)
+	}
+	tickets := idx.list()
+	if len(tickets) == 0 {
+		return nil, notFoundf("No tickets found for session %s", session)
+	}
+
+	var responses []*CmdResults
+	// Display content of all tickets
+	for _, meta := range tickets {
+		// Still running
+		if meta.Size == 0 {
+			continue
+		}
+		ticket := fmt.Sprintf("%02d.ticket", meta.Ticket)
+		content, err := os.ReadFile(filepath.Join(sessionPath, ticket))
+		if err != nil {
+			logger.Warn("failed to read ticket", "file", ticket, "err", err)
+			continue
+		}
+		resp := &CmdResults{}
+		err = json.Unmarshal(content, resp)
+		if err != nil {
+			logger.Warn("failed to unmarshal ticket", "file", ticket, "err", err)
+			continue
+		}
+		if meta.ExitCode == nil {
+			idx.learnExitCode(meta.Ticket, meta.Modified, resp.ExitCode)
+		}
+		// Tickets written before token estimates get one now
+		if resp.Tokens == 0 {
+			resp.Tokens = estimateTokens(resp.Output)
+		}
+
+		responses = append(responses, resp)
+	}
+	return responses, nil
+}
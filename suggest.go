@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// /suggest turns a goal in plain words into candidate shell commands, asking
+// the OpenAI-compatible chat completions endpoint at SUGGEST_URL, or at
+// SUMMARIZE_URL when it is not set, with the session's recent commands and
+// notes as context. It never runs what it suggests, each command comes back
+// with the risk CONFIRM_RISK would give it for the agent to submit or not.
+
+const (
+	defaultSuggestions  = 3
+	maxSuggestions      = 10
+	suggestTickets      = 5   // recent tickets sent as context
+	suggestOutputTokens = 200 // of each of their outputs
+
+	errSuggestFailedMessage = "Failed to suggest commands"
+	suggestPrompt           = "You propose shell commands for an AI agent operating a remote shell. Given a goal and the session's recent commands, answer with a JSON object {\"commands\": [{\"command\": \"...\", \"explanation\": \"...\"}]} of at most %d candidate commands, best first. Prefer commands that inspect the system before ones that change it, and never combine unrelated steps into one command. Answer with the JSON only."
+)
+
+var (
+	errGoalMessage       = paramError("goal", "Invalid or missing 'goal' parameter")
+	errCountMessage      = paramError("n", "Invalid 'n' parameter")
+	errSuggestOffMessage = newKindError(errUnavailable, "Suggestions are not enabled, set SUGGEST_URL or SUMMARIZE_URL")
+)
+
+var (
+	suggestURL   string // SUGGEST_URL or SUMMARIZE_URL, "" disables /suggest
+	suggestModel string
+	suggestKey   string
+)
+
+// loadSuggester reads SUGGEST_URL, SUGGEST_MODEL and SUGGEST_API_KEY,
+// falling back to the summarizer's endpoint, so it runs after loadSummarizer.
+func loadSuggester() error {
+	suggestURL = strings.TrimSuffix(os.Getenv("SUGGEST_URL"), "/")
+	suggestModel = os.Getenv("SUGGEST_MODEL")
+	suggestKey = os.Getenv("SUGGEST_API_KEY")
+	if suggestURL == "" {
+		suggestURL, suggestModel, suggestKey = summarizeURL, summarizeModel, summarizeKey
+		return nil
+	}
+	if !strings.HasPrefix(suggestURL, "http://") && !strings.HasPrefix(suggestURL, "https://") {
+		return fmt.Errorf("SUGGEST_URL must be an http or https URL: %s", suggestURL)
+	}
+	if suggestModel == "" {
+		return fmt.Errorf("SUGGEST_MODEL must be set with SUGGEST_URL")
+	}
+	return nil
+}
+
+// Suggestion is a candidate command, not run.
+type Suggestion struct {
+	Command     string   `json:"command"`
+	Explanation string   `json:"explanation"`
+	Risk        string   `json:"risk,omitempty"`
+	Reasons     []string `json:"reasons,omitempty"`
+}
+
+// SuggestResults answers /suggest.
+type SuggestResults struct {
+	Type        string       `json:"type"`
+	Next        string       `json:"next"`
+	Session     string       `json:"session,omitempty"`
+	Goal        string       `json:"goal"`
+	Suggestions []Suggestion `json:"suggestions"`
+}
+
+// suggestContext renders the session's latest tickets, outputs trimmed, and
+// its notes for the prompt.
+func suggestContext(session string) string {
+	var b strings.Builder
+	if history, err := readHistory(session); err == nil {
+		if len(history) > suggestTickets {
+			history = history[len(history)-suggestTickets:]
+		}
+		for _, res := range history {
+			output, _, _, _ := trimOutput(res.Output, suggestOutputTokens)
+			fmt.Fprintf(&b, "$ %s\n%s", res.Input, withNewline(output))
+			if res.ExitCode != nil {
+				fmt.Fprintf(&b, "[exit code %d]\n", *res.ExitCode)
+			}
+		}
+	}
+	if notes, err := readNotes(session); err == nil && len(notes) > 0 {
+		b.WriteString("\nNotes:\n" + notesText(notes))
+	}
+	return b.String()
+}
+
+// suggestCommands asks the model for up to n commands reaching the goal.
+func suggestCommands(ctx context.Context, session, goal string, n int) ([]Suggestion, error) {
+	prompt := "Goal: " + goal
+	if session != "" {
+		if recent := suggestContext(session); recent != "" {
+			prompt += "\n\nRecent commands in the session:\n" + recent
+		}
+	}
+	answer, err := chatCompletion(ctx, suggestURL, suggestKey, &chatRequest{
+		Model: suggestModel,
+		Messages: []chatMessage{
+			{Role: "system", Content: fmt.Sprintf(suggestPrompt, n)},
+			{Role: "user", Content: prompt},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", errSuggestFailedMessage, err)
+	}
+
+	// Models like to wrap JSON in a code fence
+	start, end := strings.IndexByte(answer, '{'), strings.LastIndexByte(answer, '}')
+	if start < 0 || end < start {
+		return nil, fmt.Errorf("%s: the answer is not JSON", errSuggestFailedMessage)
+	}
+	var parsed struct {
+		Commands []Suggestion `json:"commands"`
+	}
+	if err := json.Unmarshal([]byte(answer[start:end+1]), &parsed); err != nil {
+		return nil, fmt.Errorf("%s: the answer is not JSON: %v", errSuggestFailedMessage, err)
+	}
+
+	suggestions := []Suggestion{}
+	for _, s := range parsed.Commands {
+		if s.Command = strings.TrimSpace(s.Command); s.Command == "" {
+			continue
+		}
+		if a := classifyCommand(s.Command); a != nil {
+			s.Risk, s.Reasons = a.Risk, a.Reasons
+		}
+		if suggestions = append(suggestions, s); len(suggestions) == n {
+			break
+		}
+	}
+	return suggestions, nil
+}
+
+func suggestHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodGet {
+		writeError(w, errMethodMessage)
+		return
+	}
+
+	// Validate the hash parameter
+	hashParam := r.URL.Query().Get("hash")
+	if !checkHash(r, hashParam) {
+		writeError(w, errHashMessage)
+		return
+	}
+
+	goal := strings.TrimSpace(r.URL.Query().Get("goal"))
+	if goal == "" {
+		writeError(w, errGoalMessage)
+		return
+	}
+
+	session := r.URL.Query().Get("session")
+	if session != "" && !validSessionName(session) {
+		writeError(w, errSessionMessage)
+		return
+	}
+
+	n := defaultSuggestions
+	if s := r.URL.Query().Get("n"); s != "" {
+		v, err := strconv.Atoi(s)
+		if err != nil || v <= 0 || v > maxSuggestions {
+			writeError(w, errCountMessage)
+			return
+		}
+		n = v
+	}
+
+	if suggestURL == "" {
+		writeError(w, errSuggestOffMessage)
+		return
+	}
+
+	suggestions, err := suggestCommands(r.Context(), session, goal, n)
+	if err != nil {
+		logFrom(r.Context()).Warn("failed to suggest commands", "session", session, "err", err)
+		writeError(w, err)
+		return
+	}
+	logFrom(r.Context()).Info("suggested commands", "session", session, "suggestions", len(suggestions))
+
+	resp := &SuggestResults{
+		Type:        "suggestions",
+		Next:        "These commands were not run. Review them, then submit the one you choose to /shell",
+		Session:     session,
+		Goal:        goal,
+		Suggestions: suggestions,
+	}
+	jsonResp, err := json.Marshal(resp)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to marshal JSON response: %v", err)
+		writeJsonError(w, msg)
+		return
+	}
+
+	fmt.Fprint(w, string(jsonResp))
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Outputs estimated above SUMMARIZE_TOKENS are summarized by the
+// OpenAI-compatible chat completions endpoint at SUMMARIZE_URL, keeping the
+// agent's context window small. The result then carries the summary as its
+// output, and the full output is kept as an artifact that full_output
+// links to. Requests opt out with summarize=0.
+
+const (
+	defaultSummarizeTokens = 4000
+	summarizeTimeout       = 2 * time.Minute
+	maxSummarizeInput      = 256 << 10 // bytes of output sent to the model
+	fullOutputArtifact     = "full-output.txt"
+
+	summarizePrompt = "You summarize the output of shell commands for an AI agent operating a remote shell. " +
+		"Keep every error message, file path, version, count and other detail the agent needs to choose its next command, " +
+		"and drop repetition and noise. Answer with the summary only."
+)
+
+var (
+	summarizeURL    string // SUMMARIZE_URL, "" disables summaries
+	summarizeModel  string
+	summarizeKey    string
+	summarizeTokens = defaultSummarizeTokens
+	summarizeClient = &http.Client{Timeout: summarizeTimeout}
+)
+
+func loadSummarizer() error {
+	summarizeURL = strings.TrimSuffix(os.Getenv("SUMMARIZE_URL"), "/")
+	summarizeModel = os.Getenv("SUMMARIZE_MODEL")
+	summarizeKey = os.Getenv("SUMMARIZE_API_KEY")
+	summarizeTokens = defaultSummarizeTokens
+	if summarizeURL == "" {
+		return nil
+	}
+	if !strings.HasPrefix(summarizeURL, "http://") && !strings.HasPrefix(summarizeURL, "https://") {
+		return fmt.Errorf("SUMMARIZE_URL must be an http or https URL: %s", summarizeURL)
+	}
+	if summarizeModel == "" {
+		return fmt.Errorf("SUMMARIZE_MODEL must be set with SUMMARIZE_URL")
+	}
+	if tokenizer == tokenizerOff {
+		return fmt.Errorf("SUMMARIZE_URL needs token estimates, TOKENIZER must not be off")
+	}
+	if s := os.Getenv("SUMMARIZE_TOKENS"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("SUMMARIZE_TOKENS must be a positive number: %q", s)
+		}
+		summarizeTokens = n
+	}
+	return nil
+}
+
+// shouldSummarize reports whether an output of tokens tokens gets a summary.
+func shouldSummarize(opts execOptions, tokens int) bool {
+	return summarizeURL != "" && !opts.NoSummary && tokens > summarizeTokens
+}
+
+type chatMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type chatRequest struct {
+	Model     string        `json:"model"`
+	Messages  []chatMessage `json:"messages"`
+	MaxTokens int           `json:"max_tokens,omitempty"`
+}
+
+type chatResponse struct {
+	Choices []struct {
+		Message chatMessage `json:"message"`
+	} `json:"choices"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// summarizeOutput asks the model for a summary of a command's output.
+func summarizeOutput(ctx context.Context, input, output string, exitCode int) (string, error) {
+	// Very long outputs keep their head and tail, where errors usually are
+	if len(output) > maxSummarizeInput {
+		half := maxSummarizeInput / 2
+		output = output[:half] + "\n[... output truncated ...]\n" + output[len(output)-half:]
+	}
+	return chatCompletion(ctx, summarizeURL, summarizeKey, &chatRequest{
+		Model: summarizeModel,
+		Messages: []chatMessage{
+			{Role: "system", Content: summarizePrompt},
+			{Role: "user", Content: fmt.Sprintf("Command: %s\nExit code: %d\n\nOutput:\n%s", input, exitCode, output)},
+		},
+		MaxTokens: summarizeTokens,
+	})
+}
+
+// chatCompletion posts a chat to the OpenAI-compatible endpoint at url and
+// returns the answer.
+func chatCompletion(ctx context.Context, url, key string, chat *chatRequest) (string, error) {
+	body, err := json.Marshal(chat)
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url+"/chat/completions", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+	resp, err := summarizeClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	cr := &chatResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(cr); err != nil {
+		return "", responseError(resp, fmt.Errorf("failed to decode response: %s: %v", resp.Status, err))
+	}
+	if cr.Error != nil {
+		return "", responseError(resp, fmt.Errorf("%s: %s", resp.Status, cr.Error.Message))
+	}
+	if resp.StatusCode != http.StatusOK || len(cr.Choices) == 0 || strings.TrimSpace(cr.Choices[0].Message.Content) == "" {
+		return "", responseError(resp, fmt.Errorf("no answer in response: %s", resp.Status))
+	}
+	return strings.TrimSpace(cr.Choices[0].Message.Content), nil
+}
+
+// responseError is err about the model's response, of kind errRateLimited
+// when the model answered 429.
+func responseError(resp *http.Response, err error) error {
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return rateLimited(err)
+	}
+	return err
+}
+
+// summarizeResult replaces an oversized output with its summary, saving the
+// full output as an artifact first. The result is left as is when the
+// summary fails.
+func summarizeResult(ctx context.Context, sessionFolder string, cer *CmdResults) {
+	log := logFrom(ctx).With("session", cer.Session, "ticket", cer.Ticket)
+	exitCode := 0
+	if cer.ExitCode != nil {
+		exitCode = *cer.ExitCode
+	}
+
+	summary, err := summarizeOutput(ctx, cer.Input, cer.Output, exitCode)
+	if err != nil {
+		log.Warn("failed to summarize output", "tokens", cer.Tokens, "err", err)
+		return
+	}
+
+	name := fullOutputArtifact
+	for i := 1; hasArtifact(cer.Artifacts, name); i++ {
+		name = fmt.Sprintf("%d-%s", i, fullOutputArtifact)
+	}
+	dir := ticketArtifactsDir(sessionFolder, cer.Ticket)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Warn("failed to save full output", "err", err)
+		return
+	}
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(cer.Output), 0644); err != nil {
+		log.Warn("failed to save full output", "err", err)
+		return
+	}
+
+	full := Artifact{Name: name, Size: int64(len(cer.Output)), URL: ArtifactURL(ctx, cer.Session, cer.Ticket, name)}
+	log.Info("summarized output", "tokens", cer.Tokens, "summary_tokens", estimateTokens(summary))
+	cer.Artifacts = append(cer.Artifacts, full)
+	cer.Next = "This is a summary of your result, the complete output is at full_output. Review the Input & Output. You can now issue your next command to /shell"
+	cer.Output = summary
+	cer.Tokens = estimateTokens(summary)
+	cer.Summarized = true
+	cer.FullOutput = full.URL
+}
+
+func hasArtifact(artifacts []Artifact, name string) bool {
+	for _, a := range artifacts {
+		if a.Name == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Every tmux shell has a supervisor goroutine checking on it. When the shell
+// dies, crashed or killed by the OOM killer, the supervisor kills what it
+// left running, ends its tmux session, records a shell_died ticket in the
+// session and forgets the shell, so the next command starts a fresh one.
+//
+// The server itself reaps orphans when it runs as pid 1, as it does in the
+// container image, where background processes outliving their command would
+// otherwise stay zombies.
+
+const (
+	shellCheckInterval = time.Second
+	reapInterval       = 5 * time.Second
+)
+
+var (
+	shellsMu sync.Mutex
+	shells   = map[string]bool{} // sessions whose tmux shell is supervised
+)
+
+// superviseShell starts the session's supervisor unless it already runs.
+func superviseShell(session string) {
+	shellsMu.Lock()
+	defer shellsMu.Unlock()
+	if shells[session] {
+		return
+	}
+	shells[session] = true
+	go runSupervisor(session)
+}
+
+// shellSupervised reports whether the session's shell has a supervisor.
+func shellSupervised(session string) bool {
+	shellsMu.Lock()
+	defer shellsMu.Unlock()
+	return shells[session]
+}
+
+// forgetShell drops the session's shell, a new command starts another.
+func forgetShell(session string) {
+	shellsMu.Lock()
+	delete(shells, session)
+	shellsMu.Unlock()
+}
+
+func runSupervisor(session string) {
+	defer forgetShell(session)
+	name := tmuxName(session)
+	ticker := time.NewTicker(shellCheckInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		// An error is a tmux session killed on purpose, with the session
+		// or from outside
+		out, err := tmux("display-message", "-p", "-t", "="+name+":", "#{pane_dead}:#{pane_dead_status}:#{pane_dead_signal}:#{pane_pid}")
+		if err != nil {
+			return
+		}
+		fields := strings.Split(out, ":")
+		if len(fields) != 4 || fields[0] != "1" {
+			continue
+		}
+
+		reason, code := shellDeathReason(fields[1], fields[2])
+		logger.Warn("session shell died", "session", session, "reason", reason)
+		if pid, _ := strconv.Atoi(fields[3]); pid > 0 {
+			killShellOrphans(pid)
+		}
+		if _, err := tmux("kill-session", "-t", "="+name); err != nil {
+			logger.Warn("failed to kill tmux session", "session", session, "err", err)
+		}
+		if sessionExists(session) {
+			recordShellDeath(session, reason, code)
+		}
+		return
+	}
+}
+
+// shellDeathReason explains a dead pane's status and signal, which tmux
+// leaves empty when they don't apply, and the exit code to record.
+func shellDeathReason(exitStatus, exitSignal string) (string, int) {
+	status, _ := strconv.Atoi(exitStatus)
+	signal, _ := strconv.Atoi(exitSignal)
+	switch {
+	case signal == int(syscall.SIGKILL):
+		return "The session's shell was killed by SIGKILL, possibly by the kernel's out of memory killer", 128 + signal
+	case signal > 0:
+		return fmt.Sprintf("The session's shell died of signal %d (%s)", signal, syscall.Signal(signal)), 128 + signal
+	}
+	return fmt.Sprintf("The session's shell exited with status %d", status), status
+}
+
+// killShellOrphans kills the processes the dead shell left in its session.
+func killShellOrphans(sid int) {
+	for _, p := range processTable() {
+		if p.Sid == sid && p.Pid != sid {
+			syscall.Kill(p.Pid, syscall.SIGKILL)
+		}
+	}
+}
+
+// recordShellDeath writes a shell_died ticket telling the agent its shell
+// state is gone.
+func recordShellDeath(session, reason string, code int) {
+	sessionFolder := filepath.Join(sessionsDir, session)
+	ticket, err := getNextTicket(sessionFolder)
+	if err != nil {
+		logger.Error("failed to record shell death", "session", session, "err", err)
+		return
+	}
+	cer := &CmdResults{
+		Type:     "shell_died",
+		Next:     "The session's shell died and its state, such as the working directory and exported variables, is lost. Your next command to /shell starts a new shell",
+		Ticket:   ticket,
+		Session:  session,
+		Output:   reason + "\n",
+		ExitCode: &code,
+	}
+	jsonResp, err := json.Marshal(cer)
+	if err != nil {
+		logger.Error("failed to marshal JSON response", "err", err)
+		return
+	}
+	if err := writeTicket(sessionFolder, ticket, jsonResp); err != nil {
+		logger.Error("failed to record shell death", "session", session, "err", err)
+		return
+	}
+	emitEvent(eventShellDied, cer)
+	publishActivity(eventShellDied, session, ticket, cer)
+}
+
+// superviseTmuxShells supervises the shells a previous server process left.
+func superviseTmuxShells() {
+	out, err := tmux("list-sessions", "-F", "#{"+tmuxSessionOption+"}")
+	if err != nil {
+		return
+	}
+	for _, session := range strings.Split(out, "\n") {
+		if session != "" {
+			superviseShell(session)
+		}
+	}
+}
+
+// reapOrphans waits for the zombies reparented to the server when it is pid
+// 1. A zombie is only reaped once seen twice, so the command it belongs to
+// has had every chance to be waited for by its own goroutine.
+func reapOrphans() {
+	if os.Getpid() != 1 {
+		return
+	}
+	go func() {
+		seen := map[int]bool{}
+		for range time.Tick(reapInterval) {
+			zombies := map[int]bool{}
+			for _, p := range processTable() {
+				if p.PPid != 1 || p.State != "Z" {
+					continue
+				}
+				if seen[p.Pid] {
+					var status syscall.WaitStatus
+					syscall.Wait4(p.Pid, &status, syscall.WNOHANG, nil)
+					continue
+				}
+				zombies[p.Pid] = true
+			}
+			seen = zombies
+		}
+	}()
+}
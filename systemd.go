@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Socket activation and sd_notify, implemented on the environment variables
+// systemd documents in sd_listen_fds(3) and sd_notify(3).
+
+const listenFdsStart = 3
+
+// systemdListeners returns the sockets systemd passed to this process, or
+// none when it was not socket activated.
+func systemdListeners() ([]net.Listener, error) {
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	// Children, such as the shells, must not inherit them
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	listeners := make([]net.Listener, 0, n)
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("LISTEN_FD_%d", listenFdsStart+i)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(listenFdsStart+i), name)
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("socket %s from systemd is not a listener: %v", name, err)
+		}
+		listeners = append(listeners, ln)
+	}
+	return listeners, nil
+}
+
+// socketActivated reports whether systemd passes listening sockets, before
+// they are taken over by systemdListeners.
+func socketActivated() bool {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	return err == nil && pid == os.Getpid() && os.Getenv("LISTEN_FDS") != ""
+}
+
+var sdNotifyMu sync.Mutex
+
+// sdNotify sends a state such as "READY=1" to systemd when it supervises
+// the process with Type=notify, and does nothing otherwise.
+func sdNotify(state string) {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return
+	}
+	if strings.HasPrefix(addr, "@") {
+		addr = "\x00" + addr[1:] // abstract namespace
+	}
+
+	sdNotifyMu.Lock()
+	defer sdNotifyMu.Unlock()
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		logger.Warn("failed to reach systemd notify socket", "err", err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		logger.Warn("failed to notify systemd", "state", state, "err", err)
+	}
+}
+
+// watchdogInterval returns how often to ping systemd's watchdog, half of
+// WatchdogSec, or zero when the watchdog is off.
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid, err := strconv.Atoi(os.Getenv("WATCHDOG_PID")); err == nil && pid != os.Getpid() {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// runWatchdog pings systemd while the server is healthy. When a wedged
+// command holds the bookkeeping locks the pings stop and systemd restarts
+// the service.
+func runWatchdog() {
+	interval := watchdogInterval()
+	if interval == 0 {
+		return
+	}
+	logger.Info("systemd watchdog enabled", "interval", interval)
+	go func() {
+		for range time.Tick(interval) {
+			if serverHealthy(interval) {
+				sdNotify("WATCHDOG=1")
+			} else {
+				logger.Error("health check timed out, withholding the watchdog ping")
+			}
+		}
+	}()
+}
+
+// serverHealthy checks that the shared command state can be locked within
+// timeout.
+func serverHealthy(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		for i := range running {
+			running[i].mu.Lock()
+			running[i].mu.Unlock()
+		}
+		watchMu.Lock()
+		watchMu.Unlock()
+		approvalsMu.Lock()
+		approvalsMu.Unlock()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+// /tail streams what is appended to a file, like tail -f, as Server-Sent
+// Events, so a log a running command writes can be watched without spending
+// tickets on cat. A relative path is resolved against the directory the
+// session's next command starts in. The file is polled; when it shrinks it
+// is read again from the start, and when it is replaced, as log rotation
+// does, the new file is followed. Each event's id is the offset after its
+// data, so a client that reconnects with Last-Event-ID resumes where it
+// stopped.
+
+const (
+	tailPoll         = 250 * time.Millisecond
+	tailDefaultLines = 10
+	tailMaxLines     = 10000
+	tailMaxBacklog   = 1 << 20 // bytes read back for the last lines
+	tailMaxChunk     = 64 << 10
+)
+
+var (
+	errPathMessage   = paramError("path", "Invalid or missing 'path' parameter")
+	errLinesMessage  = paramError("lines", "Invalid 'lines' parameter")
+	errPathDirectory = paramError("path", "The 'path' parameter names a directory")
+)
+
+// TailEvent is one event of /tail: data appended to the file, or the file
+// truncated, rotated or, without follow, read to its end.
+type TailEvent struct {
+	Type    string `json:"type"`
+	Session string `json:"session"`
+	Path    string `json:"path"`
+	Offset  int64  `json:"offset"` // where data starts in the file
+	Data    string `json:"data,omitempty"`
+}
+
+const (
+	tailEventData      = "data"
+	tailEventTruncated = "truncated"
+	tailEventRotated   = "rotated"
+	tailEventEOF       = "eof"
+)
+
+// tailStart returns the offset of the file's last n lines, reading back no
+// more than tailMaxBacklog.
+func tailStart(f *os.File, size int64, n int) int64 {
+	if n == 0 || size == 0 {
+		return size
+	}
+	from := max(size-tailMaxBacklog, 0)
+	buf := make([]byte, size-from)
+	if _, err := f.ReadAt(buf, from); err != nil && err != io.EOF {
+		return size
+	}
+	// A final newline ends the last line rather than starting another
+	end := len(buf)
+	if buf[end-1] == '\n' {
+		end--
+	}
+	for i := 0; i < n; i++ {
+		nl := bytes.LastIndexByte(buf[:end], '\n')
+		if nl < 0 {
+			return from
+		}
+		end = nl
+	}
+	return from + int64(end) + 1
+}
+
+// runeSafe trims an incomplete UTF-8 sequence off the end of a full chunk,
+// so it is sent whole with the next one.
+func runeSafe(b []byte) []byte {
+	for i := 1; i < utf8.UTFMax && i <= len(b); i++ {
+		if utf8.RuneStart(b[len(b)-i]) {
+			if !utf8.FullRune(b[len(b)-i:]) {
+				return b[:len(b)-i]
+			}
+			break
+		}
+	}
+	return b
+}
+
+// tailer follows one file.
+type tailer struct {
+	path string
+	file *os.File
+	info os.FileInfo
+	pos  int64
+}
+
+// open (re)opens the file, false when it doesn't exist yet.
+func (t *tailer) open() (bool, error) {
+	f, err := os.Open(t.path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return false, err
+	}
+	if info.IsDir() {
+		f.Close()
+		return false, errPathDirectory
+	}
+	if t.file != nil {
+		t.file.Close()
+	}
+	t.file, t.info = f, info
+	return true, nil
+}
+
+func (t *tailer) close() {
+	if t.file != nil {
+		t.file.Close()
+	}
+}
+
+// read returns what was appended since the last read, at most tailMaxChunk.
+func (t *tailer) read() ([]byte, error) {
+	info, err := t.file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() <= t.pos {
+		return nil, nil
+	}
+	buf := make([]byte, min(info.Size()-t.pos, tailMaxChunk))
+	n, err := t.file.ReadAt(buf, t.pos)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	buf = buf[:n]
+	if n == tailMaxChunk {
+		buf = runeSafe(buf)
+	}
+	return buf, nil
+}
+
+// changed reports whether the path now names another file, or this one
+// shrank below what was read.
+func (t *tailer) changed() (rotated, truncated bool) {
+	if info, err := os.Stat(t.path); err == nil && !os.SameFile(info, t.info) {
+		return true, false
+	}
+	if info, err := t.file.Stat(); err == nil && info.Size() < t.pos {
+		return false, true
+	}
+	return false, false
+}
+
+func tailHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, errMethodMessage)
+		return
+	}
+
+	// Validate the hash parameter
+	hashParam := r.URL.Query().Get("hash")
+	if !checkHash(r, hashParam) {
+		writeError(w, errHashMessage)
+		return
+	}
+
+	session := r.URL.Query().Get("session")
+	if !validSessionName(session) {
+		writeError(w, errSessionMessage)
+		return
+	}
+	if !sessionExists(session) {
+		writeError(w, errSessionNotFound)
+		return
+	}
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		writeError(w, errPathMessage)
+		return
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(shellCwd(session), path)
+	}
+	lines := tailDefaultLines
+	if v := r.URL.Query().Get("lines"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > tailMaxLines {
+			writeError(w, errLinesMessage)
+			return
+		}
+		lines = n
+	}
+	follow := r.URL.Query().Get("follow") == "1"
+	text := r.URL.Query().Get("format") == formatText
+
+	t := &tailer{path: path}
+	defer t.close()
+	found, err := t.open()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if !found && !follow {
+		writeError(w, notFoundf("File %s does not exist", path))
+		return
+	}
+	if found {
+		t.pos = tailStart(t.file, t.info.Size(), lines)
+		// A reconnecting EventSource resumes after the last event it saw
+		if id, err := strconv.ParseInt(r.Header.Get("Last-Event-ID"), 10, 64); err == nil && id >= 0 && id <= t.info.Size() {
+			t.pos = id
+		}
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJsonError(w, "Streaming unsupported")
+		return
+	}
+
+	// The stream outlives the server's write timeout
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	if text {
+		setFormatContentType(w, formatText)
+	} else {
+		w.Header().Set("Content-Type", "text/event-stream")
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	send := func(typ string, offset int64, data []byte) {
+		if text {
+			w.Write(data)
+			flusher.Flush()
+			return
+		}
+		ev, err := json.Marshal(&TailEvent{Type: typ, Session: session, Path: path, Offset: offset, Data: string(data)})
+		if err != nil {
+			logger.Error("failed to marshal tail event", "err", err)
+			return
+		}
+		fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", offset+int64(len(data)), typ, ev)
+		flusher.Flush()
+	}
+
+	poll := time.NewTicker(tailPoll)
+	defer poll.Stop()
+	keepalive := time.NewTicker(30 * time.Second)
+	defer keepalive.Stop()
+
+	for {
+		if t.file == nil {
+			if _, err = t.open(); err != nil {
+				logFrom(r.Context()).Warn("failed to open tailed file", "path", path, "err", err)
+				return
+			}
+		} else if rotated, truncated := t.changed(); rotated || truncated {
+			typ := tailEventTruncated
+			if rotated {
+				typ = tailEventRotated
+				if _, err = t.open(); err != nil {
+					logFrom(r.Context()).Warn("failed to reopen tailed file", "path", path, "err", err)
+					return
+				}
+			}
+			t.pos = 0
+			send(typ, 0, nil)
+		}
+
+		// Drain what is there before waiting
+		for t.file != nil {
+			data, err := t.read()
+			if err != nil {
+				logFrom(r.Context()).Warn("failed to read tailed file", "path", path, "err", err)
+				return
+			}
+			if len(data) == 0 {
+				break
+			}
+			send(tailEventData, t.pos, data)
+			t.pos += int64(len(data))
+		}
+		if !follow {
+			send(tailEventEOF, t.pos, nil)
+			return
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			if !text {
+				fmt.Fprint(w, ": ping\n\n")
+				flusher.Flush()
+			}
+		case <-poll.C:
+		}
+	}
+}
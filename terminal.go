@@ -0,0 +1,170 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// terminalInput is a command typed into an interactive browser terminal.
+type terminalInput struct {
+	Cmd string `json:"cmd"`
+}
+
+// terminalRole authenticates a terminal request. The ADMIN_HASH gets an
+// interactive terminal and the HASH a read-only one; without an ADMIN_HASH
+// the HASH is the admin.
+func terminalRole(r *http.Request) (interactive, ok bool) {
+	hash := []byte(r.URL.Query().Get("hash"))
+	admin := adminHash.Load()
+	if admin != "" && subtle.ConstantTimeCompare(hash, []byte(admin)) == 1 {
+		auditKey(r, auditKeyAdmin)
+		return true, true
+	}
+	if trustedListener(r) {
+		auditKey(r, auditKeyListener)
+		return admin == "", true
+	}
+	if subtle.ConstantTimeCompare(hash, []byte(hashPassword.Load())) == 1 {
+		auditKey(r, auditKeyHash)
+		return admin == "", true
+	}
+	authFailed(r)
+	return false, false
+}
+
+func terminalSession(r *http.Request) (string, bool) {
+	session := r.URL.Query().Get("session")
+	return session, validSessionName(session)
+}
+
+// terminalHandler renders the xterm.js page for a session.
+func terminalHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, errMethodMessage)
+		return
+	}
+	interactive, ok := terminalRole(r)
+	if !ok {
+		writeError(w, errHashMessage)
+		return
+	}
+	session, ok := terminalSession(r)
+	if !ok {
+		writeError(w, errSessionMessage)
+		return
+	}
+
+	renderDashboard(w, r, "terminal", "Terminal "+session, map[string]interface{}{
+		"Session":     session,
+		"Interactive": interactive,
+	})
+}
+
+// terminalWSHandler streams a session's activity to the browser as terminal
+// text and, for interactive terminals, runs the lines typed into it.
+func terminalWSHandler(w http.ResponseWriter, r *http.Request) {
+	interactive, ok := terminalRole(r)
+	if !ok {
+		writeError(w, errHashMessage)
+		return
+	}
+	session, ok := terminalSession(r)
+	if !ok {
+		writeError(w, errSessionMessage)
+		return
+	}
+
+	ws, err := upgradeWebSocket(w, r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	defer ws.Close()
+
+	log := logFrom(r.Context()).With("session", session, "interactive", interactive)
+	log.Info("terminal attached")
+	defer log.Info("terminal detached")
+
+	ch := subscribeActivity()
+	defer unsubscribeActivity(ch)
+
+	mode := "read-only"
+	if interactive {
+		mode = "interactive"
+	}
+	ws.WriteText(fmt.Sprintf("\x1b[2mAttached to session %s (%s)\x1b[0m\r\n", session, mode))
+
+	// Reader: typed lines become commands, anything else is ignored
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			msg, err := ws.ReadMessage()
+			if err != nil {
+				return
+			}
+			if !interactive {
+				continue
+			}
+			var in terminalInput
+			if json.Unmarshal(msg, &in) != nil || strings.TrimSpace(in.Cmd) == "" {
+				continue
+			}
+			// Typed by a person at the dashboard, so already confirmed
+			opts := execOptions{Timeout: defaultCmdTimeout, Confirmed: true}
+			if _, err := submitCommand(r.Context(), session, in.Cmd, opts); err != nil {
+				ws.WriteText(fmt.Sprintf("\x1b[31m%s\x1b[0m\r\n", err))
+			}
+		}
+	}()
+
+	keepalive := time.NewTicker(30 * time.Second)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-keepalive.C:
+			if err := ws.writeFrame(wsOpPing, nil); err != nil {
+				return
+			}
+		case a := <-ch:
+			if a.Session != session {
+				continue
+			}
+			if text := terminalText(a); text != "" {
+				if err := ws.WriteText(text); err != nil {
+					return
+				}
+			}
+		}
+	}
+}
+
+// terminalText renders an activity event as terminal output.
+func terminalText(a *Activity) string {
+	switch a.Event {
+	case eventCommandStarted:
+		if m, ok := a.Data.(map[string]string); ok {
+			return fmt.Sprintf("\x1b[1;32m%s #%d $\x1b[0m %s\r\n", a.Session, a.Ticket, crlf(m["input"]))
+		}
+	case eventCommandOutput:
+		if m, ok := a.Data.(map[string]string); ok {
+			return crlf(m["chunk"])
+		}
+	case eventCommandFinished:
+		if cer, ok := a.Data.(*CmdResults); ok && cer.ExitCode != nil && *cer.ExitCode != 0 {
+			return fmt.Sprintf("\x1b[31m[exit %d]\x1b[0m\r\n", *cer.ExitCode)
+		}
+	}
+	return ""
+}
+
+func crlf(s string) string {
+	return strings.ReplaceAll(s, "\n", "\r\n")
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestTerminalSession(t *testing.T) {
+	tests := []struct {
+		session string
+		ok      bool
+	}{
+		{"demo", true},
+		{"my session", true},
+		{"", false},
+		{".", false},
+		{"..", false},
+		{"../demo", false},
+		{"a/b", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.session, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/terminal?session="+url.QueryEscape(tt.session), nil)
+			if _, ok := terminalSession(r); ok != tt.ok {
+				t.Fatalf("terminalSession(%q) ok = %v, want %v", tt.session, ok, tt.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Each session's tickets are indexed in memory the first time the session is
+// read, so /history and /status don't list the session folder on every
+// request, and polling a running ticket doesn't open it. The server updates
+// the index as it writes tickets. Anything else changing the folder, an
+// import or a file removed by hand, changes its modification time and the
+// index is listed again, keeping what it learnt of unchanged tickets. With
+// SHARED_STORAGE other instances write tickets too, so the folder is listed
+// for every request.
+
+// TicketMeta is what the index knows of a ticket.
+type TicketMeta struct {
+	Ticket   int
+	Size     int64 // 0 while the command runs
+	Modified time.Time
+	ExitCode *int // known once the ticket has been read
+}
+
+type ticketIndex struct {
+	mu      sync.Mutex
+	dirMod  time.Time
+	tickets map[int]*TicketMeta // nil until listed
+}
+
+var ticketIndexes sync.Map // session folder -> *ticketIndex
+
+// sessionTicketIndex returns the folder's index, listing the folder when it
+// changed since.
+func sessionTicketIndex(sessionFolder string) (*ticketIndex, error) {
+	info, err := os.Stat(sessionFolder)
+	if err != nil {
+		ticketIndexes.Delete(sessionFolder)
+		return nil, err
+	}
+	var idx *ticketIndex
+	if sharedStorage {
+		idx = &ticketIndex{}
+	} else if v, ok := ticketIndexes.Load(sessionFolder); ok {
+		idx = v.(*ticketIndex)
+	} else {
+		v, _ := ticketIndexes.LoadOrStore(sessionFolder, &ticketIndex{})
+		idx = v.(*ticketIndex)
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if idx.tickets != nil && idx.dirMod.Equal(info.ModTime()) {
+		return idx, nil
+	}
+	entries, err := os.ReadDir(sessionFolder)
+	if err != nil {
+		return nil, err
+	}
+	tickets := make(map[int]*TicketMeta, len(entries))
+	for _, e := range entries {
+		num, ok := strings.CutSuffix(e.Name(), ".ticket")
+		ticket, err := strconv.Atoi(num)
+		if !ok || err != nil || e.IsDir() {
+			continue
+		}
+		fi, err := e.Info()
+		if err != nil {
+			continue
+		}
+		meta := &TicketMeta{Ticket: ticket, Size: fi.Size(), Modified: fi.ModTime()}
+		if old := idx.tickets[ticket]; old != nil && old.Size == meta.Size && old.Modified.Equal(meta.Modified) {
+			meta.ExitCode = old.ExitCode
+		}
+		tickets[ticket] = meta
+	}
+	idx.tickets, idx.dirMod = tickets, info.ModTime()
+	return idx, nil
+}
+
+// list returns the tickets ordered by number.
+func (idx *ticketIndex) list() []TicketMeta {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	metas := make([]TicketMeta, 0, len(idx.tickets))
+	for _, meta := range idx.tickets {
+		metas = append(metas, *meta)
+	}
+	sort.Slice(metas, func(i, j int) bool { return metas[i].Ticket < metas[j].Ticket })
+	return metas
+}
+
+// get returns the ticket, false when the index doesn't know it.
+func (idx *ticketIndex) get(ticket int) (TicketMeta, bool) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	meta, ok := idx.tickets[ticket]
+	if !ok {
+		return TicketMeta{}, false
+	}
+	return *meta, true
+}
+
+// learnExitCode records the exit code read from the ticket as it was at
+// modified.
+func (idx *ticketIndex) learnExitCode(ticket int, modified time.Time, exitCode *int) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if meta := idx.tickets[ticket]; meta != nil && meta.Modified.Equal(modified) {
+		meta.ExitCode = exitCode
+	}
+}
+
+// indexTicket updates the folder's index, if it has one, after the server
+// created or wrote the ticket.
+func indexTicket(sessionFolder string, ticket int, data []byte) {
+	v, ok := ticketIndexes.Load(sessionFolder)
+	if !ok {
+		return
+	}
+	idx := v.(*ticketIndex)
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if idx.tickets == nil {
+		return
+	}
+	fi, err := os.Stat(filepath.Join(sessionFolder, fmt.Sprintf("%02d.ticket", ticket)))
+	if err != nil {
+		delete(idx.tickets, ticket)
+		return
+	}
+	meta := &TicketMeta{Ticket: ticket, Size: fi.Size(), Modified: fi.ModTime()}
+	var res struct {
+		ExitCode *int `json:"exit_code"`
+	}
+	if len(data) > 0 && json.Unmarshal(data, &res) == nil {
+		meta.ExitCode = res.ExitCode
+	}
+	idx.tickets[ticket] = meta
+}
+
+// forgetTicketIndex drops the index of a folder that was removed or moved.
+func forgetTicketIndex(sessionFolder string) {
+	ticketIndexes.Delete(sessionFolder)
+}
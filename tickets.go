@@ -0,0 +1,327 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// /tickets/prune deletes a session's tickets, with their artifacts and
+// embeddings, by number range, age and size, so storage can be managed
+// without a shell on the host. With archive=1 they are moved into a
+// compressed tarball in SESSIONS_DIR/<session>/archives instead, laid out
+// like the session folder so extracting it there restores them. Running
+// tickets are never touched. Numbers aren't reused: the highest pruned
+// ticket is remembered in ticket.seq, which new tickets count up from.
+
+const (
+	ticketSeqFile = "ticket.seq"
+	archivesDir   = "archives"
+	pruneDelete   = "delete"
+	pruneArchive  = "archive"
+)
+
+var (
+	errFromMessage = paramError("from", "Invalid 'from' or 'to' parameter")
+	errBefore      = paramError("before", "Invalid 'before' parameter, use an RFC 3339 time or a duration such as 720h")
+	errLarger      = paramError("larger", "Invalid 'larger' parameter")
+	errPruneFilter = paramError("from", "Pass at least one of 'from', 'to', 'before' or 'larger'")
+)
+
+// TicketPrune summarizes what /tickets/prune removed, or would remove.
+type TicketPrune struct {
+	Type      string `json:"type"`
+	Session   string `json:"session"`
+	Action    string `json:"action"`
+	DryRun    bool   `json:"dry_run,omitempty"`
+	Tickets   []int  `json:"tickets"`
+	Count     int    `json:"count"`
+	Bytes     int64  `json:"bytes"`             // taken by the tickets, artifacts and embeddings
+	Running   []int  `json:"running,omitempty"` // matched but still running, kept
+	Archive   string `json:"archive,omitempty"` // relative to the session folder
+	Remaining int    `json:"remaining"`
+}
+
+// pruneFilter selects tickets; zero fields don't filter.
+type pruneFilter struct {
+	From, To int
+	Before   time.Time
+	Larger   int64
+}
+
+// readTicketSeq returns the session's highest ticket number when it was last
+// pruned.
+func readTicketSeq(sessionFolder string) int {
+	data, err := os.ReadFile(filepath.Join(sessionFolder, ticketSeqFile))
+	if err != nil {
+		return 0
+	}
+	n, _ := strconv.Atoi(strings.TrimSpace(string(data)))
+	return n
+}
+
+// ticketPaths returns the files and folders that belong to the ticket,
+// relative to the session folder, and the bytes they take.
+func ticketPaths(sessionFolder string, ticket int) ([]string, int64) {
+	candidates := []string{
+		fmt.Sprintf("%02d.ticket", ticket),
+		filepath.Join(artifactsDir, fmt.Sprintf("%02d", ticket)),
+		filepath.Join(embeddingsDir, fmt.Sprintf("%d.json", ticket)),
+	}
+	var paths []string
+	var size int64
+	for _, rel := range candidates {
+		found := false
+		filepath.WalkDir(filepath.Join(sessionFolder, rel), func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return nil
+			}
+			found = true
+			if info, err := d.Info(); err == nil && info.Mode().IsRegular() {
+				size += info.Size()
+			}
+			return nil
+		})
+		if found {
+			paths = append(paths, rel)
+		}
+	}
+	return paths, size
+}
+
+// archiveTickets writes the paths into a new tarball in the session's
+// archives folder, returning its path relative to the session folder.
+func archiveTickets(sessionFolder string, first, last int, paths []string) (string, error) {
+	if err := os.MkdirAll(filepath.Join(sessionFolder, archivesDir), 0755); err != nil {
+		return "", err
+	}
+	rel := filepath.Join(archivesDir, fmt.Sprintf("tickets-%02d-%02d-%d.tar.gz", first, last, time.Now().Unix()))
+	f, err := os.OpenFile(filepath.Join(sessionFolder, rel), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return "", err
+	}
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	for _, p := range paths {
+		err = filepath.WalkDir(filepath.Join(sessionFolder, p), func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			info, err := d.Info()
+			if err != nil || !(info.Mode().IsRegular() || info.IsDir()) {
+				return err
+			}
+			name, err := filepath.Rel(sessionFolder, path)
+			if err != nil {
+				return err
+			}
+			hdr, err := tar.FileInfoHeader(info, "")
+			if err != nil {
+				return err
+			}
+			hdr.Name = filepath.ToSlash(name)
+			if err := tw.WriteHeader(hdr); err != nil || info.IsDir() {
+				return err
+			}
+			src, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer src.Close()
+			_, err = io.Copy(tw, src)
+			return err
+		})
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = tw.Close()
+	}
+	if err == nil {
+		err = gz.Close()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(filepath.Join(sessionFolder, rel))
+		return "", err
+	}
+	return rel, nil
+}
+
+// pruneTickets removes, or archives, the session's finished tickets the
+// filter selects.
+func pruneTickets(session string, filter pruneFilter, action string, dryRun bool) (*TicketPrune, error) {
+	sessionFolder := filepath.Join(sessionsDir, session)
+	idx, err := sessionTicketIndex(sessionFolder)
+	if err != nil {
+		return nil, notFoundf("Session %s does not exist", session)
+	}
+	running := map[int]bool{}
+	for _, rc := range runningForSession(session) {
+		running[rc.Ticket] = true
+	}
+
+	tp := &TicketPrune{Type: "ticket_prune", Session: session, Action: action, DryRun: dryRun, Tickets: []int{}}
+	metas := idx.list()
+	highest := 0
+	var paths []string
+	for _, meta := range metas {
+		highest = max(highest, meta.Ticket)
+		if (filter.From > 0 && meta.Ticket < filter.From) || (filter.To > 0 && meta.Ticket > filter.To) ||
+			(!filter.Before.IsZero() && !meta.Modified.Before(filter.Before)) {
+			continue
+		}
+		ticketFiles, size := ticketPaths(sessionFolder, meta.Ticket)
+		if filter.Larger > 0 && size <= filter.Larger {
+			continue
+		}
+		if meta.Size == 0 || running[meta.Ticket] {
+			tp.Running = append(tp.Running, meta.Ticket)
+			continue
+		}
+		tp.Tickets = append(tp.Tickets, meta.Ticket)
+		tp.Bytes += size
+		paths = append(paths, ticketFiles...)
+	}
+	tp.Count = len(tp.Tickets)
+	tp.Remaining = len(metas) - tp.Count
+	if dryRun || tp.Count == 0 {
+		return tp, nil
+	}
+
+	if action == pruneArchive {
+		if tp.Archive, err = archiveTickets(sessionFolder, tp.Tickets[0], tp.Tickets[tp.Count-1], paths); err != nil {
+			return nil, fmt.Errorf("Failed to archive tickets: %v", err)
+		}
+	}
+	// New tickets count up from the highest one, pruned or not
+	if highest > readTicketSeq(sessionFolder) {
+		if err := os.WriteFile(filepath.Join(sessionFolder, ticketSeqFile), []byte(strconv.Itoa(highest)+"\n"), 0644); err != nil {
+			return nil, fmt.Errorf("Failed to save the ticket sequence: %v", err)
+		}
+	}
+	for _, p := range paths {
+		if err := os.RemoveAll(filepath.Join(sessionFolder, p)); err != nil {
+			return nil, fmt.Errorf("Failed to delete tickets: %v", err)
+		}
+	}
+	forgetTicketIndex(sessionFolder)
+	forgetCachedRuns(session)
+	return tp, nil
+}
+
+// pruneText summarizes the prune in a line.
+func pruneText(tp *TicketPrune) string {
+	verb := map[string]string{pruneDelete: "Deleted", pruneArchive: "Archived"}[tp.Action]
+	if tp.DryRun {
+		verb = "Would " + tp.Action
+	}
+	text := fmt.Sprintf("%s %d ticket(s) of %s, %d bytes", verb, tp.Count, tp.Session, tp.Bytes)
+	if tp.Archive != "" {
+		text += " into " + tp.Archive
+	}
+	if len(tp.Running) > 0 {
+		text += fmt.Sprintf(", kept %d running", len(tp.Running))
+	}
+	return text + fmt.Sprintf(", %d remaining\n", tp.Remaining)
+}
+
+// parsePruneFilter reads from, to, before and larger.
+func parsePruneFilter(r *http.Request) (pruneFilter, error) {
+	q := r.URL.Query()
+	var f pruneFilter
+	var err error
+	for _, p := range []struct {
+		name string
+		dst  *int
+	}{{"from", &f.From}, {"to", &f.To}} {
+		if v := q.Get(p.name); v != "" {
+			if *p.dst, err = strconv.Atoi(v); err != nil || *p.dst < 1 {
+				return f, errFromMessage
+			}
+		}
+	}
+	if f.To > 0 && f.From > f.To {
+		return f, errFromMessage
+	}
+	if v := q.Get("before"); v != "" {
+		if t, err := time.Parse(time.RFC3339, v); err == nil {
+			f.Before = t
+		} else if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			f.Before = time.Now().Add(-d)
+		} else {
+			return f, errBefore
+		}
+	}
+	if v := q.Get("larger"); v != "" {
+		if f.Larger, err = strconv.ParseInt(v, 10, 64); err != nil || f.Larger < 0 {
+			return f, errLarger
+		}
+	}
+	if f.From == 0 && f.To == 0 && f.Before.IsZero() && f.Larger == 0 {
+		return f, errPruneFilter
+	}
+	return f, nil
+}
+
+func ticketsPruneHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodPost {
+		writeError(w, errMethodMessage)
+		return
+	}
+
+	format, err := responseFormat(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// Validate the hash parameter
+	hashParam := r.URL.Query().Get("hash")
+	if !checkHash(r, hashParam) {
+		writeError(w, errHashMessage)
+		return
+	}
+
+	session := r.URL.Query().Get("session")
+	if !validSessionName(session) {
+		writeError(w, errSessionMessage)
+		return
+	}
+	if !sessionExists(session) {
+		writeError(w, errSessionNotFound)
+		return
+	}
+	filter, err := parsePruneFilter(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	action := pruneDelete
+	if r.URL.Query().Get("archive") == "1" {
+		action = pruneArchive
+	}
+	dryRun := r.URL.Query().Get("dryrun") == "1"
+
+	tp, err := pruneTickets(session, filter, action, dryRun)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if !dryRun {
+		logFrom(r.Context()).Info("tickets pruned", "session", session, "action", action, "count", tp.Count, "bytes", tp.Bytes)
+	}
+	writeFormatted(w, format, tp, pruneText(tp))
+}
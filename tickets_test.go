@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParsePruneFilter(t *testing.T) {
+	stamp := "2026-01-02T03:04:05Z"
+	at, _ := time.Parse(time.RFC3339, stamp)
+	tests := []struct {
+		query string
+		want  pruneFilter
+		err   error
+	}{
+		{query: "from=2&to=5", want: pruneFilter{From: 2, To: 5}},
+		{query: "from=3", want: pruneFilter{From: 3}},
+		{query: "to=3", want: pruneFilter{To: 3}},
+		{query: "before=" + stamp, want: pruneFilter{Before: at}},
+		{query: "larger=1024", want: pruneFilter{Larger: 1024}},
+		{query: "", err: errPruneFilter},
+		{query: "larger=0", err: errPruneFilter},
+		{query: "from=0", err: errFromMessage},
+		{query: "from=x", err: errFromMessage},
+		{query: "from=5&to=2", err: errFromMessage},
+		{query: "before=yesterday", err: errBefore},
+		{query: "before=-1h", err: errBefore},
+		{query: "larger=-1", err: errLarger},
+		{query: "larger=big", err: errLarger},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			f, err := parsePruneFilter(httptest.NewRequest("POST", "/tickets/prune?"+tt.query, nil))
+			if tt.err != nil {
+				if err != tt.err {
+					t.Fatalf("parsePruneFilter() error = %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parsePruneFilter() error = %v", err)
+			}
+			if f != tt.want {
+				t.Fatalf("parsePruneFilter() = %+v, want %+v", f, tt.want)
+			}
+		})
+	}
+}
+
+func TestParsePruneFilterAge(t *testing.T) {
+	f, err := parsePruneFilter(httptest.NewRequest("POST", "/tickets/prune?before=720h", nil))
+	if err != nil {
+		t.Fatalf("parsePruneFilter() error = %v", err)
+	}
+	if want := time.Now().Add(-720 * time.Hour); f.Before.Sub(want).Abs() > time.Minute {
+		t.Fatalf("before=720h gave %v, want about %v", f.Before, want)
+	}
+}
+
+// pruneSession makes a session of five finished tickets, each one bigger
+// than the last and 1 and 2 days old for tickets 1 and 2, and a sixth still
+// running.
+func pruneSession(t *testing.T) (string, string) {
+	t.Helper()
+	sessionsDir = t.TempDir()
+	session := "prune"
+	folder := filepath.Join(sessionsDir, session)
+	if err := os.MkdirAll(folder, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for ticket := 1; ticket <= 6; ticket++ {
+		path := filepath.Join(folder, fmt.Sprintf("%02d.ticket", ticket))
+		data := ""
+		if ticket < 6 {
+			data = fmt.Sprintf(`{"output":%q}`, strings.Repeat("x", ticket*100))
+		}
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if ticket <= 2 {
+			old := time.Now().Add(-time.Duration(3-ticket) * 24 * time.Hour)
+			if err := os.Chtimes(path, old, old); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	trackRunning(session, &runningCmd{Ticket: 6, Input: "sleep 60"})
+	t.Cleanup(func() {
+		untrackRunning(session, 6)
+		forgetTicketIndex(folder)
+	})
+	return session, folder
+}
+
+func TestPruneTickets(t *testing.T) {
+	tests := []struct {
+		name    string
+		filter  pruneFilter
+		tickets []int
+		running []int
+	}{
+		{name: "range", filter: pruneFilter{From: 2, To: 4}, tickets: []int{2, 3, 4}},
+		{name: "from", filter: pruneFilter{From: 4}, tickets: []int{4, 5}, running: []int{6}},
+		{name: "to", filter: pruneFilter{To: 2}, tickets: []int{1, 2}},
+		{name: "age", filter: pruneFilter{Before: time.Now().Add(-12 * time.Hour)}, tickets: []int{1, 2}},
+		{name: "older age", filter: pruneFilter{Before: time.Now().Add(-36 * time.Hour)}, tickets: []int{1}},
+		{name: "size", filter: pruneFilter{Larger: 300}, tickets: []int{3, 4, 5}},
+		{name: "age and range", filter: pruneFilter{From: 2, Before: time.Now().Add(-12 * time.Hour)}, tickets: []int{2}},
+		{name: "running kept", filter: pruneFilter{From: 5}, tickets: []int{5}, running: []int{6}},
+		{name: "nothing", filter: pruneFilter{From: 7}, tickets: []int{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session, folder := pruneSession(t)
+			tp, err := pruneTickets(session, tt.filter, pruneDelete, false)
+			if err != nil {
+				t.Fatalf("pruneTickets() error = %v", err)
+			}
+			if !reflect.DeepEqual(tp.Tickets, tt.tickets) || !reflect.DeepEqual(tp.Running, tt.running) {
+				t.Fatalf("pruneTickets() pruned %v kept running %v, want %v and %v", tp.Tickets, tp.Running, tt.tickets, tt.running)
+			}
+			if tp.Count != len(tt.tickets) || tp.Remaining != 6-len(tt.tickets) {
+				t.Fatalf("pruneTickets() count %d remaining %d, want %d and %d", tp.Count, tp.Remaining, len(tt.tickets), 6-len(tt.tickets))
+			}
+			pruned := map[int]bool{}
+			for _, ticket := range tt.tickets {
+				pruned[ticket] = true
+			}
+			for ticket := 1; ticket <= 6; ticket++ {
+				_, err := os.Stat(filepath.Join(folder, fmt.Sprintf("%02d.ticket", ticket)))
+				if exists := err == nil; exists == pruned[ticket] {
+					t.Errorf("ticket %d exists = %v after pruning %v", ticket, exists, tt.tickets)
+				}
+			}
+		})
+	}
+}
+
+func TestPruneTicketsDryRun(t *testing.T) {
+	session, folder := pruneSession(t)
+	tp, err := pruneTickets(session, pruneFilter{From: 1}, pruneDelete, true)
+	if err != nil {
+		t.Fatalf("pruneTickets() error = %v", err)
+	}
+	if tp.Count != 5 {
+		t.Fatalf("dry run would prune %d tickets, want 5", tp.Count)
+	}
+	for ticket := 1; ticket <= 6; ticket++ {
+		if _, err := os.Stat(filepath.Join(folder, fmt.Sprintf("%02d.ticket", ticket))); err != nil {
+			t.Errorf("dry run removed ticket %d: %v", ticket, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(folder, ticketSeqFile)); !os.IsNotExist(err) {
+		t.Errorf("dry run wrote %s", ticketSeqFile)
+	}
+}
+
+func TestPruneTicketsArchive(t *testing.T) {
+	session, folder := pruneSession(t)
+	tp, err := pruneTickets(session, pruneFilter{To: 3}, pruneArchive, false)
+	if err != nil {
+		t.Fatalf("pruneTickets() error = %v", err)
+	}
+	if tp.Archive == "" {
+		t.Fatal("pruneTickets() made no archive")
+	}
+	if info, err := os.Stat(filepath.Join(folder, tp.Archive)); err != nil || info.Size() == 0 {
+		t.Fatalf("archive %s: %v", tp.Archive, err)
+	}
+	if _, err := os.Stat(filepath.Join(folder, "01.ticket")); !os.IsNotExist(err) {
+		t.Errorf("archived ticket 1 is still in the session")
+	}
+}
+
+func TestPruneTicketsKeepsNumbering(t *testing.T) {
+	session, folder := pruneSession(t)
+	untrackRunning(session, 6)
+	if err := os.WriteFile(filepath.Join(folder, "06.ticket"), []byte(`{"output":"done"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Pruning every ticket still counts new ones up from the highest
+	if _, err := pruneTickets(session, pruneFilter{From: 1}, pruneDelete, false); err != nil {
+		t.Fatalf("pruneTickets() error = %v", err)
+	}
+	if seq := readTicketSeq(folder); seq != 6 {
+		t.Fatalf("readTicketSeq() = %d, want 6", seq)
+	}
+	if ticket, err := getNextTicket(folder); err != nil || ticket != 7 {
+		t.Fatalf("getNextTicket() = %d, %v, want 7", ticket, err)
+	}
+
+	// A later prune of lower tickets doesn't move the sequence back
+	if _, err := pruneTickets(session, pruneFilter{To: 7}, pruneDelete, false); err != nil {
+		t.Fatalf("pruneTickets() error = %v", err)
+	}
+	if ticket, err := getNextTicket(folder); err != nil || ticket != 8 {
+		t.Fatalf("getNextTicket() after a second prune = %d, %v, want 8", ticket, err)
+	}
+}
@@ -0,0 +1,494 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// With SHELL_BACKEND=tmux each session's commands run one after another in a
+// long-lived shell inside a tmux session of its own, on a tmux server the
+// llmass server doesn't own. Shell state such as the working directory,
+// exported variables and functions carries over between commands, and a
+// restart or deploy of the server leaves running commands alone: on start it
+// picks up the commands still pending in SESSIONS_DIR/<session>/tmux and
+// writes their tickets once they finish.
+//
+// A command is sourced from a script file with its output redirected to a
+// file, its exit code is written next to it when it ends:
+//
+//	SESSIONS_DIR/<session>/tmux/07.sh    the command, after the init files
+//	SESSIONS_DIR/<session>/tmux/07.out   stdout and stderr
+//	SESSIONS_DIR/<session>/tmux/07.exit  the exit code
+//	SESSIONS_DIR/<session>/tmux/07.json  what the ticket needs once it ends
+
+const (
+	tmuxDir        = "tmux"
+	tmuxPrefix     = "llmass-"
+	tmuxPoll       = 100 * time.Millisecond
+	tmuxAliveEvery = 10 // polls between checks that the shell is still there
+	restartWait    = 10 * time.Second
+
+	// tmuxSessionOption holds the session name on its tmux session
+	tmuxSessionOption = "@llmass_session"
+
+	errTmuxGoneMessage = "The session's shell exited before the command finished"
+)
+
+var (
+	tmuxSocket string // TMUX_SOCKET, default DATA_DIR/tmux.sock
+
+	tmuxNameRe = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+)
+
+// tmuxJob is a command handed to a session's shell, kept on disk until its
+// ticket is written so another server process can finish it.
+type tmuxJob struct {
+	Session     string    `json:"session"`
+	Ticket      int       `json:"ticket"`
+	Input       string    `json:"input"`
+	Alias       string    `json:"alias,omitempty"`
+	LineNumbers bool      `json:"line_numbers,omitempty"`
+	NoSummary   bool      `json:"no_summary,omitempty"`
+	Manifest    string    `json:"manifest,omitempty"`
+	Wrap        string    `json:"wrap,omitempty"`
+	Marker      string    `json:"marker,omitempty"`
+	Started     time.Time `json:"started"`
+	Deadline    time.Time `json:"deadline"`
+}
+
+// loadTmux checks for tmux and reads TMUX_SOCKET and TMUX_WRAP.
+func loadTmux() error {
+	if _, err := exec.LookPath("tmux"); err != nil {
+		return fmt.Errorf("SHELL_BACKEND=tmux needs tmux: %v", err)
+	}
+	tmuxSocket = os.Getenv("TMUX_SOCKET")
+	tmuxWrap = wrapFile
+	if w := os.Getenv("TMUX_WRAP"); w != "" {
+		if _, ok := wrapStrategies[w]; !ok {
+			return fmt.Errorf("TMUX_WRAP must be file, markers or osc: %q", w)
+		}
+		tmuxWrap = w
+	}
+	return nil
+}
+
+func tmuxSocketPath() string {
+	if tmuxSocket != "" {
+		return tmuxSocket
+	}
+	return filepath.Join(dataDir, "tmux.sock")
+}
+
+// tmuxName is the tmux session of a session. tmux doesn't allow every
+// character a session name may have, so a name that needed changing gets a
+// hash of the original to stay unique.
+func tmuxName(session string) string {
+	name := tmuxNameRe.ReplaceAllString(session, "_")
+	if name != session {
+		sum := sha1.Sum([]byte(session))
+		name += "-" + hex.EncodeToString(sum[:4])
+	}
+	return tmuxPrefix + name
+}
+
+func tmux(args ...string) (string, error) {
+	out, err := exec.Command("tmux", append([]string{"-S", tmuxSocketPath()}, args...)...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("tmux %s: %v: %s", args[0], err, strings.TrimSpace(string(out)))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// tmuxAlive reports whether the tmux session's shell is running. A dead
+// shell's pane remains until its supervisor has seen it.
+func tmuxAlive(name string) bool {
+	out, err := tmux("display-message", "-p", "-t", "="+name+":", "#{pane_dead}")
+	return err == nil && out == "0"
+}
+
+// tmuxEnsure starts the session's shell unless it is already running, and
+// makes sure it is supervised.
+func tmuxEnsure(session string) error {
+	name := tmuxName(session)
+	if tmuxAlive(name) {
+		superviseShell(session)
+		return nil
+	}
+	wd, _ := os.Getwd()
+	return tmuxStart(session, wd)
+}
+
+// tmuxStart starts a shell for the session in dir, replacing a dead one its
+// supervisor hasn't cleaned up yet.
+func tmuxStart(session, dir string) error {
+	name := tmuxName(session)
+	tmux("kill-session", "-t", "="+name)
+	if _, err := tmux("new-session", "-d", "-s", name, "-c", dir, "-e", sessionNameEnv+"="+session, "-x", "200", "-y", "50", shellPath); err != nil {
+		return err
+	}
+	if _, err := tmux("set-option", "-t", "="+name+":", tmuxSessionOption, session); err != nil {
+		return err
+	}
+	if _, err := tmux("set-option", "-w", "-t", "="+name+":", "remain-on-exit", "on"); err != nil {
+		return err
+	}
+	superviseShell(session)
+	return nil
+}
+
+// tmuxPanePid returns the pid of the session's shell, 0 when unknown.
+func tmuxPanePid(name string) int {
+	out, err := tmux("display-message", "-p", "-t", "="+name+":", "#{pane_pid}")
+	if err != nil {
+		return 0
+	}
+	pid, _ := strconv.Atoi(out)
+	return pid
+}
+
+// tmuxIdle reports whether the session's shell is back at its prompt, with
+// nothing running in the foreground.
+func tmuxIdle(name string) bool {
+	out, err := tmux("display-message", "-p", "-t", "="+name+":", "#{pane_current_command}")
+	return err == nil && out == filepath.Base(shellPath)
+}
+
+// killTmuxSession ends the session's shell and whatever runs in it.
+func killTmuxSession(session string) {
+	if shellBackend != backendTmux {
+		return
+	}
+	name := tmuxName(session)
+	if tmuxAlive(name) {
+		if _, err := tmux("kill-session", "-t", "="+name); err != nil {
+			logger.Warn("failed to kill tmux session", "session", session, "err", err)
+		}
+	}
+}
+
+// renameShell gives the session's shell, if it has one, the tmux name of to.
+// The old supervisor returns once its name is gone. The shell's own
+// environment keeps the old name until it is restarted.
+func renameShell(session, to string) error {
+	name := tmuxName(session)
+	if _, err := tmux("has-session", "-t", "="+name); err != nil {
+		return nil
+	}
+	newName := tmuxName(to)
+	if _, err := tmux("rename-session", "-t", "="+name, newName); err != nil {
+		return err
+	}
+	if _, err := tmux("set-option", "-t", "="+newName+":", tmuxSessionOption, to); err != nil {
+		return err
+	}
+	if _, err := tmux("set-environment", "-t", "="+newName+":", sessionNameEnv, to); err != nil {
+		return err
+	}
+	superviseShell(to)
+	return nil
+}
+
+// shellCwd returns the directory the session's next command starts in: the
+// tmux shell's, or the server's when there is no shell or it was removed.
+func shellCwd(session string) string {
+	wd, _ := os.Getwd()
+	if shellBackend != backendTmux {
+		return wd
+	}
+	pid := tmuxPanePid(tmuxName(session))
+	if pid <= 0 {
+		return wd
+	}
+	dir, err := os.Readlink(filepath.Join("/proc", strconv.Itoa(pid), "cwd"))
+	if err != nil {
+		return wd
+	}
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return wd
+	}
+	return dir
+}
+
+// restartShell replaces the session's shell with a fresh one started in the
+// directory the old one was in, killing everything that ran in it, and
+// returns that directory. The session's tickets and init files are kept, so
+// the new shell starts from the same profile.
+func restartShell(session string) (string, error) {
+	name := tmuxName(session)
+	cwd := shellCwd(session)
+	if pid := tmuxPanePid(name); pid > 0 {
+		killShellOrphans(pid)
+	}
+	if _, err := tmux("kill-session", "-t", "="+name); err != nil {
+		logger.Debug("no tmux session to kill", "session", session, "err", err)
+	}
+
+	// The supervisor and the commands that ran in the shell have to notice
+	// it is gone before the new one takes its name
+	deadline := time.Now().Add(restartWait)
+	for (shellSupervised(session) || len(runningForSession(session)) > 0) && time.Now().Before(deadline) {
+		time.Sleep(tmuxPoll)
+	}
+	return cwd, tmuxStart(session, cwd)
+}
+
+func tmuxJobPath(sessionFolder string, ticket int, ext string) string {
+	return filepath.Join(sessionFolder, tmuxDir, fmt.Sprintf("%02d%s", ticket, ext))
+}
+
+// removeTmuxJob deletes a job's files once its ticket is written.
+func removeTmuxJob(sessionFolder string, ticket int) {
+	for _, ext := range []string{".sh", ".out", ".exit", ".exit.tmp", ".stream", ".json"} {
+		os.Remove(tmuxJobPath(sessionFolder, ticket, ext))
+	}
+}
+
+// executeTmux runs inputCmd in the session's tmux shell and blocks until it
+// exits or ctx is done.
+func executeTmux(ctx context.Context, session, sessionFolder string, ticket int, inputCmd string, opts execOptions) *execution {
+	start := time.Now()
+	fail := func(err error) *execution {
+		removeTmuxJob(sessionFolder, ticket)
+		logger.Error("failed to run command in tmux", "session", session, "ticket", ticket, "err", err)
+		return &execution{Output: []byte(err.Error() + "\n"), Usage: newResourceUsage(nil, time.Since(start)), ExitCode: -1, Err: err}
+	}
+
+	// What the prelude exports is typed into the shell as it is
+	for k := range opts.Env {
+		if !validEnvKey(k) {
+			return fail(errEnvMessage)
+		}
+	}
+
+	name := tmuxName(session)
+	if err := os.MkdirAll(filepath.Join(sessionFolder, tmuxDir), 0755); err != nil {
+		return fail(err)
+	}
+	if err := tmuxEnsure(session); err != nil {
+		return fail(err)
+	}
+
+	job := &tmuxJob{
+		Session:     session,
+		Ticket:      ticket,
+		Input:       inputCmd,
+		Alias:       opts.Alias,
+		LineNumbers: opts.LineNumbers,
+		NoSummary:   opts.NoSummary,
+		Wrap:        tmuxWrap,
+		Marker:      newMarker(),
+		Started:     start,
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		job.Deadline = deadline
+	}
+
+	// The prelude changes the shell for good, like a cd typed at a prompt
+	var prelude strings.Builder
+	for k, v := range opts.Env {
+		prelude.WriteString("export " + k + "=" + shellQuote(v) + "; ")
+	}
+	manifest, err := newArtifactManifest()
+	if err != nil {
+		logger.Error("failed to create artifact manifest", "err", err)
+	} else {
+		job.Manifest = manifest
+		prelude.WriteString("export " + artifactsEnv + "=" + shellQuote(manifest) + "; ")
+	}
+	if dir := sessionWorkspacesDir(sessionFolder); dir != "" {
+		prelude.WriteString("export " + workspacesEnv + "=" + shellQuote(dir) + "; ")
+	}
+	if opts.Cwd != "" {
+		prelude.WriteString("cd " + shellQuote(opts.Cwd) + " && ")
+	}
+
+	script := wrapCommand(sessionFolder, inputCmd)
+	if err := os.WriteFile(tmuxJobPath(sessionFolder, ticket, ".sh"), []byte(script+"\n"), 0600); err != nil {
+		return fail(err)
+	}
+	data, _ := json.Marshal(job)
+	if err := os.WriteFile(tmuxJobPath(sessionFolder, ticket, ".json"), data, 0600); err != nil {
+		return fail(err)
+	}
+
+	line, err := jobWrap(job).begin(name, sessionFolder, job, prelude.String())
+	if err != nil {
+		return fail(err)
+	}
+	// The leading space keeps the line out of the shell's history
+	if _, err := tmux("send-keys", "-t", "="+name+":", "-l", " "+line); err != nil {
+		return fail(err)
+	}
+	if _, err := tmux("send-keys", "-t", "="+name+":", "Enter"); err != nil {
+		return fail(err)
+	}
+
+	buf := newSpillBuffer(sessionFolder)
+	out := io.MultiWriter(buf, &activityWriter{session: session, ticket: ticket})
+	rec := openRecording(sessionFolder, session)
+	if rec != nil {
+		rec.prompt(session, ticket, inputCmd)
+		out = io.MultiWriter(out, rec)
+	}
+	tr := openTranscript(sessionFolder, ticket)
+	if tr != nil {
+		defer tr.Close()
+		tr.record("in", []byte(script))
+		out = io.MultiWriter(out, tr.writer("out"))
+	}
+
+	ex := waitTmux(ctx, sessionFolder, job, out)
+	ex.Output = buf.Bytes()
+	if a := buf.keep(ctx, sessionFolder, session, ticket); a != nil {
+		ex.Artifacts = append(ex.Artifacts, *a)
+	}
+	removeTmuxJob(sessionFolder, ticket)
+	if tr != nil {
+		tr.record("exit", []byte(strconv.Itoa(ex.ExitCode)))
+	}
+	if rec != nil {
+		rec.exit(ex.ExitCode)
+	}
+	return ex
+}
+
+// waitTmux follows a job's output into out until its exit code is written.
+// When ctx is done the command is interrupted, and given up on after
+// killGracePeriod. Artifacts are collected once it ends.
+func waitTmux(ctx context.Context, sessionFolder string, job *tmuxJob, out io.Writer) *execution {
+	name := tmuxName(job.Session)
+	trackRunning(job.Session, &runningCmd{Ticket: job.Ticket, Input: job.Input, Pid: tmuxPanePid(name), Started: job.Started})
+	defer untrackRunning(job.Session, job.Ticket)
+
+	follower := jobWrap(job).follower(name, sessionFolder, job, out)
+	defer follower.close()
+
+	ex := &execution{ExitCode: -1}
+	var giveUp <-chan time.Time
+	ticker := time.NewTicker(tmuxPoll)
+	defer ticker.Stop()
+	for polls := 1; ; polls++ {
+		if code, done := follower.follow(); done {
+			ex.ExitCode = code
+			break
+		}
+		if polls%tmuxAliveEvery == 0 && !tmuxAlive(name) {
+			follower.follow()
+			ex.Err = fmt.Errorf(errTmuxGoneMessage)
+			break
+		}
+		// An interrupted shell abandons the rest of the line, exit code
+		// included, so it is done once back at its prompt
+		if giveUp != nil && tmuxIdle(name) {
+			follower.follow()
+			break
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			if giveUp == nil {
+				ex.Err = ctx.Err()
+				tmux("send-keys", "-t", "="+name+":", "C-c")
+				giveUp = time.After(killGracePeriod)
+			}
+		case <-giveUp:
+			follower.follow()
+			return finishTmux(ex, sessionFolder, job)
+		}
+	}
+	return finishTmux(ex, sessionFolder, job)
+}
+
+func finishTmux(ex *execution, sessionFolder string, job *tmuxJob) *execution {
+	ex.Usage = newResourceUsage(nil, time.Since(job.Started))
+	if ex.ExitCode != 0 && ex.Err == nil {
+		ex.Err = fmt.Errorf("exit status %d", ex.ExitCode)
+	}
+	if job.Manifest != "" {
+		// Relative artifact paths are where the shell ended up
+		workDir, err := tmux("display-message", "-p", "-t", "="+tmuxName(job.Session)+":", "#{pane_current_path}")
+		if err != nil || workDir == "" {
+			workDir, _ = os.Getwd()
+		}
+		ex.Artifacts = collectArtifacts(context.Background(), job.Manifest, workDir, sessionFolder, job.Session, job.Ticket)
+	}
+	return ex
+}
+
+// recoverTmux finishes the commands left running in tmux by a previous
+// server process, writing their tickets once they end.
+func recoverTmux() {
+	if shellBackend != backendTmux {
+		return
+	}
+	superviseTmuxShells()
+	jobs, _ := filepath.Glob(filepath.Join(sessionsDir, "*", tmuxDir, "*.json"))
+	for _, path := range jobs {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		job := &tmuxJob{}
+		if err := json.Unmarshal(data, job); err != nil {
+			logger.Warn("skipping unreadable tmux job", "path", path, "err", err)
+			continue
+		}
+		sessionFolder := filepath.Join(sessionsDir, job.Session)
+		ticketFile := filepath.Join(sessionFolder, fmt.Sprintf("%02d.ticket", job.Ticket))
+
+		// Stopped after writing the ticket but before cleaning up
+		if ticket, err := os.ReadFile(ticketFile); err == nil && len(ticket) > 0 && json.Valid(ticket) {
+			removeTmuxJob(sessionFolder, job.Ticket)
+			continue
+		}
+		if !beginCommand() {
+			return
+		}
+		// The shell is taken before any new command can ask for it
+		turn := enqueueCommand(job.Session, job.Ticket, job.Input)
+		logger.Info("resuming command left in tmux", "session", job.Session, "ticket", job.Ticket)
+		go resumeTmuxJob(sessionFolder, ticketFile, job, turn.release)
+	}
+}
+
+func resumeTmuxJob(sessionFolder, ticketFile string, job *tmuxJob, release func()) {
+	defer endCommand()
+	defer release()
+	log := logger.With("session", job.Session, "ticket", job.Ticket)
+
+	ctx := context.Background()
+	var cancel context.CancelFunc = func() {}
+	if !job.Deadline.IsZero() {
+		ctx, cancel = context.WithDeadline(ctx, job.Deadline)
+	}
+	defer cancel()
+
+	buf := newSpillBuffer(sessionFolder)
+	ex := waitTmux(ctx, sessionFolder, job, io.MultiWriter(buf, &activityWriter{session: job.Session, ticket: job.Ticket}))
+	ex.Output = buf.Bytes()
+	if a := buf.keep(ctx, sessionFolder, job.Session, job.Ticket); a != nil {
+		ex.Artifacts = append(ex.Artifacts, *a)
+	}
+
+	file, err := os.OpenFile(ticketFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		log.Error("failed to open ticket file", "err", err)
+		return
+	}
+	defer file.Close()
+	csr := &CmdSubmission{Ticket: job.Ticket, Session: job.Session, Input: job.Input}
+	finishTicket(context.Background(), log, file, csr, execOptions{LineNumbers: job.LineNumbers, NoSummary: job.NoSummary, Alias: job.Alias}, ex)
+	removeTmuxJob(sessionFolder, job.Ticket)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// testTmux points the tmux backend at a server of the test's own.
+func testTmux(t *testing.T) {
+	t.Helper()
+	if _, err := exec.LookPath("tmux"); err != nil {
+		t.Skip("tmux is not installed")
+	}
+	oldSocket, oldShell := tmuxSocket, shellPath
+	tmuxSocket, shellPath = filepath.Join(t.TempDir(), "tmux.sock"), "/bin/sh"
+	t.Cleanup(func() {
+		tmux("kill-server")
+		tmuxSocket, shellPath = oldSocket, oldShell
+	})
+}
+
+func TestRenameShell(t *testing.T) {
+	testTmux(t)
+	if err := tmuxStart("old", t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	if err := renameShell("old", "new name"); err != nil {
+		t.Fatal(err)
+	}
+	if tmuxAlive(tmuxName("old")) {
+		t.Error("the shell is still under the old name")
+	}
+	if !tmuxAlive(tmuxName("new name")) {
+		t.Fatal("the shell isn't under the new name")
+	}
+	if got, _ := tmux("show-options", "-v", "-t", "="+tmuxName("new name")+":", tmuxSessionOption); got != "new name" {
+		t.Errorf("%s = %q, want %q", tmuxSessionOption, got, "new name")
+	}
+	if !shellSupervised("new name") {
+		t.Error("the renamed shell isn't supervised")
+	}
+
+	// A session without a shell has nothing to rename
+	if err := renameShell("none", "other"); err != nil {
+		t.Fatalf("renameShell() without a shell = %v", err)
+	}
+}
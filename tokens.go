@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Results carry an estimated token count of their output so agent
+// frameworks can budget their context before pasting it into a prompt. The
+// estimate runs without a vocabulary: TOKENIZER=cl100k (the default) mimics
+// how cl100k_base splits text into words, digit groups and symbols, chars
+// counts four bytes per token, and off leaves the count out.
+
+const (
+	tokenizerCl100k = "cl100k"
+	tokenizerChars  = "chars"
+	tokenizerOff    = "off"
+)
+
+var tokenizer = tokenizerCl100k
+
+func loadTokenizer() error {
+	switch t := os.Getenv("TOKENIZER"); t {
+	case "":
+		tokenizer = tokenizerCl100k
+	case tokenizerCl100k, tokenizerChars, tokenizerOff:
+		tokenizer = t
+	default:
+		return fmt.Errorf("TOKENIZER must be cl100k, chars or off: %q", t)
+	}
+	return nil
+}
+
+// estimateTokens returns the estimated token count of s, 0 when disabled.
+func estimateTokens(s string) int {
+	switch tokenizer {
+	case tokenizerOff:
+		return 0
+	case tokenizerChars:
+		return (len(s) + 3) / 4
+	}
+
+	// cl100k splits letters, digits in groups of up to three, runs of other
+	// symbols and newlines apart, a single space joins the following word,
+	// and words of up to five letters are one token, longer ones a token per
+	// five letters
+	tokens := 0
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		start := i
+		switch {
+		case r == ' ' && i+1 < len(s) && s[i+1] != ' ' && s[i+1] != '\n':
+			i += size
+			continue
+		case unicode.IsLetter(r):
+			i = scanRunes(s, i, unicode.IsLetter)
+			tokens += (i - start + 4) / 5
+		case unicode.IsDigit(r):
+			i = scanRunes(s, i, unicode.IsDigit)
+			tokens += (i - start + 2) / 3
+		case unicode.IsSpace(r):
+			i = scanRunes(s, i, unicode.IsSpace)
+			tokens++
+		default:
+			i = scanRunes(s, i, func(r rune) bool {
+				return !unicode.IsLetter(r) && !unicode.IsDigit(r) && !unicode.IsSpace(r)
+			})
+			// Symbols merge into tokens less often than letters
+			tokens += (i - start + 1) / 2
+		}
+	}
+	return tokens
+}
+
+// scanRunes returns the index after the run of runes matching in at i.
+func scanRunes(s string, i int, in func(rune) bool) int {
+	for i < len(s) {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if !in(r) {
+			break
+		}
+		i += size
+	}
+	return i
+}
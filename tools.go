@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// agentTools maps the MCP tools an HTTP agent can use to the endpoint that
+// implements each of them. MCP-only arguments are left out.
+var agentTools = []struct {
+	name        string
+	endpoint    string
+	description string
+	omit        []string
+}{
+	{"run_command", "/shell", "Execute a shell command in a session. Returns a ticket, fetch the result with check_status.", []string{"wait", "wait_seconds"}},
+	{"check_status", "/callback", "Fetch the result of a ticket. Returns a working status while the command is still running.", nil},
+	{"get_history", "/history", "Fetch every command and output in a session.", nil},
+}
+
+// withoutProps copies an input schema minus the named properties.
+func withoutProps(schema obj, omit []string) obj {
+	props := obj{}
+	for k, v := range schema["properties"].(obj) {
+		props[k] = v
+	}
+	for _, k := range omit {
+		delete(props, k)
+	}
+	return obj{"type": "object", "properties": props, "required": schema["required"]}
+}
+
+type openAIFunction struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Parameters  obj    `json:"parameters"`
+}
+
+type openAITool struct {
+	Type     string         `json:"type"`
+	Function openAIFunction `json:"function"`
+}
+
+type anthropicTool struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	InputSchema obj    `json:"input_schema"`
+}
+
+func findMCPTool(name string) *mcpTool {
+	for _, t := range mcpTools {
+		if t.Name == name {
+			return t
+		}
+	}
+	return nil
+}
+
+// toolDefinitions returns the agent tools in OpenAI and Anthropic formats.
+func toolDefinitions(base string) ([]openAITool, []anthropicTool) {
+	var openai []openAITool
+	var anthropic []anthropicTool
+	for _, at := range agentTools {
+		t := findMCPTool(at.name)
+		if t == nil {
+			continue
+		}
+		desc := fmt.Sprintf("%s Implemented by %s%s, authenticate with the hash query parameter.", at.description, base, at.endpoint)
+		schema := withoutProps(t.InputSchema, at.omit)
+		openai = append(openai, openAITool{
+			Type:     "function",
+			Function: openAIFunction{Name: t.Name, Description: desc, Parameters: schema},
+		})
+		anthropic = append(anthropic, anthropicTool{Name: t.Name, Description: desc, InputSchema: schema})
+	}
+	return openai, anthropic
+}
+
+func toolsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodGet {
+		writeError(w, errMethodMessage)
+		return
+	}
+
+	openai, anthropic := toolDefinitions(baseURL(r.Context()))
+
+	var resp interface{}
+	switch r.URL.Query().Get("provider") {
+	case "openai":
+		resp = openai
+	case "anthropic":
+		resp = anthropic
+	case "":
+		resp = obj{"openai": openai, "anthropic": anthropic}
+	default:
+		writeError(w, errProviderMessage)
+		return
+	}
+
+	jsonResp, err := json.MarshalIndent(resp, "", "  ")
+	if err != nil {
+		msg := fmt.Sprintf("Failed to marshal JSON response: %v", err)
+		writeJsonError(w, msg)
+		return
+	}
+
+	fmt.Fprint(w, string(jsonResp))
+}
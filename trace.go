@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A minimal OpenTelemetry tracer that exports spans with OTLP/HTTP JSON, so
+// any collector can receive them without pulling in the SDK. Tracing is off
+// unless OTEL_EXPORTER_OTLP_ENDPOINT (or _TRACES_ENDPOINT) is set.
+
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+
+	traceQueueSize     = 2048
+	traceBatchSize     = 256
+	traceFlushInterval = 5 * time.Second
+)
+
+var (
+	traceEndpoint string // full OTLP traces URL
+	traceService  string // OTEL_SERVICE_NAME
+	traceQueue    chan *span
+)
+
+type spanContextKey struct{}
+
+// span is one timed operation in a trace.
+type span struct {
+	traceID [16]byte
+	spanID  [8]byte
+	parent  [8]byte
+	name    string
+	kind    int
+	start   time.Time
+	end     time.Time
+	attrs   map[string]interface{}
+	errMsg  string
+}
+
+func loadTracing() {
+	traceEndpoint = os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if traceEndpoint == "" {
+		if base := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); base != "" {
+			traceEndpoint = strings.TrimSuffix(base, "/") + "/v1/traces"
+		}
+	}
+	if traceEndpoint == "" {
+		return
+	}
+
+	traceService = os.Getenv("OTEL_SERVICE_NAME")
+	if traceService == "" {
+		traceService = "llmass"
+	}
+	traceQueue = make(chan *span, traceQueueSize)
+	go exportSpans()
+	logger.Info("exporting traces", "endpoint", traceEndpoint)
+}
+
+func tracingEnabled() bool {
+	return traceQueue != nil
+}
+
+// startSpan starts a span as a child of the one in ctx, if any. It returns
+// nil when tracing is disabled; every span method is nil-safe.
+func startSpan(ctx context.Context, name string, kind int) (context.Context, *span) {
+	if !tracingEnabled() {
+		return ctx, nil
+	}
+	s := &span{name: name, kind: kind, start: time.Now(), attrs: map[string]interface{}{}}
+	if p := spanFromContext(ctx); p != nil {
+		s.traceID = p.traceID
+		s.parent = p.spanID
+	} else {
+		rand.Read(s.traceID[:])
+	}
+	rand.Read(s.spanID[:])
+	return context.WithValue(ctx, spanContextKey{}, s), s
+}
+
+func spanFromContext(ctx context.Context) *span {
+	s, _ := ctx.Value(spanContextKey{}).(*span)
+	return s
+}
+
+// detachSpan carries the span in ctx over to a background context, so work
+// that outlives the request stays in its trace.
+func detachSpan(ctx context.Context) context.Context {
+	if s := spanFromContext(ctx); s != nil {
+		return context.WithValue(context.Background(), spanContextKey{}, s)
+	}
+	return context.Background()
+}
+
+func (s *span) SetAttr(key string, value interface{}) {
+	if s != nil {
+		s.attrs[key] = value
+	}
+}
+
+func (s *span) SetError(err error) {
+	if s != nil && err != nil {
+		s.errMsg = err.Error()
+	}
+}
+
+func (s *span) End() {
+	if s == nil {
+		return
+	}
+	s.end = time.Now()
+	select {
+	case traceQueue <- s:
+	default:
+		// Drop spans rather than block when the collector can't keep up
+	}
+}
+
+// parseTraceparent reads a W3C traceparent header into a remote parent span.
+func parseTraceparent(h string) *span {
+	parts := strings.Split(h, "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return nil
+	}
+	p := &span{}
+	if _, err := hex.Decode(p.traceID[:], []byte(parts[1])); err != nil {
+		return nil
+	}
+	if _, err := hex.Decode(p.spanID[:], []byte(parts[2])); err != nil {
+		return nil
+	}
+	return p
+}
+
+// traceRequest wraps a handler in a server span, continuing the caller's
+// trace when a traceparent header is present.
+func traceRequest(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !tracingEnabled() {
+			h(w, r)
+			return
+		}
+
+		ctx := r.Context()
+		if p := parseTraceparent(r.Header.Get("traceparent")); p != nil {
+			ctx = context.WithValue(ctx, spanContextKey{}, p)
+		}
+		ctx, s := startSpan(ctx, r.Method+" "+r.URL.Path, spanKindServer)
+		s.SetAttr("http.request.method", r.Method)
+		s.SetAttr("url.path", r.URL.Path)
+		s.SetAttr("llmass.request_id", requestIDFrom(ctx))
+		if session := r.URL.Query().Get("session"); session != "" {
+			s.SetAttr("llmass.session", session)
+		}
+		defer s.End()
+
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		h(sw, r.WithContext(ctx))
+		s.SetAttr("http.response.status_code", sw.status)
+		if sw.status >= 500 {
+			s.SetError(fmt.Errorf("HTTP %d", sw.status))
+		}
+	}
+}
+
+// statusWriter records the status code written by a handler.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(code int) {
+	sw.status = code
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+func (sw *statusWriter) Flush() {
+	if f, ok := sw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (sw *statusWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+// exportSpans batches finished spans and POSTs them to the collector.
+func exportSpans() {
+	ticker := time.NewTicker(traceFlushInterval)
+	defer ticker.Stop()
+
+	var batch []*span
+	for {
+		select {
+		case s := <-traceQueue:
+			batch = append(batch, s)
+			if len(batch) < traceBatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		if err := postSpans(batch); err != nil {
+			logger.Warn("failed to export spans", "count", len(batch), "err", err)
+		}
+		batch = nil
+	}
+}
+
+func otlpValue(v interface{}) obj {
+	switch v := v.(type) {
+	case int:
+		return obj{"intValue": strconv.Itoa(v)}
+	case int64:
+		return obj{"intValue": strconv.FormatInt(v, 10)}
+	case bool:
+		return obj{"boolValue": v}
+	default:
+		return obj{"stringValue": fmt.Sprint(v)}
+	}
+}
+
+func otlpAttrs(attrs map[string]interface{}) []obj {
+	list := make([]obj, 0, len(attrs))
+	for k, v := range attrs {
+		list = append(list, obj{"key": k, "value": otlpValue(v)})
+	}
+	return list
+}
+
+func postSpans(batch []*span) error {
+	spans := make([]obj, 0, len(batch))
+	for _, s := range batch {
+		o := obj{
+			"traceId":           hex.EncodeToString(s.traceID[:]),
+			"spanId":            hex.EncodeToString(s.spanID[:]),
+			"name":              s.name,
+			"kind":              s.kind,
+			"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+			"attributes":        otlpAttrs(s.attrs),
+		}
+		if s.parent != [8]byte{} {
+			o["parentSpanId"] = hex.EncodeToString(s.parent[:])
+		}
+		if s.errMsg != "" {
+			o["status"] = obj{"code": 2, "message": s.errMsg}
+		}
+		spans = append(spans, o)
+	}
+
+	body, err := json.Marshal(obj{"resourceSpans": []obj{{
+		"resource":   obj{"attributes": otlpAttrs(map[string]interface{}{"service.name": traceService})},
+		"scopeSpans": []obj{{"scope": obj{"name": "llmass"}, "spans": spans}},
+	}}})
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(traceEndpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	return nil
+}
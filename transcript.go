@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const transcriptFile = "shell.log"
+
+var transcriptLog atomic.Bool // TRANSCRIPT_LOG, record raw shell I/O per session
+
+// A transcript records every byte handed to and read from the shell in
+// SESSIONS_DIR/<session>/shell.log, one timestamped line per write:
+//
+//	2026-10-15T15:14:40.511640785Z 3 in "shopt -s expand_aliases\nls"
+//	2026-10-15T15:14:40.51403446Z 3 out "a.txt\n"
+//	2026-10-15T15:14:40.514074931Z 3 exit "0"
+//
+// The payload is Go-quoted so control bytes and partial lines survive.
+type transcript struct {
+	mu     sync.Mutex
+	f      *os.File
+	ticket int
+}
+
+// openTranscript starts a ticket's transcript, or returns nil when
+// TRANSCRIPT_LOG is off or the log can't be opened.
+func openTranscript(sessionFolder string, ticket int) *transcript {
+	if !transcriptLog.Load() {
+		return nil
+	}
+	f, err := os.OpenFile(filepath.Join(sessionFolder, transcriptFile), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		logger.Error("failed to open transcript", "dir", sessionFolder, "err", err)
+		return nil
+	}
+	return &transcript{f: f, ticket: ticket}
+}
+
+func (t *transcript) record(stream string, p []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	fmt.Fprintf(t.f, "%s %d %s %q\n", time.Now().UTC().Format(time.RFC3339Nano), t.ticket, stream, p)
+}
+
+// writer tags everything written to it with stream.
+func (t *transcript) writer(stream string) io.Writer {
+	return transcriptWriter{t: t, stream: stream}
+}
+
+func (t *transcript) Close() error {
+	return t.f.Close()
+}
+
+type transcriptWriter struct {
+	t      *transcript
+	stream string
+}
+
+func (w transcriptWriter) Write(p []byte) (int, error) {
+	w.t.record(w.stream, p)
+	return len(p), nil
+}
+
+// lockedWriter serializes writes from the stdout and stderr copiers.
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (l *lockedWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Write(p)
+}
+
+// transcriptHandler serves a session's shell.log, as an attachment with
+// download=1.
+func transcriptHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodGet {
+		writeError(w, errMethodMessage)
+		return
+	}
+
+	// Validate the hash parameter
+	hashParam := r.URL.Query().Get("hash")
+	if !checkHash(r, hashParam) {
+		writeError(w, errHashMessage)
+		return
+	}
+
+	session := r.URL.Query().Get("session")
+	if !validSessionName(session) {
+		writeError(w, errSessionMessage)
+		return
+	}
+	serveTranscript(w, r, session)
+}
+
+func dashboardTranscriptHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, errMethodMessage)
+		return
+	}
+	session := r.URL.Query().Get("session")
+	if !validSessionName(session) {
+		writeError(w, errSessionMessage)
+		return
+	}
+	serveTranscript(w, r, session)
+}
+
+func serveTranscript(w http.ResponseWriter, r *http.Request, session string) {
+	f, err := os.Open(filepath.Join(sessionsDir, session, transcriptFile))
+	if err != nil {
+		writeError(w, notFoundf("No transcript for session %s, is TRANSCRIPT_LOG enabled?", session))
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if download, _ := strconv.ParseBool(r.URL.Query().Get("download")); download {
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", session+"-"+transcriptFile))
+	}
+	io.Copy(w, f)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// max_tokens trims an output to an observation budget for agents with
+// small context windows: the head and tail are kept, where commands print
+// what they are doing and how it ended, around a marker saying how much
+// was left out. Given to /shell it carries over to the callback URL. The
+// result's continue_url pages through the omitted part with /output.
+
+var errMaxTokensMessage = paramError("max_tokens", "Invalid 'max_tokens' parameter")
+
+// parseMaxTokens reads max_tokens, 0 when absent.
+func parseMaxTokens(r *http.Request) (int, error) {
+	s := r.URL.Query().Get("max_tokens")
+	if s == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n <= 0 {
+		return 0, errMaxTokensMessage
+	}
+	return n, nil
+}
+
+// countTokens estimates like estimateTokens, falling back to four bytes a
+// token when estimates are off, since a budget needs some count.
+func countTokens(s string) int {
+	if tokenizer == tokenizerOff {
+		return (len(s) + 3) / 4
+	}
+	return estimateTokens(s)
+}
+
+// trimOutput cuts s to about maxTokens, keeping its head and tail. It
+// returns the trimmed text, the lines and tokens left out and the offset in
+// s where they start.
+func trimOutput(s string, maxTokens int) (string, int, int, int) {
+	total := countTokens(s)
+	if total <= maxTokens {
+		return s, 0, 0, 0
+	}
+
+	// The largest head and smallest tail start within half the budget each,
+	// ending on line breaks when there are any
+	headEnd := searchCut(len(s), func(i int) bool { return countTokens(s[:i]) > maxTokens/2 })
+	if nl := strings.LastIndexByte(s[:headEnd], '\n'); nl > 0 {
+		headEnd = nl + 1
+	}
+	for headEnd > 0 && headEnd < len(s) && !utf8.RuneStart(s[headEnd]) {
+		headEnd--
+	}
+	tailStart := len(s) - searchCut(len(s)-headEnd, func(i int) bool { return countTokens(s[len(s)-i:]) > maxTokens-maxTokens/2 })
+	if nl := strings.IndexByte(s[tailStart:], '\n'); nl >= 0 && tailStart+nl+1 < len(s) {
+		tailStart += nl + 1
+	}
+	for tailStart < len(s) && !utf8.RuneStart(s[tailStart]) {
+		tailStart++
+	}
+	if tailStart < headEnd {
+		tailStart = headEnd
+	}
+
+	omitted := s[headEnd:tailStart]
+	lines := strings.Count(omitted, "\n")
+	tokens := countTokens(omitted)
+	marker := fmt.Sprintf("\n[... %d lines, about %d tokens omitted ...]\n", lines, tokens)
+	return strings.TrimSuffix(s[:headEnd], "\n") + marker + s[tailStart:], lines, tokens, headEnd
+}
+
+// searchCut returns the largest i <= n for which too(i) is false, too
+// being monotonic.
+func searchCut(n int, too func(int) bool) int {
+	lo, hi := 0, n
+	for lo < hi {
+		mid := (lo + hi + 1) / 2
+		if too(mid) {
+			hi = mid - 1
+		} else {
+			lo = mid
+		}
+	}
+	return lo
+}
+
+// trimResult trims a result's outputs to maxTokens each, returning the
+// offset of the part omitted from the output, 0 when nothing was.
+func trimResult(res *CmdResults, maxTokens int) int {
+	var cut int
+	res.Output, res.OmittedLines, res.OmittedTokens, cut = trimOutput(res.Output, maxTokens)
+	if res.OmittedTokens > 0 {
+		res.Tokens = estimateTokens(res.Output)
+	}
+	for _, it := range res.Iterations {
+		if out, _, omitted, _ := trimOutput(it.Output, maxTokens); omitted > 0 {
+			it.Output, it.Tokens = out, estimateTokens(out)
+		}
+	}
+	return cut
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The reverse tunnel lets an agent behind NAT be driven without inbound
+// ports: the agent dials the controller, upgrades the connection, and then
+// serves its own HTTP API over it. The controller proxies
+// /agent/<name>/... requests, and API requests with an agent parameter (see
+// controller.go), down the tunnel.
+
+const (
+	tunnelProtocol = "llmass-tunnel"
+	tunnelConns    = 4 // connections each agent keeps open
+	tunnelMaxWait  = time.Minute
+)
+
+var (
+	errAgentMessage = paramError("agent", "Invalid or disconnected 'agent' parameter")
+)
+
+var (
+	controllerURL  string // CONTROLLER_URL, set when running as an agent
+	controllerHash string // CONTROLLER_HASH, the controller's HASH
+	agentName      string // AGENT_NAME, defaults to the hostname
+
+	tunnelMu sync.Mutex
+	tunnels  = map[string]*tunnelPool{}
+)
+
+// tunnelPool holds the idle connections an agent has dialed in with.
+type tunnelPool struct {
+	conns  chan net.Conn
+	proxy  *httputil.ReverseProxy
+	client *http.Client // for requests the controller makes itself
+}
+
+func newTunnelPool(name string) *tunnelPool {
+	p := &tunnelPool{conns: make(chan net.Conn, tunnelConns*2)}
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			select {
+			case c := <-p.conns:
+				return c, nil
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(5 * time.Second):
+				return nil, fmt.Errorf("agent %s is not connected", name)
+			}
+		},
+		MaxIdleConnsPerHost: tunnelConns,
+	}
+	p.client = &http.Client{Transport: transport}
+	p.proxy = &httputil.ReverseProxy{
+		Director: func(r *http.Request) {
+			r.URL.Scheme = "http"
+			r.URL.Host = name
+		},
+		Transport:     transport,
+		FlushInterval: -1, // keep /events and /mcp/sse streaming
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			logger.Warn("tunnel to agent failed", "agent", name, "err", err)
+			w.Header().Set("Content-Type", "application/json")
+			writeError(w, errAgentMessage)
+		},
+	}
+	return p
+}
+
+func validAgentName(name string) bool {
+	if name == "" || len(name) > 64 {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// tunnelHandler accepts an agent connection and parks it for the proxy.
+func tunnelHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet {
+		writeError(w, errMethodMessage)
+		return
+	}
+
+	// Validate the hash parameter
+	hashParam := r.URL.Query().Get("hash")
+	if !checkHash(r, hashParam) {
+		writeError(w, errHashMessage)
+		return
+	}
+
+	name := r.URL.Query().Get("agent")
+	if !validAgentName(name) {
+		writeError(w, errAgentMessage)
+		return
+	}
+
+	if !strings.EqualFold(r.Header.Get("Upgrade"), tunnelProtocol) {
+		writeError(w, fmt.Errorf("%w: %s", errUpgradeMessage, tunnelProtocol))
+		return
+	}
+
+	conn, buf, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		logger.Error("failed to hijack tunnel connection", "err", err)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	fmt.Fprintf(buf, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: %s\r\n\r\n", tunnelProtocol)
+	if err := buf.Flush(); err != nil {
+		conn.Close()
+		return
+	}
+
+	tunnelMu.Lock()
+	p, ok := tunnels[name]
+	if !ok {
+		p = newTunnelPool(name)
+		tunnels[name] = p
+	}
+	tunnelMu.Unlock()
+
+	select {
+	case p.conns <- conn:
+	default:
+		// The agent has more idle connections parked than we need
+		conn.Close()
+	}
+}
+
+// agentProxyHandler forwards /agent/<name>/<path> to the named agent. The
+// agent checks its own hash, so requests carry the agent's HASH.
+func agentProxyHandler(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/agent/")
+	name, path, _ := strings.Cut(rest, "/")
+
+	tunnelMu.Lock()
+	p, ok := tunnels[name]
+	tunnelMu.Unlock()
+	if !ok {
+		w.Header().Set("Content-Type", "application/json")
+		writeError(w, errAgentMessage)
+		return
+	}
+
+	r2 := r.Clone(r.Context())
+	r2.URL.Path = "/" + path
+	r2.URL.RawPath = ""
+	p.proxy.ServeHTTP(w, r2)
+}
+
+// runAgent keeps tunnelConns connections to the controller open, serving the
+// API over each one and redialing with backoff when they drop.
+func runAgent(handler http.Handler) {
+	logger.Info("agent connecting to controller", "agent", agentName, "controller", controllerURL)
+	go sendHeartbeats()
+	for i := 0; i < tunnelConns; i++ {
+		go func() {
+			backoff := time.Second
+			for {
+				conn, err := dialController()
+				if err != nil {
+					logger.Warn("failed to reach controller", "err", err, "retry_in", backoff)
+					time.Sleep(backoff)
+					if backoff *= 2; backoff > tunnelMaxWait {
+						backoff = tunnelMaxWait
+					}
+					continue
+				}
+				backoff = time.Second
+				server := &http.Server{Handler: withController(handler)}
+				server.Serve(newConnListener(conn))
+			}
+		}()
+	}
+}
+
+func dialController() (net.Conn, error) {
+	u, err := url.Parse(controllerURL)
+	if err != nil {
+		return nil, err
+	}
+
+	host := u.Host
+	if u.Port() == "" {
+		if u.Scheme == "https" {
+			host += ":443"
+		} else {
+			host += ":80"
+		}
+	}
+
+	dialer := &net.Dialer{Timeout: 10 * time.Second, KeepAlive: 30 * time.Second}
+	var conn net.Conn
+	if u.Scheme == "https" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", host, &tls.Config{ServerName: u.Hostname()})
+	} else {
+		conn, err = dialer.Dial("tcp", host)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	q := url.Values{"hash": {controllerHash}, "agent": {agentName}}
+	path := strings.TrimSuffix(u.Path, "/") + "/tunnel?" + q.Encode()
+	fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: %s\r\nConnection: Upgrade\r\nUpgrade: %s\r\n\r\n", path, u.Host, tunnelProtocol)
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		conn.Close()
+		return nil, fmt.Errorf("controller refused tunnel: %s", resp.Status)
+	}
+	return &bufferedConn{Conn: conn, r: br}, nil
+}
+
+// bufferedConn keeps any bytes read past the upgrade response.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// connListener hands a single connection to http.Server and then blocks
+// until that connection is closed.
+type connListener struct {
+	conn   net.Conn
+	once   sync.Once
+	closed chan struct{}
+}
+
+func newConnListener(conn net.Conn) *connListener {
+	return &connListener{conn: conn, closed: make(chan struct{})}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	var c net.Conn
+	l.once.Do(func() { c = &notifyConn{Conn: l.conn, closed: l.closed} })
+	if c != nil {
+		return c, nil
+	}
+	<-l.closed
+	return nil, net.ErrClosed
+}
+
+func (l *connListener) Close() error {
+	return l.conn.Close()
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+type notifyConn struct {
+	net.Conn
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (c *notifyConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+func loadAgent() {
+	controllerURL = os.Getenv("CONTROLLER_URL")
+	if controllerURL == "" {
+		return
+	}
+	controllerHash = os.Getenv("CONTROLLER_HASH")
+	if controllerHash == "" {
+		fatal("CONTROLLER_HASH must be set when CONTROLLER_URL is set")
+	}
+	if u, err := url.Parse(controllerURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		fatal("CONTROLLER_URL must be an http or https URL", "url", controllerURL)
+	}
+
+	agentName = os.Getenv("AGENT_NAME")
+	if agentName == "" {
+		agentName, _ = os.Hostname()
+	}
+	if !validAgentName(agentName) {
+		fatal("AGENT_NAME must be letters, digits, '.', '-' or '_'", "agent", agentName)
+	}
+	if err := loadAgentHeartbeat(); err != nil {
+		fatal(err.Error())
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// ResourceUsage records what a single command cost to run.
+type ResourceUsage struct {
+	WallMs    int64 `json:"wall_ms"`
+	UserCPUMs int64 `json:"user_cpu_ms"`
+	SysCPUMs  int64 `json:"sys_cpu_ms"`
+	MaxRSSKB  int64 `json:"max_rss_kb"`
+}
+
+// newResourceUsage builds usage from the finished process state, which
+// getrusage(2) populates for the command and its waited-for children.
+func newResourceUsage(ps *os.ProcessState, wall time.Duration) *ResourceUsage {
+	usage := &ResourceUsage{WallMs: wall.Milliseconds()}
+	if ps == nil {
+		return usage
+	}
+
+	usage.UserCPUMs = ps.UserTime().Milliseconds()
+	usage.SysCPUMs = ps.SystemTime().Milliseconds()
+	if ru, ok := ps.SysUsage().(*syscall.Rusage); ok {
+		usage.MaxRSSKB = int64(ru.Maxrss) // kilobytes on linux
+	}
+	return usage
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+)
+
+const apiVersionPrefix = "/v1"
+
+// V1Error is the stable error envelope returned by every /v1 endpoint.
+type V1Error struct {
+	Code    string            `json:"code"`
+	Message string            `json:"message"`
+	Details map[string]string `json:"details,omitempty"`
+}
+
+type V1ErrorResponse struct {
+	Error V1Error `json:"error"`
+}
+
+// v1Writer marks a response as belonging to the /v1 API so writeJsonError
+// emits the envelope with a meaningful status code.
+type v1Writer struct {
+	http.ResponseWriter
+	path string
+}
+
+func (w *v1Writer) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *v1Writer) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// v1 serves h under the /v1 API contract.
+func v1(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h(&v1Writer{ResponseWriter: w, path: r.URL.Path}, r)
+	}
+}
+
+func writeV1Error(w *v1Writer, msg, param string, status int, code string) {
+	resp := &V1ErrorResponse{Error: V1Error{Code: code, Message: msg, Details: map[string]string{"path": w.path}}}
+	if param != "" {
+		resp.Error.Details["parameter"] = param
+	}
+
+	writeJSON(w, status, resp)
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
+)
+
+// /version tells an orchestrator which build it talks to and what this
+// instance has enabled, so it can gate its behavior on the server's
+// capabilities rather than on a version number alone.
+//
+// The version and build date are set at link time, e.g.
+//
+//	go build -ldflags "-X main.version=1.2.0 -X main.buildDate=$(date -u +%FT%TZ)"
+//
+// the commit comes from the VCS information go build stamps into the binary.
+
+var (
+	version   = "1.0.0"
+	commit    string // set at link time, or read from the build info
+	buildDate string
+)
+
+// VersionInfo is the /version document.
+type VersionInfo struct {
+	Type       string          `json:"type"`
+	Version    string          `json:"version"`
+	Commit     string          `json:"commit,omitempty"`
+	CommitDate string          `json:"commit_date,omitempty"`
+	Modified   bool            `json:"modified,omitempty"` // built from a tree with uncommitted changes
+	BuildDate  string          `json:"build_date,omitempty"`
+	GoVersion  string          `json:"go_version"`
+	Platform   string          `json:"platform"`
+	Features   VersionFeatures `json:"features"`
+}
+
+// VersionFeatures is what this instance offers, as configured.
+type VersionFeatures struct {
+	APIVersions      []string `json:"api_versions"`
+	ShellBackends    []string `json:"shell_backends"`
+	ShellBackend     string   `json:"shell_backend"`
+	TmuxWraps        []string `json:"tmux_wraps"`
+	TmuxWrap         string   `json:"tmux_wrap,omitempty"` // with the tmux backend
+	AuthModes        []string `json:"auth_modes"`
+	Formats          []string `json:"formats"`
+	Compression      []string `json:"compression"`
+	Transports       []string `json:"transports"`
+	Integrations     []string `json:"integrations"`
+	SharedStorage    bool     `json:"shared_storage"`
+	ConfirmRisk      bool     `json:"confirm_risk"`
+	TokenBudgets     bool     `json:"token_budgets"`
+	Agent            bool     `json:"agent"` // runs as an agent of a controller
+	HighAvailability bool     `json:"high_availability"`
+	SemanticSearch   bool     `json:"semantic_search"`
+}
+
+// buildVersion fills in the commit from the build info when it wasn't set
+// at link time.
+func buildVersion() VersionInfo {
+	v := VersionInfo{
+		Type:      "version",
+		Version:   version,
+		Commit:    commit,
+		BuildDate: buildDate,
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+		Features:  versionFeatures(),
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				if v.Commit == "" {
+					v.Commit = s.Value
+				}
+			case "vcs.time":
+				v.CommitDate = s.Value
+			case "vcs.modified":
+				v.Modified = s.Value == "true"
+			}
+		}
+	}
+	return v
+}
+
+func versionFeatures() VersionFeatures {
+	f := VersionFeatures{
+		APIVersions:      []string{"v1"},
+		ShellBackends:    executorNames(),
+		ShellBackend:     shellBackend,
+		Formats:          []string{formatJSON, formatText, formatNDJSON, formatObservation},
+		Compression:      []string{"gzip"},
+		Transports:       []string{"http", "jsonrpc", "mcp", "sse"},
+		Integrations:     []string{},
+		SharedStorage:    sharedStorage,
+		ConfirmRisk:      confirmRisk() != "",
+		TokenBudgets:     budgetsEnabled(),
+		Agent:            controllerURL != "",
+		HighAvailability: leaderLease != "",
+		SemanticSearch:   embeddingsURL != "",
+	}
+	for name := range wrapStrategies {
+		f.TmuxWraps = append(f.TmuxWraps, name)
+	}
+	sort.Strings(f.TmuxWraps)
+	if shellBackend == backendTmux {
+		f.TmuxWrap = tmuxWrap
+	}
+
+	// The hash is accepted on every listener, as a parameter or a bearer token
+	modes := map[string]bool{"hash": true, "bearer": true}
+	for _, spec := range listeners {
+		modes[spec.Auth] = true
+	}
+	for mode := range modes {
+		f.AuthModes = append(f.AuthModes, mode)
+	}
+	sort.Strings(f.AuthModes)
+
+	for _, in := range []struct {
+		name    string
+		enabled bool
+	}{
+		{"summaries", summarizeURL != ""},
+		{"suggestions", suggestURL != ""},
+		{"embeddings", embeddingsURL != ""},
+		{"checkpoints", checkpointEvery > 0},
+		{"nats", natsURL != ""},
+		{"slack", slackToken != ""},
+		{"tracing", traceEndpoint != ""},
+		{"transcripts", transcriptLog.Load()},
+		{"recordings", recordSessions.Load()},
+	} {
+		if in.enabled {
+			f.Integrations = append(f.Integrations, in.name)
+		}
+	}
+	return f
+}
+
+// versionHandler answers without the hash, like the other discovery
+// documents.
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodGet {
+		writeError(w, errMethodMessage)
+		return
+	}
+
+	jsonResp, err := json.MarshalIndent(buildVersion(), "", "  ")
+	if err != nil {
+		msg := fmt.Sprintf("Failed to marshal JSON response: %v", err)
+		writeJsonError(w, msg)
+		return
+	}
+
+	fmt.Fprint(w, string(jsonResp))
+}
+
+// runVersion prints the version and build information.
+func runVersion(args []string, stdout, stderr io.Writer) int {
+	v := buildVersion()
+	fmt.Fprintf(stdout, "llmass %s\n", v.Version)
+	if v.Commit != "" {
+		rev := v.Commit
+		if v.Modified {
+			rev += " (modified)"
+		}
+		fmt.Fprintf(stdout, "commit     %s\n", rev)
+	}
+	if v.BuildDate != "" {
+		fmt.Fprintf(stdout, "built      %s\n", v.BuildDate)
+	}
+	fmt.Fprintf(stdout, "go         %s %s\n", strings.TrimPrefix(v.GoVersion, "go"), v.Platform)
+	return 0
+}
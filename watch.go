@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultWatchInterval = 2 * time.Second
+	minWatchInterval     = 1 * time.Second
+	defaultWatchDuration = 1 * time.Minute
+	maxWatchDuration     = 1 * time.Hour
+	maxWatchIterations   = 500
+)
+
+var (
+	errIntervalMessage = paramError("interval", "Invalid 'interval' parameter")
+	errDurationMessage = paramError("duration", "Invalid 'duration' parameter")
+)
+
+type WatchIteration struct {
+	Iteration  int             `json:"iteration"`
+	Time       time.Time       `json:"time"`
+	Output     string          `json:"output"`
+	OutputJSON json.RawMessage `json:"output_json,omitempty"`
+	Tokens     int             `json:"tokens,omitempty"`
+	Usage      *ResourceUsage  `json:"usage,omitempty"`
+}
+
+var (
+	watchMu sync.Mutex
+	watches = map[string]context.CancelFunc{} // "session/ticket" -> stop
+)
+
+func watchKey(session string, ticket int) string {
+	return fmt.Sprintf("%s/%d", session, ticket)
+}
+
+// parseSeconds reads an optional duration given in seconds.
+func parseSeconds(v string, def time.Duration) (time.Duration, error) {
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.ParseFloat(v, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid seconds %q", v)
+	}
+	return time.Duration(n * float64(time.Second)), nil
+}
+
+// writeTicket atomically replaces a ticket file so readers never observe a
+// partially written iteration.
+func writeTicket(sessionFolder string, ticket int, data []byte) error {
+	outputFile := filepath.Join(sessionFolder, fmt.Sprintf("%02d.ticket", ticket))
+	tmp := filepath.Join(sessionFolder, fmt.Sprintf(".%02d.ticket.tmp", ticket))
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, outputFile); err != nil {
+		return err
+	}
+	indexTicket(sessionFolder, ticket, data)
+	return nil
+}
+
+func watchHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodGet {
+		writeError(w, errMethodMessage)
+		return
+	}
+
+	// Validate the hash parameter
+	hashParam := r.URL.Query().Get("hash")
+	if !checkHash(r, hashParam) {
+		writeError(w, errHashMessage)
+		return
+	}
+
+	// Check if session is provided in query parameters
+	session := r.URL.Query().Get("session")
+	if session == "" {
+		writeError(w, errSessionMessage)
+		return
+	}
+
+	cmdParam := r.URL.Query().Get("cmd")
+	if cmdParam == "" {
+		writeError(w, errCmdMessage)
+		return
+	}
+
+	inputCmd, err := url.QueryUnescape(cmdParam)
+	if err != nil {
+		writeError(w, paramError("cmd", fmt.Sprintf("Failed to unescape command: %v", err)))
+		return
+	}
+
+	interval, err := parseSeconds(r.URL.Query().Get("interval"), defaultWatchInterval)
+	if err != nil || interval < minWatchInterval {
+		writeError(w, errIntervalMessage)
+		return
+	}
+
+	duration, err := parseSeconds(r.URL.Query().Get("duration"), defaultWatchDuration)
+	if err != nil || duration > maxWatchDuration {
+		writeError(w, errDurationMessage)
+		return
+	}
+
+	confirmed := r.URL.Query().Get("confirm") == "true" || r.URL.Query().Get("confirm") == "1"
+	var risky *riskError
+	if err := checkRisk(session, inputCmd, execOptions{Confirmed: confirmed}); errors.As(err, &risky) {
+		writeRiskWarning(w, risky.warning)
+		return
+	}
+
+	if !beginCommand() {
+		writeError(w, errDrainingMessage)
+		return
+	}
+
+	sessionFolder := filepath.Join(sessionsDir, session)
+	ticket, err := getNextTicket(sessionFolder)
+	if err != nil {
+		endCommand()
+		writeError(w, errTicketMessage)
+		return
+	}
+
+	csr := &CmdSubmission{
+		Type:      "watch",
+		Ticket:    ticket,
+		Session:   session,
+		Input:     inputCmd,
+		Callback:  Callback(r.Context(), session, ticket),
+		RequestID: requestIDFrom(r.Context()),
+	}
+
+	ctx, cancel := context.WithTimeout(detachLinks(r.Context(), context.Background()), duration)
+	watchMu.Lock()
+	watches[watchKey(session, ticket)] = cancel
+	watchMu.Unlock()
+
+	logFrom(r.Context()).Info("watching command", "session", session, "ticket", ticket, cmdAttr(inputCmd), "interval", interval, "duration", duration)
+	go func() {
+		defer endCommand()
+		runWatch(ctx, cancel, csr, sessionFolder, interval)
+	}()
+
+	jsonResp, err := json.Marshal(csr)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to marshal JSON response: %v", err)
+		writeJsonError(w, msg)
+		return
+	}
+
+	fmt.Fprint(w, string(jsonResp))
+}
+
+// runWatch re-runs the command until the duration elapses, the iteration
+// cap is reached or it is stopped, persisting every iteration to the ticket.
+func runWatch(ctx context.Context, cancel context.CancelFunc, csr *CmdSubmission, sessionFolder string, interval time.Duration) {
+	defer func() {
+		watchMu.Lock()
+		delete(watches, watchKey(csr.Session, csr.Ticket))
+		watchMu.Unlock()
+		cancel()
+	}()
+
+	cer := &CmdResults{
+		Type:      "watch",
+		Next:      "This watch is still running. Poll the callback again for more iterations or stop it with /watch/stop",
+		Ticket:    csr.Ticket,
+		Session:   csr.Session,
+		Input:     csr.Input,
+		RequestID: csr.RequestID,
+	}
+
+	save := func() {
+		jsonResp, err := json.Marshal(cer)
+		if err != nil {
+			logger.Error("failed to marshal JSON response", "err", err)
+			return
+		}
+		if err := writeTicket(sessionFolder, csr.Ticket, jsonResp); err != nil {
+			logger.Error("failed to write watch ticket", "session", csr.Session, "ticket", csr.Ticket, "err", err)
+		}
+	}
+
+	publishActivity(eventCommandStarted, csr.Session, csr.Ticket, map[string]string{"input": csr.Input, "mode": "watch"})
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for i := 1; i <= maxWatchIterations; i++ {
+		// Each iteration runs in a fresh shell, even with the tmux backend
+		ex := executeProcess(ctx, processBackend(), csr.Session, sessionFolder, csr.Ticket, csr.Input, execOptions{})
+		if ctx.Err() != nil && i > 1 {
+			// Interrupted mid-run by stop or deadline, don't record a partial iteration
+			break
+		}
+
+		it := &WatchIteration{Iteration: i, Time: time.Now(), Output: string(ex.Output), Usage: ex.Usage}
+		it.Tokens = estimateTokens(it.Output)
+		cer.Iterations = append(cer.Iterations, it)
+		cer.Output, cer.Tokens = it.Output, it.Tokens
+		cer.Usage = ex.Usage
+		cer.Artifacts = append(cer.Artifacts, ex.Artifacts...)
+		save()
+
+		select {
+		case <-ctx.Done():
+			i = maxWatchIterations
+		case <-ticker.C:
+		}
+	}
+
+	cer.Next = "This watch has finished. Review the iterations. You can now issue your next command to /shell"
+	save()
+	emitEvent(eventTicketCompleted, cer)
+	publishActivity(eventCommandFinished, csr.Session, csr.Ticket, cer)
+}
+
+func watchStopHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodGet {
+		writeError(w, errMethodMessage)
+		return
+	}
+
+	// Validate the ticket parameter
+	ticket, err := strconv.Atoi(r.URL.Query().Get("ticket"))
+	if err != nil {
+		writeError(w, errTicketMessage)
+		return
+	}
+
+	// Validate the hash parameter
+	hashParam := r.URL.Query().Get("hash")
+	if !checkHash(r, hashParam) {
+		writeError(w, errHashMessage)
+		return
+	}
+
+	// Check if session is provided in query parameters
+	session := r.URL.Query().Get("session")
+	if session == "" {
+		writeError(w, errSessionMessage)
+		return
+	}
+
+	watchMu.Lock()
+	cancel, ok := watches[watchKey(session, ticket)]
+	watchMu.Unlock()
+	if !ok {
+		writeError(w, notFoundf("No running watch for ticket %d", ticket))
+		return
+	}
+
+	cancel()
+	writeJsonMsg(w, "stopped", fmt.Sprintf("Watch for ticket %d stopped", ticket))
+}
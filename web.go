@@ -0,0 +1,74 @@
+package main
+
+import (
+	"embed"
+	"errors"
+	"io/fs"
+	"os"
+	"sync/atomic"
+)
+
+// The docs, stylesheet, logo and dashboard templates are built into the
+// binary, so the server runs from any working directory. Files under
+// WEB_DIR, laid out the same way, take precedence for customization.
+//
+//go:embed README.md CONTEXT.md assets templates
+var embeddedWeb embed.FS
+
+// overlayFS serves WEB_DIR files when present and the embedded copies
+// otherwise. The directory can be swapped by a reload.
+type overlayFS struct {
+	dir      atomic.Pointer[fs.FS]
+	embedded fs.FS
+}
+
+var webFS = &overlayFS{embedded: embeddedWeb}
+
+func (o *overlayFS) Open(name string) (fs.File, error) {
+	if dir := o.dir.Load(); dir != nil {
+		f, err := (*dir).Open(name)
+		if err == nil {
+			return f, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+	}
+	return o.embedded.Open(name)
+}
+
+// checkWebDir validates WEB_DIR, an optional directory overriding the
+// embedded files.
+func checkWebDir(dir string) error {
+	if dir == "" {
+		return nil
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return errors.New("WEB_DIR must be a directory")
+	}
+	return nil
+}
+
+// setWebDir serves files from dir over the embedded copies, or only the
+// embedded copies when dir is empty.
+func setWebDir(dir string) {
+	if dir == "" {
+		webFS.dir.Store(nil)
+		return
+	}
+	fsys := os.DirFS(dir)
+	webFS.dir.Store(&fsys)
+	logger.Info("serving web files from WEB_DIR over the embedded copies", "path", dir)
+}
+
+func assetsFS() fs.FS {
+	sub, err := fs.Sub(webFS, "assets")
+	if err != nil {
+		fatal("failed to open embedded assets", "err", err)
+	}
+	return sub
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	eventTicketCompleted = "ticket.completed"
+	eventSessionCreated  = "session.created"
+	eventAuthFailed      = "auth.failed"
+	eventShellDied       = "shell.died"
+
+	webhooksFile    = "webhooks.json"
+	webhookTimeout  = 10 * time.Second
+	webhookAttempts = 3
+)
+
+var (
+	errURLMessage      = paramError("url", "Invalid or missing 'url' parameter")
+	errEventsMessage   = paramError("events", "Invalid or missing 'events' parameter")
+	errWebhookNotFound = newKindError(errNotFound, "Webhook subscription not found")
+)
+
+var webhookEvents = []string{eventTicketCompleted, eventSessionCreated, eventAuthFailed, eventShellDied}
+
+type Webhook struct {
+	ID      string    `json:"id"`
+	URL     string    `json:"url"`
+	Events  []string  `json:"events"`
+	Secret  string    `json:"secret,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+// WebhookEvent is the body POSTed to subscribers.
+type WebhookEvent struct {
+	ID    string      `json:"id"`
+	Event string      `json:"event"`
+	Time  time.Time   `json:"time"`
+	Data  interface{} `json:"data"`
+}
+
+var (
+	webhooksMu     sync.Mutex
+	webhooks       []*Webhook
+	eventListeners []func(event string, data interface{})
+)
+
+// onEvent registers an in-process listener called for every event, used by
+// integrations that don't go through webhook subscriptions.
+func onEvent(fn func(event string, data interface{})) {
+	webhooksMu.Lock()
+	defer webhooksMu.Unlock()
+	eventListeners = append(eventListeners, fn)
+}
+
+func newID() string {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// loadWebhooks restores subscriptions persisted in DATA_DIR.
+func loadWebhooks() error {
+	data, err := os.ReadFile(filepath.Join(dataDir, webhooksFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	webhooksMu.Lock()
+	defer webhooksMu.Unlock()
+	return json.Unmarshal(data, &webhooks)
+}
+
+// saveWebhooks persists subscriptions, the caller holds webhooksMu.
+func saveWebhooks() error {
+	data, err := json.MarshalIndent(webhooks, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(dataDir, webhooksFile+".tmp")
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dataDir, webhooksFile))
+}
+
+// emitEvent delivers an event to every subscriber of it in the background.
+func emitEvent(event string, data interface{}) {
+	webhooksMu.Lock()
+	for _, fn := range eventListeners {
+		go fn(event, data)
+	}
+	var targets []*Webhook
+	for _, wh := range webhooks {
+		for _, e := range wh.Events {
+			if e == event {
+				targets = append(targets, wh)
+				break
+			}
+		}
+	}
+	webhooksMu.Unlock()
+
+	if len(targets) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(&WebhookEvent{ID: newID(), Event: event, Time: time.Now().UTC(), Data: data})
+	if err != nil {
+		logger.Error("failed to marshal webhook event", "event", event, "err", err)
+		return
+	}
+
+	for _, wh := range targets {
+		go deliverWebhook(wh, event, body)
+	}
+}
+
+// deliverWebhook POSTs the event, retrying with a backoff on failure. When the
+// subscription has a secret the body is signed with HMAC-SHA256.
+func deliverWebhook(wh *Webhook, event string, body []byte) {
+	client := &http.Client{Timeout: webhookTimeout}
+	backoff := time.Second
+	for attempt := 1; attempt <= webhookAttempts; attempt++ {
+		req, err := http.NewRequest(http.MethodPost, wh.URL, bytes.NewReader(body))
+		if err != nil {
+			logger.Error("failed to build webhook request", "webhook", wh.ID, "err", err)
+			return
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-LLMASS-Event", event)
+		if wh.Secret != "" {
+			mac := hmac.New(sha256.New, []byte(wh.Secret))
+			mac.Write(body)
+			req.Header.Set("X-LLMASS-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+		}
+
+		resp, err := client.Do(req)
+		if err == nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode < 300 {
+				return
+			}
+			err = fmt.Errorf("HTTP %d", resp.StatusCode)
+		}
+		logger.Warn("webhook delivery failed", "webhook", wh.ID, "event", event, "attempt", attempt, "max_attempts", webhookAttempts, "err", err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func validEvent(event string) bool {
+	for _, e := range webhookEvents {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// webhooksHandler lists (GET), registers (POST) and deletes (DELETE)
+// webhook subscriptions.
+func webhooksHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// Validate the hash parameter
+	hashParam := r.URL.Query().Get("hash")
+	if !checkHash(r, hashParam) {
+		writeError(w, errHashMessage)
+		return
+	}
+
+	var resp interface{}
+	switch r.Method {
+	case http.MethodGet:
+		webhooksMu.Lock()
+		list := make([]Webhook, 0, len(webhooks))
+		for _, wh := range webhooks {
+			c := *wh
+			c.Secret = ""
+			list = append(list, c)
+		}
+		webhooksMu.Unlock()
+		resp = list
+
+	case http.MethodPost:
+		wh := &Webhook{}
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxRequestBody))
+		if err != nil || json.Unmarshal(body, wh) != nil {
+			writeError(w, errBodyMessage)
+			return
+		}
+		if u, err := url.Parse(wh.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			writeError(w, errURLMessage)
+			return
+		}
+		if len(wh.Events) == 0 {
+			writeError(w, errEventsMessage)
+			return
+		}
+		for _, e := range wh.Events {
+			if !validEvent(e) {
+				writeError(w, errEventsMessage)
+				return
+			}
+		}
+		wh.ID = newID()
+		wh.Created = time.Now().UTC()
+
+		webhooksMu.Lock()
+		webhooks = append(webhooks, wh)
+		err = saveWebhooks()
+		webhooksMu.Unlock()
+		if err != nil {
+			msg := fmt.Sprintf("Failed to save webhooks: %v", err)
+			logger.Error(msg)
+			writeJsonError(w, msg)
+			return
+		}
+		c := *wh
+		c.Secret = ""
+		resp = &c
+
+	case http.MethodDelete:
+		id := r.URL.Query().Get("id")
+		webhooksMu.Lock()
+		found := false
+		for i, wh := range webhooks {
+			if wh.ID == id {
+				webhooks = append(webhooks[:i], webhooks[i+1:]...)
+				found = true
+				break
+			}
+		}
+		var err error
+		if found {
+			err = saveWebhooks()
+		}
+		webhooksMu.Unlock()
+		if !found {
+			writeError(w, errWebhookNotFound)
+			return
+		}
+		if err != nil {
+			msg := fmt.Sprintf("Failed to save webhooks: %v", err)
+			logger.Error(msg)
+			writeJsonError(w, msg)
+			return
+		}
+		writeJsonMsg(w, "deleted", fmt.Sprintf("Webhook %s deleted", id))
+		return
+
+	default:
+		writeError(w, errMethodMessage)
+		return
+	}
+
+	jsonResp, err := json.Marshal(resp)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to marshal JSON response: %v", err)
+		writeJsonError(w, msg)
+		return
+	}
+
+	fmt.Fprint(w, string(jsonResp))
+}
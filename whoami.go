@@ -0,0 +1,149 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// /whoami lets an agent introspect the credential it holds before it tries
+// something: which key it is, its role and scopes, the sessions it reaches
+// and what is left of its token budgets. Sessions aren't partitioned by key,
+// so a key reaches every session on the server.
+
+const (
+	roleAdmin = "admin"
+	roleUser  = "user"
+
+	scopeExecute  = "execute"  // run and watch commands
+	scopeRead     = "read"     // status, history, output, search
+	scopeSessions = "sessions" // create, rename, kill, import and export sessions
+	scopeAdmin    = "admin"    // dashboard, approvals, audit, reload and /debug
+)
+
+// WhoAmI is the /whoami document.
+type WhoAmI struct {
+	Type        string       `json:"type"`
+	Key         string       `json:"key"`              // hash, admin or listener
+	KeyID       string       `json:"key_id,omitempty"` // fingerprint of the secret presented
+	Auth        string       `json:"auth"`             // how the request authenticated
+	Subject     string       `json:"subject,omitempty"`
+	Role        string       `json:"role"`
+	Scopes      []string     `json:"scopes"`
+	Sessions    []string     `json:"sessions"`
+	ConfirmRisk string       `json:"confirm_risk,omitempty"` // commands this risky need confirm=true
+	Quotas      WhoAmIQuotas `json:"quotas"`
+}
+
+// WhoAmIQuotas are the token budgets, the remaining counts are left out
+// when there is no budget.
+type WhoAmIQuotas struct {
+	HashTokenBudget        int            `json:"hash_token_budget"` // per hour, 0 is unlimited
+	HashTokensRemaining    *int           `json:"hash_tokens_remaining,omitempty"`
+	SessionTokenBudget     int            `json:"session_token_budget"`
+	SessionTokensRemaining map[string]int `json:"session_tokens_remaining,omitempty"`
+	ResetsAt               *time.Time     `json:"resets_at,omitempty"`
+}
+
+// keyID fingerprints a secret, so keys can be told apart without showing them.
+func keyID(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:4])
+}
+
+// identify works out who the request is, as checkHash and checkAdmin would
+// accept it, and reports false when neither would.
+func identify(r *http.Request, hash string) (*WhoAmI, bool) {
+	who := &WhoAmI{Type: "whoami", Auth: "hash"}
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && hash == "" {
+		hash, who.Auth = token, "bearer"
+	}
+	user := subtle.ConstantTimeCompare([]byte(hash), []byte(hashPassword.Load())) == 1
+	admin := adminHash.Load()
+	isAdmin := admin != "" && subtle.ConstantTimeCompare([]byte(hash), []byte(admin)) == 1
+
+	switch {
+	case trustedListener(r):
+		who.Key = auditKeyListener
+		who.Auth = listenFrom(r.Context()).Auth
+		if viaController(r.Context()) {
+			who.Auth = "controller"
+		} else if who.Auth == authMTLS {
+			who.Subject = r.TLS.VerifiedChains[0][0].Subject.CommonName
+		}
+		user = true
+	case user:
+		who.Key, who.KeyID = auditKeyHash, keyID(hash)
+	case isAdmin:
+		who.Key, who.KeyID = auditKeyAdmin, keyID(hash)
+	default:
+		return nil, false
+	}
+
+	// ADMIN_HASH only opens the admin endpoints, HASH stands in for it when
+	// there is none
+	who.Role, who.Scopes = roleUser, []string{}
+	if user {
+		who.Scopes = append(who.Scopes, scopeExecute, scopeRead, scopeSessions)
+	}
+	if (isAdmin || (admin == "" && user)) && !listenFrom(r.Context()).NoAdmin {
+		who.Role = roleAdmin
+		who.Scopes = append(who.Scopes, scopeAdmin)
+	}
+	return who, true
+}
+
+func whoamiHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodGet {
+		writeError(w, errMethodMessage)
+		return
+	}
+
+	// Validate the hash parameter
+	hashParam := r.URL.Query().Get("hash")
+	who, ok := identify(r, hashParam)
+	if !ok {
+		authFailed(r)
+		writeError(w, errHashMessage)
+		return
+	}
+	auditKey(r, who.Key)
+
+	sessions, err := listSessions()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	who.Sessions = make([]string, 0, len(sessions))
+	for _, s := range sessions {
+		who.Sessions = append(who.Sessions, s.Name)
+	}
+	who.ConfirmRisk = confirmRisk()
+
+	sessionBudget, hashBudget := tokenBudgets()
+	who.Quotas = WhoAmIQuotas{HashTokenBudget: hashBudget, SessionTokenBudget: sessionBudget}
+	if budgetsEnabled() {
+		hashLeft, sessionLeft := budgetLeft(who.Sessions)
+		if hashLeft >= 0 {
+			who.Quotas.HashTokensRemaining = &hashLeft
+		}
+		who.Quotas.SessionTokensRemaining = sessionLeft
+		reset := time.Now().UTC().Truncate(time.Hour).Add(time.Hour)
+		who.Quotas.ResetsAt = &reset
+	}
+
+	jsonResp, err := json.Marshal(who)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to marshal JSON response: %v", err)
+		writeJsonError(w, msg)
+		return
+	}
+
+	fmt.Fprint(w, string(jsonResp))
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Shared workspaces are named folders in DATA_DIR/workspaces that sessions
+// on the same host attach to exchange files, e.g. a builder session drops a
+// binary that a tester session picks up. Attaching links the workspace into
+// SESSIONS_DIR/<session>/workspaces/<name>, and commands find that folder
+// in $LLMASS_WORKSPACES.
+
+const (
+	workspacesDir     = "workspaces"
+	workspacesEnv     = "LLMASS_WORKSPACES"
+	sessionWorkspaces = "workspaces" // folder of links inside a session
+)
+
+var (
+	errWorkspaceMessage  = paramError("name", "Invalid or missing 'name' workspace parameter")
+	errWorkspaceExists   = newKindError(errConflict, "Workspace already exists")
+	errWorkspaceNotFound = newKindError(errNotFound, "Workspace does not exist")
+	errWorkspaceAttached = newKindError(errConflict, "Workspace is attached to sessions, detach it first")
+	errWorkspaceLinked   = newKindError(errConflict, "Workspace is already attached to the session")
+	errWorkspaceUnlinked = newKindError(errNotFound, "Workspace is not attached to the session")
+)
+
+// Workspace is a shared workspace and the sessions attached to it.
+type Workspace struct {
+	Name     string    `json:"name"`
+	Created  time.Time `json:"created"`
+	Sessions []string  `json:"sessions"`
+}
+
+// WorkspaceAction is the result of a workspace management call.
+type WorkspaceAction struct {
+	Type      string `json:"type"`
+	Workspace string `json:"workspace"`
+	Action    string `json:"action"`
+	Session   string `json:"session,omitempty"`
+}
+
+func workspacePath(name string) string {
+	return filepath.Join(dataDir, workspacesDir, name)
+}
+
+func workspaceLink(session, name string) string {
+	return filepath.Join(sessionsDir, session, sessionWorkspaces, name)
+}
+
+func workspaceExists(name string) bool {
+	info, err := os.Stat(workspacePath(name))
+	return err == nil && info.IsDir()
+}
+
+// workspaceSessions returns the sessions the workspace is attached to.
+func workspaceSessions(name string) []string {
+	sessions := []string{}
+	entries, err := os.ReadDir(sessionsDir)
+	if err != nil {
+		return sessions
+	}
+	for _, e := range entries {
+		if _, err := os.Lstat(workspaceLink(e.Name(), name)); e.IsDir() && err == nil {
+			sessions = append(sessions, e.Name())
+		}
+	}
+	return sessions
+}
+
+// listWorkspaces returns every workspace by name.
+func listWorkspaces() ([]Workspace, error) {
+	entries, err := os.ReadDir(filepath.Join(dataDir, workspacesDir))
+	if os.IsNotExist(err) {
+		return []Workspace{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read workspaces directory: %v", err)
+	}
+
+	workspaces := make([]Workspace, 0, len(entries))
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || !e.IsDir() {
+			continue
+		}
+		workspaces = append(workspaces, Workspace{Name: e.Name(), Created: info.ModTime(), Sessions: workspaceSessions(e.Name())})
+	}
+	sort.Slice(workspaces, func(i, j int) bool { return workspaces[i].Name < workspaces[j].Name })
+	return workspaces, nil
+}
+
+func createWorkspace(name string) error {
+	if !validSessionName(name) {
+		return errWorkspaceMessage
+	}
+	if err := os.MkdirAll(filepath.Join(dataDir, workspacesDir), 0755); err != nil {
+		return fmt.Errorf("Failed to create workspaces directory: %v", err)
+	}
+	if err := os.Mkdir(workspacePath(name), 0755); err != nil {
+		if os.IsExist(err) {
+			return errWorkspaceExists
+		}
+		return fmt.Errorf("Failed to create workspace: %v", err)
+	}
+	return nil
+}
+
+// deleteWorkspace removes a workspace and its files once no session is
+// attached to it.
+func deleteWorkspace(name string) error {
+	if !validSessionName(name) {
+		return errWorkspaceMessage
+	}
+	if !workspaceExists(name) {
+		return errWorkspaceNotFound
+	}
+	if len(workspaceSessions(name)) > 0 {
+		return errWorkspaceAttached
+	}
+	if err := os.RemoveAll(workspacePath(name)); err != nil {
+		return fmt.Errorf("Failed to delete workspace: %v", err)
+	}
+	return nil
+}
+
+// attachWorkspace links the workspace into the session, creating the
+// session if needed.
+func attachWorkspace(session, name string) error {
+	if !validSessionName(session) {
+		return errSessionMessage
+	}
+	if !validSessionName(name) {
+		return errWorkspaceMessage
+	}
+	if !workspaceExists(name) {
+		return errWorkspaceNotFound
+	}
+	target, err := filepath.Abs(workspacePath(name))
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Join(sessionsDir, session, sessionWorkspaces), 0755); err != nil {
+		return fmt.Errorf("Failed to create session workspaces directory: %v", err)
+	}
+	if err := os.Symlink(target, workspaceLink(session, name)); err != nil {
+		if os.IsExist(err) {
+			return errWorkspaceLinked
+		}
+		return fmt.Errorf("Failed to attach workspace: %v", err)
+	}
+	return nil
+}
+
+// detachWorkspace removes the session's link, leaving the files.
+func detachWorkspace(session, name string) error {
+	if !validSessionName(session) {
+		return errSessionMessage
+	}
+	if !validSessionName(name) {
+		return errWorkspaceMessage
+	}
+	link := workspaceLink(session, name)
+	if info, err := os.Lstat(link); err != nil || info.Mode()&os.ModeSymlink == 0 {
+		return errWorkspaceUnlinked
+	}
+	if err := os.Remove(link); err != nil {
+		return fmt.Errorf("Failed to detach workspace: %v", err)
+	}
+	return nil
+}
+
+// sessionWorkspacesDir returns the absolute folder of the session's
+// workspace links for $LLMASS_WORKSPACES, "" when it has none.
+func sessionWorkspacesDir(sessionFolder string) string {
+	dir, err := filepath.Abs(filepath.Join(sessionFolder, sessionWorkspaces))
+	if err != nil {
+		return ""
+	}
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return ""
+	}
+	return dir
+}
+
+func writeWorkspaceAction(w http.ResponseWriter, resp *WorkspaceAction) {
+	jsonResp, err := json.Marshal(resp)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to marshal JSON response: %v", err)
+		writeJsonError(w, msg)
+		return
+	}
+
+	fmt.Fprint(w, string(jsonResp))
+}
+
+// workspacesHandler lists workspaces (GET), creates one (POST) and deletes
+// one with its files (DELETE).
+func workspacesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// Validate the hash parameter
+	hashParam := r.URL.Query().Get("hash")
+	if !checkHash(r, hashParam) {
+		writeError(w, errHashMessage)
+		return
+	}
+
+	name := r.URL.Query().Get("name")
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if err := createWorkspace(name); err != nil {
+			writeError(w, err)
+			return
+		}
+		logFrom(r.Context()).Info("workspace created", "workspace", name)
+		writeWorkspaceAction(w, &WorkspaceAction{Type: "workspace", Workspace: name, Action: "create"})
+		return
+	case http.MethodDelete:
+		if err := deleteWorkspace(name); err != nil {
+			writeError(w, err)
+			return
+		}
+		logFrom(r.Context()).Info("workspace deleted", "workspace", name)
+		writeWorkspaceAction(w, &WorkspaceAction{Type: "workspace", Workspace: name, Action: "delete"})
+		return
+	default:
+		writeError(w, errMethodMessage)
+		return
+	}
+
+	workspaces, err := listWorkspaces()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	jsonResp, err := json.Marshal(workspaces)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to marshal JSON response: %v", err)
+		writeJsonError(w, msg)
+		return
+	}
+
+	fmt.Fprint(w, string(jsonResp))
+}
+
+// workspaceAttachHandler attaches a workspace to a session (POST) or
+// detaches it (DELETE).
+func workspaceAttachHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// Validate the hash parameter
+	hashParam := r.URL.Query().Get("hash")
+	if !checkHash(r, hashParam) {
+		writeError(w, errHashMessage)
+		return
+	}
+
+	session, name := r.URL.Query().Get("session"), r.URL.Query().Get("name")
+	switch r.Method {
+	case http.MethodPost:
+		if err := attachWorkspace(session, name); err != nil {
+			writeError(w, err)
+			return
+		}
+		logFrom(r.Context()).Info("workspace attached", "workspace", name, "session", session)
+		writeWorkspaceAction(w, &WorkspaceAction{Type: "workspace", Workspace: name, Action: "attach", Session: session})
+	case http.MethodDelete:
+		if err := detachWorkspace(session, name); err != nil {
+			writeError(w, err)
+			return
+		}
+		logFrom(r.Context()).Info("workspace detached", "workspace", name, "session", session)
+		writeWorkspaceAction(w, &WorkspaceAction{Type: "workspace", Workspace: name, Action: "detach", Session: session})
+	default:
+		writeError(w, errMethodMessage)
+	}
+}
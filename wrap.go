@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// A command typed into a long-lived shell has no process of its own to wait
+// for, so the tmux backend needs a way to find the command's output and learn
+// that it ended. That is a wrapStrategy, picked with TMUX_WRAP:
+//
+//   - file (default) redirects the output to a file of the job and has the
+//     shell write the exit code to another.
+//   - markers appends a marker line carrying the exit code to the output
+//     stream, for shells or remote ends with a single channel back.
+//   - osc runs the command on the shell's terminal, between OSC 133
+//     sequences captured from the pane, so it sees a TTY: colors, progress
+//     bars and prompts behave as in a terminal.
+//
+// The exec backend waits for each command's own process and needs none.
+// Another shell or remote backend plugs in its own detection by adding to
+// wrapStrategies.
+
+const (
+	wrapFile    = "file"
+	wrapMarkers = "markers"
+	wrapOSC     = "osc"
+)
+
+// wrapStrategy wraps a job's script for the shell and follows it.
+type wrapStrategy interface {
+	// begin prepares the shell and returns the line typed into it, which
+	// runs prelude and then the job's script.
+	begin(name, sessionFolder string, job *tmuxJob, prelude string) (string, error)
+	// follower follows the job's output into out.
+	follower(name, sessionFolder string, job *tmuxJob, out io.Writer) wrapFollower
+}
+
+// wrapFollower follows one job.
+type wrapFollower interface {
+	// follow copies the output produced since the last call, and reports
+	// the exit code once the command has ended.
+	follow() (exitCode int, done bool)
+	// close releases the follower and undoes what begin set up.
+	close()
+}
+
+var wrapStrategies = map[string]wrapStrategy{
+	wrapFile:    fileWrap{},
+	wrapMarkers: markerWrap{},
+	wrapOSC:     oscWrap{},
+}
+
+var tmuxWrap = wrapFile // TMUX_WRAP
+
+// jobWrap returns the job's strategy, jobs written before there was a choice
+// used files.
+func jobWrap(job *tmuxJob) wrapStrategy {
+	if w, ok := wrapStrategies[job.Wrap]; ok {
+		return w
+	}
+	return wrapStrategies[wrapFile]
+}
+
+// newMarker returns a marker no output will contain by chance.
+func newMarker() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return "__LLMASS_" + hex.EncodeToString(b) + "__"
+}
+
+// scriptCall runs the job's script after prelude, in the shell itself so a
+// cd or export sticks.
+func scriptCall(sessionFolder string, job *tmuxJob, prelude string) string {
+	return "{ " + prelude + ". " + shellQuote(tmuxJobPath(sessionFolder, job.Ticket, ".sh")) + "; }"
+}
+
+// fileWrap captures the output and the exit code in files of the job.
+type fileWrap struct{}
+
+func (fileWrap) begin(name, sessionFolder string, job *tmuxJob, prelude string) (string, error) {
+	exitFile := tmuxJobPath(sessionFolder, job.Ticket, ".exit")
+	return fmt.Sprintf("%s > %s 2>&1 < /dev/null; echo $? > %s; command mv -f %s %s",
+		scriptCall(sessionFolder, job, prelude),
+		shellQuote(tmuxJobPath(sessionFolder, job.Ticket, ".out")),
+		shellQuote(exitFile+".tmp"), shellQuote(exitFile+".tmp"), shellQuote(exitFile)), nil
+}
+
+func (fileWrap) follower(name, sessionFolder string, job *tmuxJob, out io.Writer) wrapFollower {
+	return &fileFollower{
+		outFile:  tmuxJobPath(sessionFolder, job.Ticket, ".out"),
+		exitFile: tmuxJobPath(sessionFolder, job.Ticket, ".exit"),
+		out:      out,
+	}
+}
+
+type fileFollower struct {
+	outFile, exitFile string
+	f                 *os.File
+	out               io.Writer
+}
+
+func (ff *fileFollower) copy() {
+	if ff.f == nil {
+		if ff.f, _ = os.Open(ff.outFile); ff.f == nil {
+			return
+		}
+	}
+	copyOutput(ff.out, ff.f)
+}
+
+func (ff *fileFollower) follow() (int, bool) {
+	ff.copy()
+	data, err := os.ReadFile(ff.exitFile)
+	if err != nil {
+		return 0, false
+	}
+	ff.copy()
+	code, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return -1, true
+	}
+	return code, true
+}
+
+func (ff *fileFollower) close() {
+	if ff.f != nil {
+		ff.f.Close()
+	}
+}
+
+// markerWrap sends the output and a closing marker line with the exit code
+// down one stream.
+type markerWrap struct{}
+
+func (markerWrap) begin(name, sessionFolder string, job *tmuxJob, prelude string) (string, error) {
+	return fmt.Sprintf("{ %s < /dev/null; printf '\\n%s %%d\\n' $?; } > %s 2>&1",
+		scriptCall(sessionFolder, job, prelude), job.Marker,
+		shellQuote(tmuxJobPath(sessionFolder, job.Ticket, ".stream"))), nil
+}
+
+func (markerWrap) follower(name, sessionFolder string, job *tmuxJob, out io.Writer) wrapFollower {
+	return &streamFollower{
+		path: tmuxJobPath(sessionFolder, job.Ticket, ".stream"),
+		scan: &markerScanner{out: out, started: true, end: []byte("\n" + job.Marker + " "), term: '\n'},
+	}
+}
+
+// oscWrap runs the command on the terminal between OSC 133 command start and
+// end sequences, reading the pane's output as tmux pipes it to a file.
+type oscWrap struct{}
+
+func (oscWrap) begin(name, sessionFolder string, job *tmuxJob, prelude string) (string, error) {
+	stream := tmuxJobPath(sessionFolder, job.Ticket, ".stream")
+	if _, err := tmux("pipe-pane", "-O", "-t", "="+name+":", "cat >> "+shellQuote(stream)); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("printf '\\033]133;C;%s\\007'; %s; printf '\\033]133;D;%s;%%d\\007' $?",
+		job.Marker, scriptCall(sessionFolder, job, prelude), job.Marker), nil
+}
+
+func (oscWrap) follower(name, sessionFolder string, job *tmuxJob, out io.Writer) wrapFollower {
+	return &streamFollower{
+		path: tmuxJobPath(sessionFolder, job.Ticket, ".stream"),
+		scan: &markerScanner{
+			out:   out,
+			start: []byte("\x1b]133;C;" + job.Marker + "\a"),
+			end:   []byte("\x1b]133;D;" + job.Marker + ";"),
+			term:  '\a',
+			crlf:  true,
+		},
+		stop: func() { tmux("pipe-pane", "-t", "="+name+":") },
+	}
+}
+
+// streamFollower scans a job's stream file for its markers.
+type streamFollower struct {
+	path string
+	f    *os.File
+	scan *markerScanner
+	stop func()
+}
+
+func (sf *streamFollower) follow() (int, bool) {
+	if sf.f == nil {
+		if sf.f, _ = os.Open(sf.path); sf.f == nil {
+			return 0, false
+		}
+	}
+	copyOutput(sf.scan, sf.f)
+	return sf.scan.code, sf.scan.done
+}
+
+func (sf *streamFollower) close() {
+	if sf.f != nil {
+		sf.f.Close()
+	}
+	// An interrupted command never writes its end marker
+	if sf.scan.started && !sf.scan.done {
+		sf.scan.emit(sf.scan.pending)
+	}
+	if sf.stop != nil {
+		sf.stop()
+	}
+}
+
+// markerScanner passes on what a stream holds between its start marker, when
+// it has one, and its end marker, which is followed by the exit code and
+// term. Bytes that may begin the end marker are held back until the next
+// write tells.
+type markerScanner struct {
+	out        io.Writer
+	start, end []byte
+	term       byte
+	crlf       bool // the stream is a terminal's, lines end in \r\n
+	started    bool
+	pending    []byte
+	code       int
+	done       bool
+}
+
+func (s *markerScanner) Write(p []byte) (int, error) {
+	if s.done {
+		return len(p), nil
+	}
+	s.pending = append(s.pending, p...)
+	if !s.started {
+		i := bytes.Index(s.pending, s.start)
+		if i < 0 {
+			// Keep what may be the start of the marker
+			if keep := len(s.start) - 1; len(s.pending) > keep {
+				s.pending = append(s.pending[:0], s.pending[len(s.pending)-keep:]...)
+			}
+			return len(p), nil
+		}
+		s.pending = append(s.pending[:0], s.pending[i+len(s.start):]...)
+		s.started = true
+	}
+
+	if i := bytes.Index(s.pending, s.end); i >= 0 {
+		rest := s.pending[i+len(s.end):]
+		j := bytes.IndexByte(rest, s.term)
+		if j < 0 {
+			// The exit code is still on its way
+			s.emit(s.pending[:i])
+			s.pending = append(s.pending[:0], s.pending[i:]...)
+			return len(p), nil
+		}
+		s.emit(s.pending[:i])
+		code, err := strconv.Atoi(string(rest[:j]))
+		if err != nil {
+			code = -1
+		}
+		s.code, s.done, s.pending = code, true, nil
+		return len(p), nil
+	}
+	if keep := len(s.end) - 1; len(s.pending) > keep {
+		n := len(s.pending) - keep
+		// A \r is held back with the \n that may follow it
+		if s.crlf && s.pending[n-1] == '\r' {
+			n--
+		}
+		s.emit(s.pending[:n])
+		s.pending = append(s.pending[:0], s.pending[n:]...)
+	}
+	return len(p), nil
+}
+
+func (s *markerScanner) emit(p []byte) {
+	if len(p) == 0 {
+		return
+	}
+	if s.crlf {
+		p = bytes.ReplaceAll(p, []byte("\r\n"), []byte("\n"))
+	}
+	s.out.Write(p)
+}
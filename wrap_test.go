@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+const testMarker = "__LLMASS_0123456789abcdef__"
+
+func markersScanner(out *bytes.Buffer) *markerScanner {
+	return &markerScanner{out: out, started: true, end: []byte("\n" + testMarker + " "), term: '\n'}
+}
+
+func oscScanner(out *bytes.Buffer) *markerScanner {
+	return &markerScanner{
+		out:   out,
+		start: []byte("\x1b]133;C;" + testMarker + "\a"),
+		end:   []byte("\x1b]133;D;" + testMarker + ";"),
+		term:  '\a',
+		crlf:  true,
+	}
+}
+
+// feed writes the stream to the scanner in chunks of size n.
+func feed(s *markerScanner, stream string, n int) {
+	for len(stream) > 0 {
+		chunk := min(n, len(stream))
+		s.Write([]byte(stream[:chunk]))
+		stream = stream[chunk:]
+	}
+}
+
+func TestMarkerScanner(t *testing.T) {
+	tests := []struct {
+		name   string
+		scan   func(*bytes.Buffer) *markerScanner
+		stream string
+		output string
+		code   int
+	}{
+		{
+			name:   "markers",
+			scan:   markersScanner,
+			stream: "hello\nworld\n\n" + testMarker + " 0\n",
+			output: "hello\nworld\n",
+		},
+		{
+			name:   "markers exit code",
+			scan:   markersScanner,
+			stream: "boom\n\n" + testMarker + " 127\n",
+			output: "boom\n",
+			code:   127,
+		},
+		{
+			name:   "markers without output",
+			scan:   markersScanner,
+			stream: "\n" + testMarker + " 1\n",
+			code:   1,
+		},
+		{
+			name:   "markers lookalike",
+			scan:   markersScanner,
+			stream: "__LLMASS_ is not the marker\n" + testMarker[:10] + "\n\n" + testMarker + " 0\n",
+			output: "__LLMASS_ is not the marker\n" + testMarker[:10] + "\n",
+		},
+		{
+			name:   "markers after the end",
+			scan:   markersScanner,
+			stream: "out\n\n" + testMarker + " 3\nlater\n",
+			output: "out\n",
+			code:   3,
+		},
+		{
+			name:   "markers bad exit code",
+			scan:   markersScanner,
+			stream: "out\n\n" + testMarker + " x\n",
+			output: "out\n",
+			code:   -1,
+		},
+		{
+			name:   "osc",
+			scan:   oscScanner,
+			stream: "$ prompt\r\n\x1b]133;C;" + testMarker + "\aline 1\r\nline 2\r\n\x1b]133;D;" + testMarker + ";0\a$ ",
+			output: "line 1\nline 2\n",
+		},
+		{
+			name:   "osc exit code",
+			scan:   oscScanner,
+			stream: "\x1b]133;C;" + testMarker + "\afailed\r\n\x1b]133;D;" + testMarker + ";2\a",
+			output: "failed\n",
+			code:   2,
+		},
+		{
+			name:   "osc interleaved sequences",
+			scan:   oscScanner,
+			stream: "\x1b]133;A\a$ \x1b]133;C;" + testMarker + "\a\x1b[32mgreen\x1b[0m\r\n\x1b]0;title\aprogress\rdone\r\n\x1b]133;D;" + testMarker + ";0\a\x1b]133;A\a",
+			output: "\x1b[32mgreen\x1b[0m\n\x1b]0;title\aprogress\rdone\n",
+		},
+		{
+			name:   "osc other marker",
+			scan:   oscScanner,
+			stream: "\x1b]133;C;__LLMASS_ffffffffffffffff__\aold\r\n\x1b]133;C;" + testMarker + "\anew\r\n\x1b]133;D;" + testMarker + ";0\a",
+			output: "new\n",
+		},
+	}
+	for _, tt := range tests {
+		for n := 1; n <= len(tt.stream); n++ {
+			t.Run(fmt.Sprintf("%s/%d", tt.name, n), func(t *testing.T) {
+				var out bytes.Buffer
+				s := tt.scan(&out)
+				feed(s, tt.stream, n)
+				if !s.done {
+					t.Fatalf("the end marker wasn't found")
+				}
+				if s.code != tt.code {
+					t.Errorf("code = %d, want %d", s.code, tt.code)
+				}
+				if out.String() != tt.output {
+					t.Errorf("output = %q, want %q", out.String(), tt.output)
+				}
+			})
+		}
+	}
+}
+
+func TestMarkerScannerExitCodeSplit(t *testing.T) {
+	var out bytes.Buffer
+	s := markersScanner(&out)
+	s.Write([]byte("out\n\n" + testMarker + " 1"))
+	if s.done {
+		t.Fatal("done before the exit code was terminated")
+	}
+	s.Write([]byte("28\n"))
+	if !s.done || s.code != 128 {
+		t.Fatalf("done = %v code = %d, want true and 128", s.done, s.code)
+	}
+	if out.String() != "out\n" {
+		t.Fatalf("output = %q, want %q", out.String(), "out\n")
+	}
+}
+
+func TestMarkerScannerCRLFSplit(t *testing.T) {
+	var out bytes.Buffer
+	s := oscScanner(&out)
+	s.Write([]byte("\x1b]133;C;" + testMarker + "\a" + "a long enough line to be passed on\r"))
+	s.Write([]byte("\nnext\r\n\x1b]133;D;" + testMarker + ";0\a"))
+	if want := "a long enough line to be passed on\nnext\n"; out.String() != want {
+		t.Fatalf("output = %q, want %q", out.String(), want)
+	}
+}
+
+func TestStreamFollowerInterrupted(t *testing.T) {
+	var out bytes.Buffer
+	s := markersScanner(&out)
+	s.Write([]byte("partial output\n"))
+	sf := &streamFollower{scan: s}
+	sf.close()
+	if out.String() != "partial output\n" {
+		t.Fatalf("output = %q, want what was held back passed on", out.String())
+	}
+}